@@ -3,50 +3,86 @@
 package main
 
 import (
-	"fmt"
-	"os"
-
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func checkAuthentication(auth string, expectedSubject string, streamId string) bool {
-	var JWT_SECRET = os.Getenv("JWT_SECRET")
+// Loads the authentication keys from the configuration
+// If the keys were already loaded, they are replaced
+func (node *WebRTC_CDN_Node) initAuthentication(config *AuthConfig) error {
+	keyProvider, err := loadJWTKeyProvider(config)
 
-	if JWT_SECRET == "" {
-		return true // No authentication required
+	if err != nil {
+		return err
 	}
 
-	if auth == "" {
-		return false // Authentication required, but not provided
+	oldKeyProvider := node.authKeyProvider.Swap(keyProvider)
+
+	if oldKeyProvider != nil {
+		oldKeyProvider.close()
 	}
 
-	token, err := jwt.Parse(auth, func(token *jwt.Token) (interface{}, error) {
-		// Check the algorithm
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	go keyProvider.runJWKSRefresh()
+
+	return nil
+}
+
+func checkAuthentication(keyProvider *JWTKeyProvider, auth string, expectedSubject string, streamId string) bool {
+	valid, _ := checkAuthenticationClaims(keyProvider, auth, expectedSubject, streamId)
+	return valid
+}
+
+// Checks the authentication and returns the claims of the token
+// Claims are nil if authentication is not required
+func checkAuthenticationClaims(keyProvider *JWTKeyProvider, auth string, expectedSubject string, streamId string) (bool, jwt.MapClaims) {
+	valid, claims := parseAuthentication(keyProvider, auth, expectedSubject, streamId)
 
-		// Provide signing key
-		return []byte(JWT_SECRET), nil
-	})
+	if !valid {
+		metricAuthFailures.WithLabelValues(expectedSubject).Inc()
+	}
+
+	return valid, claims
+}
+
+// Parses the authentication token and validates it
+func parseAuthentication(keyProvider *JWTKeyProvider, auth string, expectedSubject string, streamId string) (bool, jwt.MapClaims) {
+	if keyProvider == nil || !keyProvider.isAuthenticationRequired() {
+		return true, nil // No authentication required
+	}
+
+	if auth == "" {
+		return false, nil // Authentication required, but not provided
+	}
+
+	token, err := jwt.Parse(auth, keyProvider.getVerificationKey)
 
 	if err != nil {
-		return false // Invalid token
+		return false, nil // Invalid token
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 
 	if !ok || !token.Valid {
-		return false // Invalid token
+		return false, nil // Invalid token
 	}
 
-	if claims["sub"] == nil || claims["sub"].(string) != expectedSubject {
-		return false // Invalid subject
+	if sub, ok := claims["sub"].(string); !ok || sub != expectedSubject {
+		return false, nil // Invalid subject
 	}
 
-	if claims["sid"] == nil || claims["sid"].(string) != streamId {
-		return false // Not for this stream
+	if sid, ok := claims["sid"].(string); !ok || sid != streamId {
+		return false, nil // Not for this stream
 	}
 
-	return true // Valid
+	return true, claims // Valid
+}
+
+// Checks if a boolean claim is set to true
+func getBooleanClaim(claims jwt.MapClaims, name string) bool {
+	if claims == nil {
+		return false
+	}
+
+	b, ok := claims[name].(bool)
+
+	return ok && b
 }
@@ -0,0 +1,925 @@
+// Configuration
+// Loaded once at startup from an optional YAML file,
+// overridden by the environment variables and validated
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pion/ice/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Default STUN server
+const DEFAULT_STUN_SERVER = "stun:stun.l.google.com:19302"
+
+// Config - Configuration of the node
+// Each option can be set in the YAML file (yaml tag)
+// or with an environment variable (env tag), that takes precedence
+// Options with the reload tag can be changed without restarting the node
+type Config struct {
+	Log          LogConfig          `yaml:"log"`
+	HTTP         HTTPConfig         `yaml:"http"`
+	Limits       LimitsConfig       `yaml:"limits"`
+	WebRTC       WebRTCConfig       `yaml:"webrtc"`
+	ICE          ICEConfig          `yaml:"ice"`
+	InterNode    InterNodeConfig    `yaml:"inter_node"`
+	EmbeddedTURN EmbeddedTURNConfig `yaml:"embedded_turn"`
+	Keyframes    KeyframesConfig    `yaml:"keyframes"`
+	GOPCache     GOPCacheConfig     `yaml:"gop_cache"`
+	RTMP         RTMPConfig         `yaml:"rtmp"`
+	HLS          HLSConfig          `yaml:"hls"`
+	MessageBus   MessageBusConfig   `yaml:"message_bus"`
+	Redis        RedisConfig        `yaml:"redis"`
+	NATS         NATSConfig         `yaml:"nats"`
+	Auth         AuthConfig         `yaml:"auth"`
+	Publishing   PublishingConfig   `yaml:"publishing"`
+	Recording    RecordingConfig    `yaml:"recording"`
+	Admin        AdminConfig        `yaml:"admin"`
+	Metrics      MetricsConfig      `yaml:"metrics"`
+	Shutdown     ShutdownConfig     `yaml:"shutdown"`
+}
+
+// LogConfig - Log options
+type LogConfig struct {
+	Format   string `yaml:"format" env:"LOG_FORMAT"`                   // text or json
+	Level    string `yaml:"level" env:"LOG_LEVEL" reload:"true"`       // debug, info, warning or error
+	Debug    bool   `yaml:"debug" env:"LOG_DEBUG" reload:"true"`       // Same as setting the level to debug
+	Requests bool   `yaml:"requests" env:"LOG_REQUESTS" reload:"true"` // Log the requests
+}
+
+// HTTPConfig - Signaling servers options
+type HTTPConfig struct {
+	BindAddress           string `yaml:"bind_address" env:"BIND_ADDRESS"`
+	Port                  int    `yaml:"port" env:"HTTP_PORT"`
+	SSLPort               int    `yaml:"ssl_port" env:"SSL_PORT"`
+	SSLCert               string `yaml:"ssl_cert" env:"SSL_CERT"`
+	SSLKey                string `yaml:"ssl_key" env:"SSL_KEY"`
+	SSLCheckReloadSeconds int    `yaml:"ssl_check_reload_seconds" env:"SSL_CHECK_RELOAD_SECONDS"`
+}
+
+// LimitsConfig - Limits for the clients
+type LimitsConfig struct {
+	MaxIPConcurrentConnections int      `yaml:"max_ip_concurrent_connections" env:"MAX_IP_CONCURRENT_CONNECTIONS" reload:"true"`
+	MaxRequestsPerSocket       int      `yaml:"max_requests_per_socket" env:"MAX_REQUESTS_PER_SOCKET" reload:"true"`
+	ConcurrentLimitWhitelist   []string `yaml:"concurrent_limit_whitelist" env:"CONCURRENT_LIMIT_WHITELIST" reload:"true"` // IP ranges, or * for all
+
+	whitelistAll    bool         // True if all the IPs are exempted
+	whitelistRanges []*net.IPNet // Parsed IP ranges of the whitelist
+}
+
+// WebRTCConfig - WebRTC options
+type WebRTCConfig struct {
+	STUNServers               []string `yaml:"stun_servers" env:"STUN_SERVER" reload:"true"`
+	TURNServers               []string `yaml:"turn_servers" env:"TURN_SERVER" reload:"true"`
+	TURNUsername              string   `yaml:"turn_username" env:"TURN_USERNAME" reload:"true"`
+	TURNPassword              string   `yaml:"turn_password" env:"TURN_PASSWORD" reload:"true"`
+	TURNSecret                string   `yaml:"turn_secret" env:"TURN_SECRET" reload:"true"` // Shared secret for ephemeral credentials (TURN REST API)
+	TURNCredentialsTTLSeconds int      `yaml:"turn_credentials_ttl_seconds" env:"TURN_CREDENTIALS_TTL_SECONDS" reload:"true"`
+}
+
+// ICEConfig - ICE transport options, shared by all the peer connections
+type ICEConfig struct {
+	UDPMuxPort           int      `yaml:"udp_mux_port" env:"ICE_UDP_MUX_PORT"`                       // 0 to use a different port for each peer connection
+	TCPMuxPort           int      `yaml:"tcp_mux_port" env:"ICE_TCP_MUX_PORT"`                       // 0 to disable ICE over TCP
+	UDPPortMin           int      `yaml:"udp_port_min" env:"ICE_UDP_PORT_MIN"`                       // Ephemeral port range, 0 for any port
+	UDPPortMax           int      `yaml:"udp_port_max" env:"ICE_UDP_PORT_MAX"`                       // Ephemeral port range, 0 for any port
+	NAT1To1IPs           []string `yaml:"nat_1to1_ips" env:"ICE_NAT_1TO1_IPS"`                       // External IPs (external or external/local)
+	NAT1To1CandidateType string   `yaml:"nat_1to1_candidate_type" env:"ICE_NAT_1TO1_CANDIDATE_TYPE"` // host or srflx
+	Interfaces           []string `yaml:"interfaces" env:"ICE_INTERFACES"`                           // Network interfaces to use, empty for all
+	ExcludeInterfaces    []string `yaml:"exclude_interfaces" env:"ICE_EXCLUDE_INTERFACES"`           // Network interfaces to ignore
+	IPs                  []string `yaml:"ips" env:"ICE_IPS"`                                         // IP addresses or CIDR ranges to use, empty for all
+	ExcludeIPs           []string `yaml:"exclude_ips" env:"ICE_EXCLUDE_IPS"`                         // IP addresses or CIDR ranges to ignore
+	MulticastDNSMode     string   `yaml:"mdns_mode" env:"ICE_MDNS_MODE"`                             // disabled, query or gather
+
+	candidateFilter *iceCandidateFilter // Parsed interfaces and IP ranges
+}
+
+// InterNodeConfig - ICE options for the peer connections between nodes
+// If not enabled, the same options of the client peer connections are used
+type InterNodeConfig struct {
+	Enabled           bool     `yaml:"enabled" env:"INTER_NODE_ICE_ENABLED"`
+	STUNServers       []string `yaml:"stun_servers" env:"INTER_NODE_STUN_SERVER" reload:"true"`
+	TURNServers       []string `yaml:"turn_servers" env:"INTER_NODE_TURN_SERVER" reload:"true"`
+	TURNUsername      string   `yaml:"turn_username" env:"INTER_NODE_TURN_USERNAME" reload:"true"`
+	TURNPassword      string   `yaml:"turn_password" env:"INTER_NODE_TURN_PASSWORD" reload:"true"`
+	CandidatePolicy   string   `yaml:"candidate_policy" env:"INTER_NODE_CANDIDATE_POLICY" reload:"true"` // all, host or relay
+	Interfaces        []string `yaml:"interfaces" env:"INTER_NODE_INTERFACES"`                           // Network interfaces to use, empty for all
+	ExcludeInterfaces []string `yaml:"exclude_interfaces" env:"INTER_NODE_EXCLUDE_INTERFACES"`           // Network interfaces to ignore
+	IPs               []string `yaml:"ips" env:"INTER_NODE_IPS"`                                         // IP addresses or CIDR ranges to use, empty for all
+	ExcludeIPs        []string `yaml:"exclude_ips" env:"INTER_NODE_EXCLUDE_IPS"`                         // IP addresses or CIDR ranges to ignore
+
+	candidateFilter *iceCandidateFilter // Parsed interfaces and IP ranges
+}
+
+// Filter of the network interfaces and IP addresses to gather ICE candidates from
+type iceCandidateFilter struct {
+	interfaces        []string
+	excludeInterfaces []string
+	ipRanges          []*net.IPNet
+	excludeIPRanges   []*net.IPNet
+}
+
+// EmbeddedTURNConfig - Embedded TURN server options
+type EmbeddedTURNConfig struct {
+	Enabled               bool     `yaml:"enabled" env:"EMBEDDED_TURN_ENABLED"`
+	Port                  int      `yaml:"port" env:"EMBEDDED_TURN_PORT"`           // UDP and TCP listening port
+	PublicIP              string   `yaml:"public_ip" env:"EMBEDDED_TURN_PUBLIC_IP"` // Detected if not set
+	Realm                 string   `yaml:"realm" env:"EMBEDDED_TURN_REALM"`
+	Users                 []string `yaml:"users" env:"EMBEDDED_TURN_USERS"`   // Long-term credentials (user=password)
+	Secret                string   `yaml:"secret" env:"EMBEDDED_TURN_SECRET"` // Shared secret for ephemeral credentials (TURN REST API)
+	CredentialsTTLSeconds int      `yaml:"credentials_ttl_seconds" env:"EMBEDDED_TURN_CREDENTIALS_TTL_SECONDS"`
+	RelayMinPort          int      `yaml:"relay_min_port" env:"EMBEDDED_TURN_RELAY_MIN_PORT"`
+	RelayMaxPort          int      `yaml:"relay_max_port" env:"EMBEDDED_TURN_RELAY_MAX_PORT"`
+	AllowedPeerIPs        []string `yaml:"allowed_peer_ips" env:"EMBEDDED_TURN_ALLOWED_PEER_IPS"` // Internal peers the server may relay to (IP or CIDR)
+
+	publicAddr        net.IP            // Parsed or detected public IP
+	credentials       map[string]string // Parsed long-term credentials (user -> password)
+	defaultUser       string            // First user of the list, for the node peer connections
+	allowedPeerRanges []*net.IPNet      // Parsed allowed peer ranges
+}
+
+// KeyframesConfig - Keyframe requests options
+type KeyframesConfig struct {
+	FallbackIntervalSeconds int `yaml:"fallback_interval_seconds" env:"KEYFRAME_FALLBACK_INTERVAL_SECONDS"` // 0 to disable
+}
+
+// GOPCacheConfig - GOP cache options
+type GOPCacheConfig struct {
+	Enabled    bool `yaml:"enabled" env:"GOP_CACHE_ENABLED"`
+	MaxPackets int  `yaml:"max_packets" env:"GOP_CACHE_MAX_PACKETS"`
+}
+
+// RTMPConfig - RTMP ingest options
+type RTMPConfig struct {
+	Enabled bool `yaml:"enabled" env:"RTMP_ENABLED"`
+	Port    int  `yaml:"port" env:"RTMP_PORT"`
+}
+
+// HLSConfig - HLS playback options
+type HLSConfig struct {
+	Enabled            bool `yaml:"enabled" env:"HLS_ENABLED"`
+	SegmentDuration    int  `yaml:"segment_duration" env:"HLS_SEGMENT_DURATION"`
+	PlaylistSize       int  `yaml:"playlist_size" env:"HLS_PLAYLIST_SIZE"`
+	IdleTimeoutSeconds int  `yaml:"idle_timeout_seconds" env:"HLS_IDLE_TIMEOUT_SECONDS"`
+	MaxPackagers       int  `yaml:"max_packagers" env:"HLS_MAX_PACKAGERS" reload:"true"` // Max number of streams being packaged
+}
+
+// MessageBusConfig - Inter-node communication options
+type MessageBusConfig struct {
+	Type       string `yaml:"type" env:"MESSAGE_BUS"` // REDIS or NATS
+	StandAlone bool   `yaml:"stand_alone" env:"STAND_ALONE"`
+}
+
+// RedisConfig - Redis connection options
+type RedisConfig struct {
+	Host     string `yaml:"host" env:"REDIS_HOST"`
+	Port     int    `yaml:"port" env:"REDIS_PORT"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD"`
+	TLS      bool   `yaml:"tls" env:"REDIS_TLS"`
+
+	StreamRegistry           bool `yaml:"stream_registry" env:"REDIS_STREAM_REGISTRY"`                         // Store the location of the streams in Redis
+	StreamRegistryTTLSeconds int  `yaml:"stream_registry_ttl_seconds" env:"REDIS_STREAM_REGISTRY_TTL_SECONDS"` // Lifetime of the entries, refreshed by the publishing node
+}
+
+// NATSConfig - NATS connection options
+type NATSConfig struct {
+	URL             string `yaml:"url" env:"NATS_URL"`
+	SubjectPrefix   string `yaml:"subject_prefix" env:"NATS_SUBJECT_PREFIX"`
+	User            string `yaml:"user" env:"NATS_USER"`
+	Password        string `yaml:"password" env:"NATS_PASSWORD"`
+	Token           string `yaml:"token" env:"NATS_TOKEN"`
+	CredentialsFile string `yaml:"credentials_file" env:"NATS_CREDENTIALS_FILE"`
+	NKeySeedFile    string `yaml:"nkey_seed_file" env:"NATS_NKEY_SEED_FILE"`
+	TLS             bool   `yaml:"tls" env:"NATS_TLS"`
+	TLSCA           string `yaml:"tls_ca" env:"NATS_TLS_CA"`
+	TLSCert         string `yaml:"tls_cert" env:"NATS_TLS_CERT"`
+	TLSKey          string `yaml:"tls_key" env:"NATS_TLS_KEY"`
+}
+
+// AuthConfig - Authentication options
+type AuthConfig struct {
+	JWTSecret          string   `yaml:"jwt_secret" env:"JWT_SECRET" reload:"true"`
+	JWTPublicKeys      []string `yaml:"jwt_public_keys" env:"JWT_PUBLIC_KEYS" reload:"true"`
+	JWKSURL            string   `yaml:"jwks_url" env:"JWT_JWKS_URL" reload:"true"`
+	JWKSRefreshSeconds int      `yaml:"jwks_refresh_seconds" env:"JWT_JWKS_REFRESH_SECONDS" reload:"true"`
+}
+
+// PublishingConfig - Publishing policy options
+type PublishingConfig struct {
+	Exclusive                bool `yaml:"exclusive" env:"PUBLISH_EXCLUSIVE" reload:"true"`               // Reject a second publisher for the same stream
+	CheckTimeoutMilliseconds int  `yaml:"check_timeout_ms" env:"PUBLISH_CHECK_TIMEOUT_MS" reload:"true"` // Max time to wait for other nodes to answer
+}
+
+// RecordingConfig - Recording options
+type RecordingConfig struct {
+	Enabled bool   `yaml:"enabled" env:"RECORDING_ENABLED"`
+	Path    string `yaml:"path" env:"RECORDING_PATH"`
+
+	SimulcastLayer string `yaml:"simulcast_layer" env:"RECORDING_SIMULCAST_LAYER"` // Layer ID to record, empty for the first announced layer
+}
+
+// AdminConfig - Admin API options
+type AdminConfig struct {
+	Secret string `yaml:"secret" env:"ADMIN_API_SECRET"` // Empty to disable the admin API
+}
+
+// MetricsConfig - Metrics options
+type MetricsConfig struct {
+	Enabled      bool   `yaml:"enabled" env:"METRICS_ENABLED"`
+	Secret       string `yaml:"secret" env:"METRICS_SECRET"`
+	StreamLabels bool   `yaml:"stream_labels" env:"METRICS_STREAM_LABELS"`
+}
+
+// ShutdownConfig - Graceful shutdown options
+type ShutdownConfig struct {
+	DrainPeriodSeconds int  `yaml:"drain_period_seconds" env:"DRAIN_PERIOD_SECONDS"`
+	DrainNotifyClients bool `yaml:"drain_notify_clients" env:"DRAIN_NOTIFY_CLIENTS"`
+}
+
+// Gets the configuration with the default values
+func defaultConfig() *Config {
+	return &Config{
+		Log: LogConfig{
+			Format:   "text",
+			Level:    "info",
+			Requests: true,
+		},
+		HTTP: HTTPConfig{
+			Port:                  80,
+			SSLPort:               443,
+			SSLCheckReloadSeconds: 60,
+		},
+		Limits: LimitsConfig{
+			MaxIPConcurrentConnections: 4,
+			MaxRequestsPerSocket:       100,
+		},
+		WebRTC: WebRTCConfig{
+			STUNServers:               []string{DEFAULT_STUN_SERVER},
+			TURNCredentialsTTLSeconds: TURN_DEFAULT_CREDENTIALS_TTL_SECONDS,
+		},
+		ICE: ICEConfig{
+			NAT1To1CandidateType: "host",
+			MulticastDNSMode:     "query",
+		},
+		InterNode: InterNodeConfig{
+			CandidatePolicy: "all",
+		},
+		EmbeddedTURN: EmbeddedTURNConfig{
+			Port:                  EMBEDDED_TURN_DEFAULT_PORT,
+			Realm:                 EMBEDDED_TURN_DEFAULT_REALM,
+			CredentialsTTLSeconds: EMBEDDED_TURN_DEFAULT_CREDENTIALS_TTL_SECONDS,
+			RelayMinPort:          EMBEDDED_TURN_DEFAULT_RELAY_MIN_PORT,
+			RelayMaxPort:          EMBEDDED_TURN_DEFAULT_RELAY_MAX_PORT,
+		},
+		GOPCache: GOPCacheConfig{
+			Enabled:    true,
+			MaxPackets: GOP_CACHE_DEFAULT_MAX_PACKETS,
+		},
+		RTMP: RTMPConfig{
+			Port: RTMP_DEFAULT_PORT,
+		},
+		HLS: HLSConfig{
+			SegmentDuration:    HLS_DEFAULT_SEGMENT_DURATION,
+			PlaylistSize:       HLS_DEFAULT_PLAYLIST_SIZE,
+			IdleTimeoutSeconds: HLS_DEFAULT_IDLE_TIMEOUT_SECONDS,
+			MaxPackagers:       HLS_DEFAULT_MAX_PACKAGERS,
+		},
+		MessageBus: MessageBusConfig{
+			Type: "REDIS",
+		},
+		Redis: RedisConfig{
+			Host:                     "localhost",
+			Port:                     6379,
+			StreamRegistryTTLSeconds: STREAM_REGISTRY_DEFAULT_TTL_SECONDS,
+		},
+		NATS: NATSConfig{
+			URL:           nats.DefaultURL,
+			SubjectPrefix: REDIS_BROADCAST_CHANNEL,
+		},
+		Auth: AuthConfig{
+			JWKSRefreshSeconds: JWKS_DEFAULT_REFRESH_SECONDS,
+		},
+		Publishing: PublishingConfig{
+			CheckTimeoutMilliseconds: PUBLISH_DEFAULT_CHECK_TIMEOUT_MS,
+		},
+		Recording: RecordingConfig{
+			Path: RECORDING_DEFAULT_PATH,
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+		},
+		Shutdown: ShutdownConfig{
+			DrainPeriodSeconds: DRAIN_DEFAULT_PERIOD_SECONDS,
+			DrainNotifyClients: true,
+		},
+	}
+}
+
+// Loads the configuration
+// The file is optional (empty path to only use the environment variables)
+// Returns all the validation errors found
+func loadConfig(file string) (*Config, error) {
+	config := defaultConfig()
+
+	if file != "" {
+		err := config.loadFile(file)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := config.loadEnv()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Loads the options set in a YAML file
+// Unknown options are reported as errors, to detect typos
+func (config *Config) loadFile(file string) error {
+	content, err := os.ReadFile(file)
+
+	if err != nil {
+		return fmt.Errorf("could not read the configuration file: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(config)
+
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("invalid configuration file %v: %v", file, err)
+	}
+
+	return nil
+}
+
+// Gets the names of the environment variables, by option (section.name)
+func getConfigEnvNames() map[string]string {
+	result := make(map[string]string)
+
+	sections := reflect.TypeOf(Config{})
+
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+
+			if field.Tag.Get("env") != "" {
+				result[section.Tag.Get("yaml")+"."+field.Tag.Get("yaml")] = field.Tag.Get("env")
+			}
+		}
+	}
+
+	return result
+}
+
+// Loads the options set with environment variables
+// Empty variables are ignored
+func (config *Config) loadEnv() error {
+	errs := make([]error, 0)
+
+	sections := reflect.ValueOf(config).Elem()
+
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionType := section.Type()
+
+		for j := 0; j < section.NumField(); j++ {
+			name := sectionType.Field(j).Tag.Get("env")
+
+			if name == "" {
+				continue
+			}
+
+			value := os.Getenv(name)
+
+			if value == "" {
+				continue
+			}
+
+			err := setConfigValue(section.Field(j), value)
+
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%v: %v", name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Sets an option from the value of an environment variable
+func setConfigValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		switch strings.ToUpper(strings.TrimSpace(value)) {
+		case "YES", "TRUE", "1":
+			field.SetBool(true)
+		case "NO", "FALSE", "0":
+			field.SetBool(false)
+		default:
+			return fmt.Errorf("expected YES or NO, got %q", value)
+		}
+	case reflect.Slice:
+		list := make([]string, 0)
+
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+
+		field.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("unsupported option type")
+	}
+
+	return nil
+}
+
+// Checks the configuration, returning all the errors found
+// Also prepares the parsed values (e.g. the IP ranges)
+func (config *Config) validate() error {
+	errs := make([]error, 0)
+	envNames := getConfigEnvNames()
+
+	invalid := func(option string, format string, args ...any) {
+		if envNames[option] != "" {
+			option += " (" + envNames[option] + ")"
+		}
+
+		errs = append(errs, fmt.Errorf(option+": "+format, args...))
+	}
+
+	parseIPRanges := func(option string, list []string) []*net.IPNet {
+		ipRanges := make([]*net.IPNet, 0)
+
+		for _, r := range list {
+			ipRange, err := parseIPRange(r)
+
+			if err != nil {
+				invalid(option, "%q is not an IP address or CIDR range", r)
+				continue
+			}
+
+			ipRanges = append(ipRanges, ipRange)
+		}
+
+		return ipRanges
+	}
+
+	// Log
+
+	switch strings.ToLower(config.Log.Format) {
+	case "text", "json":
+	default:
+		invalid("log.format", "must be text or json, got %q", config.Log.Format)
+	}
+
+	switch strings.ToLower(config.Log.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		invalid("log.level", "must be debug, info, warning or error, got %q", config.Log.Level)
+	}
+
+	// HTTP
+
+	if !isValidPort(config.HTTP.Port) {
+		invalid("http.port", "must be a port number, got %d", config.HTTP.Port)
+	}
+
+	if !isValidPort(config.HTTP.SSLPort) {
+		invalid("http.ssl_port", "must be a port number, got %d", config.HTTP.SSLPort)
+	}
+
+	if (config.HTTP.SSLCert == "") != (config.HTTP.SSLKey == "") {
+		invalid("http.ssl_cert", "the certificate and the key must be set together")
+	}
+
+	if config.HTTP.SSLCert != "" {
+		if _, err := os.Stat(config.HTTP.SSLCert); err != nil {
+			invalid("http.ssl_cert", "%v", err)
+		}
+	}
+
+	if config.HTTP.SSLKey != "" {
+		if _, err := os.Stat(config.HTTP.SSLKey); err != nil {
+			invalid("http.ssl_key", "%v", err)
+		}
+	}
+
+	if config.HTTP.SSLCheckReloadSeconds < 0 {
+		invalid("http.ssl_check_reload_seconds", "must not be negative")
+	}
+
+	// Limits
+
+	if config.Limits.MaxIPConcurrentConnections < 0 {
+		invalid("limits.max_ip_concurrent_connections", "must not be negative")
+	}
+
+	if config.Limits.MaxRequestsPerSocket < 0 {
+		invalid("limits.max_requests_per_socket", "must not be negative")
+	}
+
+	config.Limits.whitelistAll = false
+	config.Limits.whitelistRanges = make([]*net.IPNet, 0)
+
+	for _, r := range config.Limits.ConcurrentLimitWhitelist {
+		if r == "*" {
+			config.Limits.whitelistAll = true
+			continue
+		}
+
+		ipRange, err := parseIPRange(r)
+
+		if err != nil {
+			invalid("limits.concurrent_limit_whitelist", "%q is not an IP address or CIDR range", r)
+			continue
+		}
+
+		config.Limits.whitelistRanges = append(config.Limits.whitelistRanges, ipRange)
+	}
+
+	// WebRTC
+
+	for _, server := range config.WebRTC.STUNServers {
+		if url, err := ice.ParseURL(server); err != nil || (url.Scheme != ice.SchemeTypeSTUN && url.Scheme != ice.SchemeTypeSTUNS) {
+			invalid("webrtc.stun_servers", "%q is not a valid STUN URL", server)
+		}
+	}
+
+	for _, server := range config.WebRTC.TURNServers {
+		if url, err := ice.ParseURL(server); err != nil || (url.Scheme != ice.SchemeTypeTURN && url.Scheme != ice.SchemeTypeTURNS) {
+			invalid("webrtc.turn_servers", "%q is not a valid TURN URL", server)
+		}
+	}
+
+	if config.WebRTC.TURNSecret != "" && config.WebRTC.TURNCredentialsTTLSeconds <= 0 {
+		invalid("webrtc.turn_credentials_ttl_seconds", "must be positive")
+	}
+
+	// ICE
+
+	if config.ICE.UDPMuxPort != 0 && !isValidPort(config.ICE.UDPMuxPort) {
+		invalid("ice.udp_mux_port", "must be a port number, got %d", config.ICE.UDPMuxPort)
+	}
+
+	if config.ICE.TCPMuxPort != 0 && !isValidPort(config.ICE.TCPMuxPort) {
+		invalid("ice.tcp_mux_port", "must be a port number, got %d", config.ICE.TCPMuxPort)
+	}
+
+	if config.ICE.UDPPortMin != 0 || config.ICE.UDPPortMax != 0 {
+		if !isValidPort(config.ICE.UDPPortMin) || !isValidPort(config.ICE.UDPPortMax) || config.ICE.UDPPortMin > config.ICE.UDPPortMax {
+			invalid("ice.udp_port_min", "the port range %d-%d is not valid", config.ICE.UDPPortMin, config.ICE.UDPPortMax)
+		}
+	}
+
+	for _, mapping := range config.ICE.NAT1To1IPs {
+		external, local, hasLocal := strings.Cut(mapping, "/")
+
+		if net.ParseIP(external) == nil || (hasLocal && net.ParseIP(local) == nil) {
+			invalid("ice.nat_1to1_ips", "%q must be an IP address, or a pair of IP addresses (external/local)", mapping)
+		} else if hasLocal && strings.ToLower(config.ICE.NAT1To1CandidateType) == "srflx" {
+			invalid("ice.nat_1to1_ips", "%q: local addresses are only supported for host candidates", mapping)
+		}
+	}
+
+	switch strings.ToLower(config.ICE.NAT1To1CandidateType) {
+	case "host", "srflx":
+	default:
+		invalid("ice.nat_1to1_candidate_type", "must be host or srflx, got %q", config.ICE.NAT1To1CandidateType)
+	}
+
+	switch strings.ToLower(config.ICE.MulticastDNSMode) {
+	case "disabled", "query":
+	case "gather":
+		if len(config.ICE.NAT1To1IPs) > 0 && strings.ToLower(config.ICE.NAT1To1CandidateType) == "host" {
+			invalid("ice.mdns_mode", "gather cannot be used with host NAT 1:1 IPs")
+		}
+	default:
+		invalid("ice.mdns_mode", "must be disabled, query or gather, got %q", config.ICE.MulticastDNSMode)
+	}
+
+	config.ICE.candidateFilter = &iceCandidateFilter{
+		interfaces:        config.ICE.Interfaces,
+		excludeInterfaces: config.ICE.ExcludeInterfaces,
+		ipRanges:          parseIPRanges("ice.ips", config.ICE.IPs),
+		excludeIPRanges:   parseIPRanges("ice.exclude_ips", config.ICE.ExcludeIPs),
+	}
+
+	// Inter-node ICE
+
+	for _, server := range config.InterNode.STUNServers {
+		if url, err := ice.ParseURL(server); err != nil || (url.Scheme != ice.SchemeTypeSTUN && url.Scheme != ice.SchemeTypeSTUNS) {
+			invalid("inter_node.stun_servers", "%q is not a valid STUN URL", server)
+		}
+	}
+
+	for _, server := range config.InterNode.TURNServers {
+		if url, err := ice.ParseURL(server); err != nil || (url.Scheme != ice.SchemeTypeTURN && url.Scheme != ice.SchemeTypeTURNS) {
+			invalid("inter_node.turn_servers", "%q is not a valid TURN URL", server)
+		}
+	}
+
+	switch strings.ToLower(config.InterNode.CandidatePolicy) {
+	case "all":
+	case "host":
+		if len(config.InterNode.STUNServers) > 0 || len(config.InterNode.TURNServers) > 0 {
+			invalid("inter_node.candidate_policy", "host cannot be used with STUN or TURN servers")
+		}
+	case "relay":
+		if config.InterNode.Enabled && len(config.InterNode.TURNServers) == 0 {
+			invalid("inter_node.candidate_policy", "relay requires at least one TURN server")
+		}
+	default:
+		invalid("inter_node.candidate_policy", "must be all, host or relay, got %q", config.InterNode.CandidatePolicy)
+	}
+
+	config.InterNode.candidateFilter = &iceCandidateFilter{
+		interfaces:        config.InterNode.Interfaces,
+		excludeInterfaces: config.InterNode.ExcludeInterfaces,
+		ipRanges:          parseIPRanges("inter_node.ips", config.InterNode.IPs),
+		excludeIPRanges:   parseIPRanges("inter_node.exclude_ips", config.InterNode.ExcludeIPs),
+	}
+
+	// With a UDP mux, the host candidates are the addresses the mux listens on,
+	// so the inter-node peer connections cannot use different filters
+
+	if config.InterNode.Enabled && config.ICE.UDPMuxPort != 0 {
+		if config.InterNode.candidateFilter.hasInterfaceFilter() {
+			invalid("inter_node.interfaces", "the inter-node interface filters cannot be used with ice.udp_mux_port")
+		}
+
+		if config.InterNode.candidateFilter.hasIPFilter() {
+			invalid("inter_node.ips", "the inter-node IP filters cannot be used with ice.udp_mux_port")
+		}
+	}
+
+	// Embedded TURN server
+
+	config.EmbeddedTURN.credentials = make(map[string]string)
+	config.EmbeddedTURN.defaultUser = ""
+
+	if config.EmbeddedTURN.Enabled {
+		if !isValidPort(config.EmbeddedTURN.Port) {
+			invalid("embedded_turn.port", "must be a port number, got %d", config.EmbeddedTURN.Port)
+		}
+
+		// If not set, the public IP is detected once at startup (see resolvePublicIP)
+		if config.EmbeddedTURN.PublicIP != "" {
+			config.EmbeddedTURN.publicAddr = net.ParseIP(config.EmbeddedTURN.PublicIP)
+
+			if config.EmbeddedTURN.publicAddr == nil {
+				invalid("embedded_turn.public_ip", "%q is not an IP address", config.EmbeddedTURN.PublicIP)
+			}
+		}
+
+		for _, user := range config.EmbeddedTURN.Users {
+			username, password, ok := strings.Cut(user, "=")
+
+			if !ok || username == "" || password == "" {
+				invalid("embedded_turn.users", "each user must have the format user=password")
+				continue
+			}
+
+			if config.EmbeddedTURN.defaultUser == "" {
+				config.EmbeddedTURN.defaultUser = username
+			}
+
+			config.EmbeddedTURN.credentials[username] = password
+		}
+
+		if len(config.EmbeddedTURN.Users) == 0 && config.EmbeddedTURN.Secret == "" {
+			invalid("embedded_turn.users", "at least one user or the secret must be set")
+		}
+
+		if config.EmbeddedTURN.CredentialsTTLSeconds <= 0 {
+			invalid("embedded_turn.credentials_ttl_seconds", "must be positive")
+		}
+
+		if !isValidPort(config.EmbeddedTURN.RelayMinPort) || !isValidPort(config.EmbeddedTURN.RelayMaxPort) || config.EmbeddedTURN.RelayMinPort > config.EmbeddedTURN.RelayMaxPort {
+			invalid("embedded_turn.relay_min_port", "the relay port range %d-%d is not valid", config.EmbeddedTURN.RelayMinPort, config.EmbeddedTURN.RelayMaxPort)
+		}
+
+		config.EmbeddedTURN.allowedPeerRanges = parseIPRanges("embedded_turn.allowed_peer_ips", config.EmbeddedTURN.AllowedPeerIPs)
+	}
+
+	if config.Keyframes.FallbackIntervalSeconds < 0 {
+		invalid("keyframes.fallback_interval_seconds", "must not be negative")
+	}
+
+	// GOP cache
+
+	if config.GOPCache.MaxPackets < 0 {
+		invalid("gop_cache.max_packets", "must not be negative")
+	}
+
+	// RTMP
+
+	if !isValidPort(config.RTMP.Port) {
+		invalid("rtmp.port", "must be a port number, got %d", config.RTMP.Port)
+	}
+
+	// HLS
+
+	if config.HLS.SegmentDuration <= 0 {
+		invalid("hls.segment_duration", "must be positive")
+	}
+
+	if config.HLS.PlaylistSize <= 0 {
+		invalid("hls.playlist_size", "must be positive")
+	}
+
+	if config.HLS.IdleTimeoutSeconds <= 0 {
+		invalid("hls.idle_timeout_seconds", "must be positive")
+	}
+
+	if config.HLS.MaxPackagers <= 0 {
+		invalid("hls.max_packagers", "must be positive")
+	}
+
+	// Message bus
+
+	switch strings.ToUpper(config.MessageBus.Type) {
+	case "REDIS":
+		if !config.MessageBus.StandAlone && !isValidPort(config.Redis.Port) {
+			invalid("redis.port", "must be a port number, got %d", config.Redis.Port)
+		}
+	case "NATS":
+		if !config.MessageBus.StandAlone && (config.NATS.TLSCert == "") != (config.NATS.TLSKey == "") {
+			invalid("nats.tls_cert", "the client certificate and the key must be set together")
+		}
+		if config.Redis.StreamRegistry {
+			invalid("redis.stream_registry", "requires the REDIS message bus")
+		}
+	default:
+		invalid("message_bus.type", "must be REDIS or NATS, got %q", config.MessageBus.Type)
+	}
+
+	if config.Redis.StreamRegistry && config.Redis.StreamRegistryTTLSeconds <= 0 {
+		invalid("redis.stream_registry_ttl_seconds", "must be positive")
+	}
+
+	// Authentication
+
+	for _, file := range config.Auth.JWTPublicKeys {
+		if _, err := loadPublicKeyFile(file); err != nil {
+			invalid("auth.jwt_public_keys", "could not load public key %v: %v", file, err)
+		}
+	}
+
+	if config.Auth.JWKSRefreshSeconds <= 0 {
+		invalid("auth.jwks_refresh_seconds", "must be positive")
+	}
+
+	// Publishing
+
+	if config.Publishing.CheckTimeoutMilliseconds <= 0 {
+		invalid("publishing.check_timeout_ms", "must be positive")
+	}
+
+	// Shutdown
+
+	if config.Shutdown.DrainPeriodSeconds < 0 {
+		invalid("shutdown.drain_period_seconds", "must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Checks if a number is a valid port
+func isValidPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// Parses an IP range in CIDR notation
+// Single IP addresses are also accepted
+func parseIPRange(r string) (*net.IPNet, error) {
+	if !strings.Contains(r, "/") {
+		ip := net.ParseIP(r)
+
+		if ip == nil {
+			return nil, errors.New("invalid IP address")
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipRange, err := net.ParseCIDR(r)
+
+	return ipRange, err
+}
+
+// Checks if an IP is exempted from the concurrent connections limit
+func (config *LimitsConfig) isIPExempted(ipStr string) bool {
+	if config.whitelistAll {
+		return true
+	}
+
+	ip := net.ParseIP(ipStr)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, ipRange := range config.whitelistRanges {
+		if ipRange.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if the network interfaces are filtered
+func (filter *iceCandidateFilter) hasInterfaceFilter() bool {
+	return len(filter.interfaces) > 0 || len(filter.excludeInterfaces) > 0
+}
+
+// Checks if the IP addresses are filtered
+func (filter *iceCandidateFilter) hasIPFilter() bool {
+	return len(filter.ipRanges) > 0 || len(filter.excludeIPRanges) > 0
+}
+
+// Checks if a network interface can be used to gather ICE candidates
+func (filter *iceCandidateFilter) isInterfaceAllowed(name string) bool {
+	for _, excluded := range filter.excludeInterfaces {
+		if excluded == name {
+			return false
+		}
+	}
+
+	if len(filter.interfaces) == 0 {
+		return true
+	}
+
+	for _, allowed := range filter.interfaces {
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if an IP address can be used to gather ICE candidates
+func (filter *iceCandidateFilter) isIPAllowed(ip net.IP) bool {
+	for _, ipRange := range filter.excludeIPRanges {
+		if ipRange.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(filter.ipRanges) == 0 {
+		return true
+	}
+
+	for _, ipRange := range filter.ipRanges {
+		if ipRange.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
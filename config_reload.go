@@ -0,0 +1,140 @@
+// Configuration reload
+// Applies the reloadable options without restarting the node
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// Result of reloading the configuration
+type ConfigReloadResult struct {
+	Changed         []string `json:"changed"`          // Options applied
+	RestartRequired []string `json:"restart_required"` // Options changed, but not applied until the node is restarted
+}
+
+// Reloads the configuration file and the environment variables
+// Only the options with the reload tag are applied, to the new sessions
+// If the configuration is invalid, nothing is applied
+func (node *WebRTC_CDN_Node) reloadConfig() (*ConfigReloadResult, error) {
+	node.mutexConfigReload.Lock()
+	defer node.mutexConfigReload.Unlock()
+
+	loaded, err := loadConfig(node.configFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	current := node.getConfig()
+	result, merged := mergeReloadedConfig(current, loaded)
+
+	if len(result.Changed) == 0 {
+		return result, nil
+	}
+
+	// Prepare the parsed values of the merged options
+	err = merged.validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !reflect.DeepEqual(current.Auth, merged.Auth) {
+		err = node.initAuthentication(&merged.Auth)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	node.config.Store(merged)
+
+	SetLogLevel(&merged.Log)
+
+	return result, nil
+}
+
+// Creates a copy of the current configuration,
+// replacing the reloadable options with the loaded ones
+func mergeReloadedConfig(current *Config, loaded *Config) (*ConfigReloadResult, *Config) {
+	result := &ConfigReloadResult{
+		Changed:         make([]string, 0),
+		RestartRequired: make([]string, 0),
+	}
+
+	merged := *current
+
+	currentSections := reflect.ValueOf(current).Elem()
+	loadedSections := reflect.ValueOf(loaded).Elem()
+	mergedSections := reflect.ValueOf(&merged).Elem()
+	sectionTypes := currentSections.Type()
+
+	for i := 0; i < sectionTypes.NumField(); i++ {
+		sectionType := sectionTypes.Field(i)
+
+		for j := 0; j < sectionType.Type.NumField(); j++ {
+			fieldType := sectionType.Type.Field(j)
+
+			if !fieldType.IsExported() {
+				continue
+			}
+
+			currentValue := currentSections.Field(i).Field(j)
+			loadedValue := loadedSections.Field(i).Field(j)
+
+			if reflect.DeepEqual(currentValue.Interface(), loadedValue.Interface()) {
+				continue
+			}
+
+			option := sectionType.Tag.Get("yaml") + "." + fieldType.Tag.Get("yaml")
+
+			if fieldType.Tag.Get("reload") == "true" {
+				mergedSections.Field(i).Field(j).Set(loadedValue)
+				result.Changed = append(result.Changed, option)
+			} else {
+				result.RestartRequired = append(result.RestartRequired, option)
+			}
+		}
+	}
+
+	return result, &merged
+}
+
+// Reloads the configuration and logs the result
+func (node *WebRTC_CDN_Node) reloadConfigAndLog() (*ConfigReloadResult, error) {
+	result, err := node.reloadConfig()
+
+	if err != nil {
+		LogWarning("Could not reload the configuration: " + strings.ReplaceAll(err.Error(), "\n", "; "))
+		return nil, err
+	}
+
+	if len(result.Changed) > 0 {
+		getRootLogger().Info("Configuration reloaded", "changed", result.Changed)
+	} else {
+		LogInfo("Configuration reloaded. No changes found.")
+	}
+
+	if len(result.RestartRequired) > 0 {
+		getRootLogger().Warning("Some options require restarting the node to be applied", "options", result.RestartRequired)
+	}
+
+	return result, nil
+}
+
+// Reloads the configuration when the SIGHUP signal is received
+func handleReloadSignals(node *WebRTC_CDN_Node) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for sig := range signals {
+		LogInfo("Received signal: " + sig.String() + ". Reloading configuration.")
+
+		node.reloadConfigAndLog()
+	}
+}
@@ -3,11 +3,14 @@
 package main
 
 import (
+	"encoding/json"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
 )
 
 // Period to send HEARTBEAT messages to the client
@@ -20,6 +23,12 @@ const HEARTBEAT_TIMEOUT_MS = 2 * HEARTBEAT_MSG_PERIOD_SECONDS * 1000
 const REQUEST_TYPE_PUBLISH = 1
 const REQUEST_TYPE_PLAY = 2
 
+// Body of the OK message
+// ICE servers to use for the peer connection, with the same format as RTCConfiguration
+type SignalingOkBody struct {
+	ICEServers []webrtc.ICEServer `json:"iceServers"`
+}
+
 // Connection_Handler - Stores status data
 // of an active connection
 type Connection_Handler struct {
@@ -31,6 +40,8 @@ type Connection_Handler struct {
 
 	lastHeartbeat int64 // Timestamp: Last time a HEARTBEAT message was received
 
+	startTime time.Time // Time the connection was established
+
 	closed bool // True if the connection is closed
 
 	sendingMutex *sync.Mutex // Mutex to control sending messages
@@ -41,17 +52,21 @@ type Connection_Handler struct {
 
 	sources map[string]*WRTC_Source // References to associated WebRTCs sources
 	sinks   map[string]*WRTC_Sink   // References to associated WebRTC sinks
+
+	logger *Logger // Logger including the connection fields
 }
 
 // Initialize
 func (h *Connection_Handler) init() {
 	h.closed = false
+	h.startTime = time.Now()
 	h.sendingMutex = &sync.Mutex{}
 	h.statusMutex = &sync.Mutex{}
 	h.requestCount = 0
 	h.requests = make(map[string]int)
 	h.sources = make(map[string]*WRTC_Source)
 	h.sinks = make(map[string]*WRTC_Sink)
+	h.logger = getRootLogger().With("connection_id", h.id, "ip", h.ip)
 }
 
 // Runs the handler
@@ -105,8 +120,12 @@ func (h *Connection_Handler) run() {
 			h.receivePublishMessage(msg)
 		case "PLAY":
 			h.receivePlayMessage(msg)
+		case "OFFER":
+			h.receiveOfferMessage(msg)
 		case "ANSWER":
 			h.receiveAnswerMessage(msg)
+		case "LAYER":
+			h.receiveLayerMessage(msg)
 		case "CANDIDATE":
 			h.receiveCandidateMessage(msg)
 		case "CLOSE":
@@ -168,6 +187,9 @@ func (h *Connection_Handler) receivePublishMessage(msg SignalingMessage) {
 	streamId := msg.params["stream-id"]
 	streamType := strings.ToUpper(msg.params["stream-type"])
 	auth := msg.params["auth"]
+	simulcast := strings.ToLower(msg.params["simulcast"]) == "true"
+
+	metricPublishRequests.WithLabelValues("websocket").Inc()
 
 	// Validate params
 
@@ -181,11 +203,21 @@ func (h *Connection_Handler) receivePublishMessage(msg SignalingMessage) {
 		return
 	}
 
-	if !checkAuthentication(auth, "stream_publish", streamId) {
+	validAuth, claims := checkAuthenticationClaims(h.node.authKeyProvider.Load(), auth, "stream_publish", streamId)
+
+	if !validAuth {
 		h.sendErrorMessage("INVALID_AUTH", "Invalid authentication provided.", requestId)
 		return
 	}
 
+	exclusive := isExclusivePublishing(&h.node.getConfig().Publishing, claims)
+	takeover := isPublishingTakeover(claims)
+
+	if !h.node.canPublish(streamId, exclusive, takeover) {
+		h.sendErrorMessage("STREAM_ALREADY_PUBLISHING", "The stream is already being published.", requestId)
+		return
+	}
+
 	hasAudio := true
 	hasVideo := true
 
@@ -197,12 +229,17 @@ func (h *Connection_Handler) receivePublishMessage(msg SignalingMessage) {
 
 	// Create source
 	source := WRTC_Source{
-		requestId:  requestId,
-		sid:        streamId,
-		node:       h.node,
-		hasAudio:   hasAudio,
-		hasVideo:   hasVideo,
-		connection: h,
+		requestId:   requestId,
+		sid:         streamId,
+		node:        h.node,
+		hasAudio:    hasAudio,
+		hasVideo:    hasVideo,
+		connection:  h,
+		exclusive:   exclusive,
+		takeover:    takeover,
+		record:      isRecordingEnabled(&h.node.getConfig().Recording, claims),
+		ip:          h.ip,
+		clientOffer: simulcast,
 	}
 
 	source.init()
@@ -217,19 +254,24 @@ func (h *Connection_Handler) receivePublishMessage(msg SignalingMessage) {
 			return
 		}
 
-		if h.requestCount > h.node.requestLimit {
+		if h.requestCount > uint32(h.node.getConfig().Limits.MaxRequestsPerSocket) {
+			metricRejectedRequests.WithLabelValues("limit_requests").Inc()
 			h.sendErrorMessage("LIMIT_REQUESTS", "Too many requests on the same socket.", requestId)
 			return
 		}
 
+		// Register source
+		if !h.node.registerSource(&source) {
+			h.sendErrorMessage("STREAM_ALREADY_PUBLISHING", "The stream is already being published.", requestId)
+			return
+		}
+
 		h.requestCount++
 		h.requests[requestId] = REQUEST_TYPE_PUBLISH
 		h.sources[requestId] = &source
 
 		h.sendOkMessage(requestId)
 
-		h.node.registerSource(&source) // Register source
-
 		go source.run() // Run source
 	}()
 }
@@ -239,6 +281,9 @@ func (h *Connection_Handler) receivePlayMessage(msg SignalingMessage) {
 	requestId := msg.params["request-id"]
 	streamId := msg.params["stream-id"]
 	auth := msg.params["auth"]
+	layer := msg.params["layer"]
+
+	metricPlayRequests.WithLabelValues("websocket").Inc()
 
 	// Validate params
 
@@ -252,7 +297,7 @@ func (h *Connection_Handler) receivePlayMessage(msg SignalingMessage) {
 		return
 	}
 
-	if !checkAuthentication(auth, "stream_play", streamId) {
+	if !checkAuthentication(h.node.authKeyProvider.Load(), auth, "stream_play", streamId) {
 		h.sendErrorMessage("INVALID_AUTH", "Invalid authentication provided.", requestId)
 		return
 	}
@@ -266,6 +311,8 @@ func (h *Connection_Handler) receivePlayMessage(msg SignalingMessage) {
 		sid:        streamId,
 		node:       h.node,
 		connection: h,
+		ip:         h.ip,
+		layer:      layer,
 	}
 
 	sink.init()
@@ -280,7 +327,8 @@ func (h *Connection_Handler) receivePlayMessage(msg SignalingMessage) {
 			return
 		}
 
-		if h.requestCount > h.node.requestLimit {
+		if h.requestCount > uint32(h.node.getConfig().Limits.MaxRequestsPerSocket) {
+			metricRejectedRequests.WithLabelValues("limit_requests").Inc()
 			h.sendErrorMessage("LIMIT_REQUESTS", "Too many requests on the same socket.", requestId)
 			return
 		}
@@ -297,6 +345,40 @@ func (h *Connection_Handler) receivePlayMessage(msg SignalingMessage) {
 	}()
 }
 
+// Called when an OFFER message is received from the client
+// Only for publish requests in client offer mode (simulcast)
+func (h *Connection_Handler) receiveOfferMessage(msg SignalingMessage) {
+	requestId := msg.params["request-id"]
+
+	func() {
+		h.statusMutex.Lock()
+		defer h.statusMutex.Unlock()
+
+		if h.requests[requestId] == REQUEST_TYPE_PUBLISH && h.sources[requestId] != nil {
+			h.sources[requestId].onOffer(msg.body)
+		}
+	}()
+}
+
+// Called when a LAYER message is received from the client
+// Selects the simulcast layer for a play request
+func (h *Connection_Handler) receiveLayerMessage(msg SignalingMessage) {
+	requestId := msg.params["request-id"]
+	layer := msg.params["layer"]
+
+	h.statusMutex.Lock()
+	sink := h.sinks[requestId]
+	h.statusMutex.Unlock()
+
+	if sink == nil {
+		return // IGNORE
+	}
+
+	sink.setLayer(layer)
+
+	h.node.onSinkLayerChanged(sink)
+}
+
 // Called when an ANSWER message is received from the client
 func (h *Connection_Handler) receiveAnswerMessage(msg SignalingMessage) {
 	requestId := msg.params["request-id"]
@@ -383,6 +465,7 @@ func (h *Connection_Handler) sendErrorMessage(code string, errMsg string, reques
 }
 
 // Sends an OK message to the client
+// The body includes the ICE servers, with ephemeral TURN credentials if enabled
 func (h *Connection_Handler) sendOkMessage(requestID string) {
 	msg := SignalingMessage{
 		method: "OK",
@@ -392,6 +475,18 @@ func (h *Connection_Handler) sendOkMessage(requestID string) {
 
 	msg.params["Request-ID"] = requestID
 
+	body := SignalingOkBody{
+		ICEServers: loadICEServers(h.node.getConfig(), strconv.FormatUint(h.id, 10), false),
+	}
+
+	if len(body.ICEServers) > 0 {
+		bodyJSON, err := json.Marshal(body)
+
+		if err == nil {
+			msg.body = string(bodyJSON)
+		}
+	}
+
 	h.send(msg)
 }
 
@@ -422,6 +517,20 @@ func (h *Connection_Handler) sendOffer(reqId string, sid string, offerJSON strin
 	h.send(msg)
 }
 
+// Sends an ANSWER message to the client
+func (h *Connection_Handler) sendAnswer(reqId string, sid string, answerJSON string) {
+	msg := SignalingMessage{
+		method: "ANSWER",
+		params: make(map[string]string),
+		body:   answerJSON,
+	}
+
+	msg.params["Request-ID"] = reqId
+	msg.params["Stream-ID"] = sid
+
+	h.send(msg)
+}
+
 // Sends a CANDIDATE message to the client
 func (h *Connection_Handler) sendICECandidate(reqId string, sid string, candidateJSON string) {
 	msg := SignalingMessage{
@@ -436,6 +545,20 @@ func (h *Connection_Handler) sendICECandidate(reqId string, sid string, candidat
 	h.send(msg)
 }
 
+// Sends a DRAIN message to the client
+// This means the node is shutting down and the client should reconnect to other node
+func (h *Connection_Handler) sendDrainMessage(period time.Duration) {
+	msg := SignalingMessage{
+		method: "DRAIN",
+		params: make(map[string]string),
+		body:   "",
+	}
+
+	msg.params["Drain-Seconds"] = strconv.Itoa(int(period.Seconds()))
+
+	h.send(msg)
+}
+
 // Removes a source and send a message to the client
 func (h *Connection_Handler) sendSourceClose(reqId string, sid string) {
 	h.statusMutex.Lock()
@@ -457,14 +580,39 @@ func (h *Connection_Handler) sendSourceClose(reqId string, sid string) {
 	h.send(msg)
 }
 
+// Removes a sink and send a message to the client
+func (h *Connection_Handler) sendSinkClose(reqId string, sid string) {
+	h.statusMutex.Lock()
+	defer h.statusMutex.Unlock()
+
+	if h.sinks[reqId] == nil {
+		return
+	}
+
+	delete(h.sinks, reqId)
+	delete(h.requests, reqId)
+	h.requestCount--
+
+	msg := SignalingMessage{
+		method: "CLOSE",
+		params: make(map[string]string),
+		body:   "",
+	}
+
+	msg.params["Request-ID"] = reqId
+	msg.params["Stream-ID"] = sid
+
+	h.send(msg)
+}
+
 // Logs a message for this connection
 func (h *Connection_Handler) log(msg string) {
-	LogRequest(h.id, h.ip, msg)
+	h.logger.Request(msg)
 }
 
 // Logs a debug message for this connection
 func (h *Connection_Handler) logDebug(msg string) {
-	LogDebugSession(h.id, h.ip, msg)
+	h.logger.Debug(msg)
 }
 
 // Called when connection is closed to release resources
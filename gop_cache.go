@@ -0,0 +1,244 @@
+// GOP cache
+// Keeps the video packets received since the last keyframe,
+// so new receivers can start decoding without waiting for the next keyframe
+
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Default max number of packets to keep in the cache
+// If the group of pictures is larger, it's not cached
+const GOP_CACHE_DEFAULT_MAX_PACKETS = 1000
+
+// Timestamp increment between the frames sent from the cache
+// The frames are sent in a burst, so the receiver decodes them immediately
+const GOP_CACHE_REPLAY_TIMESTAMP_STEP = 1
+
+// GOPCache - Video track fan-out keeping the current group of pictures (GOP)
+// Each receiver uses its own output track (GOPSubscriber)
+type GOPCache struct {
+	mutex *sync.Mutex
+
+	track      *webrtc.TrackLocalStaticRTP // Shared track
+	codec      webrtc.RTPCodecCapability   // Codec of the track
+	maxPackets int                         // Max number of packets to keep
+
+	packets     []*rtp.Packet           // Packets since the last keyframe (empty if there is no complete GOP)
+	subscribers map[*GOPSubscriber]bool // Receivers
+}
+
+// GOPSubscriber - Receiver of a track with GOP cache
+// Sends the cached packets when started, then the live packets.
+// Sequence numbers and timestamps are rewritten, so the receiver sees a continuous stream.
+type GOPSubscriber struct {
+	cache *GOPCache                   // Source of the packets
+	track *webrtc.TrackLocalStaticRTP // Output track
+
+	mutex *sync.Mutex
+
+	started bool // True if the receiver is ready for the live packets
+	sent    bool // True if any packet was sent
+
+	seqOffset uint16 // Offset added to the sequence numbers
+	tsOffset  uint32 // Offset added to the timestamps
+
+	lastSeq       uint16 // Last sequence number sent
+	lastTimestamp uint32 // Last timestamp sent
+
+	replayed    bool   // True if live packets may be duplicates of the sent cached packets
+	lastReplSeq uint16 // Original sequence number of the last cached packet sent
+}
+
+// Creates a GOP cache for a video track
+// Returns nil if the cache is disabled
+func newGOPCache(config *GOPCacheConfig, track *webrtc.TrackLocalStaticRTP, codec webrtc.RTPCodecCapability) *GOPCache {
+	maxPackets := config.MaxPackets
+
+	if !config.Enabled || maxPackets <= 0 {
+		return nil
+	}
+
+	return &GOPCache{
+		mutex:       &sync.Mutex{},
+		track:       track,
+		codec:       codec,
+		maxPackets:  maxPackets,
+		packets:     make([]*rtp.Packet, 0),
+		subscribers: make(map[*GOPSubscriber]bool),
+	}
+}
+
+// Writes a RTP packet received from the publisher
+// The packet is stored in the cache and sent to the receivers
+func (cache *GOPCache) Write(b []byte) (int, error) {
+	// The buffer is reused by the caller, so the cached packets need their own copy
+	buf := make([]byte, len(b))
+	copy(buf, b)
+
+	packet := &rtp.Packet{}
+
+	if err := packet.Unmarshal(buf); err != nil {
+		return cache.track.Write(b)
+	}
+
+	keyframe := isKeyframe(cache.codec.MimeType, packet.Payload)
+
+	cache.mutex.Lock()
+
+	if keyframe && (len(cache.packets) == 0 || cache.packets[len(cache.packets)-1].Timestamp != packet.Timestamp) {
+		// New GOP
+		// A new slice is used, since the subscribers may be sending the old one
+		cache.packets = []*rtp.Packet{packet}
+	} else if len(cache.packets) >= cache.maxPackets {
+		// The GOP is too large, wait for the next keyframe
+		cache.packets = make([]*rtp.Packet, 0)
+	} else if len(cache.packets) > 0 {
+		cache.packets = append(cache.packets, packet)
+	}
+
+	subscribers := make([]*GOPSubscriber, 0, len(cache.subscribers))
+	for subscriber := range cache.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+
+	cache.mutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.onPacket(packet)
+	}
+
+	return cache.track.Write(b)
+}
+
+// Gets the cached packets
+func (cache *GOPCache) getPackets() []*rtp.Packet {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.packets
+}
+
+// Creates a receiver for the track
+// Call start() when the receiver is connected
+func (cache *GOPCache) subscribe() (*GOPSubscriber, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(cache.codec, "video", "pion")
+	if err != nil {
+		return nil, err
+	}
+
+	subscriber := &GOPSubscriber{
+		cache: cache,
+		track: track,
+		mutex: &sync.Mutex{},
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.subscribers[subscriber] = true
+
+	return subscriber, nil
+}
+
+// Removes a receiver
+func (cache *GOPCache) unsubscribe(subscriber *GOPSubscriber) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.subscribers, subscriber)
+}
+
+// Starts sending packets to the receiver, beginning with the cached ones
+// Call every time the receiver connects
+// Returns true if cached packets were sent, false if the receiver needs to wait for a keyframe
+func (subscriber *GOPSubscriber) start() bool {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	subscriber.started = true
+
+	packets := subscriber.cache.getPackets()
+
+	if len(packets) == 0 {
+		return false
+	}
+
+	// Continue after the last packet sent
+	firstSeq := packets[0].SequenceNumber
+	frameTimestamp := packets[0].Timestamp
+
+	if subscriber.sent {
+		firstSeq = subscriber.lastSeq + 1
+		frameTimestamp = subscriber.lastTimestamp + GOP_CACHE_REPLAY_TIMESTAMP_STEP
+	}
+
+	subscriber.seqOffset = firstSeq - packets[0].SequenceNumber
+
+	for i, packet := range packets {
+		if i > 0 && packet.Timestamp != packets[i-1].Timestamp {
+			frameTimestamp += GOP_CACHE_REPLAY_TIMESTAMP_STEP
+		}
+
+		subscriber.tsOffset = frameTimestamp - packet.Timestamp
+
+		subscriber.send(packet)
+	}
+
+	// Live packets continue after the last cached frame
+	subscriber.replayed = true
+	subscriber.lastReplSeq = packets[len(packets)-1].SequenceNumber
+
+	return true
+}
+
+// Called for each live packet
+func (subscriber *GOPSubscriber) onPacket(packet *rtp.Packet) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if !subscriber.started {
+		return // Not connected yet
+	}
+
+	if subscriber.replayed {
+		if !isNewerSequenceNumber(packet.SequenceNumber, subscriber.lastReplSeq) {
+			return // Already sent from the cache
+		}
+
+		subscriber.replayed = false
+	}
+
+	subscriber.send(packet)
+}
+
+// Sends a packet, rewriting the sequence number and timestamp
+// Must be called with the mutex locked
+func (subscriber *GOPSubscriber) send(packet *rtp.Packet) {
+	header := packet.Header.Clone() // The cached packets are shared between receivers
+	header.SequenceNumber = packet.SequenceNumber + subscriber.seqOffset
+	header.Timestamp = packet.Timestamp + subscriber.tsOffset
+
+	if !subscriber.sent || isNewerSequenceNumber(header.SequenceNumber, subscriber.lastSeq) {
+		subscriber.lastSeq = header.SequenceNumber
+		subscriber.lastTimestamp = header.Timestamp
+	}
+
+	subscriber.sent = true
+
+	err := subscriber.track.WriteRTP(&rtp.Packet{Header: header, Payload: packet.Payload, PaddingSize: packet.PaddingSize})
+	if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		LogDebug("Could not write cached packet: " + err.Error())
+	}
+}
+
+// Stops sending packets to the receiver
+func (subscriber *GOPSubscriber) close() {
+	subscriber.cache.unsubscribe(subscriber)
+}
@@ -0,0 +1,634 @@
+// Fragmented MP4 (ISO/IEC 14496-12) writer for HLS
+// Generates the initialization segment and the media segments
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Track IDs in the fragmented MP4 files
+const FMP4_VIDEO_TRACK_ID = 1
+const FMP4_AUDIO_TRACK_ID = 2
+
+// Sample flags
+const FMP4_SAMPLE_FLAGS_SYNC = 0x02000000     // Does not depend on other samples
+const FMP4_SAMPLE_FLAGS_NON_SYNC = 0x01010000 // Depends on other samples, not a sync sample
+
+// Opus pre-skip (samples), as used by most encoders
+const FMP4_OPUS_PRE_SKIP = 312
+
+// FMP4Sample - Sample (video frame or audio packet) of a media segment
+type FMP4Sample struct {
+	data     []byte // Data. For H264, length prefixed NAL units
+	duration uint32 // Duration, in track timescale units
+	keyframe bool   // True for sync samples
+}
+
+// FMP4Track - Track of a media segment
+type FMP4Track struct {
+	id                  uint32        // Track ID
+	baseMediaDecodeTime uint64        // Decode time of the first sample, in track timescale units
+	samples             []*FMP4Sample // Samples
+}
+
+// Appends a box
+func appendMP4Box(buf []byte, boxType string, content ...[]byte) []byte {
+	size := 8
+
+	for _, c := range content {
+		size += len(c)
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(size))
+	buf = append(buf, boxType...)
+
+	for _, c := range content {
+		buf = append(buf, c...)
+	}
+
+	return buf
+}
+
+// Creates a box
+func mp4Box(boxType string, content ...[]byte) []byte {
+	return appendMP4Box(nil, boxType, content...)
+}
+
+// Creates a full box (box with version and flags)
+func mp4FullBox(boxType string, version uint8, flags uint32, content ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xFFFFFF)
+
+	return mp4Box(boxType, append([][]byte{header}, content...)...)
+}
+
+// Unity transformation matrix, used in mvhd and tkhd
+func mp4Matrix() []byte {
+	m := make([]byte, 0, 36)
+
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		m = binary.BigEndian.AppendUint32(m, v)
+	}
+
+	return m
+}
+
+// Generates the initialization segment
+// video is nil for audio only streams, audio is false for video only streams
+func generateFMP4InitSegment(video *H264Parameters, audio bool) []byte {
+	// Movie header
+	mvhd := make([]byte, 0, 96)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0)    // Creation time
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0)    // Modification time
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 1000) // Timescale
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0)    // Duration
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0x00010000)
+	mvhd = binary.BigEndian.AppendUint16(mvhd, 0x0100)
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, mp4Matrix()...)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, FMP4_AUDIO_TRACK_ID+1) // Next track ID
+
+	moov := [][]byte{mp4FullBox("mvhd", 0, 0, mvhd)}
+	mvex := make([][]byte, 0, 2)
+
+	if video != nil {
+		moov = append(moov, generateFMP4VideoTrack(video))
+		mvex = append(mvex, generateFMP4TrackExtends(FMP4_VIDEO_TRACK_ID))
+	}
+
+	if audio {
+		moov = append(moov, generateFMP4AudioTrack())
+		mvex = append(mvex, generateFMP4TrackExtends(FMP4_AUDIO_TRACK_ID))
+	}
+
+	moov = append(moov, mp4Box("mvex", mvex...))
+
+	ftyp := []byte("iso5")
+	ftyp = binary.BigEndian.AppendUint32(ftyp, 512)
+	ftyp = append(ftyp, "iso5iso6mp41"...)
+
+	return append(mp4Box("ftyp", ftyp), mp4Box("moov", moov...)...)
+}
+
+// Generates the track extends box
+func generateFMP4TrackExtends(trackId uint32) []byte {
+	trex := binary.BigEndian.AppendUint32(nil, trackId)
+	trex = binary.BigEndian.AppendUint32(trex, 1) // Sample description index
+	trex = binary.BigEndian.AppendUint32(trex, 0) // Default sample duration
+	trex = binary.BigEndian.AppendUint32(trex, 0) // Default sample size
+	trex = binary.BigEndian.AppendUint32(trex, 0) // Default sample flags
+
+	return mp4FullBox("trex", 0, 0, trex)
+}
+
+// Generates a track box
+func generateFMP4Track(trackId uint32, timescale uint32, width uint32, height uint32, handler string, mediaHeader []byte, sampleEntry []byte) []byte {
+	// Track header
+	tkhd := binary.BigEndian.AppendUint32(nil, 0) // Creation time
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // Modification time
+	tkhd = binary.BigEndian.AppendUint32(tkhd, trackId)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // Reserved
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // Duration
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = binary.BigEndian.AppendUint16(tkhd, 0) // Layer
+	tkhd = binary.BigEndian.AppendUint16(tkhd, 0) // Alternate group
+	if handler == "soun" {
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0x0100) // Volume
+	} else {
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0)
+	}
+	tkhd = binary.BigEndian.AppendUint16(tkhd, 0) // Reserved
+	tkhd = append(tkhd, mp4Matrix()...)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, width<<16)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, height<<16)
+
+	// Media header
+	mdhd := binary.BigEndian.AppendUint32(nil, 0) // Creation time
+	mdhd = binary.BigEndian.AppendUint32(mdhd, 0) // Modification time
+	mdhd = binary.BigEndian.AppendUint32(mdhd, timescale)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, 0)      // Duration
+	mdhd = binary.BigEndian.AppendUint16(mdhd, 0x55C4) // Language: und
+	mdhd = binary.BigEndian.AppendUint16(mdhd, 0)
+
+	// Handler
+	hdlr := binary.BigEndian.AppendUint32(nil, 0)
+	hdlr = append(hdlr, handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, "WebRTC CDN\x00"...)
+
+	// Data information
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, binary.BigEndian.AppendUint32(nil, 1), mp4FullBox("url ", 0, 1)))
+
+	// Sample table, empty since the samples are in the fragments
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, binary.BigEndian.AppendUint32(nil, 1), sampleEntry),
+		mp4FullBox("stts", 0, 0, make([]byte, 4)),
+		mp4FullBox("stsc", 0, 0, make([]byte, 4)),
+		mp4FullBox("stsz", 0, 0, make([]byte, 8)),
+		mp4FullBox("stco", 0, 0, make([]byte, 4)),
+	)
+
+	return mp4Box("trak",
+		mp4FullBox("tkhd", 0, 3, tkhd),
+		mp4Box("mdia",
+			mp4FullBox("mdhd", 0, 0, mdhd),
+			mp4FullBox("hdlr", 0, 0, hdlr),
+			mp4Box("minf", mediaHeader, dinf, stbl),
+		),
+	)
+}
+
+// Generates the H264 video track
+func generateFMP4VideoTrack(params *H264Parameters) []byte {
+	width, height := params.getResolution()
+
+	// AVC decoder configuration
+	sps := params.sps[0]
+	avcC := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE0 | byte(len(params.sps))}
+	for _, s := range params.sps {
+		avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(s)))
+		avcC = append(avcC, s...)
+	}
+	avcC = append(avcC, byte(len(params.pps)))
+	for _, p := range params.pps {
+		avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(p)))
+		avcC = append(avcC, p...)
+	}
+
+	// Visual sample entry
+	entry := make([]byte, 6, 86)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // Data reference index
+	entry = append(entry, make([]byte, 16)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(width))
+	entry = binary.BigEndian.AppendUint16(entry, uint16(height))
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000) // Horizontal resolution
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000) // Vertical resolution
+	entry = binary.BigEndian.AppendUint32(entry, 0)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // Frame count
+	entry = append(entry, make([]byte, 32)...)      // Compressor name
+	entry = binary.BigEndian.AppendUint16(entry, 0x0018)
+	entry = binary.BigEndian.AppendUint16(entry, 0xFFFF)
+
+	return generateFMP4Track(
+		FMP4_VIDEO_TRACK_ID,
+		90000,
+		width,
+		height,
+		"vide",
+		mp4FullBox("vmhd", 0, 1, make([]byte, 8)),
+		mp4Box("avc1", entry, mp4Box("avcC", avcC)),
+	)
+}
+
+// Generates the Opus audio track
+func generateFMP4AudioTrack() []byte {
+	// Opus specific box
+	dOps := []byte{0, 2} // Version, channels
+	dOps = binary.BigEndian.AppendUint16(dOps, FMP4_OPUS_PRE_SKIP)
+	dOps = binary.BigEndian.AppendUint32(dOps, 48000)
+	dOps = binary.BigEndian.AppendUint16(dOps, 0) // Output gain
+	dOps = append(dOps, 0)                        // Channel mapping family
+
+	// Audio sample entry
+	entry := make([]byte, 6, 28)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // Data reference index
+	entry = append(entry, make([]byte, 8)...)
+	entry = binary.BigEndian.AppendUint16(entry, 2)  // Channels
+	entry = binary.BigEndian.AppendUint16(entry, 16) // Sample size
+	entry = binary.BigEndian.AppendUint32(entry, 0)
+	entry = binary.BigEndian.AppendUint32(entry, 48000<<16) // Sample rate
+
+	return generateFMP4Track(
+		FMP4_AUDIO_TRACK_ID,
+		48000,
+		0,
+		0,
+		"soun",
+		mp4FullBox("smhd", 0, 0, make([]byte, 4)),
+		mp4Box("Opus", entry, mp4Box("dOps", dOps)),
+	)
+}
+
+// Generates a media segment
+// Tracks without samples are skipped
+func generateFMP4MediaSegment(sequenceNumber uint32, tracks []*FMP4Track) []byte {
+	// The data offsets depend on the size of the moof box,
+	// so the size is computed first with zero offsets
+	moofSize := len(generateFMP4MovieFragment(sequenceNumber, tracks, nil))
+
+	offsets := make([]uint32, len(tracks))
+	offset := uint32(moofSize + 8)
+	mdatSize := 0
+
+	for i, track := range tracks {
+		offsets[i] = offset
+
+		for _, sample := range track.samples {
+			offset += uint32(len(sample.data))
+			mdatSize += len(sample.data)
+		}
+	}
+
+	buf := generateFMP4MovieFragment(sequenceNumber, tracks, offsets)
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(mdatSize+8))
+	buf = append(buf, "mdat"...)
+
+	for _, track := range tracks {
+		for _, sample := range track.samples {
+			buf = append(buf, sample.data...)
+		}
+	}
+
+	return buf
+}
+
+// Generates the movie fragment box of a media segment
+func generateFMP4MovieFragment(sequenceNumber uint32, tracks []*FMP4Track, offsets []uint32) []byte {
+	moof := [][]byte{mp4FullBox("mfhd", 0, 0, binary.BigEndian.AppendUint32(nil, sequenceNumber))}
+
+	for i, track := range tracks {
+		if len(track.samples) == 0 {
+			continue
+		}
+
+		var dataOffset uint32
+		if offsets != nil {
+			dataOffset = offsets[i]
+		}
+
+		// Data offset, sample duration, sample size and sample flags
+		trun := binary.BigEndian.AppendUint32(nil, uint32(len(track.samples)))
+		trun = binary.BigEndian.AppendUint32(trun, dataOffset)
+
+		for _, sample := range track.samples {
+			trun = binary.BigEndian.AppendUint32(trun, sample.duration)
+			trun = binary.BigEndian.AppendUint32(trun, uint32(len(sample.data)))
+
+			if sample.keyframe {
+				trun = binary.BigEndian.AppendUint32(trun, FMP4_SAMPLE_FLAGS_SYNC)
+			} else {
+				trun = binary.BigEndian.AppendUint32(trun, FMP4_SAMPLE_FLAGS_NON_SYNC)
+			}
+		}
+
+		moof = append(moof, mp4Box("traf",
+			mp4FullBox("tfhd", 0, 0x020000, binary.BigEndian.AppendUint32(nil, track.id)), // Default base is moof
+			mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, track.baseMediaDecodeTime)),
+			mp4FullBox("trun", 0, 0x000701, trun),
+		))
+	}
+
+	return mp4Box("moof", moof...)
+}
+
+// BitReader - Reads the fields of H264 parameter sets
+type BitReader struct {
+	data []byte
+	pos  int // Position in bits
+}
+
+// Reads a bit
+func (r *BitReader) readBit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errors.New("unexpected end of data")
+	}
+
+	bit := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+
+	return uint32(bit), nil
+}
+
+// Reads n bits
+func (r *BitReader) readBits(n int) (uint32, error) {
+	var v uint32
+
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+
+	return v, nil
+}
+
+// Reads an unsigned Exp-Golomb value
+func (r *BitReader) readUE() (uint32, error) {
+	zeros := 0
+
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+
+		if bit == 1 {
+			break
+		}
+
+		zeros++
+
+		if zeros > 31 {
+			return 0, errors.New("invalid Exp-Golomb value")
+		}
+	}
+
+	v, err := r.readBits(zeros)
+	if err != nil {
+		return 0, err
+	}
+
+	return (1<<zeros - 1) + v, nil
+}
+
+// Reads a signed Exp-Golomb value
+func (r *BitReader) readSE() (int32, error) {
+	v, err := r.readUE()
+	if err != nil {
+		return 0, err
+	}
+
+	if v%2 == 0 {
+		return -int32(v / 2), nil
+	}
+
+	return int32(v/2) + 1, nil
+}
+
+// Removes the emulation prevention bytes of a NAL unit
+func removeEmulationPrevention(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+// Gets the video resolution from the SPS
+// Returns 0x0 if the SPS cannot be parsed
+func (params *H264Parameters) getResolution() (uint32, uint32) {
+	width, height, err := parseH264SPSResolution(params.sps[0])
+
+	if err != nil {
+		return 0, 0
+	}
+
+	return width, height
+}
+
+// Parses the resolution of a H264 sequence parameter set (ITU-T H.264, 7.3.2.1.1)
+func parseH264SPSResolution(sps []byte) (uint32, uint32, error) {
+	r := &BitReader{data: removeEmulationPrevention(sps)}
+
+	if _, err := r.readBits(8); err != nil { // NAL header
+		return 0, 0, err
+	}
+
+	profileIdc, err := r.readBits(8)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := r.readBits(16); err != nil { // Constraint flags and level
+		return 0, 0, err
+	}
+
+	if _, err := r.readUE(); err != nil { // SPS ID
+		return 0, 0, err
+	}
+
+	chromaFormatIdc := uint32(1)
+
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIdc, err = r.readUE(); err != nil {
+			return 0, 0, err
+		}
+
+		if chromaFormatIdc == 3 {
+			if _, err := r.readBit(); err != nil { // Separate colour plane
+				return 0, 0, err
+			}
+		}
+
+		if _, err := r.readUE(); err != nil { // Bit depth luma
+			return 0, 0, err
+		}
+
+		if _, err := r.readUE(); err != nil { // Bit depth chroma
+			return 0, 0, err
+		}
+
+		if _, err := r.readBit(); err != nil { // Transform bypass
+			return 0, 0, err
+		}
+
+		scalingMatrixPresent, err := r.readBit()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if scalingMatrixPresent == 1 {
+			count := 8
+			if chromaFormatIdc == 3 {
+				count = 12
+			}
+
+			for i := 0; i < count; i++ {
+				present, err := r.readBit()
+				if err != nil {
+					return 0, 0, err
+				}
+
+				if present == 0 {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+
+				lastScale, nextScale := int32(8), int32(8)
+
+				for j := 0; j < size; j++ {
+					if nextScale != 0 {
+						delta, err := r.readSE()
+						if err != nil {
+							return 0, 0, err
+						}
+						nextScale = (lastScale + delta + 256) % 256
+					}
+
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := r.readUE(); err != nil { // Max frame num
+		return 0, 0, err
+	}
+
+	pocType, err := r.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch pocType {
+	case 0:
+		if _, err := r.readUE(); err != nil {
+			return 0, 0, err
+		}
+	case 1:
+		if _, err := r.readBit(); err != nil {
+			return 0, 0, err
+		}
+
+		if _, err := r.readSE(); err != nil {
+			return 0, 0, err
+		}
+
+		if _, err := r.readSE(); err != nil {
+			return 0, 0, err
+		}
+
+		cycle, err := r.readUE()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for i := uint32(0); i < cycle; i++ {
+			if _, err := r.readSE(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	if _, err := r.readUE(); err != nil { // Max reference frames
+		return 0, 0, err
+	}
+
+	if _, err := r.readBit(); err != nil { // Gaps in frame num allowed
+		return 0, 0, err
+	}
+
+	widthInMbs, err := r.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	heightInMapUnits, err := r.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	frameMbsOnly, err := r.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if frameMbsOnly == 0 {
+		if _, err := r.readBit(); err != nil { // Adaptive frame field
+			return 0, 0, err
+		}
+	}
+
+	if _, err := r.readBit(); err != nil { // Direct 8x8 inference
+		return 0, 0, err
+	}
+
+	width := (widthInMbs + 1) * 16
+	height := (2 - frameMbsOnly) * (heightInMapUnits + 1) * 16
+
+	cropping, err := r.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if cropping == 1 {
+		crop := make([]uint32, 4) // Left, right, top, bottom
+
+		for i := range crop {
+			if crop[i], err = r.readUE(); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+
+		if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+			cropUnitX = 2
+		}
+
+		if chromaFormatIdc == 1 {
+			cropUnitY *= 2
+		}
+
+		width -= (crop[0] + crop[1]) * cropUnitX
+		height -= (crop[2] + crop[3]) * cropUnitY
+	}
+
+	return width, height, nil
+}
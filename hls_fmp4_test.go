@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// Test sequence parameter sets
+var (
+	testSPSBaseline640x480  = mustDecodeHex("6742c01eda0280f640")       // Baseline, 640x480, POC type 2
+	testSPSHigh1920x1080    = mustDecodeHex("67640028acd940780227e540") // High, 1920x1088 cropped to 1080
+	testSPSMainInterlaced   = mustDecodeHex("674d401eda02d09120")       // Main, 720x576 interlaced
+	testPPS                 = mustDecodeHex("68ce3c80")
+	testSPSEmulationPrevent = mustDecodeHex("6742c01eda0000030280f640")
+)
+
+// Expected Opus specific box
+var testDOps = mp4Golden(
+	"00", "02", // Version, channels
+	"0138",     // Pre-skip
+	"0000bb80", // Input sample rate
+	"0000",     // Output gain
+	"00",       // Channel mapping family
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// Builds the expected bytes of a box
+// Each part is hex encoded, or a box type if it is not valid hex
+func mp4Golden(parts ...string) []byte {
+	buf := make([]byte, 0)
+
+	for _, part := range parts {
+		if b, err := hex.DecodeString(part); err == nil {
+			buf = append(buf, b...)
+		} else {
+			buf = append(buf, part...)
+		}
+	}
+
+	return buf
+}
+
+// Bytes before the child boxes, for boxes that are not pure containers
+var mp4ChildOffsets = map[string]int{
+	"stsd": 8,  // Version, flags and entry count
+	"dref": 8,  // Version, flags and entry count
+	"avc1": 78, // Visual sample entry
+	"Opus": 28, // Audio sample entry
+}
+
+// Finds a box by its path and returns its content
+// Fails if the sizes of the boxes in the path are not consistent
+func findMP4Box(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+
+	content := data
+
+	for depth, boxType := range path {
+		var found []byte
+
+		for pos := 0; pos < len(content); {
+			if len(content)-pos < 8 {
+				t.Fatalf("%v: truncated box header", path[:depth+1])
+			}
+
+			size := int(binary.BigEndian.Uint32(content[pos:]))
+
+			if size < 8 || size > len(content)-pos {
+				t.Fatalf("%v: invalid box size %d", path[:depth+1], size)
+			}
+
+			if found == nil && string(content[pos+4:pos+8]) == boxType {
+				found = content[pos+8 : pos+size]
+			}
+
+			pos += size
+		}
+
+		if found == nil {
+			t.Fatalf("box not found: %v", path[:depth+1])
+		}
+
+		content = found
+
+		if depth < len(path)-1 {
+			content = content[mp4ChildOffsets[boxType]:]
+		}
+	}
+
+	return content
+}
+
+// Gets the boxes of a type, including their headers
+func findMP4Boxes(data []byte, boxType string) [][]byte {
+	boxes := make([][]byte, 0)
+
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+
+		if size < 8 || size > len(data)-pos {
+			break
+		}
+
+		if string(data[pos+4:pos+8]) == boxType {
+			boxes = append(boxes, data[pos:pos+size])
+		}
+
+		pos += size
+	}
+
+	return boxes
+}
+
+func TestParseH264SPSResolution(t *testing.T) {
+	cases := []struct {
+		name   string
+		sps    []byte
+		width  uint32
+		height uint32
+	}{
+		{"baseline", testSPSBaseline640x480, 640, 480},
+		{"high with cropping", testSPSHigh1920x1080, 1920, 1080},
+		{"interlaced", testSPSMainInterlaced, 720, 576},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			width, height, err := parseH264SPSResolution(c.sps)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if width != c.width || height != c.height {
+				t.Fatalf("expected %dx%d, got %dx%d", c.width, c.height, width, height)
+			}
+		})
+	}
+
+	if _, _, err := parseH264SPSResolution(testSPSBaseline640x480[:5]); err == nil {
+		t.Fatal("expected an error for a truncated SPS")
+	}
+
+	if out := removeEmulationPrevention(testSPSEmulationPrevent); !bytes.Equal(out, mustDecodeHex("6742c01eda00000280f640")) {
+		t.Fatalf("unexpected output removing the emulation prevention bytes: %x", out)
+	}
+}
+
+func TestFMP4InitSegment(t *testing.T) {
+	params := &H264Parameters{
+		sps:        [][]byte{testSPSBaseline640x480},
+		pps:        [][]byte{testPPS},
+		lengthSize: 4,
+	}
+
+	init := generateFMP4InitSegment(params, true)
+
+	// The file is only ftyp and moov
+	ftypSize := int(binary.BigEndian.Uint32(init))
+	moovSize := int(binary.BigEndian.Uint32(init[ftypSize:]))
+
+	if ftypSize+moovSize != len(init) {
+		t.Fatalf("expected ftyp (%d) and moov (%d) to fill the segment (%d)", ftypSize, moovSize, len(init))
+	}
+
+	golden := []struct {
+		name     string
+		path     []string
+		expected []byte
+	}{
+		{
+			name:     "ftyp",
+			path:     []string{"ftyp"},
+			expected: mp4Golden("iso5", "00000200", "iso5", "iso6", "mp41"),
+		},
+		{
+			name: "avcC",
+			path: []string{"moov", "trak", "mdia", "minf", "stbl", "stsd", "avc1", "avcC"},
+			expected: mp4Golden(
+				"01", "42c01e", "ff", // Version, profile, compatibility, level, length size
+				"e1", "0009", "6742c01eda0280f640", // SPS
+				"01", "0004", "68ce3c80", // PPS
+			),
+		},
+		{
+			name: "mvex",
+			path: []string{"moov", "mvex"},
+			expected: mp4Golden(
+				"00000020", "trex", "00000000", "00000001", "00000001", "00000000", "00000000", "00000000",
+				"00000020", "trex", "00000000", "00000002", "00000001", "00000000", "00000000", "00000000",
+			),
+		},
+	}
+
+	for _, g := range golden {
+		if box := findMP4Box(t, init, g.path...); !bytes.Equal(box, g.expected) {
+			t.Errorf("%s: expected %x, got %x", g.name, g.expected, box)
+		}
+	}
+
+	// Video track, then audio track
+	traks := findMP4Boxes(findMP4Box(t, init, "moov"), "trak")
+
+	if len(traks) != 2 {
+		t.Fatalf("expected 2 tracks, got %d", len(traks))
+	}
+
+	if dOps := findMP4Box(t, traks[1], "trak", "mdia", "minf", "stbl", "stsd", "Opus", "dOps"); !bytes.Equal(dOps, testDOps) {
+		t.Errorf("dOps: expected %x, got %x", testDOps, dOps)
+	}
+
+	// Video sample entry resolution
+	avc1 := findMP4Box(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd", "avc1")
+	if !bytes.Equal(avc1[24:28], mp4Golden("0280", "01e0")) {
+		t.Errorf("unexpected avc1 resolution: %x", avc1[24:28])
+	}
+
+	// Video track header and timescale (the first trak is the video track)
+	tkhd := findMP4Box(t, init, "moov", "trak", "tkhd")
+	if !bytes.Equal(tkhd[len(tkhd)-8:], mp4Golden("02800000", "01e00000")) {
+		t.Errorf("unexpected tkhd resolution: %x", tkhd[len(tkhd)-8:])
+	}
+
+	mdhd := findMP4Box(t, init, "moov", "trak", "mdia", "mdhd")
+	if !bytes.Equal(mdhd[12:16], mp4Golden("00015f90")) {
+		t.Errorf("unexpected video timescale: %x", mdhd[12:16])
+	}
+
+	hdlr := findMP4Box(t, init, "moov", "trak", "mdia", "hdlr")
+	if string(hdlr[8:12]) != "vide" {
+		t.Errorf("unexpected handler of the first track: %s", hdlr[8:12])
+	}
+}
+
+func TestFMP4InitSegmentAudioOnly(t *testing.T) {
+	init := generateFMP4InitSegment(nil, true)
+
+	if traks := findMP4Boxes(findMP4Box(t, init, "moov"), "trak"); len(traks) != 1 {
+		t.Fatalf("expected a single track, got %d", len(traks))
+	}
+
+	if dOps := findMP4Box(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd", "Opus", "dOps"); !bytes.Equal(dOps, testDOps) {
+		t.Errorf("dOps: expected %x, got %x", testDOps, dOps)
+	}
+
+	hdlr := findMP4Box(t, init, "moov", "trak", "mdia", "hdlr")
+	if string(hdlr[8:12]) != "soun" {
+		t.Errorf("unexpected handler: %s", hdlr[8:12])
+	}
+
+	mdhd := findMP4Box(t, init, "moov", "trak", "mdia", "mdhd")
+	if !bytes.Equal(mdhd[12:16], mp4Golden("0000bb80")) {
+		t.Errorf("unexpected audio timescale: %x", mdhd[12:16])
+	}
+
+	expectedMvex := mp4Golden("00000020", "trex", "00000000", "00000002", "00000001", "00000000", "00000000", "00000000")
+	if mvex := findMP4Box(t, init, "moov", "mvex"); !bytes.Equal(mvex, expectedMvex) {
+		t.Errorf("expected mvex %x, got %x", expectedMvex, mvex)
+	}
+}
+
+func TestFMP4MediaSegment(t *testing.T) {
+	segment := generateFMP4MediaSegment(7, []*FMP4Track{
+		{
+			id:                  FMP4_VIDEO_TRACK_ID,
+			baseMediaDecodeTime: 90000,
+			samples: []*FMP4Sample{
+				{data: []byte{0xAA, 0xBB, 0xCC}, duration: 3000, keyframe: true},
+				{data: []byte{0xDD}, duration: 3000},
+			},
+		},
+		{
+			id:                  FMP4_AUDIO_TRACK_ID,
+			baseMediaDecodeTime: 48000,
+			samples: []*FMP4Sample{
+				{data: []byte{0xEE, 0xFF}, duration: 960, keyframe: true},
+			},
+		},
+	})
+
+	expected := mp4Golden(
+		"000000bc", "moof",
+		/**/ "00000010", "mfhd", "00000000", "00000007",
+		/**/ "00000058", "traf",
+		/*  */ "00000010", "tfhd", "00020000", "00000001",
+		/*  */ "00000014", "tfdt", "01000000", "0000000000015f90",
+		/*  */ "0000002c", "trun", "00000701", "00000002", "000000c4",
+		/*    */ "00000bb8", "00000003", "02000000",
+		/*    */ "00000bb8", "00000001", "01010000",
+		/**/ "0000004c", "traf",
+		/*  */ "00000010", "tfhd", "00020000", "00000002",
+		/*  */ "00000014", "tfdt", "01000000", "000000000000bb80",
+		/*  */ "00000020", "trun", "00000701", "00000001", "000000c8",
+		/*    */ "000003c0", "00000002", "02000000",
+		"0000000e", "mdat", "aabbccdd", "eeff",
+	)
+
+	if !bytes.Equal(segment, expected) {
+		t.Fatalf("unexpected media segment:\nexpected %x\ngot      %x", expected, segment)
+	}
+}
+
+func TestFMP4MediaSegmentEmptyTrack(t *testing.T) {
+	segment := generateFMP4MediaSegment(1, []*FMP4Track{
+		{id: FMP4_VIDEO_TRACK_ID},
+		{id: FMP4_AUDIO_TRACK_ID, samples: []*FMP4Sample{{data: []byte{1, 2, 3}, duration: 960, keyframe: true}}},
+	})
+
+	moof := findMP4Box(t, segment, "moof")
+	traf := findMP4Box(t, segment, "moof", "traf")
+	tfhd := findMP4Box(t, segment, "moof", "traf", "tfhd")
+
+	if binary.BigEndian.Uint32(tfhd[4:]) != FMP4_AUDIO_TRACK_ID {
+		t.Fatalf("expected only the audio track, got the track %d", binary.BigEndian.Uint32(tfhd[4:]))
+	}
+
+	// The data offset points to the start of the mdat content
+	trun := findMP4Box(t, segment, "moof", "traf", "trun")
+	offset := int(binary.BigEndian.Uint32(trun[8:]))
+
+	if !bytes.Equal(segment[offset:], []byte{1, 2, 3}) {
+		t.Fatalf("the data offset %d does not point to the samples", offset)
+	}
+
+	if len(findMP4Boxes(segment, "mdat")) != 1 || len(moof) != 16+8+len(traf) {
+		t.Fatal("unexpected segment structure")
+	}
+}
@@ -0,0 +1,673 @@
+// HLS packager
+// Receives the tracks of a stream and segments them into fragmented MP4,
+// keeping a rolling playlist for HLS players
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// Default target duration of the segments, in seconds
+const HLS_DEFAULT_SEGMENT_DURATION = 2
+
+// Default number of segments in the playlist
+const HLS_DEFAULT_PLAYLIST_SIZE = 6
+
+// Number of segments kept after they leave the playlist,
+// for players still downloading them
+const HLS_EXTRA_SEGMENTS = 2
+
+// Default time to keep the packager without requests, in seconds
+const HLS_DEFAULT_IDLE_TIMEOUT_SECONDS = 30
+
+// Default max number of HLS packagers in the node
+const HLS_DEFAULT_MAX_PACKAGERS = 100
+
+// If a segment without video exceeds its target duration by this factor, it is closed
+// This prevents growing segments when the video stops
+const HLS_MAX_SEGMENT_DURATION_FACTOR = 3
+
+// Payload type of the packets received by the packager
+const HLS_PAYLOAD_TYPE = 96
+
+// HLSSegment - Media segment
+type HLSSegment struct {
+	sequenceNumber uint32  // Media sequence number
+	duration       float64 // Duration, in seconds
+	data           []byte  // Fragmented MP4 data
+	initId         int     // ID of the initialization segment
+	discontinuity  bool    // True if the segment starts after the tracks changed
+}
+
+// HLSTrackClock - Converts the RTP timestamps of a track into a continuous decode time
+type HLSTrackClock struct {
+	started       bool
+	lastTimestamp uint32
+	time          uint64
+}
+
+// Gets the decode time of a RTP timestamp
+// The first timestamp is mapped to the time elapsed since the epoch, so the tracks are aligned
+func (clock *HLSTrackClock) getTime(timestamp uint32, clockRate uint32, epoch time.Time) uint64 {
+	if !clock.started {
+		clock.started = true
+		clock.time = uint64(time.Since(epoch).Seconds() * float64(clockRate))
+	} else if diff := int32(timestamp - clock.lastTimestamp); diff > 0 {
+		clock.time += uint64(diff)
+	}
+
+	clock.lastTimestamp = timestamp
+
+	return clock.time
+}
+
+// HLSPackager - HLS packager for a stream
+// It receives the tracks as a sink, so it works for local sources and relays
+type HLSPackager struct {
+	sid  string
+	node *WebRTC_CDN_Node
+	sink *WRTC_Sink
+
+	mutex *sync.Mutex
+
+	closed     bool
+	lastAccess time.Time // Time of the last request
+
+	targetDuration time.Duration // Target duration of the segments
+	playlistSize   int           // Number of segments in the playlist
+
+	receivers  []*LocalTrackReceiver // Receivers of the current tracks
+	generation uint64                // Incremented when the tracks change
+
+	// Tracks
+
+	hasVideo bool
+	hasAudio bool
+	epoch    time.Time // Time the tracks were received
+
+	videoParams       *H264Parameters    // Parameter sets (nil until received)
+	videoDepacketizer *codecs.H264Packet // Depacketizer
+	videoFrame        []byte             // Frame being received (length prefixed NAL units)
+	videoFrameTs      uint32             // Timestamp of the frame being received
+	videoLastSeq      uint16             // Last sequence number received
+	videoSeqStarted   bool               // True if videoLastSeq is set
+	videoWaitKeyframe bool               // True if frames are dropped until the next keyframe
+	videoClock        HLSTrackClock
+	videoPending      *FMP4Sample // Last frame, waiting for the next one to know its duration
+	videoPendingTime  uint64
+
+	audioClock       HLSTrackClock
+	audioPending     *FMP4Sample
+	audioPendingTime uint64
+
+	// Segments
+
+	initReady bool           // True if the initialization segment for the current tracks is ready
+	initId    int            // ID of the current initialization segment
+	inits     map[int][]byte // Initialization segments
+
+	videoSegment      *FMP4Track // Video samples of the segment being generated
+	audioSegment      *FMP4Track // Audio samples of the segment being generated
+	keyframeRequested bool       // True if a keyframe was requested to close the segment
+
+	segments               []*HLSSegment // Generated segments
+	nextSequenceNumber     uint32        // Sequence number of the next segment
+	pendingDiscontinuity   bool          // True if the next segment starts after the tracks changed
+	removedDiscontinuities int           // Number of discontinuities removed from the list of segments
+
+	readyChan chan struct{} // Closed when the first segment is available
+	ready     bool          // True if the ready channel was closed
+}
+
+// Creates a packager for a stream
+// Call start() to receive the tracks
+func newHLSPackager(node *WebRTC_CDN_Node, sid string, ip string) (*HLSPackager, error) {
+	resourceId, err := makeId(16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	packager := &HLSPackager{
+		sid:            sid,
+		node:           node,
+		mutex:          &sync.Mutex{},
+		lastAccess:     time.Now(),
+		targetDuration: time.Duration(node.getConfig().HLS.SegmentDuration) * time.Second,
+		playlistSize:   node.getConfig().HLS.PlaylistSize,
+		receivers:      make([]*LocalTrackReceiver, 0),
+		inits:          make(map[int][]byte),
+		segments:       make([]*HLSSegment, 0),
+		readyChan:      make(chan struct{}),
+	}
+
+	packager.sink = &WRTC_Sink{
+		sinkId:     node.getSinkID(),
+		requestId:  resourceId,
+		sid:        sid,
+		node:       node,
+		connection: nil,
+		hls:        packager,
+		ip:         ip,
+	}
+
+	packager.sink.init()
+
+	return packager, nil
+}
+
+// Registers the sink of the packager, to receive the tracks
+func (packager *HLSPackager) start() {
+	packager.node.registerSink(packager.sink)
+
+	go packager.runIdleCheck()
+}
+
+// Closes the packager if there are no requests
+func (packager *HLSPackager) runIdleCheck() {
+	idleTimeout := time.Duration(packager.node.getConfig().HLS.IdleTimeoutSeconds) * time.Second
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		packager.mutex.Lock()
+		closed := packager.closed
+		idle := time.Since(packager.lastAccess) > idleTimeout
+		packager.mutex.Unlock()
+
+		if closed {
+			return
+		}
+
+		if idle {
+			packager.sink.logger.Debug("Packager closed after being idle")
+			packager.close()
+			return
+		}
+	}
+}
+
+// Closes the packager
+func (packager *HLSPackager) close() {
+	packager.mutex.Lock()
+
+	if packager.closed {
+		packager.mutex.Unlock()
+		return
+	}
+
+	packager.closed = true
+
+	packager.mutex.Unlock()
+
+	packager.sink.close()
+	packager.node.removeHLSPackager(packager)
+}
+
+// Called when the tracks are available
+// Must be called with the sink status mutex locked
+func (packager *HLSPackager) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP) {
+	packager.unbindTracks()
+
+	if localTrackVideo != nil && !strings.EqualFold(localTrackVideo.Codec().MimeType, webrtc.MimeTypeH264) {
+		packager.sink.logger.Warning("Cannot package video into HLS: Unsupported codec " + localTrackVideo.Codec().MimeType)
+		localTrackVideo = nil
+	}
+
+	if localTrackAudio != nil && !strings.EqualFold(localTrackAudio.Codec().MimeType, webrtc.MimeTypeOpus) {
+		packager.sink.logger.Warning("Cannot package audio into HLS: Unsupported codec " + localTrackAudio.Codec().MimeType)
+		localTrackAudio = nil
+	}
+
+	packager.mutex.Lock()
+
+	packager.generation++
+	generation := packager.generation
+
+	packager.resetTracks(localTrackVideo != nil, localTrackAudio != nil)
+
+	packager.mutex.Unlock()
+
+	// The tracks are bound without the mutex locked,
+	// since the tracks hold their own lock while calling the receivers
+
+	if localTrackVideo != nil {
+		packager.bindTrack(localTrackVideo, generation, packager.onVideoPacket)
+	}
+
+	if localTrackAudio != nil {
+		packager.bindTrack(localTrackAudio, generation, packager.onAudioPacket)
+	}
+}
+
+// Called when the tracks are no longer available
+// Must be called with the sink status mutex locked
+func (packager *HLSPackager) onTracksClosed() {
+	packager.unbindTracks()
+
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	packager.generation++
+	packager.resetTracks(false, false)
+}
+
+// Receives the packets of a track
+// Must be called with the sink status mutex locked
+func (packager *HLSPackager) bindTrack(track *webrtc.TrackLocalStaticRTP, generation uint64, onPacket func(generation uint64, header *rtp.Header, payload []byte)) {
+	receiver, err := newLocalTrackReceiver(track, HLS_PAYLOAD_TYPE, 0, func(header *rtp.Header, payload []byte) {
+		onPacket(generation, header, payload)
+	})
+
+	if err != nil {
+		packager.sink.logger.Error(err)
+		return
+	}
+
+	if _, err := track.Bind(receiver); err != nil {
+		packager.sink.logger.Error(err)
+		return
+	}
+
+	packager.receivers = append(packager.receivers, receiver)
+}
+
+// Stops receiving the packets of the tracks
+// Must be called with the sink status mutex locked
+func (packager *HLSPackager) unbindTracks() {
+	for _, receiver := range packager.receivers {
+		if err := receiver.track.Unbind(receiver); err != nil {
+			packager.sink.logger.Error(err)
+		}
+	}
+
+	packager.receivers = make([]*LocalTrackReceiver, 0)
+}
+
+// Resets the status of the tracks, dropping the segment being generated
+// Must be called with the mutex locked
+func (packager *HLSPackager) resetTracks(hasVideo bool, hasAudio bool) {
+	packager.hasVideo = hasVideo
+	packager.hasAudio = hasAudio
+	packager.epoch = time.Now()
+
+	packager.videoParams = nil
+	packager.videoDepacketizer = &codecs.H264Packet{IsAVC: true}
+	packager.videoFrame = nil
+	packager.videoSeqStarted = false
+	packager.videoWaitKeyframe = true
+	packager.videoClock = HLSTrackClock{}
+	packager.videoPending = nil
+
+	packager.audioClock = HLSTrackClock{}
+	packager.audioPending = nil
+
+	packager.initReady = false
+	packager.videoSegment = &FMP4Track{id: FMP4_VIDEO_TRACK_ID}
+	packager.audioSegment = &FMP4Track{id: FMP4_AUDIO_TRACK_ID}
+	packager.keyframeRequested = false
+
+	packager.pendingDiscontinuity = len(packager.segments) > 0
+
+	if !hasVideo && hasAudio {
+		// Audio only, no need to wait for the video parameters
+		packager.createInitSegment()
+	}
+}
+
+// Creates the initialization segment for the current tracks
+// Must be called with the mutex locked
+func (packager *HLSPackager) createInitSegment() {
+	var videoParams *H264Parameters
+
+	if packager.hasVideo {
+		videoParams = packager.videoParams
+	}
+
+	packager.initId++
+	packager.inits[packager.initId] = generateFMP4InitSegment(videoParams, packager.hasAudio)
+	packager.initReady = true
+}
+
+// Called for each video packet
+func (packager *HLSPackager) onVideoPacket(generation uint64, header *rtp.Header, payload []byte) {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	if generation != packager.generation || packager.closed {
+		return
+	}
+
+	if packager.videoSeqStarted && header.SequenceNumber != packager.videoLastSeq+1 {
+		// Packet lost, the frame cannot be decoded
+		packager.videoFrame = nil
+		packager.videoWaitKeyframe = true
+	}
+
+	packager.videoLastSeq = header.SequenceNumber
+	packager.videoSeqStarted = true
+
+	if len(packager.videoFrame) > 0 && header.Timestamp != packager.videoFrameTs {
+		packager.onVideoFrame() // Frame without marker
+	}
+
+	nalus, err := packager.videoDepacketizer.Unmarshal(payload)
+
+	if err != nil {
+		packager.videoFrame = nil
+		packager.videoWaitKeyframe = true
+		return
+	}
+
+	packager.videoFrame = append(packager.videoFrame, nalus...)
+	packager.videoFrameTs = header.Timestamp
+
+	if header.Marker && len(packager.videoFrame) > 0 {
+		packager.onVideoFrame()
+	}
+}
+
+// Called when a video frame is complete
+// Must be called with the mutex locked
+func (packager *HLSPackager) onVideoFrame() {
+	frame := packager.videoFrame
+	packager.videoFrame = nil
+
+	keyframe := false
+	var sps, pps []byte
+
+	for pos := 0; pos+4 <= len(frame); {
+		size := int(binary.BigEndian.Uint32(frame[pos:]))
+		pos += 4
+
+		if size > len(frame)-pos {
+			return // Invalid frame
+		}
+
+		nalu := frame[pos : pos+size]
+		pos += size
+
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1F {
+		case 5:
+			keyframe = true
+		case 7:
+			sps = nalu
+		case 8:
+			pps = nalu
+		}
+	}
+
+	if sps != nil && pps != nil && len(sps) >= 4 {
+		packager.videoParams = &H264Parameters{
+			sps:        [][]byte{sps},
+			pps:        [][]byte{pps},
+			lengthSize: 4,
+		}
+	}
+
+	if packager.videoWaitKeyframe {
+		if !keyframe {
+			return
+		}
+
+		packager.videoWaitKeyframe = false
+	}
+
+	if !packager.initReady {
+		if !keyframe || packager.videoParams == nil {
+			return // Waiting for the parameters
+		}
+
+		packager.createInitSegment()
+	}
+
+	t := packager.videoClock.getTime(packager.videoFrameTs, 90000, packager.epoch)
+
+	if packager.videoPending != nil {
+		packager.videoPending.duration = uint32(max(t-packager.videoPendingTime, 1))
+		packager.addVideoSample(packager.videoPending, packager.videoPendingTime)
+	}
+
+	packager.videoPending = &FMP4Sample{data: frame, keyframe: keyframe}
+	packager.videoPendingTime = t
+}
+
+// Adds a video sample to the segment
+// Must be called with the mutex locked
+func (packager *HLSPackager) addVideoSample(sample *FMP4Sample, t uint64) {
+	target := uint64(packager.targetDuration.Seconds() * 90000)
+
+	if sample.keyframe && len(packager.videoSegment.samples) > 0 && t-packager.videoSegment.baseMediaDecodeTime >= target {
+		packager.flushSegment()
+	}
+
+	if len(packager.videoSegment.samples) == 0 {
+		packager.videoSegment.baseMediaDecodeTime = t
+	}
+
+	packager.videoSegment.samples = append(packager.videoSegment.samples, sample)
+
+	if !packager.keyframeRequested && t+uint64(sample.duration)-packager.videoSegment.baseMediaDecodeTime >= target {
+		// A keyframe is needed to start the next segment
+		packager.keyframeRequested = true
+		go packager.sink.requestKeyframe()
+	}
+}
+
+// Called for each audio packet
+func (packager *HLSPackager) onAudioPacket(generation uint64, header *rtp.Header, payload []byte) {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	if generation != packager.generation || packager.closed {
+		return
+	}
+
+	if !packager.initReady || len(payload) == 0 {
+		return // Waiting for the video
+	}
+
+	t := packager.audioClock.getTime(header.Timestamp, 48000, packager.epoch)
+
+	if packager.audioPending != nil {
+		packager.audioPending.duration = uint32(max(t-packager.audioPendingTime, 1))
+		packager.addAudioSample(packager.audioPending, packager.audioPendingTime)
+	}
+
+	// The payload is reused by the track, so a copy is needed
+	data := make([]byte, len(payload))
+	copy(data, payload)
+
+	packager.audioPending = &FMP4Sample{data: data, keyframe: true}
+	packager.audioPendingTime = t
+}
+
+// Adds an audio sample to the segment
+// Must be called with the mutex locked
+func (packager *HLSPackager) addAudioSample(sample *FMP4Sample, t uint64) {
+	target := uint64(packager.targetDuration.Seconds() * 48000)
+
+	if len(packager.audioSegment.samples) > 0 && len(packager.videoSegment.samples) == 0 {
+		elapsed := t - packager.audioSegment.baseMediaDecodeTime
+
+		if (!packager.hasVideo && elapsed >= target) || elapsed >= target*HLS_MAX_SEGMENT_DURATION_FACTOR {
+			packager.flushSegment()
+		}
+	}
+
+	if len(packager.audioSegment.samples) == 0 {
+		packager.audioSegment.baseMediaDecodeTime = t
+	}
+
+	packager.audioSegment.samples = append(packager.audioSegment.samples, sample)
+}
+
+// Closes the segment being generated and adds it to the list
+// Must be called with the mutex locked
+func (packager *HLSPackager) flushSegment() {
+	var duration float64
+
+	if len(packager.videoSegment.samples) > 0 {
+		duration = getFMP4TrackDuration(packager.videoSegment) / 90000
+	} else {
+		duration = getFMP4TrackDuration(packager.audioSegment) / 48000
+	}
+
+	segment := &HLSSegment{
+		sequenceNumber: packager.nextSequenceNumber,
+		duration:       duration,
+		data:           generateFMP4MediaSegment(packager.nextSequenceNumber+1, []*FMP4Track{packager.videoSegment, packager.audioSegment}),
+		initId:         packager.initId,
+		discontinuity:  packager.pendingDiscontinuity,
+	}
+
+	packager.nextSequenceNumber++
+	packager.pendingDiscontinuity = false
+	packager.keyframeRequested = false
+
+	packager.videoSegment = &FMP4Track{id: FMP4_VIDEO_TRACK_ID}
+	packager.audioSegment = &FMP4Track{id: FMP4_AUDIO_TRACK_ID}
+
+	packager.segments = append(packager.segments, segment)
+
+	// Remove old segments
+	for len(packager.segments) > packager.playlistSize+HLS_EXTRA_SEGMENTS {
+		if packager.segments[0].discontinuity {
+			packager.removedDiscontinuities++
+		}
+
+		packager.segments = packager.segments[1:]
+	}
+
+	// Remove unused initialization segments
+	for id := range packager.inits {
+		if id < packager.segments[0].initId && id != packager.initId {
+			delete(packager.inits, id)
+		}
+	}
+
+	if !packager.ready {
+		packager.ready = true
+		close(packager.readyChan)
+	}
+}
+
+// Gets the duration of the samples of a track, in timescale units
+func getFMP4TrackDuration(track *FMP4Track) float64 {
+	var duration uint64
+
+	for _, sample := range track.samples {
+		duration += uint64(sample.duration)
+	}
+
+	return float64(duration)
+}
+
+// Called for each request, to keep the packager active
+func (packager *HLSPackager) onRequest() {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	packager.lastAccess = time.Now()
+}
+
+// Waits until the first segment is available
+// Returns false on timeout
+func (packager *HLSPackager) waitReady(timeout time.Duration) bool {
+	select {
+	case <-packager.readyChan:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Generates the playlist
+// The query is appended to the URIs (for example, to include the authentication token)
+func (packager *HLSPackager) getPlaylist(query string) string {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	first := max(len(packager.segments)-packager.playlistSize, 0)
+	segments := packager.segments[first:]
+
+	targetDuration := packager.targetDuration.Seconds()
+	discontinuitySequence := packager.removedDiscontinuities
+
+	for i, segment := range packager.segments {
+		if i < first && segment.discontinuity {
+			discontinuitySequence++
+		}
+
+		targetDuration = math.Max(targetDuration, segment.duration)
+	}
+
+	var mediaSequence uint32
+
+	if len(segments) > 0 {
+		mediaSequence = segments[0].sequenceNumber
+	}
+
+	playlist := &strings.Builder{}
+
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:7\n")
+	fmt.Fprintf(playlist, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	fmt.Fprintf(playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	fmt.Fprintf(playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySequence)
+
+	initId := 0
+
+	for i, segment := range segments {
+		if segment.discontinuity && i > 0 {
+			playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		if segment.initId != initId {
+			initId = segment.initId
+			fmt.Fprintf(playlist, "#EXT-X-MAP:URI=\"init_%d.mp4%s\"\n", initId, query)
+		}
+
+		fmt.Fprintf(playlist, "#EXTINF:%.3f,\n", segment.duration)
+		fmt.Fprintf(playlist, "segment_%d.m4s%s\n", segment.sequenceNumber, query)
+	}
+
+	return playlist.String()
+}
+
+// Gets an initialization segment (nil if not found)
+func (packager *HLSPackager) getInitSegment(id int) []byte {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	return packager.inits[id]
+}
+
+// Gets a media segment (nil if not found)
+func (packager *HLSPackager) getSegment(sequenceNumber uint32) []byte {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	for _, segment := range packager.segments {
+		if segment.sequenceNumber == sequenceNumber {
+			return segment.data
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Creates a packager without sink, to generate segments from samples
+func newTestHLSPackager(playlistSize int) *HLSPackager {
+	packager := &HLSPackager{
+		sid:            "test",
+		mutex:          &sync.Mutex{},
+		targetDuration: 2 * time.Second,
+		playlistSize:   playlistSize,
+		inits:          make(map[int][]byte),
+		segments:       make([]*HLSSegment, 0),
+		readyChan:      make(chan struct{}),
+	}
+
+	packager.resetTracks(false, true)
+
+	return packager
+}
+
+// Adds audio samples (20ms) until the packager generates the segments
+func addTestHLSSegments(packager *HLSPackager, count int) {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+
+	target := packager.nextSequenceNumber + uint32(count)
+
+	// Continue after the samples of the segment being generated
+	t := packager.audioSegment.baseMediaDecodeTime + uint64(getFMP4TrackDuration(packager.audioSegment))
+
+	for packager.nextSequenceNumber < target {
+		packager.addAudioSample(&FMP4Sample{data: []byte{0xFC}, duration: 960, keyframe: true}, t)
+		t += 960
+	}
+}
+
+func TestHLSPlaylistRotation(t *testing.T) {
+	packager := newTestHLSPackager(3)
+
+	if playlist := packager.getPlaylist(""); playlist != "#EXTM3U\n"+
+		"#EXT-X-VERSION:7\n"+
+		"#EXT-X-TARGETDURATION:2\n"+
+		"#EXT-X-MEDIA-SEQUENCE:0\n"+
+		"#EXT-X-DISCONTINUITY-SEQUENCE:0\n" {
+		t.Fatalf("unexpected empty playlist:\n%s", playlist)
+	}
+
+	addTestHLSSegments(packager, 4) // 0 to 3
+
+	if !packager.waitReady(time.Second) {
+		t.Fatal("the packager is not ready after the first segment")
+	}
+
+	// The tracks change, the next segment starts a discontinuity
+	packager.mutex.Lock()
+	packager.resetTracks(false, true)
+	packager.mutex.Unlock()
+
+	addTestHLSSegments(packager, 2) // 4 and 5
+
+	steps := []struct {
+		name     string
+		segments int
+		playlist string
+		kept     []uint32 // Segments that can be downloaded
+		inits    []int    // Initialization segments that can be downloaded
+	}{
+		{
+			name: "discontinuity in the playlist",
+			playlist: "#EXTM3U\n" +
+				"#EXT-X-VERSION:7\n" +
+				"#EXT-X-TARGETDURATION:2\n" +
+				"#EXT-X-MEDIA-SEQUENCE:3\n" +
+				"#EXT-X-DISCONTINUITY-SEQUENCE:0\n" +
+				"#EXT-X-MAP:URI=\"init_1.mp4?token=t\"\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_3.m4s?token=t\n" +
+				"#EXT-X-DISCONTINUITY\n" +
+				"#EXT-X-MAP:URI=\"init_2.mp4?token=t\"\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_4.m4s?token=t\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_5.m4s?token=t\n",
+			kept:  []uint32{1, 2, 3, 4, 5},
+			inits: []int{1, 2},
+		},
+		{
+			name:     "discontinuity out of the playlist",
+			segments: 2,
+			playlist: "#EXTM3U\n" +
+				"#EXT-X-VERSION:7\n" +
+				"#EXT-X-TARGETDURATION:2\n" +
+				"#EXT-X-MEDIA-SEQUENCE:5\n" +
+				"#EXT-X-DISCONTINUITY-SEQUENCE:1\n" +
+				"#EXT-X-MAP:URI=\"init_2.mp4?token=t\"\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_5.m4s?token=t\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_6.m4s?token=t\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_7.m4s?token=t\n",
+			kept:  []uint32{3, 4, 5, 6, 7},
+			inits: []int{1, 2},
+		},
+		{
+			name:     "discontinuity removed",
+			segments: 2,
+			playlist: "#EXTM3U\n" +
+				"#EXT-X-VERSION:7\n" +
+				"#EXT-X-TARGETDURATION:2\n" +
+				"#EXT-X-MEDIA-SEQUENCE:7\n" +
+				"#EXT-X-DISCONTINUITY-SEQUENCE:1\n" +
+				"#EXT-X-MAP:URI=\"init_2.mp4?token=t\"\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_7.m4s?token=t\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_8.m4s?token=t\n" +
+				"#EXTINF:2.000,\n" +
+				"segment_9.m4s?token=t\n",
+			kept:  []uint32{5, 6, 7, 8, 9},
+			inits: []int{2},
+		},
+	}
+
+	for _, step := range steps {
+		addTestHLSSegments(packager, step.segments)
+
+		if playlist := packager.getPlaylist("?token=t"); playlist != step.playlist {
+			t.Fatalf("%s: unexpected playlist:\n%s", step.name, playlist)
+		}
+
+		for sequenceNumber := uint32(0); sequenceNumber < packager.nextSequenceNumber; sequenceNumber++ {
+			kept := false
+
+			for _, k := range step.kept {
+				kept = kept || k == sequenceNumber
+			}
+
+			segment := packager.getSegment(sequenceNumber)
+
+			if kept != (segment != nil) {
+				t.Fatalf("%s: segment %d: expected kept=%v", step.name, sequenceNumber, kept)
+			}
+
+			// The fragment sequence numbers start at 1
+			if segment != nil && binary.BigEndian.Uint32(findMP4Box(t, segment, "moof", "mfhd")[4:]) != sequenceNumber+1 {
+				t.Fatalf("%s: segment %d: unexpected fragment sequence number", step.name, sequenceNumber)
+			}
+		}
+
+		for id := 1; id <= 2; id++ {
+			kept := false
+
+			for _, k := range step.inits {
+				kept = kept || k == id
+			}
+
+			if kept != (packager.getInitSegment(id) != nil) {
+				t.Fatalf("%s: initialization segment %d: expected kept=%v", step.name, id, kept)
+			}
+		}
+	}
+}
+
+func TestHLSPackagerLimit(t *testing.T) {
+	node := newTestNode(t, "node", nil)
+
+	config := *node.getConfig()
+	config.HLS.MaxPackagers = 2
+	node.config.Store(&config)
+
+	a, created, err := node.getOrCreateHLSPackager("a", "127.0.0.1")
+	if err != nil || !created {
+		t.Fatalf("expected the packager to be created, got created=%v, err=%v", created, err)
+	}
+
+	if _, created, err := node.getOrCreateHLSPackager("b", "127.0.0.1"); err != nil || !created {
+		t.Fatalf("expected the packager to be created, got created=%v, err=%v", created, err)
+	}
+
+	// Existing packagers are returned even if the limit is reached
+	if p, created, err := node.getOrCreateHLSPackager("a", "127.0.0.1"); err != nil || created || p != a {
+		t.Fatalf("expected the existing packager, got created=%v, err=%v", created, err)
+	}
+
+	if _, _, err := node.getOrCreateHLSPackager("c", "127.0.0.1"); err != errHLSPackagerLimit {
+		t.Fatalf("expected the packager limit error, got %v", err)
+	}
+
+	node.removeHLSPackager(a)
+
+	if _, created, err := node.getOrCreateHLSPackager("c", "127.0.0.1"); err != nil || !created {
+		t.Fatalf("expected the packager to be created after removing one, got created=%v, err=%v", created, err)
+	}
+}
@@ -0,0 +1,556 @@
+// Admin API
+// Allows operators to inspect and control the node
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Path prefix for the admin API
+const ADMIN_API_PATH_PREFIX = "/admin/"
+
+// Information of a source, returned by the admin API
+type AdminSourceInfo struct {
+	StreamId      string   `json:"stream_id"`
+	RequestId     string   `json:"request_id"`
+	Protocol      string   `json:"protocol"`
+	ConnectionId  uint64   `json:"connection_id,omitempty"`
+	ClientIP      string   `json:"client_ip"`
+	State         string   `json:"state"`
+	Ready         bool     `json:"ready"`
+	HasAudio      bool     `json:"has_audio"`
+	HasVideo      bool     `json:"has_video"`
+	Recording     bool     `json:"recording"`
+	Layers        []string `json:"simulcast_layers,omitempty"`
+	StartTime     int64    `json:"start_time"`
+	UptimeSeconds float64  `json:"uptime_seconds"`
+}
+
+// Information of a sink, returned by the admin API
+type AdminSinkInfo struct {
+	SinkId        uint64  `json:"sink_id"`
+	StreamId      string  `json:"stream_id"`
+	RequestId     string  `json:"request_id"`
+	Protocol      string  `json:"protocol"`
+	ConnectionId  uint64  `json:"connection_id,omitempty"`
+	ClientIP      string  `json:"client_ip"`
+	State         string  `json:"state"`
+	HasAudio      bool    `json:"has_audio"`
+	HasVideo      bool    `json:"has_video"`
+	Layer         string  `json:"simulcast_layer,omitempty"`
+	LayerAuto     bool    `json:"simulcast_auto,omitempty"`
+	StartTime     int64   `json:"start_time"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// Information of a relay or a sender, returned by the admin API
+type AdminNodeLinkInfo struct {
+	StreamId      string  `json:"stream_id"`
+	RemoteNode    string  `json:"remote_node"`
+	State         string  `json:"state"`
+	Ready         bool    `json:"ready"`
+	HasAudio      bool    `json:"has_audio"`
+	HasVideo      bool    `json:"has_video"`
+	StartTime     int64   `json:"start_time"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// Information of a websocket connection, returned by the admin API
+type AdminConnectionInfo struct {
+	ConnectionId  uint64  `json:"connection_id"`
+	ClientIP      string  `json:"client_ip"`
+	Requests      uint32  `json:"requests"`
+	StartTime     int64   `json:"start_time"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// Status of the node, returned by the admin API
+type AdminNodeStatus struct {
+	NodeId        string                  `json:"node_id"`
+	Version       string                  `json:"version"`
+	StartTime     int64                   `json:"start_time"`
+	UptimeSeconds float64                 `json:"uptime_seconds"`
+	Sources       []AdminSourceInfo       `json:"sources"`
+	Relays        []AdminNodeLinkInfo     `json:"relays"`
+	Sinks         []AdminSinkInfo         `json:"sinks"`
+	Senders       []AdminNodeLinkInfo     `json:"senders"`
+	Connections   []AdminConnectionInfo   `json:"connections"`
+	Forwarders    []AdminRTPForwarderInfo `json:"forwarders"`
+}
+
+// Gets the state of a peer connection as a string
+func getPeerConnectionState(peerConnection *webrtc.PeerConnection) string {
+	if peerConnection == nil {
+		return "waiting"
+	}
+
+	return peerConnection.ConnectionState().String()
+}
+
+// Gets the information of the sources
+func (node *WebRTC_CDN_Node) getAdminSourcesInfo() []AdminSourceInfo {
+	node.mutexStatus.Lock()
+
+	sources := make([]*WRTC_Source, 0, len(node.sources))
+
+	for _, source := range node.sources {
+		sources = append(sources, source)
+	}
+
+	node.mutexStatus.Unlock()
+
+	result := make([]AdminSourceInfo, 0, len(sources))
+
+	for _, source := range sources {
+		source.statusMutex.Lock()
+
+		info := AdminSourceInfo{
+			StreamId:      source.sid,
+			RequestId:     source.requestId,
+			Protocol:      "websocket",
+			ClientIP:      source.ip,
+			State:         getPeerConnectionState(source.peerConnection),
+			Ready:         source.ready,
+			HasAudio:      source.hasAudio,
+			HasVideo:      source.hasVideo,
+			Recording:     source.record,
+			StartTime:     source.startTime.UnixMilli(),
+			UptimeSeconds: time.Since(source.startTime).Seconds(),
+		}
+
+		if source.simulcast != nil {
+			info.Layers = source.simulcast.getLayerIds()
+		}
+
+		if source.connection != nil {
+			info.ConnectionId = source.connection.id
+		} else if source.rtmp != nil {
+			info.Protocol = "rtmp"
+			info.State = "connected"
+		} else {
+			info.Protocol = "whip"
+		}
+
+		source.statusMutex.Unlock()
+
+		result = append(result, info)
+	}
+
+	return result
+}
+
+// Gets the information of the sinks
+func (node *WebRTC_CDN_Node) getAdminSinksInfo() []AdminSinkInfo {
+	node.mutexStatus.Lock()
+
+	sinks := make([]*WRTC_Sink, 0)
+
+	for _, sinksForStream := range node.sinks {
+		for _, sink := range sinksForStream {
+			sinks = append(sinks, sink)
+		}
+	}
+
+	node.mutexStatus.Unlock()
+
+	result := make([]AdminSinkInfo, 0, len(sinks))
+
+	for _, sink := range sinks {
+		sink.statusMutex.Lock()
+
+		info := AdminSinkInfo{
+			SinkId:        sink.sinkId,
+			StreamId:      sink.sid,
+			RequestId:     sink.requestId,
+			Protocol:      "websocket",
+			ClientIP:      sink.ip,
+			State:         getPeerConnectionState(sink.peerConnection),
+			HasAudio:      sink.hasAudio,
+			HasVideo:      sink.hasVideo,
+			StartTime:     sink.startTime.UnixMilli(),
+			UptimeSeconds: time.Since(sink.startTime).Seconds(),
+		}
+
+		if sink.layerSwitcher != nil {
+			info.Layer, info.LayerAuto = sink.layerSwitcher.getStatus()
+		}
+
+		if sink.connection != nil {
+			info.ConnectionId = sink.connection.id
+		} else if sink.hls != nil {
+			info.Protocol = "hls"
+			info.State = "packaging"
+		} else if sink.forwarder != nil {
+			info.Protocol = "rtp"
+			info.State = "forwarding"
+		} else {
+			info.Protocol = "whep"
+		}
+
+		sink.statusMutex.Unlock()
+
+		result = append(result, info)
+	}
+
+	return result
+}
+
+// Gets the information of the relays
+func (node *WebRTC_CDN_Node) getAdminRelaysInfo() []AdminNodeLinkInfo {
+	node.mutexStatus.Lock()
+
+	relays := make([]*WRTC_Relay, 0, len(node.relays))
+
+	for _, relay := range node.relays {
+		relays = append(relays, relay)
+	}
+
+	node.mutexStatus.Unlock()
+
+	result := make([]AdminNodeLinkInfo, 0, len(relays))
+
+	for _, relay := range relays {
+		relay.statusMutex.Lock()
+
+		result = append(result, AdminNodeLinkInfo{
+			StreamId:      relay.sid,
+			RemoteNode:    relay.remoteId,
+			State:         getPeerConnectionState(relay.peerConnection),
+			Ready:         relay.ready,
+			HasAudio:      relay.hasAudio,
+			HasVideo:      relay.hasVideo,
+			StartTime:     relay.startTime.UnixMilli(),
+			UptimeSeconds: time.Since(relay.startTime).Seconds(),
+		})
+
+		relay.statusMutex.Unlock()
+	}
+
+	return result
+}
+
+// Gets the information of the senders
+func (node *WebRTC_CDN_Node) getAdminSendersInfo() []AdminNodeLinkInfo {
+	node.mutexStatus.Lock()
+
+	senders := make([]*WRTC_Source_Sender, 0)
+
+	for _, sendersForStream := range node.senders {
+		for _, sender := range sendersForStream {
+			senders = append(senders, sender)
+		}
+	}
+
+	node.mutexStatus.Unlock()
+
+	result := make([]AdminNodeLinkInfo, 0, len(senders))
+
+	for _, sender := range senders {
+		sender.statusMutex.Lock()
+
+		result = append(result, AdminNodeLinkInfo{
+			StreamId:      sender.sid,
+			RemoteNode:    sender.remoteId,
+			State:         getPeerConnectionState(sender.peerConnection),
+			Ready:         sender.hasAudio || sender.hasVideo,
+			HasAudio:      sender.hasAudio,
+			HasVideo:      sender.hasVideo,
+			StartTime:     sender.startTime.UnixMilli(),
+			UptimeSeconds: time.Since(sender.startTime).Seconds(),
+		})
+
+		sender.statusMutex.Unlock()
+	}
+
+	return result
+}
+
+// Gets the information of the websocket connections
+func (node *WebRTC_CDN_Node) getAdminConnectionsInfo() []AdminConnectionInfo {
+	node.mutexConnections.Lock()
+
+	connections := make([]*Connection_Handler, 0, len(node.connections))
+
+	for _, connection := range node.connections {
+		connections = append(connections, connection)
+	}
+
+	node.mutexConnections.Unlock()
+
+	result := make([]AdminConnectionInfo, 0, len(connections))
+
+	for _, connection := range connections {
+		connection.statusMutex.Lock()
+
+		result = append(result, AdminConnectionInfo{
+			ConnectionId:  connection.id,
+			ClientIP:      connection.ip,
+			Requests:      connection.requestCount,
+			StartTime:     connection.startTime.UnixMilli(),
+			UptimeSeconds: time.Since(connection.startTime).Seconds(),
+		})
+
+		connection.statusMutex.Unlock()
+	}
+
+	return result
+}
+
+// Gets the full status of the node
+func (node *WebRTC_CDN_Node) getAdminNodeStatus() AdminNodeStatus {
+	return AdminNodeStatus{
+		NodeId:        node.id,
+		Version:       VERSION,
+		StartTime:     node.startTime.UnixMilli(),
+		UptimeSeconds: time.Since(node.startTime).Seconds(),
+		Sources:       node.getAdminSourcesInfo(),
+		Relays:        node.getAdminRelaysInfo(),
+		Sinks:         node.getAdminSinksInfo(),
+		Senders:       node.getAdminSendersInfo(),
+		Connections:   node.getAdminConnectionsInfo(),
+		Forwarders:    node.getAdminRTPForwardersInfo(),
+	}
+}
+
+// Kicks the publisher of a stream
+// Returns false if there is no source for the stream
+func (node *WebRTC_CDN_Node) adminKickSource(sid string) bool {
+	node.mutexStatus.Lock()
+	source := node.sources[sid]
+	node.mutexStatus.Unlock()
+
+	if source == nil {
+		return false
+	}
+
+	source.close(true, true)
+
+	return true
+}
+
+// Kicks a viewer
+// Returns false if the sink does not exist
+func (node *WebRTC_CDN_Node) adminKickSink(sinkId uint64) bool {
+	var sink *WRTC_Sink
+
+	node.mutexStatus.Lock()
+
+	for _, sinksForStream := range node.sinks {
+		if sinksForStream[sinkId] != nil {
+			sink = sinksForStream[sinkId]
+			break
+		}
+	}
+
+	node.mutexStatus.Unlock()
+
+	if sink == nil {
+		return false
+	}
+
+	sink.kick()
+
+	return true
+}
+
+// Closes the relay of a stream
+// The sinks will try to resolve the stream again
+// Returns false if there is no relay for the stream
+func (node *WebRTC_CDN_Node) adminCloseRelay(sid string) bool {
+	node.mutexStatus.Lock()
+	relay := node.relays[sid]
+	node.mutexStatus.Unlock()
+
+	if relay == nil {
+		return false
+	}
+
+	relay.onClose()
+
+	return true
+}
+
+// Checks the authentication for the admin API
+// The token must match the admin API secret
+func checkAdminAuthentication(secret string, req *http.Request) bool {
+	if secret == "" {
+		return false
+	}
+
+	token := getBearerToken(req)
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// Sends a JSON response
+func sendJSONResponse(w http.ResponseWriter, status int, data interface{}) {
+	b, err := json.Marshal(data)
+
+	if err != nil {
+		LogError(err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// Sends a JSON error response
+func sendJSONError(w http.ResponseWriter, status int, code string, message string) {
+	sendJSONResponse(w, status, map[string]string{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// Handles requests to the admin API
+// GET /admin/status - Full status of the node
+// GET /admin/{sources|relays|sinks|senders|connections|forwarders} - Lists
+// POST /admin/sources/{streamId}/kick - Kicks a publisher
+// POST /admin/sinks/{sinkId}/kick - Kicks a viewer
+// POST /admin/relays/{streamId}/close - Closes a relay
+// POST /admin/forwarders - Starts forwarding a stream via RTP
+// GET /admin/forwarders/{forwarderId}/sdp - SDP file of a RTP forwarder
+// POST /admin/forwarders/{forwarderId}/close - Stops forwarding a stream
+// POST /admin/reload - Reloads the configuration
+func (node *WebRTC_CDN_Node) handleAdminAPI(w http.ResponseWriter, req *http.Request, reqId uint64, ip string) {
+	if node.getConfig().Admin.Secret == "" {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Not found.")
+		return
+	}
+
+	if !checkAdminAuthentication(node.getConfig().Admin.Secret, req) {
+		LogRequest(reqId, ip, "Admin API: Invalid authentication")
+		sendJSONError(w, 401, "INVALID_AUTH", "Invalid authentication provided.")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), ADMIN_API_PATH_PREFIX), "/")
+
+	if len(parts) == 1 {
+		if parts[0] == "forwarders" && req.Method == "POST" {
+			node.handleAdminCreateRTPForwarder(w, req, reqId, ip)
+			return
+		}
+
+		if parts[0] == "reload" {
+			node.handleAdminReloadConfig(w, req, reqId, ip)
+			return
+		}
+
+		if req.Method != "GET" {
+			sendJSONError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed.")
+			return
+		}
+
+		switch parts[0] {
+		case "status":
+			sendJSONResponse(w, 200, node.getAdminNodeStatus())
+		case "sources":
+			sendJSONResponse(w, 200, node.getAdminSourcesInfo())
+		case "relays":
+			sendJSONResponse(w, 200, node.getAdminRelaysInfo())
+		case "sinks":
+			sendJSONResponse(w, 200, node.getAdminSinksInfo())
+		case "senders":
+			sendJSONResponse(w, 200, node.getAdminSendersInfo())
+		case "connections":
+			sendJSONResponse(w, 200, node.getAdminConnectionsInfo())
+		case "forwarders":
+			sendJSONResponse(w, 200, node.getAdminRTPForwardersInfo())
+		default:
+			sendJSONError(w, 404, "NOT_FOUND", "Not found.")
+		}
+
+		return
+	}
+
+	if len(parts) != 3 {
+		sendJSONError(w, 404, "NOT_FOUND", "Not found.")
+		return
+	}
+
+	if parts[0] == "forwarders" && parts[2] == "sdp" {
+		if req.Method != "GET" {
+			sendJSONError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed.")
+			return
+		}
+
+		node.handleAdminRTPForwarderSDP(w, parts[1])
+		return
+	}
+
+	if req.Method != "POST" {
+		sendJSONError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed.")
+		return
+	}
+
+	target, err := url.PathUnescape(parts[1])
+
+	if err != nil {
+		sendJSONError(w, 404, "NOT_FOUND", "Not found.")
+		return
+	}
+
+	action := parts[0] + "/" + parts[2]
+
+	var found bool
+
+	switch action {
+	case "sources/kick":
+		found = node.adminKickSource(target)
+	case "sinks/kick":
+		sinkId, err := strconv.ParseUint(target, 10, 64)
+		found = err == nil && node.adminKickSink(sinkId)
+	case "relays/close":
+		found = node.adminCloseRelay(target)
+	case "forwarders/close":
+		found = node.adminCloseRTPForwarder(target)
+	default:
+		sendJSONError(w, 404, "NOT_FOUND", "Not found.")
+		return
+	}
+
+	if !found {
+		sendJSONError(w, 404, "NOT_FOUND", "The requested element was not found.")
+		return
+	}
+
+	LogRequest(reqId, ip, "Admin API: "+action+" "+target)
+
+	sendJSONResponse(w, 200, map[string]bool{"success": true})
+}
+
+// Handles a request to reload the configuration
+// POST /admin/reload
+func (node *WebRTC_CDN_Node) handleAdminReloadConfig(w http.ResponseWriter, req *http.Request, reqId uint64, ip string) {
+	if req.Method != "POST" {
+		sendJSONError(w, 405, "METHOD_NOT_ALLOWED", "Method not allowed.")
+		return
+	}
+
+	LogRequest(reqId, ip, "Admin API: Reloading configuration")
+
+	result, err := node.reloadConfigAndLog()
+
+	if err != nil {
+		sendJSONError(w, 400, "INVALID_CONFIG", strings.ReplaceAll(err.Error(), "\n", "; "))
+		return
+	}
+
+	sendJSONResponse(w, 200, result)
+}
@@ -0,0 +1,183 @@
+// Admin API for RTP forwarding
+// Allows operators to forward streams to external RTP receivers
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Max size of the body of the admin API requests
+const ADMIN_API_BODY_SIZE_LIMIT = 16 * 1024
+
+// Max time to wait for the tracks, in order to include the SDP in the response
+const RTP_FORWARD_TRACKS_WAIT_TIMEOUT = 5 * time.Second
+
+// Request to start forwarding a stream
+type AdminRTPForwardRequest struct {
+	StreamId  string `json:"stream_id"`
+	Host      string `json:"host"`
+	VideoPort int    `json:"video_port"`
+	AudioPort int    `json:"audio_port"`
+}
+
+// Response after starting forwarding a stream
+type AdminRTPForwardResponse struct {
+	ForwarderId string `json:"forwarder_id"`
+	SinkId      uint64 `json:"sink_id"`
+	SDP         string `json:"sdp,omitempty"`
+}
+
+// Information of a RTP forwarder, returned by the admin API
+type AdminRTPForwarderInfo struct {
+	ForwarderId   string  `json:"forwarder_id"`
+	SinkId        uint64  `json:"sink_id"`
+	StreamId      string  `json:"stream_id"`
+	Host          string  `json:"host"`
+	VideoPort     int     `json:"video_port,omitempty"`
+	AudioPort     int     `json:"audio_port,omitempty"`
+	VideoCodec    string  `json:"video_codec,omitempty"`
+	AudioCodec    string  `json:"audio_codec,omitempty"`
+	StartTime     int64   `json:"start_time"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// Gets the information of the RTP forwarders
+func (node *WebRTC_CDN_Node) getAdminRTPForwardersInfo() []AdminRTPForwarderInfo {
+	node.mutexHTTPResources.Lock()
+
+	forwarders := make([]*RTPForwarder, 0, len(node.rtpForwarders))
+
+	for _, forwarder := range node.rtpForwarders {
+		forwarders = append(forwarders, forwarder)
+	}
+
+	node.mutexHTTPResources.Unlock()
+
+	result := make([]AdminRTPForwarderInfo, 0, len(forwarders))
+
+	for _, forwarder := range forwarders {
+		info := AdminRTPForwarderInfo{
+			ForwarderId:   forwarder.id,
+			SinkId:        forwarder.sink.sinkId,
+			StreamId:      forwarder.sid,
+			Host:          forwarder.host,
+			VideoPort:     forwarder.videoPort,
+			AudioPort:     forwarder.audioPort,
+			StartTime:     forwarder.startTime.UnixMilli(),
+			UptimeSeconds: time.Since(forwarder.startTime).Seconds(),
+		}
+
+		forwarder.mutex.Lock()
+
+		if forwarder.videoCodec != nil {
+			info.VideoCodec = forwarder.videoCodec.MimeType
+		}
+
+		if forwarder.audioCodec != nil {
+			info.AudioCodec = forwarder.audioCodec.MimeType
+		}
+
+		forwarder.mutex.Unlock()
+
+		result = append(result, info)
+	}
+
+	return result
+}
+
+// Closes a RTP forwarder
+// Returns false if the forwarder does not exist
+func (node *WebRTC_CDN_Node) adminCloseRTPForwarder(id string) bool {
+	forwarder := node.getRTPForwarder(id)
+
+	if forwarder == nil {
+		return false
+	}
+
+	forwarder.close()
+
+	return true
+}
+
+// Handles a request to start forwarding a stream
+// POST /admin/forwarders
+func (node *WebRTC_CDN_Node) handleAdminCreateRTPForwarder(w http.ResponseWriter, req *http.Request, reqId uint64, ip string) {
+	if node.isDraining() {
+		w.Header().Set("Retry-After", "5")
+		sendJSONError(w, 503, "DRAINING", "The node is shutting down.")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, ADMIN_API_BODY_SIZE_LIMIT))
+
+	if err != nil {
+		sendJSONError(w, 400, "INVALID_REQUEST", "Could not read the request body.")
+		return
+	}
+
+	request := AdminRTPForwardRequest{}
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		sendJSONError(w, 400, "INVALID_REQUEST", "The request body must be a valid JSON object.")
+		return
+	}
+
+	if len(request.StreamId) == 0 || len(request.StreamId) > 255 {
+		sendJSONError(w, 400, "INVALID_REQUEST", "Invalid stream ID.")
+		return
+	}
+
+	forwarder, err := newRTPForwarder(node, request.StreamId, request.Host, request.VideoPort, request.AudioPort, ip)
+
+	if err != nil {
+		sendJSONError(w, 400, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	node.addRTPForwarder(forwarder)
+
+	metricPlayRequests.WithLabelValues("rtp").Inc()
+
+	forwarder.start()
+
+	forwarder.sink.logger.Request("Admin API: RTP forwarding started", "connection_id", reqId, "destination", forwarder.host)
+
+	response := AdminRTPForwardResponse{
+		ForwarderId: forwarder.id,
+		SinkId:      forwarder.sink.sinkId,
+	}
+
+	if forwarder.waitReady(RTP_FORWARD_TRACKS_WAIT_TIMEOUT) {
+		response.SDP, _ = forwarder.getSDP()
+	}
+
+	sendJSONResponse(w, 201, response)
+}
+
+// Handles a request for the SDP file of a RTP forwarder
+// GET /admin/forwarders/{forwarderId}/sdp
+func (node *WebRTC_CDN_Node) handleAdminRTPForwarderSDP(w http.ResponseWriter, id string) {
+	forwarder := node.getRTPForwarder(id)
+
+	if forwarder == nil {
+		sendJSONError(w, 404, "NOT_FOUND", "The requested element was not found.")
+		return
+	}
+
+	sdp, ok := forwarder.getSDP()
+
+	if !ok {
+		sendJSONError(w, 409, "NOT_READY", "The tracks of the stream are not available yet.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Content-Length", strconv.Itoa(len(sdp)))
+	w.WriteHeader(200)
+	w.Write([]byte(sdp))
+}
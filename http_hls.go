@@ -0,0 +1,218 @@
+// HLS playback
+// Serves the playlists and segments generated by the HLS packagers
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path prefix for the HLS endpoints
+const HLS_PATH_PREFIX = "/hls/"
+
+// Max time to wait for the first segment when the playlist is requested
+const HLS_PLAYLIST_WAIT_TIMEOUT = 20 * time.Second
+
+// Error returned when the node reached the max number of HLS packagers
+var errHLSPackagerLimit = errors.New("too many HLS packagers")
+
+// Gets the HLS packager of a stream (nil if not found)
+func (node *WebRTC_CDN_Node) getHLSPackager(sid string) *HLSPackager {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	return node.hlsPackagers[sid]
+}
+
+// Gets the HLS packager of a stream, creating it if it does not exist
+// Returns true if the packager was created
+// Returns errHLSPackagerLimit if the max number of packagers is reached
+func (node *WebRTC_CDN_Node) getOrCreateHLSPackager(sid string, ip string) (*HLSPackager, bool, error) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	if node.hlsPackagers[sid] != nil {
+		return node.hlsPackagers[sid], false, nil
+	}
+
+	if len(node.hlsPackagers) >= node.getConfig().HLS.MaxPackagers {
+		return nil, false, errHLSPackagerLimit
+	}
+
+	packager, err := newHLSPackager(node, sid, ip)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	node.hlsPackagers[sid] = packager
+
+	return packager, true, nil
+}
+
+// Removes an HLS packager
+func (node *WebRTC_CDN_Node) removeHLSPackager(packager *HLSPackager) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	if node.hlsPackagers[packager.sid] == packager {
+		delete(node.hlsPackagers, packager.sid)
+	}
+}
+
+// Handles requests to the HLS endpoints
+// GET /hls/{streamId}/index.m3u8 - Playlist
+// GET /hls/{streamId}/init_{id}.mp4 - Initialization segment
+// GET /hls/{streamId}/segment_{sequenceNumber}.m4s - Media segment
+func (node *WebRTC_CDN_Node) handleHLS(w http.ResponseWriter, req *http.Request, reqId uint64, ip string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+
+	streamId, fileName, ok := splitHTTPSignalingPath(req, HLS_PATH_PREFIX)
+
+	if !ok || fileName == "" || !node.getConfig().HLS.Enabled {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Not found.")
+		return
+	}
+
+	if req.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed.")
+		return
+	}
+
+	// The token can be sent as a query parameter, since players cannot set headers
+	// In that case, it's appended to the URIs of the playlist
+	query := ""
+	token := req.URL.Query().Get("token")
+
+	if token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	} else {
+		token = getBearerToken(req)
+	}
+
+	if !checkAuthentication(node.authKeyProvider.Load(), token, "stream_play", streamId) {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Invalid authentication provided.")
+		return
+	}
+
+	if fileName == "index.m3u8" {
+		node.handleHLSPlaylist(w, reqId, ip, streamId, query)
+		return
+	}
+
+	packager := node.getHLSPackager(streamId)
+
+	if packager == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Not found.")
+		return
+	}
+
+	packager.onRequest()
+
+	var data []byte
+	var contentType string
+
+	if strings.HasPrefix(fileName, "init_") && strings.HasSuffix(fileName, ".mp4") {
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(fileName, "init_"), ".mp4"))
+
+		if err == nil {
+			data = packager.getInitSegment(id)
+		}
+
+		contentType = "video/mp4"
+	} else if strings.HasPrefix(fileName, "segment_") && strings.HasSuffix(fileName, ".m4s") {
+		sequenceNumber, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(fileName, "segment_"), ".m4s"), 10, 32)
+
+		if err == nil {
+			data = packager.getSegment(uint32(sequenceNumber))
+		}
+
+		contentType = "video/iso.segment"
+	}
+
+	if data == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Not found.")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// Handles a request for the playlist of a stream
+// The packager is created if it does not exist
+func (node *WebRTC_CDN_Node) handleHLSPlaylist(w http.ResponseWriter, reqId uint64, ip string, streamId string, query string) {
+	packager := node.getHLSPackager(streamId)
+
+	if packager == nil {
+		if node.isDraining() {
+			// The node is shutting down, players must connect to other node
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(503)
+			fmt.Fprintf(w, "The node is shutting down.")
+			return
+		}
+
+		p, created, err := node.getOrCreateHLSPackager(streamId, ip)
+
+		if err == errHLSPackagerLimit {
+			metricRejectedRequests.WithLabelValues("hls_limit").Inc()
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(503)
+			fmt.Fprintf(w, "Too many streams being packaged.")
+			return
+		}
+
+		if err != nil {
+			LogError(err)
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Internal server error.")
+			return
+		}
+
+		if created {
+			metricPlayRequests.WithLabelValues("hls").Inc()
+
+			p.start()
+
+			p.sink.logger.Request("HLS packaging started", "connection_id", reqId)
+		}
+
+		packager = p
+	}
+
+	packager.onRequest()
+
+	// Wait for the first segment
+
+	if !packager.waitReady(HLS_PLAYLIST_WAIT_TIMEOUT) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Stream not available.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	fmt.Fprint(w, packager.getPlaylist(query))
+}
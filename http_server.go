@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,7 +36,7 @@ func (node *WebRTC_CDN_Node) AddIP(ip string) bool {
 
 	c := node.ipCount[ip]
 
-	if c >= node.ipLimit {
+	if c >= uint32(node.getConfig().Limits.MaxIPConcurrentConnections) {
 		return false
 	}
 
@@ -47,35 +46,8 @@ func (node *WebRTC_CDN_Node) AddIP(ip string) bool {
 }
 
 // Checks if an IP is exempted from the limit
-func (node *WebRTC_CDN_Node) isIPExempted(ipStr string) bool {
-	r := os.Getenv("CONCURRENT_LIMIT_WHITELIST")
-
-	if r == "" {
-		return false
-	}
-
-	if r == "*" {
-		return true
-	}
-
-	ip := net.ParseIP(ipStr)
-
-	parts := strings.Split(r, ",")
-
-	for i := 0; i < len(parts); i++ {
-		_, rang, e := net.ParseCIDR(parts[i])
-
-		if e != nil {
-			LogError(e)
-			continue
-		}
-
-		if rang.Contains(ip) {
-			return true
-		}
-	}
-
-	return false
+func (node *WebRTC_CDN_Node) isIPExempted(ip string) bool {
+	return node.getConfig().Limits.isIPExempted(ip)
 }
 
 // Removes an IP from the list
@@ -98,34 +70,19 @@ func (node *WebRTC_CDN_Node) runHTTPSecureServer(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	bind_addr := os.Getenv("BIND_ADDRESS")
+	bind_addr := node.getConfig().HTTP.BindAddress
 
 	// Setup HTTPS server
-	var port int
-	port = 443
-	customSSLPort := os.Getenv("SSL_PORT")
-	if customSSLPort != "" {
-		sslp, e := strconv.Atoi(customSSLPort)
-		if e == nil {
-			port = sslp
-		}
-	}
+	port := node.getConfig().HTTP.SSLPort
 
-	certFile := os.Getenv("SSL_CERT")
-	keyFile := os.Getenv("SSL_KEY")
+	certFile := node.getConfig().HTTP.SSLCert
+	keyFile := node.getConfig().HTTP.SSLKey
 
 	if certFile == "" || keyFile == "" {
 		return
 	}
 
-	var sslReloadSeconds = 60
-	customSslReloadSeconds := os.Getenv("SSL_CHECK_RELOAD_SECONDS")
-	if customSslReloadSeconds != "" {
-		n, e := strconv.Atoi(customSslReloadSeconds)
-		if e == nil {
-			sslReloadSeconds = n
-		}
-	}
+	sslReloadSeconds := node.getConfig().HTTP.SSLCheckReloadSeconds
 
 	certificateLoader, err := tls_certificate_loader.NewTlsCertificateLoader(tls_certificate_loader.TlsCertificateLoaderConfig{
 		CertificatePath:   certFile,
@@ -148,7 +105,7 @@ func (node *WebRTC_CDN_Node) runHTTPSecureServer(wg *sync.WaitGroup) {
 
 	// Setup HTTPS server
 
-	tlsServer := http.Server{
+	tlsServer := &http.Server{
 		Addr:    bind_addr + ":" + strconv.Itoa(port),
 		Handler: node,
 		TLSConfig: &tls.Config{
@@ -156,13 +113,17 @@ func (node *WebRTC_CDN_Node) runHTTPSecureServer(wg *sync.WaitGroup) {
 		},
 	}
 
+	if !node.addHTTPServer(tlsServer) {
+		return // Shutting down
+	}
+
 	// Listen
 
-	LogInfo("[SSL] Listening on " + bind_addr + ":" + strconv.Itoa(port))
+	getRootLogger().Info("Listening on "+bind_addr+":"+strconv.Itoa(port), "service", "https")
 
 	errSSL := tlsServer.ListenAndServeTLS("", "")
 
-	if errSSL != nil {
+	if errSSL != nil && errSSL != http.ErrServerClosed {
 		LogError(errSSL)
 	}
 }
@@ -173,24 +134,25 @@ func (node *WebRTC_CDN_Node) runHTTPServer(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	bind_addr := os.Getenv("BIND_ADDRESS")
+	bind_addr := node.getConfig().HTTP.BindAddress
 
 	// Setup HTTP server
-	var tcp_port int
-	tcp_port = 80
-	customTCPPort := os.Getenv("HTTP_PORT")
-	if customTCPPort != "" {
-		tcpp, e := strconv.Atoi(customTCPPort)
-		if e == nil {
-			tcp_port = tcpp
-		}
+	tcp_port := node.getConfig().HTTP.Port
+
+	server := &http.Server{
+		Addr:    bind_addr + ":" + strconv.Itoa(tcp_port),
+		Handler: node,
+	}
+
+	if !node.addHTTPServer(server) {
+		return // Shutting down
 	}
 
 	// Listen
-	LogInfo("[HTTP] Listening on " + bind_addr + ":" + strconv.Itoa(tcp_port))
-	errHTTP := http.ListenAndServe(bind_addr+":"+strconv.Itoa(tcp_port), node)
+	getRootLogger().Info("Listening on "+bind_addr+":"+strconv.Itoa(tcp_port), "service", "http")
+	errHTTP := server.ListenAndServe()
 
-	if errHTTP != nil {
+	if errHTTP != nil && errHTTP != http.ErrServerClosed {
 		LogError(errHTTP)
 	}
 }
@@ -210,10 +172,20 @@ func (node *WebRTC_CDN_Node) ServeHTTP(w http.ResponseWriter, req *http.Request)
 
 	LogRequest(reqId, ip, ""+req.Method+" "+req.RequestURI)
 
+	if node.isDraining() && isNewSessionRequest(req) {
+		// The node is shutting down, clients must connect to other node
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "The node is shutting down.")
+		LogRequest(reqId, ip, "Request rejected: The node is shutting down")
+		return
+	}
+
 	if req.URL.Path == "/ws" {
 		// Websocket signaling connection
 		if !node.isIPExempted(ip) {
 			if !node.AddIP(ip) {
+				metricRejectedRequests.WithLabelValues("ip_limit").Inc()
 				w.WriteHeader(429)
 				fmt.Fprintf(w, "Too many requests.")
 				LogRequest(reqId, ip, "Connection rejected: Too many requests")
@@ -245,6 +217,21 @@ func (node *WebRTC_CDN_Node) ServeHTTP(w http.ResponseWriter, req *http.Request)
 		node.mutexConnections.Unlock()
 
 		go handler.run()
+	} else if strings.HasPrefix(req.URL.Path, WHIP_PATH_PREFIX) {
+		// WHIP ingest
+		node.handleWHIP(w, req, reqId, ip)
+	} else if strings.HasPrefix(req.URL.Path, WHEP_PATH_PREFIX) {
+		// WHEP playback
+		node.handleWHEP(w, req, reqId, ip)
+	} else if strings.HasPrefix(req.URL.Path, HLS_PATH_PREFIX) {
+		// HLS playback
+		node.handleHLS(w, req, reqId, ip)
+	} else if req.URL.Path == METRICS_PATH {
+		// Prometheus metrics
+		node.handleMetrics(w, req)
+	} else if strings.HasPrefix(req.URL.Path, ADMIN_API_PATH_PREFIX) {
+		// Admin API
+		node.handleAdminAPI(w, req, reqId, ip)
 	} else {
 		w.WriteHeader(200)
 		fmt.Fprintf(w, "WebRTC-CDN Signaling Server. Connect to /ws for signaling")
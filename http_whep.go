@@ -0,0 +1,439 @@
+// WHEP (WebRTC-HTTP egress protocol)
+// Allows viewers to play streams using HTTP for signaling
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Path prefix for the WHEP endpoints
+const WHEP_PATH_PREFIX = "/whep/"
+
+// Max time to wait for the tracks of the stream to be available
+const WHEP_TRACKS_WAIT_TIMEOUT = 10 * time.Second
+
+// Registers a WHEP sink, so it can be found later
+func (node *WebRTC_CDN_Node) addWHEPSink(sink *WRTC_Sink) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	node.whepSinks[sink.requestId] = sink
+}
+
+// Finds a WHEP sink by its resource ID
+func (node *WebRTC_CDN_Node) getWHEPSink(resourceId string) *WRTC_Sink {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	return node.whepSinks[resourceId]
+}
+
+// Removes a WHEP sink
+// The IP address of the client is released from the concurrent connections limit
+func (node *WebRTC_CDN_Node) removeWHEPSink(resourceId string) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	sink := node.whepSinks[resourceId]
+
+	if sink == nil {
+		return
+	}
+
+	delete(node.whepSinks, resourceId)
+
+	if sink.ipLimited {
+		node.RemoveIP(sink.ip)
+	}
+}
+
+// Called when tracks are available for a WHEP sink
+// Must be called with the status mutex locked
+func (sink *WRTC_Sink) onTracksReadyWHEP() {
+	if sink.peerConnection != nil {
+		// Already connected, switch to the new tracks
+		sink.replaceTracksWHEP()
+		return
+	}
+
+	if !sink.whepReady {
+		sink.whepReady = true
+		close(sink.whepReadyChan)
+	}
+}
+
+// Replaces the tracks being sent to a WHEP client
+// Must be called with the status mutex locked
+func (sink *WRTC_Sink) replaceTracksWHEP() {
+	var err error
+
+	if sink.rtpSenderVideo != nil {
+		if sink.localTrackVideo != nil {
+			err = sink.rtpSenderVideo.ReplaceTrack(sink.localTrackVideo)
+		} else {
+			err = sink.rtpSenderVideo.ReplaceTrack(nil)
+		}
+	}
+
+	if err == nil && sink.rtpSenderAudio != nil {
+		if sink.localTrackAudio != nil {
+			err = sink.rtpSenderAudio.ReplaceTrack(sink.localTrackAudio)
+		} else {
+			err = sink.rtpSenderAudio.ReplaceTrack(nil)
+		}
+	}
+
+	if err != nil {
+		// Incompatible tracks (different codecs)
+		// The client must request a new resource
+		sink.logger.Error(err)
+		go sink.reconnect()
+		return
+	}
+
+	if sink.rtpSenderVideo != nil && sink.localTrackVideo != nil {
+		go sink.startVideo()
+	}
+}
+
+// Creates the peer connection from an SDP offer sent by a WHEP client
+// Waits for the ICE gathering to complete and returns the SDP answer
+func (sink *WRTC_Sink) answerWHEP(offerSDP string, offerVideo bool, offerAudio bool) (string, error) {
+	peerConnection, gatherComplete, err := sink.startWHEP(offerSDP, offerVideo, offerAudio)
+	if err != nil {
+		return "", err
+	}
+
+	// The answer is sent with all the candidates
+	// The status mutex must not be locked while waiting, since the node notifies the sink with its own mutex locked
+	<-gatherComplete
+
+	sink.statusMutex.Lock()
+	defer sink.statusMutex.Unlock()
+
+	if sink.closed || sink.peerConnection != peerConnection {
+		return "", errors.New("the sink was closed")
+	}
+
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// Creates the peer connection from an SDP offer sent by a WHEP client
+// Returns a channel that is closed when the ICE gathering is completed
+func (sink *WRTC_Sink) startWHEP(offerSDP string, offerVideo bool, offerAudio bool) (*webrtc.PeerConnection, <-chan struct{}, error) {
+	sink.statusMutex.Lock()
+	defer sink.statusMutex.Unlock()
+
+	if sink.closed {
+		return nil, nil, errors.New("the sink was closed")
+	}
+
+	if !sink.hasVideo && !sink.hasAudio {
+		return nil, nil, errors.New("there are no tracks available for the stream")
+	}
+
+	peerConnectionConfig := loadWebRTCConfig(sink.node.getConfig()) // Load config
+
+	// Create a new PeerConnection
+	peerConnection, err := sink.node.webrtcAPI.NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sink.peerConnection = peerConnection
+
+	// Connection status handler
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			sink.logger.Debug("Sink disconnected")
+			sink.reconnect()
+		} else if state == webrtc.PeerConnectionStateConnected {
+			sink.logger.Debug("Sink connected")
+			sink.startVideo()
+		}
+	})
+
+	// Set the remote SessionDescription
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerSDP,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Include the audio track
+	if sink.hasAudio && offerAudio {
+		audioSender, err := peerConnection.AddTrack(sink.localTrackAudio)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sink.rtpSenderAudio = audioSender
+
+		go readPacketsFromRTPSender(audioSender)
+	}
+
+	// Include the video track
+	if sink.hasVideo && offerVideo {
+		videoSender, err := peerConnection.AddTrack(sink.localTrackVideo)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sink.rtpSenderVideo = videoSender
+
+		go sink.readVideoFeedback(videoSender)
+	}
+
+	// Create SDP answer
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	err = peerConnection.SetLocalDescription(answer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return peerConnection, gatherComplete, nil
+}
+
+// Adds ICE candidates received via trickle ICE (SDP fragment)
+func (sink *WRTC_Sink) onSDPFragment(fragment string) error {
+	sink.statusMutex.Lock()
+	defer sink.statusMutex.Unlock()
+
+	if sink.peerConnection == nil {
+		return errors.New("the sink is not connected")
+	}
+
+	var mid *string
+
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "a=mid:") {
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		} else if strings.HasPrefix(line, "a=candidate:") {
+			err := sink.peerConnection.AddICECandidate(webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Handles requests to the WHEP endpoints
+// POST /whep/{streamId} - Play
+// PATCH /whep/{streamId}/{resourceId} - Trickle ICE
+// DELETE /whep/{streamId}/{resourceId} - Stop
+func (node *WebRTC_CDN_Node) handleWHEP(w http.ResponseWriter, req *http.Request, reqId uint64, ip string) {
+	setSignalingCORSHeaders(w, "POST, PATCH, DELETE, OPTIONS")
+
+	streamId, resourceId, ok := splitHTTPSignalingPath(req, WHEP_PATH_PREFIX)
+
+	if !ok {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Not found.")
+		return
+	}
+
+	if req.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if resourceId == "" {
+		if req.Method != "POST" {
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "Method not allowed.")
+			return
+		}
+
+		node.handleWHEPPlay(w, req, reqId, ip, streamId)
+		return
+	}
+
+	sink := node.getWHEPSink(resourceId)
+
+	if sink == nil || sink.sid != streamId {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Resource not found.")
+		return
+	}
+
+	switch req.Method {
+	case "PATCH":
+		node.handleWHEPPatch(w, req, sink)
+	case "DELETE":
+		node.removeWHEPSink(resourceId)
+
+		sink.close()
+
+		sink.logger.Request("WHEP play ended", "connection_id", reqId)
+
+		w.WriteHeader(200)
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed.")
+	}
+}
+
+// Handles a WHEP play request
+func (node *WebRTC_CDN_Node) handleWHEPPlay(w http.ResponseWriter, req *http.Request, reqId uint64, ip string, streamId string) {
+	metricPlayRequests.WithLabelValues("whep").Inc()
+
+	// Each WHEP resource counts as a connection for the IP limit,
+	// until the resource is removed
+	ipLimited := !node.isIPExempted(ip)
+
+	if ipLimited {
+		if !node.AddIP(ip) {
+			metricRejectedRequests.WithLabelValues("ip_limit").Inc()
+			w.WriteHeader(429)
+			fmt.Fprintf(w, "Too many requests.")
+			return
+		}
+	}
+
+	ipReleased := false
+
+	defer func() {
+		if ipLimited && !ipReleased {
+			node.RemoveIP(ip)
+		}
+	}()
+
+	if !checkAuthentication(node.authKeyProvider.Load(), getBearerToken(req), "stream_play", streamId) {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Invalid authentication provided.")
+		return
+	}
+
+	offer, ok := readSDPBody(w, req)
+
+	if !ok {
+		return
+	}
+
+	offerVideo, offerAudio, err := getSDPMediaKinds(offer)
+
+	if err != nil || (!offerVideo && !offerAudio) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid SDP offer.")
+		return
+	}
+
+	resourceId, err := makeId(16)
+
+	if err != nil {
+		LogError(err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error.")
+		return
+	}
+
+	// Create sink
+	sink := WRTC_Sink{
+		sinkId:     node.getSinkID(),
+		requestId:  resourceId,
+		sid:        streamId,
+		node:       node,
+		connection: nil,
+		whep:       true,
+		ip:         ip,
+		ipLimited:  ipLimited,
+		layer:      req.URL.Query().Get("layer"),
+	}
+
+	sink.init()
+
+	node.addWHEPSink(&sink)
+
+	ipReleased = true // Released when the resource is removed
+
+	node.registerSink(&sink) // Register sink
+
+	// Wait for the tracks to be available
+
+	select {
+	case <-sink.whepReadyChan:
+	case <-time.After(WHEP_TRACKS_WAIT_TIMEOUT):
+		node.removeWHEPSink(resourceId)
+		sink.close()
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "The stream is not available.")
+		return
+	case <-req.Context().Done():
+		node.removeWHEPSink(resourceId)
+		sink.close()
+		return
+	}
+
+	answer, err := sink.answerWHEP(offer, offerVideo, offerAudio)
+
+	if err != nil {
+		LogError(err)
+		node.removeWHEPSink(resourceId)
+		sink.close()
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Could not process the SDP offer.")
+		return
+	}
+
+	sink.logger.Request("WHEP play started", "connection_id", reqId)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", WHEP_PATH_PREFIX+url.PathEscape(streamId)+"/"+resourceId)
+	w.WriteHeader(201)
+	fmt.Fprint(w, answer)
+}
+
+// Handles a WHEP trickle ICE request
+func (node *WebRTC_CDN_Node) handleWHEPPatch(w http.ResponseWriter, req *http.Request, sink *WRTC_Sink) {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+		w.WriteHeader(415)
+		fmt.Fprintf(w, "Content type must be application/trickle-ice-sdpfrag.")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, HTTP_SDP_SIZE_LIMIT))
+
+	if err != nil {
+		w.WriteHeader(413)
+		fmt.Fprintf(w, "Request body too large.")
+		return
+	}
+
+	err = sink.onSDPFragment(string(body))
+
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Could not process the SDP fragment: %s", err.Error())
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,312 @@
+// WHIP (WebRTC-HTTP ingestion protocol)
+// Allows broadcasters to publish using HTTP for signaling
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// Path prefix for the WHIP endpoints
+const WHIP_PATH_PREFIX = "/whip/"
+
+// Size limit for SDP bodies received via HTTP (64 kb)
+const HTTP_SDP_SIZE_LIMIT = 64 * 1024
+
+// Registers a WHIP source, so it can be removed later
+func (node *WebRTC_CDN_Node) addWHIPSource(source *WRTC_Source) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	node.whipSources[source.requestId] = source
+}
+
+// Finds a WHIP source by its resource ID
+func (node *WebRTC_CDN_Node) getWHIPSource(resourceId string) *WRTC_Source {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	return node.whipSources[resourceId]
+}
+
+// Removes a WHIP source
+// The IP address of the client is released from the concurrent connections limit
+func (node *WebRTC_CDN_Node) removeWHIPSource(resourceId string) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	source := node.whipSources[resourceId]
+
+	if source == nil {
+		return
+	}
+
+	delete(node.whipSources, resourceId)
+
+	if source.ipLimited {
+		node.RemoveIP(source.ip)
+	}
+}
+
+// Splits the path of a WHIP or WHEP request
+// Returns the stream ID and the resource ID (empty for the endpoint)
+func splitHTTPSignalingPath(req *http.Request, prefix string) (streamId string, resourceId string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), prefix), "/")
+
+	if len(parts) < 1 || len(parts) > 2 {
+		return "", "", false
+	}
+
+	streamId, err := url.PathUnescape(parts[0])
+
+	if err != nil || len(streamId) == 0 || len(streamId) > 255 {
+		return "", "", false
+	}
+
+	if len(parts) == 2 {
+		resourceId = parts[1]
+
+		if resourceId == "" {
+			return "", "", false
+		}
+	}
+
+	return streamId, resourceId, true
+}
+
+// Gets the bearer token from the Authorization header
+func getBearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+
+	if len(auth) > 7 && strings.EqualFold(auth[0:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	return ""
+}
+
+// Sets the CORS headers for the HTTP signaling endpoints
+func setSignalingCORSHeaders(w http.ResponseWriter, methods string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Link, ETag")
+}
+
+// Reads an SDP body from the request
+// Responds with an error and returns false if the body is not valid
+func readSDPBody(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/sdp") {
+		w.WriteHeader(415)
+		fmt.Fprintf(w, "Content type must be application/sdp.")
+		return "", false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, HTTP_SDP_SIZE_LIMIT))
+
+	if err != nil {
+		w.WriteHeader(413)
+		fmt.Fprintf(w, "Request body too large.")
+		return "", false
+	}
+
+	return string(body), true
+}
+
+// Checks the media kinds present in an SDP
+func getSDPMediaKinds(rawSDP string) (hasVideo bool, hasAudio bool, err error) {
+	parsed := sdp.SessionDescription{}
+
+	err = parsed.UnmarshalString(rawSDP)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		switch media.MediaName.Media {
+		case "video":
+			hasVideo = true
+		case "audio":
+			hasAudio = true
+		}
+	}
+
+	return hasVideo, hasAudio, nil
+}
+
+// Handles requests to the WHIP endpoints
+// POST /whip/{streamId} - Publish
+// DELETE /whip/{streamId}/{resourceId} - Unpublish
+func (node *WebRTC_CDN_Node) handleWHIP(w http.ResponseWriter, req *http.Request, reqId uint64, ip string) {
+	setSignalingCORSHeaders(w, "POST, DELETE, OPTIONS")
+
+	streamId, resourceId, ok := splitHTTPSignalingPath(req, WHIP_PATH_PREFIX)
+
+	if !ok {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Not found.")
+		return
+	}
+
+	if req.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if resourceId == "" {
+		if req.Method != "POST" {
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "Method not allowed.")
+			return
+		}
+
+		node.handleWHIPPublish(w, req, reqId, ip, streamId)
+	} else {
+		if req.Method != "DELETE" {
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "Method not allowed.")
+			return
+		}
+
+		node.handleWHIPDelete(w, reqId, ip, streamId, resourceId)
+	}
+}
+
+// Handles a WHIP publish request
+func (node *WebRTC_CDN_Node) handleWHIPPublish(w http.ResponseWriter, req *http.Request, reqId uint64, ip string, streamId string) {
+	metricPublishRequests.WithLabelValues("whip").Inc()
+
+	// Each WHIP resource counts as a connection for the IP limit,
+	// until the resource is removed
+	ipLimited := !node.isIPExempted(ip)
+
+	if ipLimited {
+		if !node.AddIP(ip) {
+			metricRejectedRequests.WithLabelValues("ip_limit").Inc()
+			w.WriteHeader(429)
+			fmt.Fprintf(w, "Too many requests.")
+			return
+		}
+	}
+
+	ipReleased := false
+
+	defer func() {
+		if ipLimited && !ipReleased {
+			node.RemoveIP(ip)
+		}
+	}()
+
+	validAuth, claims := checkAuthenticationClaims(node.authKeyProvider.Load(), getBearerToken(req), "stream_publish", streamId)
+
+	if !validAuth {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Invalid authentication provided.")
+		return
+	}
+
+	exclusive := isExclusivePublishing(&node.getConfig().Publishing, claims)
+	takeover := isPublishingTakeover(claims)
+
+	if !node.canPublish(streamId, exclusive, takeover) {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "The stream is already being published.")
+		return
+	}
+
+	offer, ok := readSDPBody(w, req)
+
+	if !ok {
+		return
+	}
+
+	hasVideo, hasAudio, err := getSDPMediaKinds(offer)
+
+	if err != nil || (!hasVideo && !hasAudio) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid SDP offer.")
+		return
+	}
+
+	resourceId, err := makeId(16)
+
+	if err != nil {
+		LogError(err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error.")
+		return
+	}
+
+	// Create source
+	source := WRTC_Source{
+		requestId:  resourceId,
+		sid:        streamId,
+		node:       node,
+		hasAudio:   hasAudio,
+		hasVideo:   hasVideo,
+		connection: nil,
+		exclusive:  exclusive,
+		takeover:   takeover,
+		record:     isRecordingEnabled(&node.getConfig().Recording, claims),
+		ip:         ip,
+		ipLimited:  ipLimited,
+	}
+
+	source.init()
+
+	answer, err := source.runWHIP(offer)
+
+	if err != nil {
+		LogError(err)
+		source.close(false, false)
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Could not process the SDP offer.")
+		return
+	}
+
+	node.addWHIPSource(&source)
+
+	ipReleased = true // Released when the resource is removed
+
+	// Register source
+	if !node.registerSource(&source) {
+		node.removeWHIPSource(resourceId)
+		source.close(false, false)
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "The stream is already being published.")
+		return
+	}
+
+	source.logger.Request("WHIP publish started", "connection_id", reqId)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", WHIP_PATH_PREFIX+url.PathEscape(streamId)+"/"+resourceId)
+	w.WriteHeader(201)
+	fmt.Fprint(w, answer)
+}
+
+// Handles a WHIP delete request
+func (node *WebRTC_CDN_Node) handleWHIPDelete(w http.ResponseWriter, reqId uint64, ip string, streamId string, resourceId string) {
+	source := node.getWHIPSource(resourceId)
+
+	if source == nil || source.sid != streamId {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Resource not found.")
+		return
+	}
+
+	node.removeWHIPSource(resourceId)
+
+	source.close(false, true)
+
+	source.logger.Request("WHIP publish ended", "connection_id", reqId)
+
+	w.WriteHeader(200)
+}
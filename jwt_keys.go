@@ -0,0 +1,468 @@
+// JWT verification keys
+// Supports HMAC secrets, public keys (RSA, ECDSA, Ed25519)
+// loaded from PEM files and JSON Web Key Sets (JWKS)
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Default period to refresh the JWKS
+const JWKS_DEFAULT_REFRESH_SECONDS = 300
+
+// Min time between JWKS refreshes triggered by unknown key IDs
+const JWKS_MIN_REFRESH_INTERVAL = 10 * time.Second
+
+// Timeout for the JWKS HTTP requests
+const JWKS_REQUEST_TIMEOUT = 10 * time.Second
+
+// Max size of a JWKS document (1 MB)
+const JWKS_SIZE_LIMIT = 1024 * 1024
+
+// JWTKeyProvider - Provides the keys to verify
+// the JSON web tokens used for authentication
+type JWTKeyProvider struct {
+	hmacSecret []byte // Secret for HMAC algorithms
+
+	staticKeys map[string]interface{} // Public keys loaded from files, by key ID
+
+	jwksURL         string                 // URL of the JWKS
+	jwksRefresh     time.Duration          // Period to refresh the JWKS
+	jwksKeys        map[string]interface{} // Public keys loaded from the JWKS, by key ID
+	jwksLastRefresh time.Time              // Last time the JWKS was loaded
+
+	mutex *sync.Mutex // Mutex to control access to the keys
+
+	closed     chan struct{} // Closed when the provider is replaced
+	closedOnce *sync.Once    // Ensures the channel is only closed once
+}
+
+// Public key in JWK format
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JSON Web Key Set
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Loads the JWT key provider from the configuration
+// jwt_secret - HMAC secret
+// jwt_public_keys - List of PEM files. The key ID is the file name without extension.
+// jwks_url - URL to load a JSON Web Key Set
+func loadJWTKeyProvider(config *AuthConfig) (*JWTKeyProvider, error) {
+	provider := &JWTKeyProvider{
+		staticKeys:  make(map[string]interface{}),
+		jwksURL:     config.JWKSURL,
+		jwksRefresh: time.Duration(config.JWKSRefreshSeconds) * time.Second,
+		jwksKeys:    make(map[string]interface{}),
+		mutex:       &sync.Mutex{},
+		closed:      make(chan struct{}),
+		closedOnce:  &sync.Once{},
+	}
+
+	if config.JWTSecret != "" {
+		provider.hmacSecret = []byte(config.JWTSecret)
+	}
+
+	for _, file := range config.JWTPublicKeys {
+		key, err := loadPublicKeyFile(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not load public key %v: %v", file, err)
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+		provider.staticKeys[kid] = key
+	}
+
+	if provider.jwksURL != "" {
+		err := provider.refreshJWKS()
+
+		if err != nil {
+			// Not fatal, the JWKS may be available later
+			LogWarning("Could not load JWKS from " + provider.jwksURL + ": " + err.Error())
+		}
+	}
+
+	return provider, nil
+}
+
+// Returns true if there are keys configured, so authentication is required
+func (provider *JWTKeyProvider) isAuthenticationRequired() bool {
+	return len(provider.hmacSecret) > 0 || len(provider.staticKeys) > 0 || provider.jwksURL != ""
+}
+
+// Starts refreshing the JWKS periodically
+func (provider *JWTKeyProvider) runJWKSRefresh() {
+	if provider.jwksURL == "" {
+		return
+	}
+
+	ticker := time.NewTicker(provider.jwksRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-provider.closed:
+			return
+		}
+
+		err := provider.refreshJWKS()
+
+		if err != nil {
+			LogWarning("Could not refresh JWKS from " + provider.jwksURL + ": " + err.Error())
+		}
+	}
+}
+
+// Stops refreshing the JWKS
+// Called when the provider is replaced after reloading the configuration
+func (provider *JWTKeyProvider) close() {
+	provider.closedOnce.Do(func() {
+		close(provider.closed)
+	})
+}
+
+// Loads the JWKS from the URL and replaces the cached keys
+func (provider *JWTKeyProvider) refreshJWKS() error {
+	provider.mutex.Lock()
+	provider.jwksLastRefresh = time.Now()
+	provider.mutex.Unlock()
+
+	return provider.loadJWKS()
+}
+
+// Requests the JWKS and replaces the cached keys
+// Does not update the time of the last refresh
+func (provider *JWTKeyProvider) loadJWKS() error {
+	client := http.Client{
+		Timeout: JWKS_REQUEST_TIMEOUT,
+	}
+
+	res, err := client.Get(provider.jwksURL)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return errors.New("unexpected status code: " + strconv.Itoa(res.StatusCode))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, JWKS_SIZE_LIMIT))
+
+	if err != nil {
+		return err
+	}
+
+	keySet := jsonWebKeySet{}
+
+	err = json.Unmarshal(body, &keySet)
+
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.toPublicKey()
+
+		if err != nil {
+			LogWarning("Ignored key '" + jwk.Kid + "' from JWKS: " + err.Error())
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	provider.mutex.Lock()
+	provider.jwksKeys = keys
+	provider.mutex.Unlock()
+
+	LogDebug("Loaded " + strconv.Itoa(len(keys)) + " keys from JWKS " + provider.jwksURL)
+
+	return nil
+}
+
+// Finds the keys to verify a token
+// Implements jwt.Keyfunc
+func (provider *JWTKeyProvider) getVerificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(provider.hmacSecret) == 0 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return provider.hmacSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	if kid != "" {
+		key := provider.findKey(kid)
+
+		if key == nil && provider.jwksURL != "" && provider.tryStartJWKSRefresh() {
+			// Unknown key, maybe it was rotated
+			err := provider.loadJWKS()
+
+			if err != nil {
+				LogWarning("Could not refresh JWKS from " + provider.jwksURL + ": " + err.Error())
+			}
+
+			key = provider.findKey(kid)
+		}
+
+		if key == nil {
+			return nil, fmt.Errorf("unknown key ID: %v", kid)
+		}
+
+		if !isKeyValidForMethod(key, token.Method) {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key, nil
+	}
+
+	// No key ID, try every key compatible with the algorithm
+
+	keySet := jwt.VerificationKeySet{
+		Keys: make([]jwt.VerificationKey, 0),
+	}
+
+	for _, key := range provider.getAllKeys() {
+		if isKeyValidForMethod(key, token.Method) {
+			keySet.Keys = append(keySet.Keys, key)
+		}
+	}
+
+	if len(keySet.Keys) == 0 {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return keySet, nil
+}
+
+// Finds a public key by its ID
+func (provider *JWTKeyProvider) findKey(kid string) interface{} {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if provider.staticKeys[kid] != nil {
+		return provider.staticKeys[kid]
+	}
+
+	return provider.jwksKeys[kid]
+}
+
+// Gets all the public keys
+func (provider *JWTKeyProvider) getAllKeys() []interface{} {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	keys := make([]interface{}, 0, len(provider.staticKeys)+len(provider.jwksKeys))
+
+	for _, key := range provider.staticKeys {
+		keys = append(keys, key)
+	}
+
+	for _, key := range provider.jwksKeys {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Checks if the JWKS can be refreshed on demand (rate limited)
+// If it can, the time of the last refresh is updated under the same lock,
+// so concurrent requests with unknown keys start a single refresh
+func (provider *JWTKeyProvider) tryStartJWKSRefresh() bool {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if time.Since(provider.jwksLastRefresh) < JWKS_MIN_REFRESH_INTERVAL {
+		return false
+	}
+
+	provider.jwksLastRefresh = time.Now()
+
+	return true
+}
+
+// Checks if a key can be used with a signing method
+func isKeyValidForMethod(key interface{}, method jwt.SigningMethod) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		_, isRSA := method.(*jwt.SigningMethodRSA)
+		_, isRSAPSS := method.(*jwt.SigningMethodRSAPSS)
+		return isRSA || isRSAPSS
+	case *ecdsa.PublicKey:
+		_, ok := method.(*jwt.SigningMethodECDSA)
+		return ok
+	case ed25519.PublicKey:
+		_, ok := method.(*jwt.SigningMethodEd25519)
+		return ok
+	default:
+		return false
+	}
+}
+
+// Loads a public key from a PEM file
+// Supports PKIX public keys, PKCS1 RSA public keys and certificates
+func loadPublicKeyFile(file string) (interface{}, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, errors.New("invalid PEM file")
+	}
+
+	var key interface{}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, errors.New("unsupported PEM block type: " + block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+}
+
+// Decodes a base64url encoded big integer
+func decodeJWKInteger(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Converts a JWK into a public key
+func (jwk *jsonWebKey) toPublicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeJWKInteger(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeJWKInteger(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() || e.Int64() > int64(^uint32(0)>>1) {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve: " + jwk.Crv)
+		}
+
+		x, err := decodeJWKInteger(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeJWKInteger(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve: " + jwk.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errors.New("unsupported key type: " + jwk.Kty)
+	}
+}
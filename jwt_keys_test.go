@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Keys used to sign the test tokens
+type testJWTKeys struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestJWTKeys(t *testing.T) *testJWTKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testJWTKeys{
+		rsa:     rsaKey,
+		ecdsa:   ecKey,
+		ed25519: edKey,
+	}
+}
+
+// Writes a PEM file in the directory
+func writeTestPEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	file := filepath.Join(dir, name+".pem")
+
+	err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// Writes a public key in PKIX format
+func writeTestPublicKey(t *testing.T, dir string, name string, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeTestPEM(t, dir, name, "PUBLIC KEY", der)
+}
+
+// Signs a token for the test stream
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"sub": "play",
+		"sid": "test",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+// Converts a public key to JWK
+func toTestJWK(kid string, key crypto.PublicKey) jsonWebKey {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{Kid: kid, Kty: "RSA", Use: "sig", N: encode(k.N.Bytes()), E: encode([]byte{1, 0, 1})}
+	case *ecdsa.PublicKey:
+		return jsonWebKey{Kid: kid, Kty: "EC", Crv: "P-256", X: encode(k.X.FillBytes(make([]byte, 32))), Y: encode(k.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return jsonWebKey{Kid: kid, Kty: "OKP", Crv: "Ed25519", X: encode(k)}
+	default:
+		return jsonWebKey{Kid: kid}
+	}
+}
+
+// JWKS server for the tests
+type testJWKSServer struct {
+	server   *httptest.Server
+	requests atomic.Int32 // Number of requests received
+
+	mutex *sync.Mutex
+	keys  []jsonWebKey // Keys served
+}
+
+func newTestJWKSServer(t *testing.T, keys ...jsonWebKey) *testJWKSServer {
+	s := &testJWKSServer{
+		mutex: &sync.Mutex{},
+		keys:  keys,
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.requests.Add(1)
+
+		s.mutex.Lock()
+		keySet := jsonWebKeySet{Keys: s.keys}
+		s.mutex.Unlock()
+
+		json.NewEncoder(w).Encode(keySet)
+	}))
+
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+func (s *testJWKSServer) setKeys(keys ...jsonWebKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys = keys
+}
+
+func TestJWTPublicKeyFiles(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	dir := t.TempDir()
+
+	certTemplate := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	certDER, err := x509.CreateCertificate(rand.Reader, certTemplate, certTemplate, keys.ecdsa.Public(), keys.ecdsa)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := loadJWTKeyProvider(&AuthConfig{
+		JWTPublicKeys: []string{
+			writeTestPublicKey(t, dir, "rsa", keys.rsa.Public()),
+			writeTestPEM(t, dir, "rsa-pkcs1", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey)),
+			writeTestPublicKey(t, dir, "ec", keys.ecdsa.Public()),
+			writeTestPEM(t, dir, "ec-cert", "CERTIFICATE", certDER),
+			writeTestPublicKey(t, dir, "ed", keys.ed25519.Public()),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method jwt.SigningMethod
+		kid    string
+		key    interface{}
+		valid  bool
+	}{
+		{"RS256", jwt.SigningMethodRS256, "rsa", keys.rsa, true},
+		{"RS256 PKCS1", jwt.SigningMethodRS256, "rsa-pkcs1", keys.rsa, true},
+		{"PS256", jwt.SigningMethodPS256, "rsa", keys.rsa, true},
+		{"ES256", jwt.SigningMethodES256, "ec", keys.ecdsa, true},
+		{"ES256 certificate", jwt.SigningMethodES256, "ec-cert", keys.ecdsa, true},
+		{"EdDSA", jwt.SigningMethodEdDSA, "ed", keys.ed25519, true},
+		{"without key ID", jwt.SigningMethodES256, "", keys.ecdsa, true},
+		{"unknown key ID", jwt.SigningMethodRS256, "other", keys.rsa, false},
+		{"RS256 with an EC key ID", jwt.SigningMethodRS256, "ec", keys.rsa, false},
+		{"ES256 with an RSA key ID", jwt.SigningMethodES256, "rsa", keys.ecdsa, false},
+		{"EdDSA with an EC key ID", jwt.SigningMethodEdDSA, "ec", keys.ed25519, false},
+		{"HMAC without secret", jwt.SigningMethodHS256, "rsa", x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey), false},
+		{"HMAC without secret or key ID", jwt.SigningMethodHS256, "", []byte("secret"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			valid, _ := parseAuthentication(provider, signTestToken(t, c.method, c.kid, c.key), "play", "test")
+
+			if valid != c.valid {
+				t.Fatalf("expected valid=%v, got valid=%v", c.valid, valid)
+			}
+		})
+	}
+}
+
+func TestJWTPublicKeyFilesInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a PEM file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{
+		invalid,
+		writeTestPEM(t, dir, "private", "PRIVATE KEY", []byte{1, 2, 3}),
+		writeTestPEM(t, dir, "corrupted", "PUBLIC KEY", []byte{1, 2, 3}),
+		filepath.Join(dir, "missing.pem"),
+	}
+
+	for _, file := range files {
+		if _, err := loadJWTKeyProvider(&AuthConfig{JWTPublicKeys: []string{file}}); err == nil {
+			t.Errorf("expected an error loading %s", filepath.Base(file))
+		}
+	}
+}
+
+func TestJWTSecret(t *testing.T) {
+	keys := newTestJWTKeys(t)
+
+	provider, err := loadJWTKeyProvider(&AuthConfig{JWTSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if valid, _ := parseAuthentication(provider, signTestToken(t, jwt.SigningMethodHS256, "", []byte("secret")), "play", "test"); !valid {
+		t.Error("expected the HMAC token to be valid")
+	}
+
+	if valid, _ := parseAuthentication(provider, signTestToken(t, jwt.SigningMethodHS256, "", []byte("other")), "play", "test"); valid {
+		t.Error("expected the token signed with another secret to be invalid")
+	}
+
+	if valid, _ := parseAuthentication(provider, signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa), "play", "test"); valid {
+		t.Error("expected the RS256 token to be invalid without public keys")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	rotatedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestJWKSServer(t,
+		toTestJWK("rsa", keys.rsa.Public()),
+		toTestJWK("ec", keys.ecdsa.Public()),
+		toTestJWK("ed", keys.ed25519.Public()),
+		jsonWebKey{Kid: "enc", Kty: "RSA", Use: "enc"},
+		jsonWebKey{Kid: "unsupported", Kty: "oct"},
+	)
+
+	provider, err := loadJWTKeyProvider(&AuthConfig{
+		JWKSURL:            server.server.URL,
+		JWKSRefreshSeconds: JWKS_DEFAULT_REFRESH_SECONDS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := server.requests.Load(); n != 1 {
+		t.Fatalf("expected the JWKS to be loaded once, got %d requests", n)
+	}
+
+	check := func(name string, token string, expected bool) {
+		t.Helper()
+
+		if valid, _ := parseAuthentication(provider, token, "play", "test"); valid != expected {
+			t.Fatalf("%s: expected valid=%v, got valid=%v", name, expected, valid)
+		}
+	}
+
+	check("RS256", signTestToken(t, jwt.SigningMethodRS256, "rsa", keys.rsa), true)
+	check("ES256", signTestToken(t, jwt.SigningMethodES256, "ec", keys.ecdsa), true)
+	check("EdDSA", signTestToken(t, jwt.SigningMethodEdDSA, "ed", keys.ed25519), true)
+	check("RS256 with an EC key ID", signTestToken(t, jwt.SigningMethodRS256, "ec", keys.rsa), false)
+	check("ES256 with an Ed25519 key ID", signTestToken(t, jwt.SigningMethodES256, "ed", keys.ecdsa), false)
+	check("HMAC with an RSA key ID", signTestToken(t, jwt.SigningMethodHS256, "rsa", x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey)), false)
+
+	// The key is rotated
+	server.setKeys(toTestJWK("rotated", rotatedKey.Public()))
+
+	rotatedToken := signTestToken(t, jwt.SigningMethodRS256, "rotated", rotatedKey)
+
+	// Just loaded, the unknown key ID does not trigger a refresh
+	check("rotated key (rate limited)", rotatedToken, false)
+
+	if n := server.requests.Load(); n != 1 {
+		t.Fatalf("expected the refresh to be rate limited, got %d requests", n)
+	}
+
+	// After the min interval, the unknown key ID triggers a refresh
+	provider.mutex.Lock()
+	provider.jwksLastRefresh = time.Now().Add(-JWKS_MIN_REFRESH_INTERVAL)
+	provider.mutex.Unlock()
+
+	check("rotated key", rotatedToken, true)
+
+	if n := server.requests.Load(); n != 2 {
+		t.Fatalf("expected the unknown key ID to refresh the JWKS, got %d requests", n)
+	}
+
+	check("removed key", signTestToken(t, jwt.SigningMethodRS256, "rsa", keys.rsa), false)
+	check("unknown key ID", signTestToken(t, jwt.SigningMethodRS256, "other", rotatedKey), false)
+
+	if n := server.requests.Load(); n != 2 {
+		t.Fatalf("expected the refreshes to be rate limited, got %d requests", n)
+	}
+}
+
+func TestJWKSConcurrentRefresh(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestJWKSServer(t)
+
+	provider, err := loadJWTKeyProvider(&AuthConfig{
+		JWKSURL:            server.server.URL,
+		JWKSRefreshSeconds: JWKS_DEFAULT_REFRESH_SECONDS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.setKeys(toTestJWK("new", key.Public()))
+
+	provider.mutex.Lock()
+	provider.jwksLastRefresh = time.Time{}
+	provider.mutex.Unlock()
+
+	token := signTestToken(t, jwt.SigningMethodRS256, "other", key)
+
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parseAuthentication(provider, token, "play", "test")
+		}()
+	}
+
+	wg.Wait()
+
+	if n := server.requests.Load(); n != 2 {
+		t.Fatalf("expected a single refresh for concurrent requests, got %d requests", n)
+	}
+}
+
+func TestJWKToPublicKey(t *testing.T) {
+	keys := newTestJWTKeys(t)
+
+	ecJWK := toTestJWK("ec", keys.ecdsa.Public())
+	offCurve := ecJWK
+	offCurve.Y = ecJWK.X
+
+	cases := []struct {
+		name  string
+		jwk   jsonWebKey
+		valid bool
+	}{
+		{"RSA", toTestJWK("rsa", keys.rsa.Public()), true},
+		{"EC", ecJWK, true},
+		{"Ed25519", toTestJWK("ed", keys.ed25519.Public()), true},
+		{"EC point not on the curve", offCurve, false},
+		{"unsupported curve", jsonWebKey{Kty: "EC", Crv: "secp256k1"}, false},
+		{"unsupported OKP curve", jsonWebKey{Kty: "OKP", Crv: "X25519", X: ecJWK.X}, false},
+		{"invalid Ed25519 size", jsonWebKey{Kty: "OKP", Crv: "Ed25519", X: ecJWK.X[:10]}, false},
+		{"invalid RSA encoding", jsonWebKey{Kty: "RSA", N: "!", E: "AQAB"}, false},
+		{"invalid RSA exponent", jsonWebKey{Kty: "RSA", N: "AQAB", E: "AQAAAAAAAAAA"}, false},
+		{"unsupported key type", jsonWebKey{Kty: "oct"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := c.jwk.toPublicKey()
+
+			if c.valid && err != nil {
+				t.Fatal(err)
+			}
+
+			if !c.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+// Keyframe detection and keyframe requests
+
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Checks if an RTP payload starts a keyframe
+// Supported codecs: VP8, VP9 and H264
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isKeyframeVP8(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isKeyframeVP9(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isKeyframeH264(payload)
+	default:
+		return false
+	}
+}
+
+// Checks for a VP8 keyframe (RFC 7741)
+func isKeyframeVP8(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	// Payload descriptor
+	// Only the first partition of the frame contains the frame header
+	startOfPartition := payload[0]&0x10 != 0
+	partitionIndex := payload[0] & 0x07
+
+	if !startOfPartition || partitionIndex != 0 {
+		return false
+	}
+
+	offset := 1
+
+	if payload[0]&0x80 != 0 {
+		// Extended control bits
+		if len(payload) <= offset {
+			return false
+		}
+
+		ext := payload[offset]
+		offset++
+
+		if ext&0x80 != 0 {
+			// Picture ID (7 or 15 bits)
+			if len(payload) <= offset {
+				return false
+			}
+
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+
+		if ext&0x40 != 0 {
+			offset++ // TL0PICIDX
+		}
+
+		if ext&0x30 != 0 {
+			offset++ // TID / KEYIDX
+		}
+	}
+
+	if len(payload) <= offset {
+		return false
+	}
+
+	// Payload header, the P bit is 0 for keyframes
+	return payload[offset]&0x01 == 0
+}
+
+// Checks for a VP9 keyframe (RFC 9628)
+func isKeyframeVP9(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	interPicturePredicted := payload[0]&0x40 != 0
+	startOfFrame := payload[0]&0x08 != 0
+
+	return !interPicturePredicted && startOfFrame
+}
+
+// Checks for an H264 IDR picture or parameter sets (RFC 6184)
+func isKeyframeH264(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	naluType := payload[0] & 0x1F
+
+	switch naluType {
+	case 5, 7: // IDR, SPS
+		return true
+	case 24: // STAP-A
+		offset := 1
+
+		for offset+2 < len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+
+			if size == 0 || offset+size > len(payload) {
+				return false
+			}
+
+			t := payload[offset] & 0x1F
+
+			if t == 5 || t == 7 {
+				return true
+			}
+
+			offset += size
+		}
+
+		return false
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return false
+		}
+
+		start := payload[1]&0x80 != 0
+
+		return start && payload[1]&0x1F == 5
+	default:
+		return false
+	}
+}
+
+// Min time between keyframe requests sent to a publisher
+// Requests received during this time are aggregated into a single one
+const KEYFRAME_REQUEST_MIN_INTERVAL = 500 * time.Millisecond
+
+// KeyframeRequester - Sends keyframe requests to the publisher of a video track,
+// aggregating and rate limiting the requests of the receivers
+type KeyframeRequester struct {
+	mutex *sync.Mutex
+
+	send func() // Sends the request (PLI) to the publisher
+
+	lastSent time.Time // Last time a request was sent
+	pending  bool      // True if a request is scheduled
+	closed   bool      // True if the track is closed
+}
+
+// Creates a keyframe requester
+func newKeyframeRequester(send func()) *KeyframeRequester {
+	return &KeyframeRequester{
+		mutex: &sync.Mutex{},
+		send:  send,
+	}
+}
+
+// Requests a keyframe
+// If a request was recently sent, it's delayed until the min interval passes
+func (r *KeyframeRequester) request() {
+	r.mutex.Lock()
+
+	if r.closed || r.pending {
+		r.mutex.Unlock()
+		return // Already scheduled
+	}
+
+	wait := KEYFRAME_REQUEST_MIN_INTERVAL - time.Since(r.lastSent)
+
+	if wait > 0 {
+		r.pending = true
+		r.mutex.Unlock()
+
+		time.AfterFunc(wait, r.sendPending)
+		return
+	}
+
+	r.lastSent = time.Now()
+
+	r.mutex.Unlock()
+
+	r.send()
+}
+
+// Sends a delayed request
+func (r *KeyframeRequester) sendPending() {
+	r.mutex.Lock()
+
+	r.pending = false
+
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+
+	r.lastSent = time.Now()
+
+	r.mutex.Unlock()
+
+	r.send()
+}
+
+// Stops sending requests
+func (r *KeyframeRequester) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+}
+
+// Creates a function to send PLI packets
+// for a remote track using a peer connection
+func makePLISender(peerConnection *webrtc.PeerConnection, remoteTrack *webrtc.TrackRemote) func() {
+	return func() {
+		err := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}})
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			LogDebug("Could not send PLI: " + err.Error())
+		}
+	}
+}
+
+// Checks if a list of RTCP packets contains a keyframe request (PLI or FIR)
+func hasKeyframeRequest(packets []rtcp.Packet) bool {
+	for _, packet := range packets {
+		switch packet.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			return true
+		}
+	}
+
+	return false
+}
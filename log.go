@@ -3,63 +3,160 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
 	"os"
-	"strconv"
-	"sync"
-	"time"
+	"strings"
+	"sync/atomic"
 )
 
-var LOG_MUTEX = sync.Mutex{}
-var LOG_REQUESTS_ENABLED = true
-var LOG_DEBUG_ENABLED = false
+// True to log the requests
+var logRequestsEnabled atomic.Bool
+
+// Minimum level of the messages, shared by all the loggers
+var logLevel = &slog.LevelVar{}
+
+// Root logger, with the fields common to all the messages
+var rootLogger atomic.Pointer[Logger]
+
+// Logger - Structured logger with contextual fields
+type Logger struct {
+	logger *slog.Logger
+}
 
 // Loads log configuration
-func InitLog() {
-	LOG_REQUESTS_ENABLED = (os.Getenv("LOG_REQUESTS") != "NO")
-	LOG_DEBUG_ENABLED = os.Getenv("LOG_DEBUG") == "YES"
+func InitLog(config *LogConfig) {
+	SetLogLevel(config)
+
+	rootLogger.Store(&Logger{
+		logger: slog.New(createLogHandler(config.Format, logLevel)),
+	})
+}
+
+// Sets the minimum log level and enables or disables the request logs
+// Applied to all the loggers, including the ones already created
+func SetLogLevel(config *LogConfig) {
+	logRequestsEnabled.Store(config.Requests)
+
+	level := parseLogLevel(config.Level)
+
+	if config.Debug {
+		level = slog.LevelDebug
+	}
+
+	logLevel.Set(level)
+}
+
+// Parses the minimum log level (info by default)
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Creates the handler for the log format (text by default)
+func createLogHandler(format string, level slog.Leveler) slog.Handler {
+	options := &slog.HandlerOptions{
+		Level: level,
+	}
+
+	if strings.ToLower(format) == "json" {
+		return slog.NewJSONHandler(os.Stdout, options)
+	}
+
+	return slog.NewTextHandler(os.Stdout, options)
 }
 
-// Logs a message, including the date and time
-func LogLine(line string) {
-	tm := time.Now()
-	LOG_MUTEX.Lock()
-	defer LOG_MUTEX.Unlock()
-	fmt.Printf("[%s] %s\n", tm.Format("2006-01-02 15:04:05"), line)
+// Gets the root logger
+func getRootLogger() *Logger {
+	logger := rootLogger.Load()
+
+	if logger == nil {
+		// Not initialized, use the default configuration
+		logger = &Logger{
+			logger: slog.New(createLogHandler("text", logLevel)),
+		}
+
+		if !rootLogger.CompareAndSwap(nil, logger) {
+			logger = rootLogger.Load()
+		}
+	}
+
+	return logger
+}
+
+// Sets the node ID, included in all the messages
+func SetLogNodeId(nodeId string) {
+	rootLogger.Store(getRootLogger().With("node_id", nodeId))
+}
+
+// Creates a logger including additional fields
+// The arguments are key-value pairs
+func (logger *Logger) With(args ...any) *Logger {
+	return &Logger{
+		logger: logger.logger.With(args...),
+	}
+}
+
+// Logs a warning message
+func (logger *Logger) Warning(msg string, args ...any) {
+	logger.logger.Warn(msg, args...)
+}
+
+// Logs an info message
+func (logger *Logger) Info(msg string, args ...any) {
+	logger.logger.Info(msg, args...)
+}
+
+// Logs an error
+func (logger *Logger) Error(err error, args ...any) {
+	logger.logger.Error(err.Error(), args...)
+}
+
+// Logs a request message
+func (logger *Logger) Request(msg string, args ...any) {
+	if logRequestsEnabled.Load() {
+		logger.logger.Info(msg, args...)
+	}
+}
+
+// Logs a debug message
+func (logger *Logger) Debug(msg string, args ...any) {
+	logger.logger.Debug(msg, args...)
 }
 
 // Logs a warning message
 func LogWarning(line string) {
-	LogLine("[WARNING] " + line)
+	getRootLogger().Warning(line)
 }
 
 // Logs an info message
 func LogInfo(line string) {
-	LogLine("[INFO] " + line)
+	getRootLogger().Info(line)
 }
 
 // Logs an error message
 func LogError(err error) {
-	LogLine("[ERROR] " + err.Error())
+	getRootLogger().Error(err)
 }
 
 // Logs a request message
 func LogRequest(session_id uint64, ip string, line string) {
-	if LOG_REQUESTS_ENABLED {
-		LogLine("[REQUEST] #" + strconv.Itoa(int(session_id)) + " (" + ip + ") " + line)
-	}
+	getRootLogger().Request(line, "connection_id", session_id, "ip", ip)
 }
 
 // Logs a debug message
 func LogDebug(line string) {
-	if LOG_DEBUG_ENABLED {
-		LogLine("[DEBUG] " + line)
-	}
+	getRootLogger().Debug(line)
 }
 
 // Logs a debug message for a session
 func LogDebugSession(session_id uint64, ip string, line string) {
-	if LOG_DEBUG_ENABLED {
-		LogLine("[DEBUG] #" + strconv.Itoa(int(session_id)) + " (" + ip + ") " + line)
-	}
+	getRootLogger().Debug(line, "connection_id", session_id, "ip", ip)
 }
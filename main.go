@@ -5,6 +5,11 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 )
@@ -24,7 +29,33 @@ const VERSION = "1.0.0"
 func main() {
 	godotenv.Load() // Load env vars
 
-	InitLog()
+	// Command line options
+
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "Path to the YAML configuration file")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+
+	flag.Parse()
+
+	// Load configuration
+
+	config, err := loadConfig(*configFile)
+
+	if err == nil {
+		err = config.EmbeddedTURN.resolvePublicIP()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if *checkConfig {
+		fmt.Println("Configuration is valid")
+		return
+	}
+
+	InitLog(&config.Log)
 
 	LogInfo("Started WebRTC CDN - Version " + VERSION)
 
@@ -34,20 +65,61 @@ func main() {
 		LogError(err)
 	}
 
+	SetLogNodeId(nodeId)
+
 	LogInfo("Assigned node identifier: " + nodeId)
 
 	// Create Node service
 
 	node := WebRTC_CDN_Node{
-		id: nodeId,
+		id:         nodeId,
+		configFile: *configFile,
+	}
+
+	node.config.Store(config)
+
+	// Load authentication keys
+	err = node.initAuthentication(&config.Auth)
+
+	if err != nil {
+		LogError(err)
+		os.Exit(1)
 	}
 
 	// Init node
 	node.init()
+	node.initMetrics()
 
-	// Start redis listener
-	go setupRedisListener(&node)
+	// Start listening for messages from other nodes
+	go node.runMessageBusListener()
+	go node.runStreamRegistryWorker()
+	go node.runStreamRegistryRefresh()
+
+	// Graceful shutdown
+	go handleShutdownSignals(&node)
+
+	// Configuration reload
+	go handleReloadSignals(&node)
 
 	// Run
 	node.run()
 }
+
+// Waits for termination signals to shut down the node
+// A second signal forces the exit
+func handleShutdownSignals(node *WebRTC_CDN_Node) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+
+	LogInfo("Received signal: " + sig.String())
+
+	go node.shutdown()
+
+	sig = <-signals
+
+	LogWarning("Received signal: " + sig.String() + ". Exiting without draining.")
+
+	os.Exit(1)
+}
@@ -0,0 +1,201 @@
+// Inter-node message bus
+// Documented at doc/redis.md
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// This channel is used to broadcast messages to all the nodes
+const REDIS_BROADCAST_CHANNEL = "webrtc_cdn"
+
+// MessageBus - Publish-subscription service
+// used for inter-node communication
+type MessageBus interface {
+	// Publishes a message into a channel
+	Publish(channel string, msg string) error
+
+	// Subscribes to a list of channels.
+	// Calls the handler for each message received.
+	// Blocks until the bus is closed
+	Subscribe(channels []string, handler func(msg string))
+
+	// Closes the bus
+	Close()
+}
+
+// Creates the message bus for the node, based on the configuration
+// The service is chosen with the message bus type (REDIS or NATS)
+func createMessageBus(config *Config) (MessageBus, error) {
+	switch strings.ToUpper(config.MessageBus.Type) {
+	case "NATS":
+		return loadNATSMessageBus(&config.NATS)
+	case "REDIS":
+		return NewRedisMessageBus(&config.Redis), nil
+	default:
+		return nil, errors.New("unknown message bus: " + config.MessageBus.Type)
+	}
+}
+
+// Listens for messages from other nodes
+func (node *WebRTC_CDN_Node) runMessageBusListener() {
+	if node.bus == nil {
+		return
+	}
+
+	node.bus.Subscribe([]string{REDIS_BROADCAST_CHANNEL, node.id}, node.receiveBusMessage)
+}
+
+// Parses messages received from the bus
+// and calls the corresponding functions
+func (node *WebRTC_CDN_Node) receiveBusMessage(msg string) {
+	msgData := map[string]string{}
+
+	// Decode message
+	json.Unmarshal([]byte(msg), &msgData)
+
+	msgType := strings.ToUpper(msgData["type"])
+	msgSource := msgData["src"]
+
+	if msgSource == node.id {
+		return // Ignore messages from self
+	}
+
+	metricBusMessagesReceived.WithLabelValues(msgType).Inc()
+
+	switch msgType {
+	case "RESOLVE":
+		sid := msgData["sid"]
+		if node.isDraining() {
+			break
+		}
+		if source := node.resolveSource(sid); source != nil {
+			node.sendInfoMessage(msgSource, source) // Tell the node who asked that we have that source
+		}
+	case "INFO":
+		sid := msgData["sid"]
+		startTime, _ := strconv.ParseInt(msgData["start"], 10, 64)
+		publisher := PublisherInfo{
+			exclusive: (msgData["exclusive"] == "true"),
+			takeover:  (msgData["takeover"] == "true"),
+			startTime: startTime,
+		}
+		node.receiveInfoMessage(msgSource, sid, publisher)
+	case "CONNECT":
+		sid := msgData["sid"]
+		layers := parseLayerList(msgData["layers"])
+		node.receiveConnectMessage(msgSource, sid, layers)
+	case "UNAVAILABLE":
+		sid := msgData["sid"]
+		node.receiveUnavailableMessage(msgSource, sid)
+	case "OFFER":
+		sid := msgData["sid"]
+		data := msgData["data"]
+		hasVideo := (msgData["video"] == "true")
+		hasAudio := (msgData["audio"] == "true")
+		layers := parseLayerList(msgData["layers"])
+		node.receiveOfferMessage(sid, data, hasVideo, hasAudio, layers)
+	case "ANSWER":
+		sid := msgData["sid"]
+		data := msgData["data"]
+		node.receiveAnswerMessage(msgSource, sid, data)
+	case "CANDIDATE":
+		sid := msgData["sid"]
+		data := msgData["data"]
+		node.receiveCandidateMessage(msgSource, sid, data)
+	}
+}
+
+// Sends a message to other node(s) using the bus
+func (node *WebRTC_CDN_Node) sendBusMessage(channel string, msg *map[string]string) {
+	if node.bus == nil {
+		return
+	}
+
+	b, e := json.Marshal(msg)
+	if e != nil {
+		LogError(e)
+		return
+	}
+
+	e = node.bus.Publish(channel, string(b))
+	if e != nil {
+		LogError(e)
+	} else {
+		metricBusMessagesSent.WithLabelValues((*msg)["type"]).Inc()
+		getRootLogger().Debug("Message sent to the bus", "channel", channel, "message", string(b))
+	}
+}
+
+// Sends an INFO message to other node(s)
+// This message makes them aware the node has a WebRTC source
+// for the specified Stream ID (sid)
+// It includes the publishing info, to resolve conflicts with exclusive streams
+func (node *WebRTC_CDN_Node) sendInfoMessage(channel string, source *WRTC_Source) {
+	publisher := source.getPublisherInfo()
+
+	mp := make(map[string]string)
+
+	mp["type"] = "INFO"
+	mp["src"] = node.id
+	mp["sid"] = source.sid
+	mp["start"] = strconv.FormatInt(publisher.startTime, 10)
+	if publisher.exclusive {
+		mp["exclusive"] = "true"
+	}
+	if publisher.takeover {
+		mp["takeover"] = "true"
+	}
+
+	node.sendBusMessage(channel, &mp)
+}
+
+// Sends a RESOLVE message
+// This message asks other nodes if they have a WebRTC source
+// for the specified Stream ID (sid)
+// They will respond with INFO if they have it
+func (node *WebRTC_CDN_Node) sendResolveMessage(sid string) {
+	mp := make(map[string]string)
+
+	mp["type"] = "RESOLVE"
+	mp["src"] = node.id
+	mp["sid"] = sid
+
+	node.sendBusMessage(REDIS_BROADCAST_CHANNEL, &mp)
+}
+
+// Sends a CONNECT message
+// This message asks a node to open a connection
+// to receive an external WebRTC source
+// Optionally, it can specify the simulcast layers to receive
+func (node *WebRTC_CDN_Node) sendConnectMessage(dst string, sid string, layers []string) {
+	mp := make(map[string]string)
+
+	mp["type"] = "CONNECT"
+	mp["src"] = node.id
+	mp["dst"] = dst
+	mp["sid"] = sid
+	if len(layers) > 0 {
+		mp["layers"] = strings.Join(layers, ",")
+	}
+
+	node.sendBusMessage(dst, &mp)
+}
+
+// Sends an UNAVAILABLE message
+// This message is the answer to a CONNECT message
+// for a stream the node does not have
+func (node *WebRTC_CDN_Node) sendUnavailableMessage(dst string, sid string) {
+	mp := make(map[string]string)
+
+	mp["type"] = "UNAVAILABLE"
+	mp["src"] = node.id
+	mp["dst"] = dst
+	mp["sid"] = sid
+
+	node.sendBusMessage(dst, &mp)
+}
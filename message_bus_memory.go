@@ -0,0 +1,172 @@
+// In-memory message bus
+// Allows multiple nodes to run in the same process
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// MemoryMessageBus - Message bus that delivers the messages
+// in the same process. The same instance must be shared
+// by all the nodes that need to communicate
+type MemoryMessageBus struct {
+	mutex *sync.Mutex
+
+	closed bool
+
+	subscriptions map[string][]*memoryBusSubscription // Subscriptions by channel
+}
+
+// Subscription to the in-memory bus
+// Messages are queued, so the publisher never blocks
+type memoryBusSubscription struct {
+	cond *sync.Cond
+
+	queue  []string
+	closed bool
+}
+
+// Creates an in-memory message bus
+func NewMemoryMessageBus() *MemoryMessageBus {
+	return &MemoryMessageBus{
+		mutex:         &sync.Mutex{},
+		closed:        false,
+		subscriptions: make(map[string][]*memoryBusSubscription),
+	}
+}
+
+// Publishes a message into a channel
+func (bus *MemoryMessageBus) Publish(channel string, msg string) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if bus.closed {
+		return errors.New("the message bus is closed")
+	}
+
+	for _, sub := range bus.subscriptions[channel] {
+		sub.push(msg)
+	}
+
+	return nil
+}
+
+// Subscribes to a list of channels
+func (bus *MemoryMessageBus) Subscribe(channels []string, handler func(msg string)) {
+	sub := &memoryBusSubscription{
+		cond:   sync.NewCond(&sync.Mutex{}),
+		queue:  make([]string, 0),
+		closed: false,
+	}
+
+	bus.mutex.Lock()
+
+	if bus.closed {
+		bus.mutex.Unlock()
+		return
+	}
+
+	for _, channel := range channels {
+		bus.subscriptions[channel] = append(bus.subscriptions[channel], sub)
+	}
+
+	bus.mutex.Unlock()
+
+	defer bus.unsubscribe(channels, sub)
+
+	getRootLogger().Debug("Listening for commands on channels "+formatChannelList(channels), "service", "memory")
+
+	for {
+		msg, ok := sub.pop()
+
+		if !ok {
+			return // Closed
+		}
+
+		handler(msg)
+	}
+}
+
+// Removes a subscription
+func (bus *MemoryMessageBus) unsubscribe(channels []string, sub *memoryBusSubscription) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for _, channel := range channels {
+		list := bus.subscriptions[channel]
+
+		for i := 0; i < len(list); i++ {
+			if list[i] == sub {
+				list = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+
+		if len(list) == 0 {
+			delete(bus.subscriptions, channel)
+		} else {
+			bus.subscriptions[channel] = list
+		}
+	}
+}
+
+// Closes the bus
+// All the subscriptions will stop
+func (bus *MemoryMessageBus) Close() {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.closed = true
+
+	for _, list := range bus.subscriptions {
+		for _, sub := range list {
+			sub.close()
+		}
+	}
+}
+
+// Adds a message to the queue
+func (sub *memoryBusSubscription) push(msg string) {
+	sub.cond.L.Lock()
+	defer sub.cond.L.Unlock()
+
+	sub.queue = append(sub.queue, msg)
+	sub.cond.Signal()
+}
+
+// Waits for the next message of the queue
+// Returns false if the subscription is closed
+func (sub *memoryBusSubscription) pop() (string, bool) {
+	sub.cond.L.Lock()
+	defer sub.cond.L.Unlock()
+
+	for len(sub.queue) == 0 && !sub.closed {
+		sub.cond.Wait()
+	}
+
+	if sub.closed {
+		return "", false
+	}
+
+	msg := sub.queue[0]
+	sub.queue = sub.queue[1:]
+
+	return msg, true
+}
+
+// Closes the subscription
+func (sub *memoryBusSubscription) close() {
+	sub.cond.L.Lock()
+	defer sub.cond.L.Unlock()
+
+	sub.closed = true
+	sub.cond.Broadcast()
+}
+
+// Formats a list of channels for logging
+func formatChannelList(channels []string) string {
+	return "'" + strings.Join(channels, "', '") + "'"
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Creates a node for testing, with the default configuration
+// If the bus is not nil, the node listens for messages on it
+func newTestNode(t *testing.T, id string, bus MessageBus) *WebRTC_CDN_Node {
+	t.Helper()
+
+	config := defaultConfig()
+	config.MessageBus.StandAlone = (bus == nil)
+
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	node := &WebRTC_CDN_Node{id: id, bus: bus}
+
+	node.config.Store(config)
+
+	node.init()
+
+	if bus != nil {
+		go node.runMessageBusListener()
+	}
+
+	return node
+}
+
+// Waits until a channel of the memory bus has the expected number of subscriptions
+func waitMemoryBusSubscriptions(t *testing.T, bus *MemoryMessageBus, channel string, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		bus.mutex.Lock()
+		n := len(bus.subscriptions[channel])
+		bus.mutex.Unlock()
+
+		if n >= count {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timeout waiting for %d subscriptions on channel %q", count, channel)
+}
+
+// Collects the messages received by a subscription
+type memoryBusCollector struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (c *memoryBusCollector) handle(msg string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.messages = append(c.messages, msg)
+}
+
+func (c *memoryBusCollector) get() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.messages...)
+}
+
+// Gets the types of the collected messages, with the sender and receiver nodes
+// Format: {type} {src}->{dst}
+func (c *memoryBusCollector) getTypes() map[string]bool {
+	types := make(map[string]bool)
+
+	for _, msg := range c.get() {
+		msgData := map[string]string{}
+
+		if err := json.Unmarshal([]byte(msg), &msgData); err != nil {
+			continue
+		}
+
+		types[msgData["type"]+" "+msgData["src"]+"->"+msgData["dst"]] = true
+	}
+
+	return types
+}
+
+func TestMemoryMessageBusChannels(t *testing.T) {
+	bus := NewMemoryMessageBus()
+	defer bus.Close()
+
+	a := &memoryBusCollector{}
+	b := &memoryBusCollector{}
+
+	go bus.Subscribe([]string{REDIS_BROADCAST_CHANNEL, "node-a"}, a.handle)
+	go bus.Subscribe([]string{REDIS_BROADCAST_CHANNEL, "node-b"}, b.handle)
+
+	waitMemoryBusSubscriptions(t, bus, REDIS_BROADCAST_CHANNEL, 2)
+
+	messages := []struct {
+		channel string
+		msg     string
+	}{
+		{REDIS_BROADCAST_CHANNEL, "broadcast"},
+		{"node-a", "to-a"},
+		{"node-b", "to-b"},
+		{"node-c", "to-c"},
+	}
+
+	for _, m := range messages {
+		if err := bus.Publish(m.channel, m.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	expected := []struct {
+		name      string
+		collector *memoryBusCollector
+		messages  []string
+	}{
+		{"node-a", a, []string{"broadcast", "to-a"}},
+		{"node-b", b, []string{"broadcast", "to-b"}},
+	}
+
+	for _, e := range expected {
+		got := e.collector.get()
+
+		if len(got) != len(e.messages) {
+			t.Fatalf("%s: expected messages %v, got %v", e.name, e.messages, got)
+		}
+
+		for i := range got {
+			if got[i] != e.messages[i] {
+				t.Fatalf("%s: expected messages %v, got %v", e.name, e.messages, got)
+			}
+		}
+	}
+}
+
+func TestMemoryMessageBusClose(t *testing.T) {
+	bus := NewMemoryMessageBus()
+
+	done := make(chan struct{})
+
+	go func() {
+		bus.Subscribe([]string{REDIS_BROADCAST_CHANNEL}, func(msg string) {})
+		close(done)
+	}()
+
+	waitMemoryBusSubscriptions(t, bus, REDIS_BROADCAST_CHANNEL, 1)
+
+	bus.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscription did not stop after closing the bus")
+	}
+
+	if err := bus.Publish(REDIS_BROADCAST_CHANNEL, "msg"); err == nil {
+		t.Fatal("expected an error publishing to a closed bus")
+	}
+}
+
+func TestMemoryMessageBusResolve(t *testing.T) {
+	bus := NewMemoryMessageBus()
+	defer bus.Close()
+
+	nodeA := newTestNode(t, "node-a", bus)
+	nodeB := newTestNode(t, "node-b", bus)
+	newTestNode(t, "node-c", bus)
+
+	// Observers of the messages sent to nodes B and C
+	observerB := &memoryBusCollector{}
+	observerC := &memoryBusCollector{}
+
+	go bus.Subscribe([]string{"node-b"}, observerB.handle)
+	go bus.Subscribe([]string{"node-c"}, observerC.handle)
+
+	waitMemoryBusSubscriptions(t, bus, REDIS_BROADCAST_CHANNEL, 3)
+	waitMemoryBusSubscriptions(t, bus, "node-b", 2)
+	waitMemoryBusSubscriptions(t, bus, "node-c", 2)
+
+	// Node A publishes the stream
+	nodeA.mutexStatus.Lock()
+	nodeA.sources["stream"] = &WRTC_Source{sid: "stream", node: nodeA}
+	nodeA.mutexStatus.Unlock()
+
+	// Node B sends RESOLVE, and node A answers with INFO only to node B
+	// Nobody publishes the other stream
+	nodeB.sendResolveMessage("stream")
+	nodeB.sendResolveMessage("other")
+
+	time.Sleep(200 * time.Millisecond)
+
+	infoMessages := make([]string, 0)
+
+	for _, msg := range observerB.get() {
+		msgData := map[string]string{}
+
+		if err := json.Unmarshal([]byte(msg), &msgData); err != nil {
+			t.Fatal(err)
+		}
+
+		if msgData["type"] == "INFO" {
+			infoMessages = append(infoMessages, msgData["src"]+" "+msgData["sid"])
+		}
+	}
+
+	if len(infoMessages) != 1 || infoMessages[0] != "node-a stream" {
+		t.Fatalf("expected a single INFO message from node A, got %v", infoMessages)
+	}
+
+	if msgs := observerC.get(); len(msgs) != 0 {
+		t.Fatalf("unexpected messages for node C: %v", msgs)
+	}
+}
+
+// Creates a ready source with an audio track, publishing in a node
+// Audio packets are written until the test ends
+func newTestAudioSource(t *testing.T, node *WebRTC_CDN_Node, sid string) *WRTC_Source {
+	t.Helper()
+
+	audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &WRTC_Source{
+		requestId: "1",
+		sid:       sid,
+		node:      node,
+		hasAudio:  true,
+	}
+
+	source.init()
+
+	source.localTrackAudio = audioTrack
+	source.ready = true
+
+	node.mutexStatus.Lock()
+	node.sources[sid] = source
+	node.mutexStatus.Unlock()
+
+	stopPackets := make(chan struct{})
+	t.Cleanup(func() { close(stopPackets) })
+
+	go func() {
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:     2,
+				PayloadType: 111,
+				SSRC:        1,
+			},
+			Payload: []byte{0xF8, 0xFF, 0xFE},
+		}
+
+		for {
+			select {
+			case <-stopPackets:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			packet.SequenceNumber++
+			packet.Timestamp += 960
+
+			if err := audioTrack.WriteRTP(packet); err != nil {
+				return
+			}
+		}
+	}()
+
+	return source
+}
+
+// Creates a WHEP sink waiting for a stream in a node
+func newTestSink(t *testing.T, node *WebRTC_CDN_Node, sid string) *WRTC_Sink {
+	t.Helper()
+
+	sink := &WRTC_Sink{
+		sinkId:    node.getSinkID(),
+		requestId: "1",
+		sid:       sid,
+		node:      node,
+		whep:      true,
+	}
+
+	sink.init()
+	t.Cleanup(sink.close)
+
+	node.registerSink(sink)
+
+	return sink
+}
+
+// Waits until a sink receives the audio track
+func waitTestSinkAudio(t *testing.T, sink *WRTC_Sink, observer *memoryBusCollector) {
+	t.Helper()
+
+	select {
+	case <-sink.whepReadyChan:
+	case <-time.After(20 * time.Second):
+		t.Fatalf("the relay was not ready, messages: %v", observer.getTypes())
+	}
+
+	sink.statusMutex.Lock()
+	hasAudio := sink.localTrackAudio != nil
+	sink.statusMutex.Unlock()
+
+	if !hasAudio {
+		t.Fatal("the sink did not receive the audio track of the relay")
+	}
+}
+
+// Checks the observer received the expected messages
+func expectTestMessageTypes(t *testing.T, observer *memoryBusCollector, expected []string) {
+	t.Helper()
+
+	types := observer.getTypes()
+
+	for _, e := range expected {
+		if !types[e] {
+			t.Errorf("message %q was not sent, messages: %v", e, types)
+		}
+	}
+}
+
+func TestMemoryMessageBusRelay(t *testing.T) {
+	bus := NewMemoryMessageBus()
+	defer bus.Close()
+
+	observer := &memoryBusCollector{}
+
+	go bus.Subscribe([]string{REDIS_BROADCAST_CHANNEL, "node-a", "node-b"}, observer.handle)
+
+	nodeA := newTestNode(t, "node-a", bus)
+	nodeB := newTestNode(t, "node-b", bus)
+
+	waitMemoryBusSubscriptions(t, bus, REDIS_BROADCAST_CHANNEL, 3)
+
+	// Node A has a ready source with an audio track
+	newTestAudioSource(t, nodeA, "stream")
+
+	// Node B has a sink waiting for the stream
+	sink := newTestSink(t, nodeB, "stream")
+
+	// RESOLVE -> INFO -> CONNECT -> OFFER -> ANSWER -> CANDIDATE, until the relay is ready
+	waitTestSinkAudio(t, sink, observer)
+
+	expectTestMessageTypes(t, observer, []string{
+		"RESOLVE node-b->",
+		"INFO node-a->",
+		"CONNECT node-b->node-a",
+		"OFFER node-a->node-b",
+		"ANSWER node-b->node-a",
+		"CANDIDATE node-a->node-b",
+		"CANDIDATE node-b->node-a",
+	})
+}
+
+// Stream registry for testing, storing the entries in memory
+type testStreamRegistry struct {
+	mutex   sync.Mutex
+	entries map[string]*StreamRegistryEntry
+}
+
+func (registry *testStreamRegistry) Register(sid string, entry *StreamRegistryEntry) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.entries[sid] = entry
+
+	return nil
+}
+
+func (registry *testStreamRegistry) Unregister(sid string, entry *StreamRegistryEntry) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	current := registry.entries[sid]
+
+	if current != nil && current.Node == entry.Node && current.StartTime == entry.StartTime {
+		delete(registry.entries, sid)
+	}
+
+	return nil
+}
+
+func (registry *testStreamRegistry) Lookup(sid string) (*StreamRegistryEntry, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return registry.entries[sid], nil
+}
+
+func (registry *testStreamRegistry) Close() {}
+
+func TestMemoryMessageBusStaleRegistryEntry(t *testing.T) {
+	bus := NewMemoryMessageBus()
+	defer bus.Close()
+
+	observer := &memoryBusCollector{}
+
+	go bus.Subscribe([]string{REDIS_BROADCAST_CHANNEL, "node-a", "node-b", "node-c"}, observer.handle)
+
+	nodeA := newTestNode(t, "node-a", bus)
+	nodeB := newTestNode(t, "node-b", bus)
+	newTestNode(t, "node-c", bus)
+
+	waitMemoryBusSubscriptions(t, bus, REDIS_BROADCAST_CHANNEL, 4)
+
+	// The registry of node B says node C publishes the stream, but node A does
+	registry := &testStreamRegistry{
+		entries: map[string]*StreamRegistryEntry{
+			"stream": {Node: "node-c", StartTime: 1},
+		},
+	}
+
+	nodeB.registry = registry
+
+	go nodeB.runStreamRegistryWorker()
+	defer nodeB.registryQueue.close()
+
+	newTestAudioSource(t, nodeA, "stream")
+
+	// CONNECT -> UNAVAILABLE, then the stale entry is removed
+	// and the stream is found with RESOLVE
+	sink := newTestSink(t, nodeB, "stream")
+
+	waitTestSinkAudio(t, sink, observer)
+
+	expectTestMessageTypes(t, observer, []string{
+		"CONNECT node-b->node-c",
+		"UNAVAILABLE node-c->node-b",
+		"RESOLVE node-b->",
+		"INFO node-a->",
+		"CONNECT node-b->node-a",
+	})
+
+	if entry, _ := registry.Lookup("stream"); entry != nil {
+		t.Fatalf("the stale entry was not removed: %+v", entry)
+	}
+}
+
+func TestMemoryMessageBusExclusivePublishing(t *testing.T) {
+	bus := NewMemoryMessageBus()
+	defer bus.Close()
+
+	nodeA := newTestNode(t, "node-a", bus)
+	nodeB := newTestNode(t, "node-b", bus)
+
+	waitMemoryBusSubscriptions(t, bus, REDIS_BROADCAST_CHANNEL, 2)
+
+	// Node A publishes an exclusive stream and a regular one
+	nodeA.mutexStatus.Lock()
+	nodeA.sources["exclusive"] = &WRTC_Source{sid: "exclusive", node: nodeA, startTime: time.Now(), exclusive: true}
+	nodeA.sources["regular"] = &WRTC_Source{sid: "regular", node: nodeA, startTime: time.Now()}
+	nodeA.mutexStatus.Unlock()
+
+	cases := []struct {
+		sid       string
+		exclusive bool
+		takeover  bool
+		expected  bool
+	}{
+		{"exclusive", false, false, false}, // The existing source is exclusive, even if the new publisher is not
+		{"exclusive", true, false, false},
+		{"exclusive", false, true, true},
+		{"regular", false, false, true},
+		{"regular", true, false, false},
+		{"other", true, false, true},
+	}
+
+	for _, c := range cases {
+		if result := nodeB.canPublish(c.sid, c.exclusive, c.takeover); result != c.expected {
+			t.Errorf("canPublish(%q, exclusive=%v, takeover=%v): expected %v, got %v", c.sid, c.exclusive, c.takeover, c.expected, result)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Prometheus metrics
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Path of the metrics endpoint
+const METRICS_PATH = "/metrics"
+
+// Namespace for all the metrics
+const METRICS_NAMESPACE = "webrtc_cdn"
+
+// If true, the per-track metrics are labeled by stream ID
+var METRICS_STREAM_LABELS = false
+
+// HTTP handler for the metrics endpoint
+var metricsHandler = promhttp.Handler()
+
+var (
+	metricPublishRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "publish_requests_total",
+		Help:      "Number of publish requests received.",
+	}, []string{"protocol"})
+
+	metricPlayRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "play_requests_total",
+		Help:      "Number of play requests received.",
+	}, []string{"protocol"})
+
+	metricAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "auth_failures_total",
+		Help:      "Number of requests rejected due to invalid authentication.",
+	}, []string{"subject"})
+
+	metricRejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rejected_requests_total",
+		Help:      "Number of requests rejected due to limits.",
+	}, []string{"reason"})
+
+	metricBusMessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "bus_messages_sent_total",
+		Help:      "Number of messages sent to other nodes.",
+	}, []string{"type"})
+
+	metricBusMessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "bus_messages_received_total",
+		Help:      "Number of messages received from other nodes.",
+	}, []string{"type"})
+
+	metricStreamRegistryLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "stream_registry_lookups_total",
+		Help:      "Number of lookups in the stream registry.",
+	}, []string{"result"})
+
+	metricTrackBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "track_forwarded_bytes_total",
+		Help:      "Number of RTP bytes forwarded by the tracks.",
+	}, []string{"kind", "stream_id"})
+
+	metricTrackPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "track_forwarded_packets_total",
+		Help:      "Number of RTP packets forwarded by the tracks.",
+	}, []string{"kind", "stream_id"})
+)
+
+// Counters for a forwarded track
+type TrackMetrics struct {
+	bytes   prometheus.Counter
+	packets prometheus.Counter
+
+	kind string
+	sid  string
+
+	released bool // True after the track released the counters
+}
+
+// Key of the per-stream track counters
+type TrackMetricsKey struct {
+	kind string
+	sid  string
+}
+
+// Number of tracks using each per-stream series
+// Several tracks share a series (simulcast layers, takeovers, replaced relays),
+// so it's only deleted when the last of them is released
+var (
+	trackMetricsMutex = &sync.Mutex{}
+	trackMetricsUsers = make(map[TrackMetricsKey]int)
+)
+
+// Loads metrics configuration
+// and registers the node gauges
+func (node *WebRTC_CDN_Node) initMetrics() {
+	METRICS_STREAM_LABELS = node.getConfig().Metrics.StreamLabels
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "connections",
+		Help:      "Number of active websocket connections.",
+	}, func() float64 {
+		node.mutexConnections.Lock()
+		defer node.mutexConnections.Unlock()
+
+		return float64(len(node.connections))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "sources",
+		Help:      "Number of active sources (publishers).",
+	}, func() float64 {
+		node.mutexStatus.Lock()
+		defer node.mutexStatus.Unlock()
+
+		return float64(len(node.sources))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "relays",
+		Help:      "Number of active relays (streams received from other nodes).",
+	}, func() float64 {
+		node.mutexStatus.Lock()
+		defer node.mutexStatus.Unlock()
+
+		return float64(len(node.relays))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "sinks",
+		Help:      "Number of active sinks (viewers).",
+	}, func() float64 {
+		node.mutexStatus.Lock()
+		defer node.mutexStatus.Unlock()
+
+		count := 0
+
+		for _, sinksForStream := range node.sinks {
+			count += len(sinksForStream)
+		}
+
+		return float64(count)
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "senders",
+		Help:      "Number of active senders (streams sent to other nodes).",
+	}, func() float64 {
+		node.mutexStatus.Lock()
+		defer node.mutexStatus.Unlock()
+
+		count := 0
+
+		for _, sendersForStream := range node.senders {
+			count += len(sendersForStream)
+		}
+
+		return float64(count)
+	})
+}
+
+// Gets the counters for a forwarded track
+func getTrackMetrics(kind string, sid string) *TrackMetrics {
+	if !METRICS_STREAM_LABELS {
+		sid = ""
+	}
+
+	if sid != "" {
+		trackMetricsMutex.Lock()
+		trackMetricsUsers[TrackMetricsKey{kind: kind, sid: sid}]++
+		trackMetricsMutex.Unlock()
+	}
+
+	return &TrackMetrics{
+		bytes:   metricTrackBytes.WithLabelValues(kind, sid),
+		packets: metricTrackPackets.WithLabelValues(kind, sid),
+		kind:    kind,
+		sid:     sid,
+	}
+}
+
+// Counts a forwarded packet
+func (m *TrackMetrics) onPacket(size int) {
+	m.bytes.Add(float64(size))
+	m.packets.Inc()
+}
+
+// Releases the counters of the track
+// If labeled by stream, they are removed once no other track uses them
+func (m *TrackMetrics) release() {
+	if m.sid == "" {
+		return
+	}
+
+	trackMetricsMutex.Lock()
+	defer trackMetricsMutex.Unlock()
+
+	if m.released {
+		return
+	}
+
+	m.released = true
+
+	key := TrackMetricsKey{kind: m.kind, sid: m.sid}
+
+	trackMetricsUsers[key]--
+
+	if trackMetricsUsers[key] > 0 {
+		return
+	}
+
+	delete(trackMetricsUsers, key)
+
+	metricTrackBytes.DeleteLabelValues(m.kind, m.sid)
+	metricTrackPackets.DeleteLabelValues(m.kind, m.sid)
+}
+
+// Handles requests to the metrics endpoint
+// If the metrics secret is set, it's required as a bearer token
+func (node *WebRTC_CDN_Node) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if !node.getConfig().Metrics.Enabled {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Not found.")
+		return
+	}
+
+	secret := node.getConfig().Metrics.Secret
+
+	if secret != "" && subtle.ConstantTimeCompare([]byte(getBearerToken(req)), []byte(secret)) != 1 {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Unauthorized.")
+		return
+	}
+
+	metricsHandler.ServeHTTP(w, req)
+}
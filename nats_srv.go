@@ -0,0 +1,181 @@
+// NATS service
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Size of the buffer for received NATS messages
+const NATS_RECEIVE_BUFFER_SIZE = 1024
+
+// NATSMessageBus - Message bus using NATS
+// The broadcast channel is mapped to the subject {prefix}
+// The node channels are mapped to the subjects {prefix}.node.{channel}
+type NATSMessageBus struct {
+	conn *nats.Conn // NATS connection
+
+	subjectPrefix string // Prefix for the subjects
+
+	mutex  *sync.Mutex   // Mutex to control access to the struct
+	closed chan struct{} // Closed when the bus is closed
+
+	logger *Logger // Logger including the service field
+}
+
+// Creates a message bus using NATS,
+// with the options of the configuration
+func loadNATSMessageBus(config *NATSConfig) (*NATSMessageBus, error) {
+	natsURL := config.URL
+	if natsURL == "" {
+		natsURL = nats.DefaultURL
+	}
+
+	subjectPrefix := config.SubjectPrefix
+	if subjectPrefix == "" {
+		subjectPrefix = REDIS_BROADCAST_CHANNEL
+	}
+
+	options := make([]nats.Option, 0)
+
+	// Authentication
+
+	if config.User != "" {
+		options = append(options, nats.UserInfo(config.User, config.Password))
+	}
+
+	if config.Token != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+
+	if config.CredentialsFile != "" {
+		options = append(options, nats.UserCredentials(config.CredentialsFile))
+	}
+
+	if config.NKeySeedFile != "" {
+		nkeyOption, err := nats.NkeyOptionFromSeed(config.NKeySeedFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, nkeyOption)
+	}
+
+	// TLS
+
+	if config.TLS {
+		options = append(options, nats.Secure())
+	}
+
+	if config.TLSCA != "" {
+		options = append(options, nats.RootCAs(config.TLSCA))
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		options = append(options, nats.ClientCert(config.TLSCert, config.TLSKey))
+	}
+
+	return NewNATSMessageBus(natsURL, subjectPrefix, options...)
+}
+
+// Creates a message bus using NATS
+// Extra connection options can be provided (authentication, TLS, etc)
+func NewNATSMessageBus(natsURL string, subjectPrefix string, options ...nats.Option) (*NATSMessageBus, error) {
+	logger := getRootLogger().With("service", "nats")
+
+	options = append([]nats.Option{
+		nats.Name("webrtc-cdn"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2 * time.Second),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			if err != nil {
+				logger.Warning("Connection to NATS lost: " + err.Error())
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			logger.Info("Reconnected to " + c.ConnectedUrlRedacted())
+		}),
+	}, options...)
+
+	conn, err := nats.Connect(natsURL, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSMessageBus{
+		conn:          conn,
+		subjectPrefix: subjectPrefix,
+		mutex:         &sync.Mutex{},
+		closed:        make(chan struct{}),
+		logger:        logger,
+	}, nil
+}
+
+// Maps a channel to a NATS subject
+func (bus *NATSMessageBus) getSubject(channel string) string {
+	if channel == REDIS_BROADCAST_CHANNEL {
+		return bus.subjectPrefix
+	}
+
+	return bus.subjectPrefix + ".node." + channel
+}
+
+// Publishes a message into a channel
+func (bus *NATSMessageBus) Publish(channel string, msg string) error {
+	return bus.conn.Publish(bus.getSubject(channel), []byte(msg))
+}
+
+// Subscribes to a list of channels
+func (bus *NATSMessageBus) Subscribe(channels []string, handler func(msg string)) {
+	msgChan := make(chan *nats.Msg, NATS_RECEIVE_BUFFER_SIZE)
+
+	subjects := make([]string, 0, len(channels))
+
+	for _, channel := range channels {
+		subject := bus.getSubject(channel)
+
+		sub, err := bus.conn.ChanSubscribe(subject, msgChan)
+
+		if err != nil {
+			bus.logger.Error(err)
+			continue
+		}
+
+		defer sub.Unsubscribe()
+
+		subjects = append(subjects, subject)
+	}
+
+	bus.logger.Info("Listening for commands on subjects '" + strings.Join(subjects, "', '") + "'")
+
+	for {
+		select {
+		case msg := <-msgChan:
+			handler(string(msg.Data))
+		case <-bus.closed:
+			return
+		}
+	}
+}
+
+// Closes the bus
+func (bus *NATSMessageBus) Close() {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	select {
+	case <-bus.closed:
+		return // Already closed
+	default:
+		close(bus.closed)
+	}
+
+	bus.conn.Close()
+}
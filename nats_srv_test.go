@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// Starts an embedded NATS server for testing
+// The host and port are set to a random local port
+func startTestNATSServer(t *testing.T, opts *server.Options) *server.Server {
+	t.Helper()
+
+	opts.Host = "127.0.0.1"
+	opts.Port = -1
+	opts.NoLog = true
+	opts.NoSigs = true
+
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Start()
+
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+// Creates a NATS message bus for testing
+func newTestNATSMessageBus(t *testing.T, config *NATSConfig) *NATSMessageBus {
+	t.Helper()
+
+	bus, err := loadNATSMessageBus(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(bus.Close)
+
+	return bus
+}
+
+// Subscribes to the channels of a bus, and waits for the subscriptions to be active
+// Returns a channel receiving the messages
+func subscribeTestNATSMessageBus(t *testing.T, bus *NATSMessageBus, channels []string) chan string {
+	t.Helper()
+
+	received := make(chan string, 16)
+
+	go bus.Subscribe(channels, func(msg string) {
+		received <- msg
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for bus.conn.NumSubscriptions() < len(channels) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the NATS subscriptions")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := bus.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return received
+}
+
+// Waits for a message
+func expectNATSMessage(t *testing.T, received chan string, expected string) {
+	t.Helper()
+
+	select {
+	case msg := <-received:
+		if msg != expected {
+			t.Fatalf("expected message %q, got %q", expected, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for message %q", expected)
+	}
+}
+
+// Checks a bus is connected, sending a message to itself
+func checkNATSRoundTrip(t *testing.T, bus *NATSMessageBus) {
+	t.Helper()
+
+	received := subscribeTestNATSMessageBus(t, bus, []string{"node-a"})
+
+	if err := bus.Publish("node-a", "ping"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNATSMessage(t, received, "ping")
+}
+
+// Checks a bus cannot connect to the server
+func checkNATSNotConnected(t *testing.T, config *NATSConfig) {
+	t.Helper()
+
+	bus, err := loadNATSMessageBus(config)
+	if err != nil {
+		return // Rejected when connecting
+	}
+
+	defer bus.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	if bus.conn.IsConnected() {
+		t.Fatal("connected to the NATS server with invalid options")
+	}
+}
+
+func TestNATSMessageBusSubjects(t *testing.T) {
+	s := startTestNATSServer(t, &server.Options{})
+
+	busA := newTestNATSMessageBus(t, &NATSConfig{URL: s.ClientURL(), SubjectPrefix: "cdn"})
+	busB := newTestNATSMessageBus(t, &NATSConfig{URL: s.ClientURL(), SubjectPrefix: "cdn"})
+
+	receivedA := subscribeTestNATSMessageBus(t, busA, []string{REDIS_BROADCAST_CHANNEL, "node-a"})
+	receivedB := subscribeTestNATSMessageBus(t, busB, []string{REDIS_BROADCAST_CHANNEL, "node-b"})
+
+	// Plain connection to check the subjects
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	broadcastSub, err := conn.SubscribeSync("cdn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeSub, err := conn.SubscribeSync("cdn.node.node-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Broadcast channel, received by all the nodes
+
+	if err := busA.Publish(REDIS_BROADCAST_CHANNEL, "broadcast"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNATSMessage(t, receivedA, "broadcast")
+	expectNATSMessage(t, receivedB, "broadcast")
+
+	if msg, err := broadcastSub.NextMsg(5 * time.Second); err != nil || string(msg.Data) != "broadcast" {
+		t.Fatalf("the broadcast channel is not mapped to the prefix subject: %v", err)
+	}
+
+	// Node channel, received only by that node
+
+	if err := busA.Publish("node-b", "to-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNATSMessage(t, receivedB, "to-b")
+
+	if msg, err := nodeSub.NextMsg(5 * time.Second); err != nil || string(msg.Data) != "to-b" {
+		t.Fatalf("the node channel is not mapped to the node subject: %v", err)
+	}
+
+	// Messages published directly into the subjects
+
+	if err := conn.Publish("cdn.node.node-a", []byte("to-a")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNATSMessage(t, receivedA, "to-a")
+
+	select {
+	case msg := <-receivedA:
+		t.Fatalf("unexpected message for node A: %q", msg)
+	case msg := <-receivedB:
+		t.Fatalf("unexpected message for node B: %q", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNATSMessageBusDefaultPrefix(t *testing.T) {
+	s := startTestNATSServer(t, &server.Options{})
+
+	bus := newTestNATSMessageBus(t, &NATSConfig{URL: s.ClientURL()})
+
+	if subject := bus.getSubject(REDIS_BROADCAST_CHANNEL); subject != REDIS_BROADCAST_CHANNEL {
+		t.Fatalf("unexpected broadcast subject: %q", subject)
+	}
+
+	if subject := bus.getSubject("node-a"); subject != REDIS_BROADCAST_CHANNEL+".node.node-a" {
+		t.Fatalf("unexpected node subject: %q", subject)
+	}
+}
+
+func TestNATSMessageBusUserPassword(t *testing.T) {
+	s := startTestNATSServer(t, &server.Options{Username: "user", Password: "secret"})
+
+	checkNATSRoundTrip(t, newTestNATSMessageBus(t, &NATSConfig{URL: s.ClientURL(), User: "user", Password: "secret"}))
+
+	checkNATSNotConnected(t, &NATSConfig{URL: s.ClientURL(), User: "user", Password: "wrong"})
+}
+
+func TestNATSMessageBusToken(t *testing.T) {
+	s := startTestNATSServer(t, &server.Options{Authorization: "token"})
+
+	checkNATSRoundTrip(t, newTestNATSMessageBus(t, &NATSConfig{URL: s.ClientURL(), Token: "token"}))
+
+	checkNATSNotConnected(t, &NATSConfig{URL: s.ClientURL(), Token: "wrong"})
+}
+
+func TestNATSMessageBusNKey(t *testing.T) {
+	dir := t.TempDir()
+
+	writeSeed := func(name string) (string, string) {
+		user, err := nkeys.CreateUser()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seed, err := user.Seed()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publicKey, err := user.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file := filepath.Join(dir, name)
+
+		if err := os.WriteFile(file, seed, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		return file, publicKey
+	}
+
+	seedFile, publicKey := writeSeed("user.nk")
+	otherSeedFile, _ := writeSeed("other.nk")
+
+	s := startTestNATSServer(t, &server.Options{Nkeys: []*server.NkeyUser{{Nkey: publicKey}}})
+
+	checkNATSRoundTrip(t, newTestNATSMessageBus(t, &NATSConfig{URL: s.ClientURL(), NKeySeedFile: seedFile}))
+
+	checkNATSNotConnected(t, &NATSConfig{URL: s.ClientURL(), NKeySeedFile: otherSeedFile})
+
+	if _, err := loadNATSMessageBus(&NATSConfig{URL: s.ClientURL(), NKeySeedFile: filepath.Join(dir, "missing.nk")}); err == nil {
+		t.Fatal("expected an error with a missing seed file")
+	}
+}
+
+// Writes a certificate and its key as PEM files
+// If the parent is nil, the certificate is self-signed (CA)
+func writeTestCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestNATSMessageBusTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := time.Now().Add(time.Hour)
+
+	ca, caKey := writeTestCertificate(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	writeTestCertificate(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	writeTestCertificate(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "webrtc-cdn"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	// The server requires client certificates signed by the CA
+
+	tlsConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CaFile:   filepath.Join(dir, "ca.pem"),
+		Verify:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTestNATSServer(t, &server.Options{TLS: true, TLSVerify: true, TLSConfig: tlsConfig, TLSTimeout: 2})
+
+	url := s.ClientURL()
+
+	checkNATSRoundTrip(t, newTestNATSMessageBus(t, &NATSConfig{
+		URL:     url,
+		TLS:     true,
+		TLSCA:   filepath.Join(dir, "ca.pem"),
+		TLSCert: filepath.Join(dir, "client.pem"),
+		TLSKey:  filepath.Join(dir, "client-key.pem"),
+	}))
+
+	// Without the client certificate
+	checkNATSNotConnected(t, &NATSConfig{
+		URL:   url,
+		TLS:   true,
+		TLSCA: filepath.Join(dir, "ca.pem"),
+	})
+
+	// Without the CA, the server certificate is not trusted
+	checkNATSNotConnected(t, &NATSConfig{
+		URL:     url,
+		TLS:     true,
+		TLSCert: filepath.Join(dir, "client.pem"),
+		TLSKey:  filepath.Join(dir, "client-key.pem"),
+	})
+}
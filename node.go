@@ -3,15 +3,17 @@
 package main
 
 import (
-	"crypto/tls"
 	"os"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"net"
 	"net/http"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
+	"github.com/pion/turn/v5"
+	"github.com/pion/webrtc/v4"
 )
 
 // WebRTC_CDN_Node - Status data of the server
@@ -19,14 +21,19 @@ import (
 // sources, inks, relays and senders
 type WebRTC_CDN_Node struct {
 	// Config
-	id           string
-	redisClient  *redis.Client
-	standAlone   bool
-	upgrader     *websocket.Upgrader
-	reqCount     uint64
-	sinkCount    uint64
-	ipLimit      uint32
-	requestLimit uint32
+	id            string
+	config        atomic.Pointer[Config] // Current configuration (replaced when reloaded)
+	configFile    string                 // Path to the configuration file (may be empty)
+	webrtcAPI     *webrtc.API            // WebRTC API for the peer connections with the clients
+	nodeAPI       *webrtc.API            // WebRTC API for the peer connections between nodes
+	bus           MessageBus
+	registry      StreamRegistry       // Stream registry (nil if disabled)
+	registryQueue *streamRegistryQueue // Pending operations of the stream registry
+	standAlone    bool
+	upgrader      *websocket.Upgrader
+	reqCount      uint64
+	sinkCount     uint64
+	startTime     time.Time
 
 	// Sync
 	mutexReqCount *sync.Mutex
@@ -34,12 +41,19 @@ type WebRTC_CDN_Node struct {
 	mutexIpCount     *sync.Mutex
 	mutexConnections *sync.Mutex
 
-	mutexRedisSend *sync.Mutex
-
 	mutexSinkCount *sync.Mutex
 
 	mutexStatus *sync.Mutex
 
+	mutexHTTPResources *sync.Mutex
+
+	mutexShutdown *sync.Mutex
+
+	mutexConfigReload *sync.Mutex
+
+	// Authentication
+	authKeyProvider atomic.Pointer[JWTKeyProvider]
+
 	// Status
 	connections map[uint64]*Connection_Handler
 	ipCount     map[string]uint32
@@ -49,16 +63,34 @@ type WebRTC_CDN_Node struct {
 
 	sinks   map[string]map[uint64]*WRTC_Sink
 	senders map[string]map[string]*WRTC_Source_Sender
+
+	whipSources map[string]*WRTC_Source
+	whepSinks   map[string]*WRTC_Sink
+
+	hlsPackagers  map[string]*HLSPackager
+	rtpForwarders map[string]*RTPForwarder
+
+	publishingChecks map[string][]chan PublisherInfo
+
+	// Shutdown
+	draining     bool
+	httpServers  []*http.Server
+	rtmpListener net.Listener
+	turnServer   *turn.Server
 }
 
 func (node *WebRTC_CDN_Node) init() {
+	node.startTime = time.Now()
+
 	// Mutex
 	node.mutexReqCount = &sync.Mutex{}
 	node.mutexIpCount = &sync.Mutex{}
 	node.mutexConnections = &sync.Mutex{}
-	node.mutexRedisSend = &sync.Mutex{}
 	node.mutexStatus = &sync.Mutex{}
 	node.mutexSinkCount = &sync.Mutex{}
+	node.mutexHTTPResources = &sync.Mutex{}
+	node.mutexShutdown = &sync.Mutex{}
+	node.mutexConfigReload = &sync.Mutex{}
 
 	// Status
 	node.connections = make(map[uint64]*Connection_Handler)
@@ -67,65 +99,64 @@ func (node *WebRTC_CDN_Node) init() {
 	node.relays = make(map[string]*WRTC_Relay)
 	node.sinks = make(map[string]map[uint64]*WRTC_Sink)
 	node.senders = make(map[string]map[string]*WRTC_Source_Sender)
+	node.whipSources = make(map[string]*WRTC_Source)
+	node.whepSinks = make(map[string]*WRTC_Sink)
+	node.hlsPackagers = make(map[string]*HLSPackager)
+	node.rtpForwarders = make(map[string]*RTPForwarder)
+	node.publishingChecks = make(map[string][]chan PublisherInfo)
 
 	// Config
-	node.ipLimit = 4
-	custom_ip_limit := os.Getenv("MAX_IP_CONCURRENT_CONNECTIONS")
-	if custom_ip_limit != "" {
-		cil, e := strconv.Atoi(custom_ip_limit)
-		if e != nil {
-			node.ipLimit = uint32(cil)
-		}
-	}
-
 	node.reqCount = 0
 	node.sinkCount = 0
 
-	node.requestLimit = 100
-	custom_req_limit := os.Getenv("MAX_REQUESTS_PER_SOCKET")
-	if custom_req_limit != "" {
-		cil, e := strconv.Atoi(custom_req_limit)
-		if e != nil {
-			node.requestLimit = uint32(cil)
-		}
+	node.standAlone = node.getConfig().MessageBus.StandAlone
+
+	// WebRTC APIs
+	api, interNodeAPI, err := createWebRTCAPIs(node.getConfig())
+
+	if err != nil {
+		LogError(err)
+		os.Exit(1)
 	}
 
-	node.standAlone = os.Getenv("STAND_ALONE") == "YES"
-}
+	node.webrtcAPI = api
+	node.nodeAPI = interNodeAPI
 
-// Runs the node
-func (node *WebRTC_CDN_Node) run() {
-	// Setup Redis sender
+	// Message bus (it may be already set, to share it between nodes in the same process)
+	if node.bus == nil && !node.standAlone {
+		bus, err := createMessageBus(node.getConfig())
 
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = "localhost"
-	}
+		if err != nil {
+			LogError(err)
+			os.Exit(1)
+		}
 
-	redisPort := os.Getenv("REDIS_PORT")
-	if redisPort == "" {
-		redisPort = "6379"
+		node.bus = bus
 	}
 
-	redisPassword := os.Getenv("REDIS_PASSWORD")
-
-	redisTLS := os.Getenv("REDIS_TLS")
-
-	if !node.standAlone {
-		if redisTLS == "YES" {
-			node.redisClient = redis.NewClient(&redis.Options{
-				Addr:      redisHost + ":" + redisPort,
-				Password:  redisPassword,
-				TLSConfig: &tls.Config{},
-			})
-		} else {
-			node.redisClient = redis.NewClient(&redis.Options{
-				Addr:     redisHost + ":" + redisPort,
-				Password: redisPassword,
-			})
+	// Stream registry (it may be already set, like the message bus)
+	if node.registry == nil && !node.standAlone {
+		registry, err := createStreamRegistry(node.getConfig())
+
+		if err != nil {
+			LogError(err)
+			os.Exit(1)
 		}
+
+		node.registry = registry
 	}
 
+	node.registryQueue = newStreamRegistryQueue()
+}
+
+// Gets the current configuration
+// Must not be modified, since it's shared
+func (node *WebRTC_CDN_Node) getConfig() *Config {
+	return node.config.Load()
+}
+
+// Runs the node
+func (node *WebRTC_CDN_Node) run() {
 	// Setup websocket handler
 
 	node.upgrader = &websocket.Upgrader{}
@@ -133,10 +164,12 @@ func (node *WebRTC_CDN_Node) run() {
 
 	var wg sync.WaitGroup
 
-	wg.Add(2)
+	wg.Add(4)
 
 	go node.runHTTPServer(&wg)
 	go node.runHTTPSecureServer(&wg)
+	go node.runRTMPServer(&wg)
+	go node.runTURNServer(&wg)
 
 	wg.Wait()
 }
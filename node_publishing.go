@@ -0,0 +1,154 @@
+// Publishing policy
+// Exclusive streams reject a second publisher, unless it is allowed to take over the stream
+
+package main
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Default max time to wait for other nodes to answer if a stream is being published (milliseconds)
+const PUBLISH_DEFAULT_CHECK_TIMEOUT_MS = 500
+
+// Publishing info of a source, announced to other nodes with the INFO message
+type PublisherInfo struct {
+	exclusive bool  // If true, other publishers are rejected
+	takeover  bool  // If true, the publisher replaces any existing one
+	startTime int64 // Unix timestamp (milliseconds) of the start of the publishing
+}
+
+// Checks if a stream is exclusive
+// Exclusive publishing is enabled for all the streams in the configuration
+// or per stream with the 'exclusive' claim of the publish token
+func isExclusivePublishing(config *PublishingConfig, claims jwt.MapClaims) bool {
+	return config.Exclusive || getBooleanClaim(claims, "exclusive")
+}
+
+// Checks if a publisher is allowed to take over an exclusive stream
+// Only allowed with the 'takeover' claim of the publish token
+func isPublishingTakeover(claims jwt.MapClaims) bool {
+	return getBooleanClaim(claims, "takeover")
+}
+
+// Gets the publishing info of the source
+func (source *WRTC_Source) getPublisherInfo() PublisherInfo {
+	return PublisherInfo{
+		exclusive: source.exclusive,
+		takeover:  source.takeover,
+		startTime: source.startTime.UnixMilli(),
+	}
+}
+
+// Checks if the source must be kept when other node announces a source for the same stream
+// The decision is the same in both nodes, so only one of the sources is kept
+func (source *WRTC_Source) keepsStream(nodeId string, remoteId string, remote PublisherInfo) bool {
+	if !source.exclusive && !remote.exclusive {
+		return false // Not exclusive, the last publisher takes the stream
+	}
+
+	if remote.takeover {
+		return false
+	}
+
+	if source.takeover {
+		return true
+	}
+
+	// The first publisher keeps the stream
+
+	startTime := source.startTime.UnixMilli()
+
+	if startTime != remote.startTime {
+		return startTime < remote.startTime
+	}
+
+	return nodeId < remoteId
+}
+
+// Checks if a new publisher is allowed to publish a stream
+// Unless the publisher can take over the stream, the node and the other nodes are checked.
+// The publisher is rejected if the stream is already being published,
+// and the new publisher or the existing one is exclusive
+// Conflicts with a local source are checked again when the source is registered
+func (node *WebRTC_CDN_Node) canPublish(sid string, exclusive bool, takeover bool) bool {
+	if takeover {
+		return true
+	}
+
+	existing, publishing := node.findStreamPublisher(sid)
+
+	if !publishing {
+		return true
+	}
+
+	return !exclusive && !existing.exclusive
+}
+
+// Finds the publisher of a stream, in the node or in other nodes of the cluster
+// Other nodes are asked with a RESOLVE message, waiting for the INFO answer
+// up to the configured timeout
+// Returns false if the stream is not being published
+func (node *WebRTC_CDN_Node) findStreamPublisher(sid string) (PublisherInfo, bool) {
+	if source := node.resolveSource(sid); source != nil {
+		return source.getPublisherInfo(), true
+	}
+
+	if node.bus == nil {
+		return PublisherInfo{}, false
+	}
+
+	waiter := make(chan PublisherInfo, 1)
+
+	node.mutexStatus.Lock()
+	node.publishingChecks[sid] = append(node.publishingChecks[sid], waiter)
+	node.mutexStatus.Unlock()
+
+	defer node.removePublishingCheck(sid, waiter)
+
+	node.sendResolveMessage(sid)
+
+	timer := time.NewTimer(time.Duration(node.getConfig().Publishing.CheckTimeoutMilliseconds) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case publisher := <-waiter:
+		return publisher, true
+	case <-timer.C:
+		return PublisherInfo{}, false
+	}
+}
+
+// Removes a waiter of the publishing checks of a stream
+func (node *WebRTC_CDN_Node) removePublishingCheck(sid string, waiter chan PublisherInfo) {
+	node.mutexStatus.Lock()
+	defer node.mutexStatus.Unlock()
+
+	waiters := node.publishingChecks[sid]
+
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(node.publishingChecks, sid)
+	} else {
+		node.publishingChecks[sid] = waiters
+	}
+}
+
+// Notifies the publishing checks of a stream
+// that other node has a source for it, with its publishing info
+// Must be called with the status mutex locked
+func (node *WebRTC_CDN_Node) notifyPublishingChecks(sid string, publisher PublisherInfo) {
+	for _, waiter := range node.publishingChecks[sid] {
+		select {
+		case waiter <- publisher:
+		default:
+		}
+	}
+}
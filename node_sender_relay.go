@@ -3,17 +3,25 @@
 
 package main
 
+import (
+	"strings"
+	"time"
+)
+
 // Called when a CONNECT message is received
 // If the node has a WebRTC source for the specified Stream ID,
 // it will create a sender for the node that requested the connection
-func (node *WebRTC_CDN_Node) receiveConnectMessage(from string, sid string) {
+// The list of layers indicates the simulcast layers requested (empty for all)
+func (node *WebRTC_CDN_Node) receiveConnectMessage(from string, sid string, layers []string) {
 	node.mutexStatus.Lock()
 	defer node.mutexStatus.Unlock()
 
 	source := node.sources[sid]
 
 	if source == nil {
-		return // Ignore, no source available
+		// No source available, the node that asked must resolve the stream again
+		node.sendUnavailableMessage(from, sid)
+		return
 	}
 
 	if node.senders[sid] != nil && node.senders[sid][from] != nil {
@@ -23,9 +31,10 @@ func (node *WebRTC_CDN_Node) receiveConnectMessage(from string, sid string) {
 
 	// Create a sender
 	sender := WRTC_Source_Sender{
-		sid:      sid,
-		remoteId: from,
-		node:     node,
+		sid:             sid,
+		remoteId:        from,
+		node:            node,
+		requestedLayers: layers,
 	}
 
 	sender.init()
@@ -38,7 +47,7 @@ func (node *WebRTC_CDN_Node) receiveConnectMessage(from string, sid string) {
 
 	if node.sources[sid] != nil && node.sources[sid].ready {
 		// Tracks already available
-		sender.onTracksReady(node.sources[sid].localTrackVideo, node.sources[sid].localTrackAudio)
+		sender.onTracksReady(node.sources[sid].localTrackVideo, node.sources[sid].localTrackAudio, node.sources[sid].simulcast, node.sources[sid].gopCache)
 	}
 }
 
@@ -85,53 +94,172 @@ func (node *WebRTC_CDN_Node) receiveCandidateMessage(from string, sid string, ca
 }
 
 // Called when an INFO message is received
-func (node *WebRTC_CDN_Node) receiveInfoMessage(from string, sid string) {
+func (node *WebRTC_CDN_Node) receiveInfoMessage(from string, sid string, publisher PublisherInfo) {
+	draining := node.isDraining()
+
 	node.mutexStatus.Lock()
 	defer node.mutexStatus.Unlock()
 
+	// The stream is being published in other node
+	node.notifyPublishingChecks(sid, publisher)
+
 	// If we receive an INFO message from another node
 	// and we have an existing connection for that stream,
 	// we must close it to prevent duplicates
 	if node.sources[sid] != nil {
-		// Close the old source
 		s := node.sources[sid]
+
+		if !draining && s.keepsStream(node.id, from, publisher) {
+			// Exclusive stream, tell the other node to close its source
+			node.sendInfoMessage(from, s)
+			return
+		}
+
+		if s.connection != nil && !publisher.takeover && (s.exclusive || publisher.exclusive) {
+			s.connection.sendErrorMessage("STREAM_ALREADY_PUBLISHING", "The stream is already being published.", s.requestId)
+		}
+
+		// Close the old source
 		s.close(true, false)
 		delete(node.sources, sid)
+		node.unregisterStream(s)
 	}
 
 	// If we have any pending sinks for that stream,
 	// we create a relay for that source
 	if node.sinks[sid] != nil && len(node.sinks[sid]) > 0 {
-		// Close old relay
-		if node.relays[sid] != nil {
-			node.relays[sid].close()
-			delete(node.relays, sid)
+		node.createRelay(sid, from)
+	}
+}
+
+// Creates a relay to receive a stream from other node
+// replacing any existing relay for the stream
+// Must be called with the status mutex locked
+func (node *WebRTC_CDN_Node) createRelay(sid string, from string) *WRTC_Relay {
+	// Close old relay
+	if node.relays[sid] != nil {
+		node.relays[sid].close()
+		delete(node.relays, sid)
+	}
+
+	// Create new relay
+	relay := WRTC_Relay{
+		sid:             sid,
+		remoteId:        from,
+		node:            node,
+		requestedLayers: node.getRequestedLayers(sid),
+	}
+
+	relay.init()
+
+	relay.connectTimer = time.AfterFunc(RELAY_CONNECT_TIMEOUT, func() {
+		node.onRelayConnectTimeout(&relay)
+	})
+
+	node.relays[sid] = &relay
+
+	// Send a connect message
+	node.sendConnectMessage(from, sid, relay.requestedLayers)
+
+	return &relay
+}
+
+// Called when a relay is not ready after RELAY_CONNECT_TIMEOUT
+func (node *WebRTC_CDN_Node) onRelayConnectTimeout(relay *WRTC_Relay) {
+	node.mutexStatus.Lock()
+	defer node.mutexStatus.Unlock()
+
+	if node.relays[relay.sid] != relay || relay.ready {
+		return // Replaced or connected
+	}
+
+	relay.logger.Warning("Timed out waiting for the tracks of the remote node")
+
+	node.failRelay(relay)
+}
+
+// Called when an UNAVAILABLE message is received
+// The remote node does not have the stream the relay asked for
+func (node *WebRTC_CDN_Node) receiveUnavailableMessage(from string, sid string) {
+	node.mutexStatus.Lock()
+	defer node.mutexStatus.Unlock()
+
+	relay := node.relays[sid]
+
+	if relay == nil || relay.remoteId != from || relay.ready {
+		return
+	}
+
+	relay.logger.Warning("The remote node does not have the stream")
+
+	node.failRelay(relay)
+}
+
+// Closes a relay that could not connect to the remote node
+// If the relay was created from a registry entry, the entry is stale, so it's removed
+// Then, the stream is resolved with a RESOLVE message, without checking the registry
+// Must be called with the status mutex locked
+func (node *WebRTC_CDN_Node) failRelay(relay *WRTC_Relay) {
+	relay.close()
+	delete(node.relays, relay.sid)
+
+	if relay.registryEntry != nil {
+		node.removeStaleStream(relay.sid, relay.registryEntry)
+	}
+
+	if len(node.sinks[relay.sid]) > 0 {
+		node.sendResolveMessage(relay.sid)
+	}
+}
+
+// Checks if the relay for a stream carries the simulcast layers requested by the sinks
+// If not, the relay is replaced, requesting the new list of layers
+// Must be called with the status mutex locked
+func (node *WebRTC_CDN_Node) checkRelayLayers(sid string) {
+	relay := node.relays[sid]
+
+	if relay == nil || len(relay.requestedLayers) == 0 {
+		return // All the layers are carried
+	}
+
+	requested := node.getRequestedLayers(sid)
+
+	if len(requested) > 0 {
+		missing := false
+
+		for _, layer := range requested {
+			if !containsString(relay.requestedLayers, layer) {
+				missing = true
+				break
+			}
 		}
 
-		// Create new relay
-		relay := WRTC_Relay{
-			sid:      sid,
-			remoteId: from,
-			node:     node,
+		if !missing {
+			return
 		}
+	}
 
-		relay.init()
+	newRelay := node.createRelay(sid, relay.remoteId)
+	newRelay.registryEntry = relay.registryEntry
+}
 
-		node.relays[sid] = &relay
+// Called when a sink changes its layer preference
+func (node *WebRTC_CDN_Node) onSinkLayerChanged(sink *WRTC_Sink) {
+	node.mutexStatus.Lock()
+	defer node.mutexStatus.Unlock()
 
-		// Send a connect message
-		node.sendConnectMessage(from, sid)
-	}
+	node.checkRelayLayers(sink.sid)
 }
 
 // Called when an OFFER message is received
 // This message is managed by the relay
-func (node *WebRTC_CDN_Node) receiveOfferMessage(sid string, data string, hasVideo bool, hasAudio bool) {
+// The list of layers contains the simulcast layers sent (empty if not simulcast)
+func (node *WebRTC_CDN_Node) receiveOfferMessage(sid string, data string, hasVideo bool, hasAudio bool, layers []string) {
 	node.mutexStatus.Lock()
 	defer node.mutexStatus.Unlock()
 
 	if node.relays[sid] != nil {
-		go node.relays[sid].onOffer(data, hasVideo, hasAudio)
+		go node.relays[sid].onOffer(data, hasVideo, hasAudio, layers)
 	}
 }
 
@@ -143,10 +271,12 @@ func (node *WebRTC_CDN_Node) onRelayReady(relay *WRTC_Relay) {
 
 	relay.ready = true
 
+	relay.stopConnectTimer()
+
 	// Notify sinks
 	if node.sinks[relay.sid] != nil {
 		for _, sink := range node.sinks[relay.sid] {
-			sink.onTracksReady(relay.localTrackVideo, relay.localTrackAudio)
+			sink.onTracksReady(relay.localTrackVideo, relay.localTrackAudio, relay.simulcast, relay.gopCache)
 		}
 	}
 }
@@ -161,13 +291,36 @@ func (node *WebRTC_CDN_Node) onRelayClosed(relay *WRTC_Relay) {
 	// Any sinks waiting, tell them the tracks are closed
 	if node.sinks[relay.sid] != nil {
 		for _, sink := range node.sinks[relay.sid] {
-			sink.onTracksClosed(relay.localTrackVideo, relay.localTrackAudio)
+			sink.onTracksClosed(relay.localTrackVideo, relay.localTrackAudio, relay.simulcast, relay.gopCache)
 		}
 	}
 
 	// If there are sinks for that stream ID
-	// and there are no source, try resolving it
+	// and there are no source, try locating it
 	if node.sinks[relay.sid] != nil && len(node.sinks[relay.sid]) > 0 {
-		node.sendResolveMessage(relay.sid)
+		node.locateStream(relay.sid)
 	}
 }
+
+// Gets the simulcast layers requested by the sinks of a stream
+// Returns an empty list (all the layers) if any sink uses the automatic selection
+// Must be called with the status mutex locked
+func (node *WebRTC_CDN_Node) getRequestedLayers(sid string) []string {
+	layers := make([]string, 0)
+
+	for _, sink := range node.sinks[sid] {
+		sink.statusMutex.Lock()
+		layer := sink.layer
+		sink.statusMutex.Unlock()
+
+		if layer == "" || strings.EqualFold(layer, SIMULCAST_LAYER_AUTO) {
+			return make([]string, 0)
+		}
+
+		if !containsString(layers, layer) {
+			layers = append(layers, layer)
+		}
+	}
+
+	return layers
+}
@@ -0,0 +1,228 @@
+// Graceful shutdown and draining
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Default drain period, in seconds
+const DRAIN_DEFAULT_PERIOD_SECONDS = 30
+
+// Max time to wait for the HTTP servers to shut down
+const HTTP_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// Checks if the node is draining (shutting down)
+func (node *WebRTC_CDN_Node) isDraining() bool {
+	node.mutexShutdown.Lock()
+	defer node.mutexShutdown.Unlock()
+
+	return node.draining
+}
+
+// Registers an HTTP server, so it can be shut down
+// Returns false if the node is already shutting down
+func (node *WebRTC_CDN_Node) addHTTPServer(server *http.Server) bool {
+	node.mutexShutdown.Lock()
+	defer node.mutexShutdown.Unlock()
+
+	if node.draining {
+		return false
+	}
+
+	node.httpServers = append(node.httpServers, server)
+
+	return true
+}
+
+// Checks if an HTTP request creates a new session
+// Those requests are rejected while draining
+func isNewSessionRequest(req *http.Request) bool {
+	if req.URL.Path == "/ws" {
+		return true
+	}
+
+	if req.Method != "POST" {
+		return false
+	}
+
+	return strings.HasPrefix(req.URL.Path, WHIP_PATH_PREFIX) || strings.HasPrefix(req.URL.Path, WHEP_PATH_PREFIX)
+}
+
+// Counts the sources and sinks still active in the node
+// HLS and forwarder sinks are not counted, since they have no client
+// and stay until their stream ends
+func (node *WebRTC_CDN_Node) countActiveSessions() int {
+	node.mutexStatus.Lock()
+	defer node.mutexStatus.Unlock()
+
+	count := len(node.sources)
+
+	for _, sinksForStream := range node.sinks {
+		for _, sink := range sinksForStream {
+			if sink.hls == nil && sink.forwarder == nil {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// Gracefully shuts down the node
+//  1. Stops accepting new sessions, answering RESOLVE messages and registering its streams
+//  2. Notifies the clients with a DRAIN message (unless disabled)
+//  3. Waits for the drain period, or until all the sessions are closed
+//  4. Closes sources, sinks, relays, senders and connections
+//  5. Stops the HTTP, RTMP and TURN servers
+func (node *WebRTC_CDN_Node) shutdown() {
+	node.mutexShutdown.Lock()
+
+	if node.draining {
+		node.mutexShutdown.Unlock()
+		return
+	}
+
+	node.draining = true
+
+	node.mutexShutdown.Unlock()
+
+	node.unregisterAllStreams()
+
+	drainPeriod := time.Duration(node.getConfig().Shutdown.DrainPeriodSeconds) * time.Second
+
+	LogInfo("Draining node. Waiting up to " + drainPeriod.String() + " before closing all the sessions")
+
+	// Notify clients
+
+	if node.getConfig().Shutdown.DrainNotifyClients {
+		for _, connection := range node.getConnectionsList() {
+			connection.sendDrainMessage(drainPeriod)
+		}
+	}
+
+	// Wait
+
+	deadline := time.Now().Add(drainPeriod)
+
+	for time.Now().Before(deadline) && node.countActiveSessions() > 0 {
+		time.Sleep(time.Second)
+	}
+
+	// Close everything
+
+	node.closeAllSessions()
+
+	for _, connection := range node.getConnectionsList() {
+		connection.connection.Close()
+	}
+
+	if node.bus != nil {
+		node.bus.Close()
+	}
+
+	if node.registry != nil {
+		// Wait for the pending operations, like the removal of the streams
+		node.registryQueue.close()
+		<-node.registryQueue.done
+		node.registry.Close()
+	}
+
+	// Stop HTTP, RTMP and TURN servers
+
+	LogInfo("All sessions closed. Stopping HTTP, RTMP and TURN servers")
+
+	node.mutexShutdown.Lock()
+	servers := node.httpServers
+	node.httpServers = nil
+	rtmpListener := node.rtmpListener
+	node.rtmpListener = nil
+	turnServer := node.turnServer
+	node.turnServer = nil
+	node.mutexShutdown.Unlock()
+
+	if turnServer != nil {
+		turnServer.Close()
+	}
+
+	if rtmpListener != nil {
+		rtmpListener.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+
+		if err != nil {
+			LogError(err)
+		}
+	}
+}
+
+// Gets the list of active websocket connections
+func (node *WebRTC_CDN_Node) getConnectionsList() []*Connection_Handler {
+	node.mutexConnections.Lock()
+	defer node.mutexConnections.Unlock()
+
+	connections := make([]*Connection_Handler, 0, len(node.connections))
+
+	for _, connection := range node.connections {
+		connections = append(connections, connection)
+	}
+
+	return connections
+}
+
+// Closes all the sources, sinks, relays and senders
+func (node *WebRTC_CDN_Node) closeAllSessions() {
+	node.mutexStatus.Lock()
+
+	sources := make([]*WRTC_Source, 0, len(node.sources))
+	for _, source := range node.sources {
+		sources = append(sources, source)
+	}
+
+	sinks := make([]*WRTC_Sink, 0)
+	for _, sinksForStream := range node.sinks {
+		for _, sink := range sinksForStream {
+			sinks = append(sinks, sink)
+		}
+	}
+
+	relays := make([]*WRTC_Relay, 0, len(node.relays))
+	for _, relay := range node.relays {
+		relays = append(relays, relay)
+	}
+	node.relays = make(map[string]*WRTC_Relay)
+
+	senders := make([]*WRTC_Source_Sender, 0)
+	for _, sendersForStream := range node.senders {
+		for _, sender := range sendersForStream {
+			senders = append(senders, sender)
+		}
+	}
+	node.senders = make(map[string]map[string]*WRTC_Source_Sender)
+
+	node.mutexStatus.Unlock()
+
+	for _, sink := range sinks {
+		sink.kick()
+	}
+
+	for _, relay := range relays {
+		relay.close()
+	}
+
+	for _, sender := range senders {
+		sender.close()
+	}
+
+	for _, source := range sources {
+		source.close(true, true)
+	}
+}
@@ -25,19 +25,25 @@ func (node *WebRTC_CDN_Node) registerSink(sink *WRTC_Sink) {
 
 	// Is there a ready source for it?
 	if node.sources[sink.sid] != nil && node.sources[sink.sid].ready {
-		sink.onTracksReady(node.sources[sink.sid].localTrackVideo, node.sources[sink.sid].localTrackAudio)
+		sink.onTracksReady(node.sources[sink.sid].localTrackVideo, node.sources[sink.sid].localTrackAudio, node.sources[sink.sid].simulcast, node.sources[sink.sid].gopCache)
 		return
 	}
 
 	// Is there a relay for it?
+	node.checkRelayLayers(sink.sid)
+
 	if node.relays[sink.sid] != nil && node.relays[sink.sid].ready {
-		sink.onTracksReady(node.relays[sink.sid].localTrackVideo, node.relays[sink.sid].localTrackAudio)
+		sink.onTracksReady(node.relays[sink.sid].localTrackVideo, node.relays[sink.sid].localTrackAudio, node.relays[sink.sid].simulcast, node.relays[sink.sid].gopCache)
 		return
 	}
 
+	if node.relays[sink.sid] != nil {
+		return // Waiting for the relay to be ready
+	}
+
 	// Can't find any source, maybe other node has it?
-	// Announce to other nodes to create the relay
-	node.sendResolveMessage(sink.sid)
+	// Check the registry, or announce to other nodes to create the relay
+	node.locateStream(sink.sid)
 }
 
 // Removes a sink
@@ -2,23 +2,31 @@
 
 package main
 
-// Checks if the node has a WebRTC source
+// Finds the WebRTC source of the node
 // for the specified Stream Id (sid)
-func (node *WebRTC_CDN_Node) resolveSource(sid string) bool {
+// Returns nil if the node does not have it
+func (node *WebRTC_CDN_Node) resolveSource(sid string) *WRTC_Source {
 	node.mutexStatus.Lock()
 	defer node.mutexStatus.Unlock()
 
-	return node.sources[sid] != nil
+	return node.sources[sid]
 }
 
 // Registers a WebRTC source
-func (node *WebRTC_CDN_Node) registerSource(source *WRTC_Source) {
+// Returns false if the stream is already being published in the node,
+// and the source is not allowed to replace the existing one
+func (node *WebRTC_CDN_Node) registerSource(source *WRTC_Source) bool {
 	node.mutexStatus.Lock()
 	defer node.mutexStatus.Unlock()
 
 	if node.sources[source.sid] != nil {
-		// Close the old source
 		s := node.sources[source.sid]
+
+		if !source.takeover && (source.exclusive || s.exclusive) {
+			return false // Exclusive stream
+		}
+
+		// Close the old source
 		s.close(true, false)
 	}
 
@@ -39,7 +47,10 @@ func (node *WebRTC_CDN_Node) registerSource(source *WRTC_Source) {
 	}
 
 	// Announce to other nodes
-	node.sendInfoMessage(REDIS_BROADCAST_CHANNEL, source.sid)
+	node.sendInfoMessage(REDIS_BROADCAST_CHANNEL, source)
+	node.registerStream(source)
+
+	return true
 }
 
 // Called when a WebRTC source is ready
@@ -53,14 +64,14 @@ func (node *WebRTC_CDN_Node) onSourceReady(source *WRTC_Source) {
 	// Notify sinks
 	if node.sinks[source.sid] != nil {
 		for _, sink := range node.sinks[source.sid] {
-			sink.onTracksReady(source.localTrackVideo, source.localTrackAudio)
+			sink.onTracksReady(source.localTrackVideo, source.localTrackAudio, source.simulcast, source.gopCache)
 		}
 	}
 
 	// Notify senders
 	if node.senders[source.sid] != nil {
 		for _, sender := range node.senders[source.sid] {
-			sender.onTracksReady(source.localTrackVideo, source.localTrackAudio)
+			sender.onTracksReady(source.localTrackVideo, source.localTrackAudio, source.simulcast, source.gopCache)
 		}
 	}
 }
@@ -72,6 +83,7 @@ func (node *WebRTC_CDN_Node) onSourceClosed(source *WRTC_Source) {
 	defer node.mutexStatus.Unlock()
 
 	delete(node.sources, source.sid)
+	node.unregisterStream(source)
 
 	// Close and remove all the senders
 	if node.senders[source.sid] != nil {
@@ -85,7 +97,31 @@ func (node *WebRTC_CDN_Node) onSourceClosed(source *WRTC_Source) {
 	// Any sinks waiting, tell them the tracks are closed
 	if node.sinks[source.sid] != nil {
 		for _, sink := range node.sinks[source.sid] {
-			sink.onTracksClosed(source.localTrackVideo, source.localTrackAudio)
+			sink.onTracksClosed(source.localTrackVideo, source.localTrackAudio, source.simulcast, source.gopCache)
 		}
 	}
 }
+
+// Requests a keyframe to the publisher of a stream
+// If the stream is received from another node, the request is sent to that node
+// rid is the simulcast layer ID. If empty, a keyframe is requested for every layer
+func (node *WebRTC_CDN_Node) requestKeyframe(sid string, rid string) {
+	node.mutexStatus.Lock()
+	source := node.sources[sid]
+	relay := node.relays[sid]
+	node.mutexStatus.Unlock()
+
+	if source != nil {
+		source.requestKeyframe(rid)
+	} else if relay != nil {
+		relay.requestKeyframe(rid)
+	}
+}
+
+// Checks if a stream has any sinks or senders
+func (node *WebRTC_CDN_Node) hasStreamConsumers(sid string) bool {
+	node.mutexStatus.Lock()
+	defer node.mutexStatus.Unlock()
+
+	return len(node.sinks[sid]) > 0 || len(node.senders[sid]) > 0
+}
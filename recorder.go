@@ -0,0 +1,157 @@
+// Stream recording
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// Default folder to store the recordings
+const RECORDING_DEFAULT_PATH = "./recordings"
+
+// Characters not allowed in the recording file names
+var recordingFileNameSanitizer = regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+
+// TrackRecorder - Writes the RTP packets
+// of a track into a file
+type TrackRecorder struct {
+	fileName string       // Path to the file
+	writer   media.Writer // Media writer for the codec
+
+	mutex  *sync.Mutex // Mutex to control access to the writer
+	closed bool        // True if the file was closed
+}
+
+// Checks if a stream must be recorded
+// Recording is enabled for all the streams in the configuration
+// or per stream with the 'rec' claim of the publish token
+func isRecordingEnabled(config *RecordingConfig, claims jwt.MapClaims) bool {
+	return config.Enabled || getBooleanClaim(claims, "rec")
+}
+
+// Gets the path of the recording file
+// {RECORDING_PATH}/{stream-id}/{stream-id}_{timestamp}_{recording-id}_{kind}.{ext}
+// The recording ID is unique for each source, so sources starting in the same second,
+// or with stream IDs that are sanitized to the same name, do not share files
+func getRecordingFileName(recordingPath string, sid string, startTime time.Time, recordingId string, kind string, ext string) string {
+	if recordingPath == "" {
+		recordingPath = RECORDING_DEFAULT_PATH
+	}
+
+	safeSid := recordingFileNameSanitizer.ReplaceAllString(sid, "_")
+
+	return filepath.Join(recordingPath, safeSid, safeSid+"_"+startTime.UTC().Format("20060102-150405")+"_"+recordingId+"_"+kind+"."+ext)
+}
+
+// Creates a recorder for a track
+// Returns nil if the codec is not supported or the file cannot be created
+func createTrackRecorder(config *RecordingConfig, sid string, startTime time.Time, recordingId string, codec webrtc.RTPCodecParameters) *TrackRecorder {
+	var fileName string
+
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9):
+		fileName = getRecordingFileName(config.Path, sid, startTime, recordingId, "video", "ivf")
+	case strings.ToLower(webrtc.MimeTypeH264):
+		fileName = getRecordingFileName(config.Path, sid, startTime, recordingId, "video", "h264")
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		fileName = getRecordingFileName(config.Path, sid, startTime, recordingId, "audio", "ogg")
+	default:
+		LogWarning("Cannot record stream " + sid + ": Unsupported codec " + codec.MimeType)
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+
+	if err != nil {
+		LogError(err)
+		return nil
+	}
+
+	// Reserve the file name, failing if the file exists,
+	// since the media writers truncate the file they open
+
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		LogError(err)
+		return nil
+	}
+
+	file.Close()
+
+	var writer media.Writer
+
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9):
+		writer, err = ivfwriter.New(fileName, ivfwriter.WithCodec(codec.MimeType))
+	case strings.ToLower(webrtc.MimeTypeH264):
+		writer, err = h264writer.New(fileName)
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		writer, err = oggwriter.New(fileName, codec.ClockRate, codec.Channels)
+	}
+
+	if err != nil {
+		LogError(err)
+		return nil
+	}
+
+	LogInfo("Recording stream " + sid + " into " + fileName)
+
+	return &TrackRecorder{
+		fileName: fileName,
+		writer:   writer,
+		mutex:    &sync.Mutex{},
+		closed:   false,
+	}
+}
+
+// Writes a packet into the file
+func (recorder *TrackRecorder) writePacket(buf []byte) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.closed {
+		return
+	}
+
+	packet := &rtp.Packet{}
+
+	if err := packet.Unmarshal(buf); err != nil {
+		return // Invalid packet
+	}
+
+	if err := recorder.writer.WriteRTP(packet); err != nil {
+		LogError(err)
+	}
+}
+
+// Closes the recording file
+func (recorder *TrackRecorder) close() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.closed {
+		return
+	}
+
+	recorder.closed = true
+
+	if err := recorder.writer.Close(); err != nil {
+		LogError(err)
+	}
+
+	LogInfo("Recording finished: " + recorder.fileName)
+}
@@ -0,0 +1,110 @@
+// Redis stream registry
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Prefix of the Redis keys of the stream registry
+// Key: {prefix}{stream-id}
+const REDIS_STREAM_REGISTRY_KEY_PREFIX = "webrtc_cdn:stream:"
+
+// Max time to wait for a command of the stream registry
+const REDIS_STREAM_REGISTRY_TIMEOUT = 2 * time.Second
+
+// Deletes a key only if it has the expected value
+var redisDeleteIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisStreamRegistry - Stream registry using Redis keys with expiration
+// The value of each key is the JSON encoded entry
+type RedisStreamRegistry struct {
+	client *redis.Client // Redis client
+
+	ttl time.Duration // Lifetime of the entries
+
+	ctx    context.Context    // Context for the redis commands
+	cancel context.CancelFunc // Cancels the context when the registry is closed
+}
+
+// Creates a stream registry using Redis,
+// with the options of the configuration
+func NewRedisStreamRegistry(config *RedisConfig) *RedisStreamRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &RedisStreamRegistry{
+		client: newRedisClient(config),
+		ttl:    time.Duration(config.StreamRegistryTTLSeconds) * time.Second,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Registers a stream, or refreshes the entry
+func (registry *RedisStreamRegistry) Register(sid string, entry *StreamRegistryEntry) error {
+	value, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(registry.ctx, REDIS_STREAM_REGISTRY_TIMEOUT)
+	defer cancel()
+
+	return registry.client.Set(ctx, REDIS_STREAM_REGISTRY_KEY_PREFIX+sid, value, registry.ttl).Err()
+}
+
+// Removes a stream, only if the key still contains the entry
+func (registry *RedisStreamRegistry) Unregister(sid string, entry *StreamRegistryEntry) error {
+	value, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(registry.ctx, REDIS_STREAM_REGISTRY_TIMEOUT)
+	defer cancel()
+
+	return redisDeleteIfEqualScript.Run(ctx, registry.client, []string{REDIS_STREAM_REGISTRY_KEY_PREFIX + sid}, string(value)).Err()
+}
+
+// Finds the location of a stream
+func (registry *RedisStreamRegistry) Lookup(sid string) (*StreamRegistryEntry, error) {
+	ctx, cancel := context.WithTimeout(registry.ctx, REDIS_STREAM_REGISTRY_TIMEOUT)
+	defer cancel()
+
+	value, err := registry.client.Get(ctx, REDIS_STREAM_REGISTRY_KEY_PREFIX+sid).Bytes()
+
+	if err == redis.Nil {
+		return nil, nil // Not registered
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	entry := StreamRegistryEntry{}
+
+	err = json.Unmarshal(value, &entry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// Closes the registry
+func (registry *RedisStreamRegistry) Close() {
+	registry.cancel()
+	registry.client.Close()
+}
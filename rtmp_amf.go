@@ -0,0 +1,258 @@
+// AMF0 encoding, used by the RTMP commands
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers
+const (
+	AMF0_NUMBER       = 0x00
+	AMF0_BOOLEAN      = 0x01
+	AMF0_STRING       = 0x02
+	AMF0_OBJECT       = 0x03
+	AMF0_NULL         = 0x05
+	AMF0_UNDEFINED    = 0x06
+	AMF0_ECMA_ARRAY   = 0x08
+	AMF0_OBJECT_END   = 0x09
+	AMF0_STRICT_ARRAY = 0x0A
+	AMF0_DATE         = 0x0B
+	AMF0_LONG_STRING  = 0x0C
+)
+
+// Max nesting of objects and arrays
+const AMF0_MAX_DEPTH = 16
+
+// AMF0Decoder - Reads AMF0 values from a buffer
+type AMF0Decoder struct {
+	data []byte
+	pos  int
+}
+
+// Checks if there are more values to read
+func (decoder *AMF0Decoder) hasMore() bool {
+	return decoder.pos < len(decoder.data)
+}
+
+// Reads n bytes
+func (decoder *AMF0Decoder) read(n int) ([]byte, error) {
+	if n < 0 || decoder.pos+n > len(decoder.data) {
+		return nil, errors.New("unexpected end of AMF0 data")
+	}
+
+	b := decoder.data[decoder.pos : decoder.pos+n]
+	decoder.pos += n
+
+	return b, nil
+}
+
+// Reads a string without type marker
+func (decoder *AMF0Decoder) readRawString(long bool) (string, error) {
+	var length int
+
+	if long {
+		b, err := decoder.read(4)
+		if err != nil {
+			return "", err
+		}
+		length = int(binary.BigEndian.Uint32(b))
+	} else {
+		b, err := decoder.read(2)
+		if err != nil {
+			return "", err
+		}
+		length = int(binary.BigEndian.Uint16(b))
+	}
+
+	b, err := decoder.read(length)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Reads the properties of an object, until the end marker
+func (decoder *AMF0Decoder) readProperties(depth int) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+
+	for {
+		key, err := decoder.readRawString(false)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" {
+			marker, err := decoder.read(1)
+			if err != nil {
+				return nil, err
+			}
+
+			if marker[0] != AMF0_OBJECT_END {
+				return nil, errors.New("invalid AMF0 object end")
+			}
+
+			return obj, nil
+		}
+
+		value, err := decoder.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		obj[key] = value
+	}
+}
+
+// Reads a value
+// Numbers are returned as float64, objects and ECMA arrays as map[string]interface{}
+// strict arrays as []interface{}, and null or undefined as nil
+func (decoder *AMF0Decoder) readValue(depth int) (interface{}, error) {
+	if depth > AMF0_MAX_DEPTH {
+		return nil, errors.New("AMF0 data is too deep")
+	}
+
+	marker, err := decoder.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker[0] {
+	case AMF0_NUMBER:
+		b, err := decoder.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case AMF0_BOOLEAN:
+		b, err := decoder.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case AMF0_STRING:
+		return decoder.readRawString(false)
+	case AMF0_LONG_STRING:
+		return decoder.readRawString(true)
+	case AMF0_OBJECT:
+		return decoder.readProperties(depth)
+	case AMF0_ECMA_ARRAY:
+		if _, err := decoder.read(4); err != nil {
+			return nil, err
+		}
+		return decoder.readProperties(depth)
+	case AMF0_STRICT_ARRAY:
+		b, err := decoder.read(4)
+		if err != nil {
+			return nil, err
+		}
+
+		count := int(binary.BigEndian.Uint32(b))
+
+		if count > len(decoder.data)-decoder.pos {
+			return nil, errors.New("invalid AMF0 array length")
+		}
+
+		arr := make([]interface{}, 0, count)
+
+		for i := 0; i < count; i++ {
+			value, err := decoder.readValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+
+		return arr, nil
+	case AMF0_DATE:
+		b, err := decoder.read(10)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[:8])), nil
+	case AMF0_NULL, AMF0_UNDEFINED:
+		return nil, nil
+	default:
+		return nil, errors.New("unsupported AMF0 type")
+	}
+}
+
+// Decodes all the AMF0 values of a buffer
+func decodeAMF0(data []byte) ([]interface{}, error) {
+	decoder := &AMF0Decoder{data: data}
+	values := make([]interface{}, 0)
+
+	for decoder.hasMore() {
+		value, err := decoder.readValue(0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// Encodes AMF0 values
+// Supported types: float64, int, bool, string, map[string]interface{} (object) and nil (null)
+func encodeAMF0(values ...interface{}) []byte {
+	buf := make([]byte, 0, 256)
+
+	for _, value := range values {
+		buf = appendAMF0Value(buf, value)
+	}
+
+	return buf
+}
+
+// Appends an AMF0 value to a buffer
+func appendAMF0Value(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case float64:
+		buf = append(buf, AMF0_NUMBER)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+	case int:
+		buf = appendAMF0Value(buf, float64(v))
+	case bool:
+		buf = append(buf, AMF0_BOOLEAN)
+		if v {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	case string:
+		if len(v) > math.MaxUint16 {
+			buf = append(buf, AMF0_LONG_STRING)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+		} else {
+			buf = append(buf, AMF0_STRING)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(v)))
+		}
+		buf = append(buf, v...)
+	case map[string]interface{}:
+		buf = append(buf, AMF0_OBJECT)
+
+		// Sorted keys, for a deterministic output
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+			buf = append(buf, key...)
+			buf = appendAMF0Value(buf, v[key])
+		}
+
+		buf = append(buf, 0, 0, AMF0_OBJECT_END)
+	default:
+		buf = append(buf, AMF0_NULL)
+	}
+
+	return buf
+}
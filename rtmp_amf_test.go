@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAMF0RoundTrip(t *testing.T) {
+	longString := strings.Repeat("a", 70000)
+
+	values := []interface{}{
+		"connect",
+		float64(1),
+		map[string]interface{}{
+			"app":      "live",
+			"tcUrl":    "rtmp://localhost/live",
+			"fpad":     false,
+			"audio":    float64(3575),
+			"nested":   map[string]interface{}{"level": "status"},
+			"nothing":  nil,
+			"longText": longString,
+		},
+		nil,
+		true,
+	}
+
+	decoded, err := decodeAMF0(encodeAMF0(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, values) {
+		t.Fatalf("the decoded values are different: %v", decoded)
+	}
+}
+
+func TestAMF0Decode(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		expected []interface{}
+	}{
+		{
+			name:     "ECMA array",
+			data:     []byte{AMF0_ECMA_ARRAY, 0, 0, 0, 1, 0, 1, 'a', AMF0_BOOLEAN, 1, 0, 0, AMF0_OBJECT_END},
+			expected: []interface{}{map[string]interface{}{"a": true}},
+		},
+		{
+			name:     "strict array",
+			data:     []byte{AMF0_STRICT_ARRAY, 0, 0, 0, 2, AMF0_NULL, AMF0_UNDEFINED},
+			expected: []interface{}{[]interface{}{nil, nil}},
+		},
+		{
+			name:     "date",
+			data:     append(append([]byte{AMF0_DATE}, binary.BigEndian.AppendUint64(nil, 0x4000000000000000)...), 0, 0),
+			expected: []interface{}{float64(2)},
+		},
+		{
+			name:     "long string",
+			data:     []byte{AMF0_LONG_STRING, 0, 0, 0, 2, 'o', 'k'},
+			expected: []interface{}{"ok"},
+		},
+		{
+			name:     "empty",
+			data:     []byte{},
+			expected: []interface{}{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			decoded, err := decodeAMF0(c.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(decoded, c.expected) {
+				t.Fatalf("expected %v, got %v", c.expected, decoded)
+			}
+		})
+	}
+}
+
+func TestAMF0DecodeInvalid(t *testing.T) {
+	deep := bytes.Repeat([]byte{AMF0_STRICT_ARRAY, 0, 0, 0, 1}, AMF0_MAX_DEPTH+2)
+	deep = append(deep, AMF0_NULL)
+
+	cases := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"truncated number", []byte{AMF0_NUMBER, 0, 0, 0}, "unexpected end of AMF0 data"},
+		{"truncated boolean", []byte{AMF0_BOOLEAN}, "unexpected end of AMF0 data"},
+		{"truncated string length", []byte{AMF0_STRING, 0}, "unexpected end of AMF0 data"},
+		{"truncated string", []byte{AMF0_STRING, 0, 5, 'a', 'b'}, "unexpected end of AMF0 data"},
+		{"truncated long string", []byte{AMF0_LONG_STRING, 0xFF, 0xFF, 0xFF, 0xFF, 'a'}, "unexpected end of AMF0 data"},
+		{"truncated object key", []byte{AMF0_OBJECT, 0, 3, 'a'}, "unexpected end of AMF0 data"},
+		{"truncated object value", []byte{AMF0_OBJECT, 0, 1, 'a'}, "unexpected end of AMF0 data"},
+		{"object without end", []byte{AMF0_OBJECT, 0, 1, 'a', AMF0_NULL}, "unexpected end of AMF0 data"},
+		{"invalid object end", []byte{AMF0_OBJECT, 0, 0, AMF0_NULL}, "invalid AMF0 object end"},
+		{"truncated ECMA array count", []byte{AMF0_ECMA_ARRAY, 0, 0}, "unexpected end of AMF0 data"},
+		{"truncated strict array count", []byte{AMF0_STRICT_ARRAY, 0}, "unexpected end of AMF0 data"},
+		{"strict array count too big", []byte{AMF0_STRICT_ARRAY, 0xFF, 0xFF, 0xFF, 0xFF, AMF0_NULL}, "invalid AMF0 array length"},
+		{"truncated strict array", []byte{AMF0_STRICT_ARRAY, 0, 0, 0, 2, AMF0_NUMBER, 0}, "unexpected end of AMF0 data"},
+		{"truncated date", []byte{AMF0_DATE, 0, 0, 0, 0, 0, 0, 0, 0}, "unexpected end of AMF0 data"},
+		{"too deep", deep, "AMF0 data is too deep"},
+		{"unsupported type", []byte{0x11}, "unsupported AMF0 type"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := decodeAMF0(c.data)
+
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if err.Error() != c.err {
+				t.Fatalf("expected error %q, got %q", c.err, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+// RTMP chunk stream
+// Splits the RTMP messages into chunks and assembles the received chunks into messages
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+)
+
+// Default chunk size
+const RTMP_DEFAULT_CHUNK_SIZE = 128
+
+// Chunk size used to send messages
+const RTMP_OUT_CHUNK_SIZE = 4096
+
+// Max chunk size accepted from the client
+const RTMP_MAX_CHUNK_SIZE = 16 * 1024 * 1024
+
+// Max size of a message received from the client
+const RTMP_MAX_MESSAGE_SIZE = 8 * 1024 * 1024
+
+// Max number of chunk streams a client can open
+const RTMP_MAX_CHUNK_STREAMS = 64
+
+// Max number of bytes of chunk data read at once
+// Message buffers grow by this amount as the data arrives
+const RTMP_READ_STEP = 64 * 1024
+
+// Value of the timestamp field when the extended timestamp is used
+const RTMP_EXTENDED_TIMESTAMP = 0xFFFFFF
+
+// RTMP message types
+const (
+	RTMP_TYPE_SET_CHUNK_SIZE     = 1
+	RTMP_TYPE_ABORT              = 2
+	RTMP_TYPE_ACKNOWLEDGEMENT    = 3
+	RTMP_TYPE_USER_CONTROL       = 4
+	RTMP_TYPE_WINDOW_ACK_SIZE    = 5
+	RTMP_TYPE_SET_PEER_BANDWIDTH = 6
+	RTMP_TYPE_AUDIO              = 8
+	RTMP_TYPE_VIDEO              = 9
+	RTMP_TYPE_DATA_AMF3          = 15
+	RTMP_TYPE_COMMAND_AMF3       = 17
+	RTMP_TYPE_DATA_AMF0          = 18
+	RTMP_TYPE_COMMAND_AMF0       = 20
+)
+
+// RTMPMessage - Message sent or received
+type RTMPMessage struct {
+	typeId    uint8  // Message type
+	streamId  uint32 // Message stream ID
+	timestamp uint32 // Timestamp (ms)
+	payload   []byte // Payload
+}
+
+// RTMPChunkStream - Status of a chunk stream being received
+type RTMPChunkStream struct {
+	timestamp      uint32 // Timestamp of the last message
+	timestampDelta uint32 // Last timestamp delta
+	extended       bool   // True if the last header used the extended timestamp
+	length         uint32 // Length of the message
+	typeId         uint8  // Type of the message
+	streamId       uint32 // Message stream ID
+
+	buffer []byte // Message being received
+}
+
+// RTMPChunkReader - Reads messages from the client
+type RTMPChunkReader struct {
+	reader    io.Reader
+	chunkSize uint32
+	streams   map[uint32]*RTMPChunkStream
+
+	bytesRead uint64 // Total number of bytes read, for acknowledgements
+}
+
+// Creates a chunk reader
+func newRTMPChunkReader(reader io.Reader) *RTMPChunkReader {
+	return &RTMPChunkReader{
+		reader:    reader,
+		chunkSize: RTMP_DEFAULT_CHUNK_SIZE,
+		streams:   make(map[uint32]*RTMPChunkStream),
+	}
+}
+
+// Reads n bytes
+func (r *RTMPChunkReader) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+
+	_, err := io.ReadFull(r.reader, b)
+	if err != nil {
+		return nil, err
+	}
+
+	r.bytesRead += uint64(n)
+
+	return b, nil
+}
+
+// Reads n bytes, appending them to a buffer
+// The buffer grows as the data arrives, instead of being reserved in advance
+func (r *RTMPChunkReader) readAppend(buf []byte, n int) ([]byte, error) {
+	for n > 0 {
+		step := min(n, RTMP_READ_STEP)
+		start := len(buf)
+
+		buf = slices.Grow(buf, step)[:start+step]
+
+		_, err := io.ReadFull(r.reader, buf[start:])
+		if err != nil {
+			return nil, err
+		}
+
+		r.bytesRead += uint64(step)
+		n -= step
+	}
+
+	return buf, nil
+}
+
+// Reads a big endian unsigned integer of n bytes
+func (r *RTMPChunkReader) readUint(n int) (uint32, error) {
+	b, err := r.read(n)
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint32
+
+	for _, x := range b {
+		v = v<<8 | uint32(x)
+	}
+
+	return v, nil
+}
+
+// Reads chunks until a message is complete
+func (r *RTMPChunkReader) readMessage() (*RTMPMessage, error) {
+	for {
+		msg, err := r.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg != nil {
+			return msg, nil
+		}
+	}
+}
+
+// Reads a chunk
+// Returns the message if the chunk completes it
+func (r *RTMPChunkReader) readChunk() (*RTMPMessage, error) {
+	// Basic header
+	b, err := r.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	format := b[0] >> 6
+	csid := uint32(b[0] & 0x3F)
+
+	switch csid {
+	case 0:
+		n, err := r.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + n
+	case 1:
+		b, err := r.read(2)
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])*256
+	}
+
+	stream := r.streams[csid]
+
+	if stream == nil {
+		if format != 0 {
+			return nil, errors.New("the first chunk of a chunk stream must have a full header")
+		}
+
+		if len(r.streams) >= RTMP_MAX_CHUNK_STREAMS {
+			return nil, errors.New("too many chunk streams")
+		}
+
+		stream = &RTMPChunkStream{}
+		r.streams[csid] = stream
+	}
+
+	newMessage := len(stream.buffer) == 0
+
+	if !newMessage && format < 2 {
+		// The length and type can only change with a new message
+		return nil, errors.New("message header received before the previous message was complete")
+	}
+
+	// Message header
+	var timestampField uint32
+
+	switch format {
+	case 0:
+		if timestampField, err = r.readUint(3); err != nil {
+			return nil, err
+		}
+		if stream.length, err = r.readUint(3); err != nil {
+			return nil, err
+		}
+		t, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		stream.typeId = t[0]
+		s, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		stream.streamId = binary.LittleEndian.Uint32(s)
+	case 1:
+		if timestampField, err = r.readUint(3); err != nil {
+			return nil, err
+		}
+		if stream.length, err = r.readUint(3); err != nil {
+			return nil, err
+		}
+		t, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		stream.typeId = t[0]
+	case 2:
+		if timestampField, err = r.readUint(3); err != nil {
+			return nil, err
+		}
+	}
+
+	if format < 3 {
+		stream.extended = timestampField == RTMP_EXTENDED_TIMESTAMP
+	}
+
+	// Extended timestamp
+	if stream.extended {
+		if timestampField, err = r.readUint(4); err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case 0:
+		stream.timestamp = timestampField
+		stream.timestampDelta = 0
+	case 1, 2:
+		stream.timestampDelta = timestampField
+		stream.timestamp += timestampField
+	case 3:
+		if newMessage {
+			stream.timestamp += stream.timestampDelta
+		}
+	}
+
+	if stream.length > RTMP_MAX_MESSAGE_SIZE {
+		return nil, errors.New("the message is too large")
+	}
+
+	// Chunk data
+	size := stream.length - uint32(len(stream.buffer))
+	if size > r.chunkSize {
+		size = r.chunkSize
+	}
+
+	if stream.buffer, err = r.readAppend(stream.buffer, int(size)); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(stream.buffer)) < stream.length {
+		return nil, nil // Incomplete
+	}
+
+	msg := &RTMPMessage{
+		typeId:    stream.typeId,
+		streamId:  stream.streamId,
+		timestamp: stream.timestamp,
+		payload:   stream.buffer,
+	}
+
+	stream.buffer = nil
+
+	return msg, nil
+}
+
+// Sets the chunk size, after a Set Chunk Size message
+func (r *RTMPChunkReader) setChunkSize(size uint32) error {
+	size = size & 0x7FFFFFFF
+
+	if size < 1 || size > RTMP_MAX_CHUNK_SIZE {
+		return errors.New("invalid chunk size")
+	}
+
+	r.chunkSize = size
+
+	return nil
+}
+
+// Discards the message being received in a chunk stream, after an Abort message
+func (r *RTMPChunkReader) abort(csid uint32) {
+	if r.streams[csid] != nil {
+		r.streams[csid].buffer = nil
+	}
+}
+
+// RTMPChunkWriter - Sends messages to the client
+type RTMPChunkWriter struct {
+	mutex     *sync.Mutex
+	writer    io.Writer
+	chunkSize uint32
+}
+
+// Creates a chunk writer
+func newRTMPChunkWriter(writer io.Writer) *RTMPChunkWriter {
+	return &RTMPChunkWriter{
+		mutex:     &sync.Mutex{},
+		writer:    writer,
+		chunkSize: RTMP_DEFAULT_CHUNK_SIZE,
+	}
+}
+
+// Sends a message using a chunk stream (csid from 2 to 63)
+func (w *RTMPChunkWriter) writeMessage(csid uint32, msg *RTMPMessage) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	extended := msg.timestamp >= RTMP_EXTENDED_TIMESTAMP
+	timestampField := msg.timestamp
+	if extended {
+		timestampField = RTMP_EXTENDED_TIMESTAMP
+	}
+
+	buf := make([]byte, 0, len(msg.payload)+32)
+
+	// First chunk, with full header
+	buf = append(buf, byte(csid&0x3F))
+	buf = append(buf, byte(timestampField>>16), byte(timestampField>>8), byte(timestampField))
+	length := len(msg.payload)
+	buf = append(buf, byte(length>>16), byte(length>>8), byte(length))
+	buf = append(buf, msg.typeId)
+	buf = binary.LittleEndian.AppendUint32(buf, msg.streamId)
+
+	if extended {
+		buf = binary.BigEndian.AppendUint32(buf, msg.timestamp)
+	}
+
+	for pos := 0; pos < length || pos == 0; {
+		if pos > 0 {
+			// Continuation chunk
+			buf = append(buf, 0xC0|byte(csid&0x3F))
+
+			if extended {
+				buf = binary.BigEndian.AppendUint32(buf, msg.timestamp)
+			}
+		}
+
+		end := pos + int(w.chunkSize)
+		if end > length {
+			end = length
+		}
+
+		buf = append(buf, msg.payload[pos:end]...)
+		pos = end
+
+		if length == 0 {
+			break
+		}
+	}
+
+	_, err := w.writer.Write(buf)
+
+	return err
+}
+
+// Sets the chunk size for the next messages
+// Call after sending a Set Chunk Size message
+func (w *RTMPChunkWriter) setChunkSize(size uint32) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.chunkSize = size
+}
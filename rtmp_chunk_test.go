@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// Builds the basic header of a chunk
+func rtmpBasicHeader(format byte, csid uint32) []byte {
+	switch {
+	case csid < 64:
+		return []byte{format<<6 | byte(csid)}
+	case csid < 320:
+		return []byte{format << 6, byte(csid - 64)}
+	default:
+		return []byte{format<<6 | 1, byte((csid - 64) % 256), byte((csid - 64) / 256)}
+	}
+}
+
+// Appends a big endian 24 bit integer
+func appendUint24(b []byte, v uint32) []byte {
+	return append(b, byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Builds a chunk with a full header (format 0)
+func rtmpChunk0(csid uint32, timestamp uint32, length int, typeId byte, streamId uint32, data []byte) []byte {
+	b := rtmpBasicHeader(0, csid)
+
+	if timestamp >= RTMP_EXTENDED_TIMESTAMP {
+		b = appendUint24(b, RTMP_EXTENDED_TIMESTAMP)
+	} else {
+		b = appendUint24(b, timestamp)
+	}
+
+	b = appendUint24(b, uint32(length))
+	b = append(b, typeId)
+	b = binary.LittleEndian.AppendUint32(b, streamId)
+
+	if timestamp >= RTMP_EXTENDED_TIMESTAMP {
+		b = binary.BigEndian.AppendUint32(b, timestamp)
+	}
+
+	return append(b, data...)
+}
+
+// Builds a chunk with the same message stream ID (format 1)
+func rtmpChunk1(csid uint32, delta uint32, length int, typeId byte, data []byte) []byte {
+	b := rtmpBasicHeader(1, csid)
+	b = appendUint24(b, delta)
+	b = appendUint24(b, uint32(length))
+	b = append(b, typeId)
+
+	return append(b, data...)
+}
+
+// Builds a chunk with only the timestamp delta (format 2)
+func rtmpChunk2(csid uint32, delta uint32, data []byte) []byte {
+	b := rtmpBasicHeader(2, csid)
+	b = appendUint24(b, delta)
+
+	return append(b, data...)
+}
+
+// Builds a chunk without message header (format 3)
+// The extended timestamp is included if the chunk stream uses it
+func rtmpChunk3(csid uint32, extendedTimestamp uint32, data []byte) []byte {
+	b := rtmpBasicHeader(3, csid)
+
+	if extendedTimestamp != 0 {
+		b = binary.BigEndian.AppendUint32(b, extendedTimestamp)
+	}
+
+	return append(b, data...)
+}
+
+// Builds a payload of n bytes
+func rtmpTestPayload(n int) []byte {
+	b := make([]byte, n)
+
+	for i := range b {
+		b[i] = byte(i)
+	}
+
+	return b
+}
+
+// Joins byte slices
+func joinBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// Reads all the messages from the data
+// Returns the messages read before the first error
+func readAllRTMPMessages(reader *RTMPChunkReader) ([]*RTMPMessage, error) {
+	messages := make([]*RTMPMessage, 0)
+
+	for {
+		msg, err := reader.readMessage()
+
+		if err == io.EOF {
+			return messages, nil
+		}
+
+		if err != nil {
+			return messages, err
+		}
+
+		messages = append(messages, msg)
+	}
+}
+
+func TestRTMPChunkReader(t *testing.T) {
+	payload300 := rtmpTestPayload(300)
+	payload10 := rtmpTestPayload(10)
+
+	cases := []struct {
+		name     string
+		data     []byte
+		expected []RTMPMessage
+		err      bool
+	}{
+		{
+			name:     "single chunk",
+			data:     rtmpChunk0(3, 1000, 10, RTMP_TYPE_COMMAND_AMF0, 0, payload10),
+			expected: []RTMPMessage{{RTMP_TYPE_COMMAND_AMF0, 0, 1000, payload10}},
+		},
+		{
+			name: "message split into chunks",
+			data: joinBytes(
+				rtmpChunk0(4, 40, 300, RTMP_TYPE_VIDEO, 1, payload300[:128]),
+				rtmpChunk3(4, 0, payload300[128:256]),
+				rtmpChunk3(4, 0, payload300[256:]),
+			),
+			expected: []RTMPMessage{{RTMP_TYPE_VIDEO, 1, 40, payload300}},
+		},
+		{
+			name: "format 1, 2 and 3 headers",
+			data: joinBytes(
+				rtmpChunk0(4, 100, 10, RTMP_TYPE_AUDIO, 1, payload10),
+				rtmpChunk1(4, 20, 5, RTMP_TYPE_VIDEO, payload10[:5]),
+				rtmpChunk2(4, 30, payload10[5:]),
+				rtmpChunk3(4, 0, payload10[:5]),
+			),
+			expected: []RTMPMessage{
+				{RTMP_TYPE_AUDIO, 1, 100, payload10},
+				{RTMP_TYPE_VIDEO, 1, 120, payload10[:5]},
+				{RTMP_TYPE_VIDEO, 1, 150, payload10[5:]},
+				{RTMP_TYPE_VIDEO, 1, 180, payload10[:5]}, // Same delta as the previous message
+			},
+		},
+		{
+			name: "extended timestamp",
+			data: joinBytes(
+				rtmpChunk0(4, 0x01000000, 300, RTMP_TYPE_VIDEO, 1, payload300[:128]),
+				rtmpChunk3(4, 0x01000000, payload300[128:256]),
+				rtmpChunk3(4, 0x01000000, payload300[256:]),
+			),
+			expected: []RTMPMessage{{RTMP_TYPE_VIDEO, 1, 0x01000000, payload300}},
+		},
+		{
+			name: "extended timestamp delta",
+			data: joinBytes(
+				rtmpChunk0(4, 0, 10, RTMP_TYPE_VIDEO, 1, payload10),
+				joinBytes(rtmpBasicHeader(2, 4), appendUint24(nil, RTMP_EXTENDED_TIMESTAMP), binary.BigEndian.AppendUint32(nil, 0x01000000), payload10),
+			),
+			expected: []RTMPMessage{
+				{RTMP_TYPE_VIDEO, 1, 0, payload10},
+				{RTMP_TYPE_VIDEO, 1, 0x01000000, payload10},
+			},
+		},
+		{
+			name: "interleaved chunk streams",
+			data: joinBytes(
+				rtmpChunk0(4, 10, 300, RTMP_TYPE_VIDEO, 1, payload300[:128]),
+				rtmpChunk0(5, 20, 10, RTMP_TYPE_AUDIO, 1, payload10),
+				rtmpChunk3(4, 0, payload300[128:256]),
+				rtmpChunk3(4, 0, payload300[256:]),
+			),
+			expected: []RTMPMessage{
+				{RTMP_TYPE_AUDIO, 1, 20, payload10},
+				{RTMP_TYPE_VIDEO, 1, 10, payload300},
+			},
+		},
+		{
+			name: "2 and 3 byte chunk stream IDs",
+			data: joinBytes(
+				rtmpChunk0(100, 1, 10, RTMP_TYPE_AUDIO, 1, payload10),
+				rtmpChunk0(1000, 2, 10, RTMP_TYPE_VIDEO, 1, payload10),
+				rtmpChunk3(100, 0, payload10),
+			),
+			expected: []RTMPMessage{
+				{RTMP_TYPE_AUDIO, 1, 1, payload10},
+				{RTMP_TYPE_VIDEO, 1, 2, payload10},
+				{RTMP_TYPE_AUDIO, 1, 1, payload10},
+			},
+		},
+		{
+			name: "empty message",
+			data: rtmpChunk0(3, 0, 0, RTMP_TYPE_COMMAND_AMF0, 0, nil),
+			expected: []RTMPMessage{
+				{RTMP_TYPE_COMMAND_AMF0, 0, 0, nil},
+			},
+		},
+		{
+			name: "first chunk without full header",
+			data: rtmpChunk1(4, 0, 10, RTMP_TYPE_VIDEO, payload10),
+			err:  true,
+		},
+		{
+			name: "length changed before the message is complete",
+			data: joinBytes(
+				rtmpChunk0(4, 0, 300, RTMP_TYPE_VIDEO, 1, payload300[:128]),
+				rtmpChunk1(4, 0, 10, RTMP_TYPE_VIDEO, payload10),
+			),
+			err: true,
+		},
+		{
+			name: "full header before the message is complete",
+			data: joinBytes(
+				rtmpChunk0(4, 0, 300, RTMP_TYPE_VIDEO, 1, payload300[:128]),
+				rtmpChunk0(4, 0, 10, RTMP_TYPE_VIDEO, 1, payload10),
+			),
+			err: true,
+		},
+		{
+			name: "oversized message",
+			data: rtmpChunk0(4, 0, RTMP_MAX_MESSAGE_SIZE+1, RTMP_TYPE_VIDEO, 1, payload10),
+			err:  true,
+		},
+		{
+			name: "truncated chunk",
+			data: rtmpChunk0(4, 0, 100, RTMP_TYPE_VIDEO, 1, payload10),
+			err:  true,
+		},
+		{
+			name: "truncated header",
+			data: rtmpChunk0(4, 0, 10, RTMP_TYPE_VIDEO, 1, nil)[:5],
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			messages, err := readAllRTMPMessages(newRTMPChunkReader(bytes.NewReader(c.data)))
+
+			if c.err && err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !c.err && err != nil {
+				t.Fatal(err)
+			}
+
+			if c.err {
+				return
+			}
+
+			if len(messages) != len(c.expected) {
+				t.Fatalf("expected %d messages, got %d", len(c.expected), len(messages))
+			}
+
+			for i, msg := range messages {
+				e := c.expected[i]
+
+				if msg.typeId != e.typeId || msg.streamId != e.streamId || msg.timestamp != e.timestamp || !bytes.Equal(msg.payload, e.payload) {
+					t.Fatalf("message %d: expected type=%d stream=%d timestamp=%d length=%d, got type=%d stream=%d timestamp=%d length=%d",
+						i, e.typeId, e.streamId, e.timestamp, len(e.payload), msg.typeId, msg.streamId, msg.timestamp, len(msg.payload))
+				}
+			}
+		})
+	}
+}
+
+func TestRTMPChunkReaderTooManyStreams(t *testing.T) {
+	data := make([]byte, 0)
+
+	for csid := uint32(3); csid < 3+RTMP_MAX_CHUNK_STREAMS+1; csid++ {
+		data = append(data, rtmpChunk0(csid, 0, 10, RTMP_TYPE_AUDIO, 1, rtmpTestPayload(10))...)
+	}
+
+	_, err := readAllRTMPMessages(newRTMPChunkReader(bytes.NewReader(data)))
+
+	if err == nil || err.Error() != "too many chunk streams" {
+		t.Fatalf("expected an error for too many chunk streams, got %v", err)
+	}
+}
+
+func TestRTMPChunkReaderSetChunkSize(t *testing.T) {
+	payload := rtmpTestPayload(5000)
+
+	reader := newRTMPChunkReader(bytes.NewReader(joinBytes(
+		rtmpChunk0(4, 0, 5000, RTMP_TYPE_VIDEO, 1, payload[:4096]),
+		rtmpChunk3(4, 0, payload[4096:]),
+	)))
+
+	// The most significant bit is ignored
+	if err := reader.setChunkSize(0x80000000 | 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := reader.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg.payload, payload) {
+		t.Fatal("unexpected payload")
+	}
+
+	for _, size := range []uint32{0, RTMP_MAX_CHUNK_SIZE + 1} {
+		if err := reader.setChunkSize(size); err == nil {
+			t.Fatalf("expected an error for the chunk size %d", size)
+		}
+	}
+}
+
+func TestRTMPChunkReaderAbort(t *testing.T) {
+	payload300 := rtmpTestPayload(300)
+	payload10 := rtmpTestPayload(10)
+
+	data := bytes.NewBuffer(nil)
+	reader := newRTMPChunkReader(data)
+
+	// Partial message
+	data.Write(rtmpChunk0(4, 0, 300, RTMP_TYPE_VIDEO, 1, payload300[:128]))
+
+	msg, err := reader.readChunk()
+	if err != nil || msg != nil {
+		t.Fatalf("expected an incomplete message, got %v, %v", msg, err)
+	}
+
+	// After the abort, a new message can start in the chunk stream
+	reader.abort(4)
+
+	data.Write(rtmpChunk0(4, 50, 10, RTMP_TYPE_AUDIO, 1, payload10))
+
+	msg, err = reader.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.typeId != RTMP_TYPE_AUDIO || msg.timestamp != 50 || !bytes.Equal(msg.payload, payload10) {
+		t.Fatalf("unexpected message after abort: type=%d timestamp=%d length=%d", msg.typeId, msg.timestamp, len(msg.payload))
+	}
+
+	// Aborting an unknown chunk stream is ignored
+	reader.abort(10)
+}
+
+func TestRTMPChunkWriter(t *testing.T) {
+	cases := []struct {
+		name      string
+		chunkSize uint32
+		msg       RTMPMessage
+	}{
+		{"small message", RTMP_DEFAULT_CHUNK_SIZE, RTMPMessage{RTMP_TYPE_COMMAND_AMF0, 0, 10, rtmpTestPayload(10)}},
+		{"empty message", RTMP_DEFAULT_CHUNK_SIZE, RTMPMessage{RTMP_TYPE_COMMAND_AMF0, 0, 10, []byte{}}},
+		{"several chunks", RTMP_DEFAULT_CHUNK_SIZE, RTMPMessage{RTMP_TYPE_DATA_AMF0, 1, 20, rtmpTestPayload(1000)}},
+		{"extended timestamp", RTMP_DEFAULT_CHUNK_SIZE, RTMPMessage{RTMP_TYPE_DATA_AMF0, 1, 0x01020304, rtmpTestPayload(1000)}},
+		{"output chunk size", RTMP_OUT_CHUNK_SIZE, RTMPMessage{RTMP_TYPE_DATA_AMF0, 1, 30, rtmpTestPayload(10000)}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+
+			writer := newRTMPChunkWriter(buf)
+			writer.setChunkSize(c.chunkSize)
+
+			if err := writer.writeMessage(RTMP_CSID_COMMAND, &c.msg); err != nil {
+				t.Fatal(err)
+			}
+
+			reader := newRTMPChunkReader(buf)
+
+			if err := reader.setChunkSize(c.chunkSize); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := reader.readMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.typeId != c.msg.typeId || msg.streamId != c.msg.streamId || msg.timestamp != c.msg.timestamp || !bytes.Equal(msg.payload, c.msg.payload) {
+				t.Fatalf("the message read is different: type=%d stream=%d timestamp=%d length=%d", msg.typeId, msg.streamId, msg.timestamp, len(msg.payload))
+			}
+
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes left after the message", buf.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+// RTMP media
+// Parses the audio and video messages (FLV tags, including enhanced RTMP)
+// and packetizes the frames into RTP
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// Max size of the RTP payloads
+const RTMP_RTP_MTU = 1200
+
+// FLV video codec IDs
+const FLV_VIDEO_CODEC_AVC = 7
+
+// FLV video frame types
+const FLV_VIDEO_FRAME_KEY = 1
+const FLV_VIDEO_FRAME_COMMAND = 5
+
+// AVC packet types (legacy and enhanced RTMP)
+const FLV_AVC_SEQUENCE_HEADER = 0
+const FLV_AVC_NALU = 1
+
+// Enhanced RTMP video packet types
+const ERTMP_VIDEO_SEQUENCE_START = 0
+const ERTMP_VIDEO_CODED_FRAMES = 1
+const ERTMP_VIDEO_CODED_FRAMES_X = 3
+
+// FLV audio formats
+const FLV_AUDIO_FORMAT_EX_HEADER = 9
+const FLV_AUDIO_FORMAT_AAC = 10
+const FLV_AUDIO_FORMAT_OPUS = 13
+
+// Enhanced RTMP audio packet types
+const ERTMP_AUDIO_SEQUENCE_START = 0
+const ERTMP_AUDIO_CODED_FRAMES = 1
+
+// Error returned for AAC audio
+var ErrRTMPAACNotSupported = errors.New("AAC audio is not supported, configure the encoder to send Opus audio (enhanced RTMP)")
+
+// RTMPTrack - Track received from a RTMP publisher, packetized into RTP
+type RTMPTrack struct {
+	codec webrtc.RTPCodecCapability // Codec
+
+	track    *webrtc.TrackLocalStaticRTP // Local track
+	writer   io.Writer                   // Receives the RTP packets (the track or its GOP cache)
+	recorder *TrackRecorder              // Recorder (nil if not recording)
+	metrics  *TrackMetrics               // Metrics
+
+	payloader rtp.Payloader // Splits the frames into RTP payloads (nil to send each frame in a single packet)
+	ssrc      uint32
+	sequencer rtp.Sequencer
+}
+
+// Creates a track
+func newRTMPTrack(kind string, codec webrtc.RTPCodecCapability, sid string, recorder *TrackRecorder) (*RTMPTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, kind, "pion")
+	if err != nil {
+		return nil, err
+	}
+
+	var payloader rtp.Payloader
+
+	if codec.MimeType == webrtc.MimeTypeH264 {
+		payloader = &codecs.H264Payloader{}
+	}
+
+	return &RTMPTrack{
+		codec:     codec,
+		track:     track,
+		writer:    track,
+		recorder:  recorder,
+		metrics:   getTrackMetrics(kind, sid),
+		payloader: payloader,
+		ssrc:      rand.Uint32(),
+		sequencer: rtp.NewRandomSequencer(),
+	}, nil
+}
+
+// Writes a frame, splitting it into RTP packets
+// The marker bit is set on the last packet of the frame
+func (t *RTMPTrack) writeFrame(frame []byte, timestamp uint32) {
+	if t.payloader == nil {
+		t.writePacket(frame, timestamp, true)
+		return
+	}
+
+	payloads := t.payloader.Payload(RTMP_RTP_MTU, frame)
+
+	for i, payload := range payloads {
+		t.writePacket(payload, timestamp, i == len(payloads)-1)
+	}
+}
+
+// Writes a RTP packet
+func (t *RTMPTrack) writePacket(payload []byte, timestamp uint32, marker bool) {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			SequenceNumber: t.sequencer.NextSequenceNumber(),
+			Timestamp:      timestamp,
+			SSRC:           t.ssrc,
+		},
+		Payload: payload,
+	}
+
+	buf, err := packet.Marshal()
+	if err != nil {
+		LogError(err)
+		return
+	}
+
+	t.metrics.onPacket(len(buf))
+
+	if t.recorder != nil {
+		t.recorder.writePacket(buf)
+	}
+
+	if _, err := t.writer.Write(buf); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		LogDebug("Could not write RTMP packet: " + err.Error())
+	}
+}
+
+// Releases the resources of the track
+func (t *RTMPTrack) close() {
+	if t.recorder != nil {
+		t.recorder.close()
+	}
+
+	t.metrics.release()
+}
+
+// RTMPVideoFrame - Video message received from the publisher
+type RTMPVideoFrame struct {
+	sequenceHeader  bool   // True if the payload is the AVC decoder configuration
+	keyframe        bool   // True for keyframes
+	compositionTime int32  // Composition time offset (ms)
+	payload         []byte // AVC decoder configuration or length prefixed NAL units
+}
+
+// Parses a video message
+// Returns nil (without error) for messages that do not contain frames
+func parseRTMPVideoMessage(data []byte) (*RTMPVideoFrame, error) {
+	if len(data) < 1 {
+		return nil, nil
+	}
+
+	if data[0]&0x80 != 0 {
+		// Enhanced RTMP
+		frameType := (data[0] >> 4) & 0x07
+		packetType := data[0] & 0x0F
+
+		if len(data) < 5 {
+			return nil, errors.New("invalid enhanced RTMP video message")
+		}
+
+		if string(data[1:5]) != "avc1" {
+			return nil, errors.New("unsupported video codec: " + string(data[1:5]) + ", only H.264 is supported")
+		}
+
+		if frameType == FLV_VIDEO_FRAME_COMMAND {
+			return nil, nil
+		}
+
+		switch packetType {
+		case ERTMP_VIDEO_SEQUENCE_START:
+			return &RTMPVideoFrame{sequenceHeader: true, payload: data[5:]}, nil
+		case ERTMP_VIDEO_CODED_FRAMES:
+			if len(data) < 8 {
+				return nil, errors.New("invalid enhanced RTMP video message")
+			}
+			return &RTMPVideoFrame{keyframe: frameType == FLV_VIDEO_FRAME_KEY, compositionTime: readInt24(data[5:8]), payload: data[8:]}, nil
+		case ERTMP_VIDEO_CODED_FRAMES_X:
+			return &RTMPVideoFrame{keyframe: frameType == FLV_VIDEO_FRAME_KEY, payload: data[5:]}, nil
+		default:
+			return nil, nil
+		}
+	}
+
+	frameType := data[0] >> 4
+	codecId := data[0] & 0x0F
+
+	if codecId != FLV_VIDEO_CODEC_AVC {
+		return nil, errors.New("unsupported video codec, only H.264 is supported")
+	}
+
+	if frameType == FLV_VIDEO_FRAME_COMMAND {
+		return nil, nil
+	}
+
+	if len(data) < 5 {
+		return nil, errors.New("invalid AVC video message")
+	}
+
+	switch data[1] {
+	case FLV_AVC_SEQUENCE_HEADER:
+		return &RTMPVideoFrame{sequenceHeader: true, payload: data[5:]}, nil
+	case FLV_AVC_NALU:
+		return &RTMPVideoFrame{keyframe: frameType == FLV_VIDEO_FRAME_KEY, compositionTime: readInt24(data[2:5]), payload: data[5:]}, nil
+	default:
+		return nil, nil // End of sequence
+	}
+}
+
+// RTMPAudioFrame - Audio message received from the publisher
+type RTMPAudioFrame struct {
+	sequenceHeader bool   // True if the payload is the codec configuration
+	payload        []byte // Opus packet
+}
+
+// Parses an audio message
+// Only Opus is supported, as enhanced RTMP (Opus FourCC) or using the sound format 13
+// Returns nil (without error) for messages that do not contain frames
+func parseRTMPAudioMessage(data []byte) (*RTMPAudioFrame, error) {
+	if len(data) < 1 {
+		return nil, nil
+	}
+
+	switch data[0] >> 4 {
+	case FLV_AUDIO_FORMAT_EX_HEADER:
+		packetType := data[0] & 0x0F
+
+		if len(data) < 5 {
+			return nil, errors.New("invalid enhanced RTMP audio message")
+		}
+
+		switch string(data[1:5]) {
+		case "Opus":
+		case "mp4a":
+			return nil, ErrRTMPAACNotSupported
+		default:
+			return nil, errors.New("unsupported audio codec: " + string(data[1:5]) + ", only Opus is supported")
+		}
+
+		switch packetType {
+		case ERTMP_AUDIO_SEQUENCE_START:
+			return &RTMPAudioFrame{sequenceHeader: true, payload: data[5:]}, nil
+		case ERTMP_AUDIO_CODED_FRAMES:
+			return &RTMPAudioFrame{payload: data[5:]}, nil
+		default:
+			return nil, nil
+		}
+	case FLV_AUDIO_FORMAT_OPUS:
+		if len(data) < 2 {
+			return nil, errors.New("invalid Opus audio message")
+		}
+
+		return &RTMPAudioFrame{sequenceHeader: data[1] == 0, payload: data[2:]}, nil
+	case FLV_AUDIO_FORMAT_AAC:
+		return nil, ErrRTMPAACNotSupported
+	default:
+		return nil, errors.New("unsupported audio codec, only Opus is supported")
+	}
+}
+
+// H264Parameters - Parameter sets from the AVC decoder configuration
+type H264Parameters struct {
+	sps        [][]byte // Sequence parameter sets
+	pps        [][]byte // Picture parameter sets
+	lengthSize int      // Size of the NAL unit length prefix
+}
+
+// Parses an AVC decoder configuration record (ISO/IEC 14496-15)
+func parseAVCDecoderConfiguration(data []byte) (*H264Parameters, error) {
+	if len(data) < 6 {
+		return nil, errors.New("invalid AVC decoder configuration")
+	}
+
+	params := &H264Parameters{
+		sps:        make([][]byte, 0),
+		pps:        make([][]byte, 0),
+		lengthSize: int(data[4]&0x03) + 1,
+	}
+
+	pos := 6
+
+	for i := 0; i < int(data[5]&0x1F); i++ {
+		if pos+2 > len(data) {
+			return nil, errors.New("invalid AVC decoder configuration")
+		}
+
+		size := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+
+		if pos+size > len(data) {
+			return nil, errors.New("invalid AVC decoder configuration")
+		}
+
+		params.sps = append(params.sps, data[pos:pos+size])
+		pos += size
+	}
+
+	if pos >= len(data) {
+		return nil, errors.New("invalid AVC decoder configuration")
+	}
+
+	count := int(data[pos])
+	pos++
+
+	for i := 0; i < count; i++ {
+		if pos+2 > len(data) {
+			return nil, errors.New("invalid AVC decoder configuration")
+		}
+
+		size := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+
+		if pos+size > len(data) {
+			return nil, errors.New("invalid AVC decoder configuration")
+		}
+
+		params.pps = append(params.pps, data[pos:pos+size])
+		pos += size
+	}
+
+	if len(params.sps) == 0 || len(params.sps[0]) < 4 {
+		return nil, errors.New("the AVC decoder configuration has no SPS")
+	}
+
+	return params, nil
+}
+
+// Gets the H264 codec for the parameters
+func (params *H264Parameters) getCodec() webrtc.RTPCodecCapability {
+	profileLevelId := hex.EncodeToString(params.sps[0][1:4])
+
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profileLevelId,
+	}
+}
+
+// Converts length prefixed NAL units into Annex-B format
+// For keyframes, the parameter sets are included if the frame does not have them
+func (params *H264Parameters) toAnnexB(data []byte, keyframe bool) ([]byte, error) {
+	out := make([]byte, 0, len(data)+64)
+	hasParameterSets := false
+	pos := 0
+
+	for pos < len(data) {
+		if pos+params.lengthSize > len(data) {
+			return nil, errors.New("invalid NAL unit length")
+		}
+
+		size := 0
+		for i := 0; i < params.lengthSize; i++ {
+			size = size<<8 | int(data[pos+i])
+		}
+		pos += params.lengthSize
+
+		if size > len(data)-pos {
+			return nil, errors.New("invalid NAL unit length")
+		}
+
+		nalu := data[pos : pos+size]
+		pos += size
+
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1F {
+		case 5: // IDR
+			keyframe = true
+		case 7: // SPS
+			hasParameterSets = true
+		}
+
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, nalu...)
+	}
+
+	if !keyframe || hasParameterSets {
+		return out, nil
+	}
+
+	withParameterSets := make([]byte, 0, len(out)+128)
+
+	for _, sps := range params.sps {
+		withParameterSets = append(withParameterSets, 0, 0, 0, 1)
+		withParameterSets = append(withParameterSets, sps...)
+	}
+
+	for _, pps := range params.pps {
+		withParameterSets = append(withParameterSets, 0, 0, 0, 1)
+		withParameterSets = append(withParameterSets, pps...)
+	}
+
+	return append(withParameterSets, out...), nil
+}
+
+// Gets the Opus codec
+func getRTMPOpusCodec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1",
+	}
+}
+
+// Reads a signed 24 bit integer
+func readInt24(b []byte) int32 {
+	n := int32(b[0])<<16 | int32(b[1])<<8 | int32(b[2])
+
+	if n&0x800000 != 0 {
+		n -= 0x1000000
+	}
+
+	return n
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseRTMPVideoMessage(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		expected *RTMPVideoFrame
+		err      bool
+	}{
+		{
+			name:     "empty",
+			data:     []byte{},
+			expected: nil,
+		},
+		{
+			name:     "AVC sequence header",
+			data:     []byte{0x17, FLV_AVC_SEQUENCE_HEADER, 0, 0, 0, 1, 2, 3},
+			expected: &RTMPVideoFrame{sequenceHeader: true, payload: []byte{1, 2, 3}},
+		},
+		{
+			name:     "AVC keyframe",
+			data:     []byte{0x17, FLV_AVC_NALU, 0, 0, 40, 1, 2},
+			expected: &RTMPVideoFrame{keyframe: true, compositionTime: 40, payload: []byte{1, 2}},
+		},
+		{
+			name:     "AVC inter frame with negative composition time",
+			data:     []byte{0x27, FLV_AVC_NALU, 0xFF, 0xFF, 0xD8, 1},
+			expected: &RTMPVideoFrame{compositionTime: -40, payload: []byte{1}},
+		},
+		{
+			name:     "AVC end of sequence",
+			data:     []byte{0x17, 2, 0, 0, 0},
+			expected: nil,
+		},
+		{
+			name:     "video info command",
+			data:     []byte{0x57, 0},
+			expected: nil,
+		},
+		{
+			name: "truncated AVC message",
+			data: []byte{0x17, FLV_AVC_NALU, 0},
+			err:  true,
+		},
+		{
+			name: "unsupported codec",
+			data: []byte{0x12, 0, 0, 0, 0},
+			err:  true,
+		},
+		{
+			name:     "enhanced sequence start",
+			data:     []byte{0x90 | ERTMP_VIDEO_SEQUENCE_START, 'a', 'v', 'c', '1', 1, 2},
+			expected: &RTMPVideoFrame{sequenceHeader: true, payload: []byte{1, 2}},
+		},
+		{
+			name:     "enhanced coded frames",
+			data:     []byte{0x90 | ERTMP_VIDEO_CODED_FRAMES, 'a', 'v', 'c', '1', 0, 0, 33, 1, 2},
+			expected: &RTMPVideoFrame{keyframe: true, compositionTime: 33, payload: []byte{1, 2}},
+		},
+		{
+			name:     "enhanced coded frames without composition time",
+			data:     []byte{0xA0 | ERTMP_VIDEO_CODED_FRAMES_X, 'a', 'v', 'c', '1', 1, 2},
+			expected: &RTMPVideoFrame{payload: []byte{1, 2}},
+		},
+		{
+			name:     "enhanced command frame",
+			data:     []byte{0xD0 | ERTMP_VIDEO_CODED_FRAMES, 'a', 'v', 'c', '1'},
+			expected: nil,
+		},
+		{
+			name: "truncated enhanced message",
+			data: []byte{0x90, 'a', 'v'},
+			err:  true,
+		},
+		{
+			name: "truncated enhanced coded frames",
+			data: []byte{0x90 | ERTMP_VIDEO_CODED_FRAMES, 'a', 'v', 'c', '1', 0},
+			err:  true,
+		},
+		{
+			name: "enhanced unsupported codec",
+			data: []byte{0x90, 'h', 'v', 'c', '1', 1},
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame, err := parseRTMPVideoMessage(c.data)
+
+			if c.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(frame, c.expected) {
+				t.Fatalf("expected %+v, got %+v", c.expected, frame)
+			}
+		})
+	}
+}
+
+func TestParseRTMPAudioMessage(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		expected *RTMPAudioFrame
+		err      error
+	}{
+		{
+			name:     "empty",
+			data:     []byte{},
+			expected: nil,
+		},
+		{
+			name:     "enhanced Opus sequence start",
+			data:     []byte{0x90 | ERTMP_AUDIO_SEQUENCE_START, 'O', 'p', 'u', 's', 1, 2},
+			expected: &RTMPAudioFrame{sequenceHeader: true, payload: []byte{1, 2}},
+		},
+		{
+			name:     "enhanced Opus coded frames",
+			data:     []byte{0x90 | ERTMP_AUDIO_CODED_FRAMES, 'O', 'p', 'u', 's', 3},
+			expected: &RTMPAudioFrame{payload: []byte{3}},
+		},
+		{
+			name:     "enhanced unknown packet type",
+			data:     []byte{0x90 | 4, 'O', 'p', 'u', 's'},
+			expected: nil,
+		},
+		{
+			name: "enhanced AAC",
+			data: []byte{0x90, 'm', 'p', '4', 'a'},
+			err:  ErrRTMPAACNotSupported,
+		},
+		{
+			name: "enhanced unsupported codec",
+			data: []byte{0x90, 'f', 'L', 'a', 'C'},
+			err:  errors.New("unsupported audio codec: fLaC, only Opus is supported"),
+		},
+		{
+			name: "truncated enhanced message",
+			data: []byte{0x90, 'O'},
+			err:  errors.New("invalid enhanced RTMP audio message"),
+		},
+		{
+			name:     "legacy Opus header",
+			data:     []byte{0xD0, 0, 1},
+			expected: &RTMPAudioFrame{sequenceHeader: true, payload: []byte{1}},
+		},
+		{
+			name:     "legacy Opus frame",
+			data:     []byte{0xD0, 1, 2, 3},
+			expected: &RTMPAudioFrame{payload: []byte{2, 3}},
+		},
+		{
+			name: "truncated legacy Opus message",
+			data: []byte{0xD0},
+			err:  errors.New("invalid Opus audio message"),
+		},
+		{
+			name: "legacy AAC",
+			data: []byte{0xAF, 1, 2},
+			err:  ErrRTMPAACNotSupported,
+		},
+		{
+			name: "legacy MP3",
+			data: []byte{0x2F, 1},
+			err:  errors.New("unsupported audio codec, only Opus is supported"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame, err := parseRTMPAudioMessage(c.data)
+
+			if c.err != nil {
+				if err == nil || err.Error() != c.err.Error() {
+					t.Fatalf("expected error %q, got %v", c.err.Error(), err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(frame, c.expected) {
+				t.Fatalf("expected %+v, got %+v", c.expected, frame)
+			}
+		})
+	}
+}
+
+func TestParseAVCDecoderConfiguration(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xC0, 0x1F, 0xAA}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+
+	config := []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, byte(len(sps))}
+	config = append(config, sps...)
+	config = append(config, 1, 0, byte(len(pps)))
+	config = append(config, pps...)
+
+	params, err := parseAVCDecoderConfiguration(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params.lengthSize != 4 || len(params.sps) != 1 || len(params.pps) != 1 || !bytes.Equal(params.sps[0], sps) || !bytes.Equal(params.pps[0], pps) {
+		t.Fatalf("unexpected parameters: %+v", params)
+	}
+
+	if fmtp := params.getCodec().SDPFmtpLine; fmtp != "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c01f" {
+		t.Fatalf("unexpected fmtp line: %s", fmtp)
+	}
+
+	// Truncated configurations
+	for i := 0; i < len(config); i++ {
+		if _, err := parseAVCDecoderConfiguration(config[:i]); err == nil {
+			t.Fatalf("expected an error for a configuration truncated at %d bytes", i)
+		}
+	}
+
+	// No SPS
+	if _, err := parseAVCDecoderConfiguration([]byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE0, 0}); err == nil {
+		t.Fatal("expected an error for a configuration without SPS")
+	}
+}
+
+func TestH264ToAnnexB(t *testing.T) {
+	params := &H264Parameters{
+		sps:        [][]byte{{0x67, 1}},
+		pps:        [][]byte{{0x68, 2}},
+		lengthSize: 4,
+	}
+
+	cases := []struct {
+		name     string
+		data     []byte
+		keyframe bool
+		expected []byte
+		err      bool
+	}{
+		{
+			name:     "inter frame",
+			data:     []byte{0, 0, 0, 2, 0x41, 9, 0, 0, 0, 1, 0x41},
+			expected: []byte{0, 0, 0, 1, 0x41, 9, 0, 0, 0, 1, 0x41},
+		},
+		{
+			name:     "IDR without parameter sets",
+			data:     []byte{0, 0, 0, 2, 0x65, 9},
+			expected: []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2, 0, 0, 0, 1, 0x65, 9},
+		},
+		{
+			name:     "keyframe flag without parameter sets",
+			data:     []byte{0, 0, 0, 1, 0x41},
+			keyframe: true,
+			expected: []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2, 0, 0, 0, 1, 0x41},
+		},
+		{
+			name:     "IDR with parameter sets",
+			data:     []byte{0, 0, 0, 2, 0x67, 3, 0, 0, 0, 1, 0x65},
+			expected: []byte{0, 0, 0, 1, 0x67, 3, 0, 0, 0, 1, 0x65},
+		},
+		{
+			name:     "empty NAL unit",
+			data:     []byte{0, 0, 0, 0, 0, 0, 0, 1, 0x41},
+			expected: []byte{0, 0, 0, 1, 0x41},
+		},
+		{
+			name: "truncated length",
+			data: []byte{0, 0, 0},
+			err:  true,
+		},
+		{
+			name: "length too big",
+			data: []byte{0, 0, 0, 5, 0x41},
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := params.toAnnexB(c.data, c.keyframe)
+
+			if c.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out, c.expected) {
+				t.Fatalf("expected %x, got %x", c.expected, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// RTMP server
+// Allows broadcasters using RTMP encoders to publish streams
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default RTMP port
+const RTMP_DEFAULT_PORT = 1935
+
+// RTMP protocol version
+const RTMP_VERSION = 3
+
+// Size of the handshake packets (C1, C2, S1, S2)
+const RTMP_HANDSHAKE_SIZE = 1536
+
+// Max time to complete the handshake
+const RTMP_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Max time without receiving data from the publisher
+const RTMP_READ_TIMEOUT = 30 * time.Second
+
+// Registers the RTMP listener, so it can be closed
+// Returns false if the node is already shutting down
+func (node *WebRTC_CDN_Node) addRTMPListener(listener net.Listener) bool {
+	node.mutexShutdown.Lock()
+	defer node.mutexShutdown.Unlock()
+
+	if node.draining {
+		return false
+	}
+
+	node.rtmpListener = listener
+
+	return true
+}
+
+// Runs RTMP server
+func (node *WebRTC_CDN_Node) runRTMPServer(wg *sync.WaitGroup) {
+	defer func() {
+		wg.Done()
+	}()
+
+	if !node.getConfig().RTMP.Enabled {
+		return
+	}
+
+	bind_addr := node.getConfig().HTTP.BindAddress
+
+	port := node.getConfig().RTMP.Port
+
+	listener, err := net.Listen("tcp", bind_addr+":"+strconv.Itoa(port))
+
+	if err != nil {
+		LogError(err)
+		return
+	}
+
+	if !node.addRTMPListener(listener) {
+		listener.Close()
+		return // Shutting down
+	}
+
+	// Listen
+	getRootLogger().Info("Listening on "+bind_addr+":"+strconv.Itoa(port), "service", "rtmp")
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				LogError(err)
+			}
+			return
+		}
+
+		go node.handleRTMPConnection(conn)
+	}
+}
+
+// Handles a connection from a RTMP publisher
+func (node *WebRTC_CDN_Node) handleRTMPConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reqId := node.getRequestID()
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		LogError(err)
+		return
+	}
+
+	logger := getRootLogger().With("connection_id", reqId, "ip", ip, "protocol", "rtmp")
+
+	logger.Request("Connection accepted")
+
+	if node.isDraining() {
+		// The node is shutting down, publishers must connect to other node
+		logger.Request("Connection rejected: The node is shutting down")
+		return
+	}
+
+	if !node.isIPExempted(ip) {
+		if !node.AddIP(ip) {
+			metricRejectedRequests.WithLabelValues("ip_limit").Inc()
+			logger.Request("Connection rejected: Too many requests")
+			return
+		}
+
+		defer node.RemoveIP(ip)
+	}
+
+	conn.SetDeadline(time.Now().Add(RTMP_HANDSHAKE_TIMEOUT))
+
+	if err := rtmpServerHandshake(conn); err != nil {
+		logger.Debug("Handshake failed: " + err.Error())
+		return
+	}
+
+	session := newRTMPSession(node, conn, reqId, ip, logger)
+
+	session.run()
+
+	logger.Request("Connection closed")
+}
+
+// Performs the server side of the RTMP handshake
+// C0+C1 -> S0+S1+S2 -> C2
+func rtmpServerHandshake(conn net.Conn) error {
+	c0c1 := make([]byte, 1+RTMP_HANDSHAKE_SIZE)
+
+	if _, err := io.ReadFull(conn, c0c1); err != nil {
+		return err
+	}
+
+	if c0c1[0] != RTMP_VERSION {
+		return errors.New("unsupported RTMP version: " + strconv.Itoa(int(c0c1[0])))
+	}
+
+	c1 := c0c1[1:]
+
+	// S1 = time (4 bytes) + zero (4 bytes) + random data
+	s1 := make([]byte, RTMP_HANDSHAKE_SIZE)
+
+	if _, err := rand.Read(s1[8:]); err != nil {
+		return err
+	}
+
+	// S2 echoes C1
+	s0s1s2 := bytes.NewBuffer(make([]byte, 0, 1+2*RTMP_HANDSHAKE_SIZE))
+	s0s1s2.WriteByte(RTMP_VERSION)
+	s0s1s2.Write(s1)
+	s0s1s2.Write(c1)
+
+	if _, err := conn.Write(s0s1s2.Bytes()); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, RTMP_HANDSHAKE_SIZE)
+
+	if _, err := io.ReadFull(conn, c2); err != nil {
+		return err
+	}
+
+	return nil
+}
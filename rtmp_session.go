@@ -0,0 +1,621 @@
+// RTMP session
+// Handles the commands of a RTMP publisher and feeds its media into a source
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Window acknowledgement size and peer bandwidth sent to the client
+const RTMP_WINDOW_ACK_SIZE = 2500000
+
+// Max time to wait for the tracks announced by the publisher
+// After that, the source is ready with the tracks received so far
+const RTMP_TRACKS_WAIT_TIMEOUT = 5 * time.Second
+
+// Chunk stream IDs used to send messages
+const RTMP_CSID_CONTROL = 2
+const RTMP_CSID_COMMAND = 3
+const RTMP_CSID_STATUS = 5
+
+// Message stream ID assigned to the publisher
+const RTMP_PUBLISH_STREAM_ID = 1
+
+// User control events
+const RTMP_EVENT_PING_REQUEST = 6
+const RTMP_EVENT_PING_RESPONSE = 7
+
+// FourCC codec IDs used in the metadata by enhanced RTMP encoders
+const RTMP_FOURCC_MP4A = 0x6D703461
+
+// Error returned when the publisher ends the stream
+var errRTMPUnpublished = errors.New("unpublished")
+
+// Error returned when a track is received after the source is ready
+// Viewers already received the tracks, so the new one cannot be added
+var errRTMPLateTrack = errors.New("received after the stream started")
+
+// RTMPSession - Status of a connection from a RTMP publisher
+type RTMPSession struct {
+	id   uint64 // Request ID
+	ip   string // IP address of the client
+	node *WebRTC_CDN_Node
+
+	conn   net.Conn
+	reader *RTMPChunkReader
+	writer *RTMPChunkWriter
+
+	ackWindow uint32 // Window acknowledgement size set by the client
+	lastAck   uint64 // Bytes read when the last acknowledgement was sent
+
+	hasVideo bool // Video track announced in the metadata (or not known)
+	hasAudio bool // Audio track announced in the metadata (or not known)
+
+	source   *WRTC_Source    // Source being published (nil if not publishing)
+	h264     *H264Parameters // Parameter sets of the video track
+	video    *RTMPTrack      // Video track
+	audio    *RTMPTrack      // Audio track
+	ignored  map[string]bool // Kinds of the tracks ignored, since they were received too late
+	streamId uint32          // Message stream ID used to publish
+
+	closeMutex *sync.Mutex
+	closed     bool
+
+	logger *Logger // Logger including the connection fields
+}
+
+// Creates a session for a connection, after the handshake
+func newRTMPSession(node *WebRTC_CDN_Node, conn net.Conn, id uint64, ip string, logger *Logger) *RTMPSession {
+	return &RTMPSession{
+		id:         id,
+		ip:         ip,
+		node:       node,
+		conn:       conn,
+		reader:     newRTMPChunkReader(conn),
+		writer:     newRTMPChunkWriter(conn),
+		hasVideo:   true,
+		hasAudio:   true,
+		ignored:    make(map[string]bool),
+		closeMutex: &sync.Mutex{},
+		logger:     logger,
+	}
+}
+
+// Reads messages until the connection is closed
+func (session *RTMPSession) run() {
+	session.conn.SetDeadline(time.Time{})
+
+	for {
+		session.conn.SetReadDeadline(time.Now().Add(RTMP_READ_TIMEOUT))
+
+		msg, err := session.reader.readMessage()
+
+		if err != nil {
+			break
+		}
+
+		if err := session.sendAcknowledgementIfNeeded(); err != nil {
+			break
+		}
+
+		if err := session.handleMessage(msg); err != nil {
+			if err != errRTMPUnpublished {
+				session.logger.Request("Session closed: " + err.Error())
+			}
+			break
+		}
+	}
+
+	session.close()
+	session.onClosed()
+}
+
+// Closes the connection
+// Can be called from any goroutine
+func (session *RTMPSession) close() {
+	session.closeMutex.Lock()
+	defer session.closeMutex.Unlock()
+
+	if session.closed {
+		return
+	}
+
+	session.closed = true
+
+	session.conn.Close()
+}
+
+// Releases the tracks and closes the source
+// Called when the read loop ends
+func (session *RTMPSession) onClosed() {
+	if session.video != nil {
+		session.video.close()
+	}
+
+	if session.audio != nil {
+		session.audio.close()
+	}
+
+	if session.source != nil {
+		session.source.onClose()
+
+		session.source.logger.Request("RTMP publish ended")
+	}
+}
+
+// Sends an acknowledgement if the client window was reached
+func (session *RTMPSession) sendAcknowledgementIfNeeded() error {
+	if session.ackWindow == 0 || session.reader.bytesRead-session.lastAck < uint64(session.ackWindow) {
+		return nil
+	}
+
+	session.lastAck = session.reader.bytesRead
+
+	return session.sendControl(RTMP_TYPE_ACKNOWLEDGEMENT, binary.BigEndian.AppendUint32(nil, uint32(session.reader.bytesRead)))
+}
+
+// Sends a protocol control message
+func (session *RTMPSession) sendControl(typeId uint8, payload []byte) error {
+	return session.writer.writeMessage(RTMP_CSID_CONTROL, &RTMPMessage{typeId: typeId, payload: payload})
+}
+
+// Sends a command message
+func (session *RTMPSession) sendCommand(streamId uint32, values ...interface{}) error {
+	return session.writer.writeMessage(RTMP_CSID_COMMAND, &RTMPMessage{typeId: RTMP_TYPE_COMMAND_AMF0, streamId: streamId, payload: encodeAMF0(values...)})
+}
+
+// Sends an onStatus message for the published stream
+func (session *RTMPSession) sendStatus(level string, code string, description string) error {
+	return session.writer.writeMessage(RTMP_CSID_STATUS, &RTMPMessage{
+		typeId:   RTMP_TYPE_COMMAND_AMF0,
+		streamId: session.streamId,
+		payload: encodeAMF0("onStatus", 0, nil, map[string]interface{}{
+			"level":       level,
+			"code":        code,
+			"description": description,
+		}),
+	})
+}
+
+// Notifies the client the publishing was rejected
+// Returns the error, to end the session
+func (session *RTMPSession) reject(code string, err error) error {
+	session.sendStatus("error", code, err.Error())
+
+	return err
+}
+
+// Handles a message received from the client
+func (session *RTMPSession) handleMessage(msg *RTMPMessage) error {
+	switch msg.typeId {
+	case RTMP_TYPE_SET_CHUNK_SIZE:
+		if len(msg.payload) < 4 {
+			return errors.New("invalid set chunk size message")
+		}
+		return session.reader.setChunkSize(binary.BigEndian.Uint32(msg.payload))
+	case RTMP_TYPE_ABORT:
+		if len(msg.payload) >= 4 {
+			session.reader.abort(binary.BigEndian.Uint32(msg.payload))
+		}
+	case RTMP_TYPE_WINDOW_ACK_SIZE:
+		if len(msg.payload) >= 4 {
+			session.ackWindow = binary.BigEndian.Uint32(msg.payload)
+		}
+	case RTMP_TYPE_USER_CONTROL:
+		if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == RTMP_EVENT_PING_REQUEST {
+			pong := binary.BigEndian.AppendUint16(nil, RTMP_EVENT_PING_RESPONSE)
+			return session.sendControl(RTMP_TYPE_USER_CONTROL, append(pong, msg.payload[2:6]...))
+		}
+	case RTMP_TYPE_COMMAND_AMF0:
+		return session.handleCommand(msg, msg.payload)
+	case RTMP_TYPE_COMMAND_AMF3:
+		if len(msg.payload) > 0 {
+			return session.handleCommand(msg, msg.payload[1:]) // AMF0 after the format byte
+		}
+	case RTMP_TYPE_DATA_AMF0:
+		return session.handleData(msg.payload)
+	case RTMP_TYPE_DATA_AMF3:
+		if len(msg.payload) > 0 {
+			return session.handleData(msg.payload[1:])
+		}
+	case RTMP_TYPE_VIDEO:
+		return session.handleVideo(msg)
+	case RTMP_TYPE_AUDIO:
+		return session.handleAudio(msg)
+	}
+
+	return nil
+}
+
+// Handles a command message
+func (session *RTMPSession) handleCommand(msg *RTMPMessage, data []byte) error {
+	values, err := decodeAMF0(data)
+
+	if err != nil {
+		return err
+	}
+
+	if len(values) < 2 {
+		return nil
+	}
+
+	name, _ := values[0].(string)
+	transactionId, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		return session.handleConnect(transactionId)
+	case "releaseStream", "FCPublish":
+		return session.sendCommand(msg.streamId, "_result", transactionId, nil)
+	case "createStream":
+		return session.sendCommand(msg.streamId, "_result", transactionId, nil, RTMP_PUBLISH_STREAM_ID)
+	case "publish":
+		streamKey := ""
+		if len(values) > 3 {
+			streamKey, _ = values[3].(string)
+		}
+		return session.handlePublish(msg.streamId, streamKey)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		if session.source != nil {
+			return errRTMPUnpublished
+		}
+	}
+
+	return nil
+}
+
+// Handles the connect command
+func (session *RTMPSession) handleConnect(transactionId float64) error {
+	if err := session.sendControl(RTMP_TYPE_WINDOW_ACK_SIZE, binary.BigEndian.AppendUint32(nil, RTMP_WINDOW_ACK_SIZE)); err != nil {
+		return err
+	}
+
+	if err := session.sendControl(RTMP_TYPE_SET_PEER_BANDWIDTH, append(binary.BigEndian.AppendUint32(nil, RTMP_WINDOW_ACK_SIZE), 2)); err != nil {
+		return err
+	}
+
+	if err := session.sendControl(RTMP_TYPE_SET_CHUNK_SIZE, binary.BigEndian.AppendUint32(nil, RTMP_OUT_CHUNK_SIZE)); err != nil {
+		return err
+	}
+
+	session.writer.setChunkSize(RTMP_OUT_CHUNK_SIZE)
+
+	return session.sendCommand(0, "_result", transactionId, map[string]interface{}{
+		"fmsVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}, map[string]interface{}{
+		"level":          "status",
+		"code":           "NetConnection.Connect.Success",
+		"description":    "Connection succeeded.",
+		"objectEncoding": 0,
+	})
+}
+
+// Parses the stream key sent by the publisher
+// Format: {streamId}?token={authToken}
+func parseRTMPStreamKey(streamKey string) (streamId string, token string, ok bool) {
+	streamId, query, _ := strings.Cut(streamKey, "?")
+
+	if len(streamId) == 0 || len(streamId) > 255 {
+		return "", "", false
+	}
+
+	params, err := url.ParseQuery(query)
+
+	if err != nil {
+		return "", "", false
+	}
+
+	return streamId, params.Get("token"), true
+}
+
+// Handles the publish command
+func (session *RTMPSession) handlePublish(streamId uint32, streamKey string) error {
+	session.streamId = streamId
+
+	if session.source != nil {
+		return session.reject("NetStream.Publish.BadName", errors.New("already publishing"))
+	}
+
+	sid, token, ok := parseRTMPStreamKey(streamKey)
+
+	if !ok {
+		return session.reject("NetStream.Publish.BadName", errors.New("invalid stream key"))
+	}
+
+	metricPublishRequests.WithLabelValues("rtmp").Inc()
+
+	validAuth, claims := checkAuthenticationClaims(session.node.authKeyProvider.Load(), token, "stream_publish", sid)
+
+	if !validAuth {
+		return session.reject("NetStream.Publish.Unauthorized", errors.New("invalid authentication provided"))
+	}
+
+	exclusive := isExclusivePublishing(&session.node.getConfig().Publishing, claims)
+	takeover := isPublishingTakeover(claims)
+
+	if !session.node.canPublish(sid, exclusive, takeover) {
+		return session.reject("NetStream.Publish.BadName", errors.New("stream already publishing"))
+	}
+
+	resourceId, err := makeId(16)
+
+	if err != nil {
+		return session.reject("NetStream.Publish.Failed", err)
+	}
+
+	// Create source
+	source := WRTC_Source{
+		requestId:  resourceId,
+		sid:        sid,
+		node:       session.node,
+		hasAudio:   session.hasAudio,
+		hasVideo:   session.hasVideo,
+		connection: nil,
+		rtmp:       session,
+		exclusive:  exclusive,
+		takeover:   takeover,
+		record:     isRecordingEnabled(&session.node.getConfig().Recording, claims),
+		ip:         session.ip,
+	}
+
+	source.init()
+
+	// Register source
+	if !session.node.registerSource(&source) {
+		source.close(false, false)
+		return session.reject("NetStream.Publish.BadName", errors.New("stream already publishing"))
+	}
+
+	session.source = &source
+
+	source.logger.Request("RTMP publish started")
+
+	// Do not wait forever for tracks the publisher may not send
+	time.AfterFunc(RTMP_TRACKS_WAIT_TIMEOUT, session.onTracksWaitTimeout)
+
+	return session.sendStatus("status", "NetStream.Publish.Start", "Publishing "+sid+".")
+}
+
+// Handles a data message (metadata)
+func (session *RTMPSession) handleData(data []byte) error {
+	values, err := decodeAMF0(data)
+
+	if err != nil || len(values) == 0 {
+		return nil // Metadata is optional
+	}
+
+	if name, _ := values[0].(string); name == "@setDataFrame" {
+		values = values[1:]
+	}
+
+	if len(values) < 2 {
+		return nil
+	}
+
+	if name, _ := values[0].(string); name != "onMetaData" {
+		return nil
+	}
+
+	metadata, _ := values[1].(map[string]interface{})
+
+	if metadata == nil {
+		return nil
+	}
+
+	_, hasVideoCodec := metadata["videocodecid"]
+	audioCodec, hasAudioCodec := metadata["audiocodecid"]
+
+	if !hasVideoCodec && !hasAudioCodec {
+		return nil // Tracks not announced
+	}
+
+	switch audioCodec {
+	case float64(FLV_AUDIO_FORMAT_AAC), float64(RTMP_FOURCC_MP4A), "mp4a":
+		return session.reject("NetStream.Publish.Rejected", ErrRTMPAACNotSupported)
+	}
+
+	session.hasVideo = hasVideoCodec
+	session.hasAudio = hasAudioCodec
+
+	if session.source != nil {
+		source := session.source
+
+		source.statusMutex.Lock()
+		defer source.statusMutex.Unlock()
+
+		if !source.notifiedReady {
+			source.hasVideo = hasVideoCodec
+			source.hasAudio = hasAudioCodec
+			source.checkReady(false)
+		}
+	}
+
+	return nil
+}
+
+// Handles a video message
+func (session *RTMPSession) handleVideo(msg *RTMPMessage) error {
+	if session.source == nil {
+		return nil // Not publishing
+	}
+
+	frame, err := parseRTMPVideoMessage(msg.payload)
+
+	if err != nil {
+		return session.reject("NetStream.Publish.Rejected", err)
+	}
+
+	if frame == nil {
+		return nil
+	}
+
+	if frame.sequenceHeader {
+		params, err := parseAVCDecoderConfiguration(frame.payload)
+
+		if err != nil {
+			return session.reject("NetStream.Publish.Rejected", err)
+		}
+
+		session.h264 = params
+
+		if session.video == nil && !session.ignored["video"] {
+			session.video, err = session.addTrack("video", params.getCodec())
+
+			if err == errRTMPLateTrack {
+				session.ignoreTrack("video")
+			} else if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if session.video == nil || session.h264 == nil {
+		return nil // Waiting for the sequence header
+	}
+
+	data, err := session.h264.toAnnexB(frame.payload, frame.keyframe)
+
+	if err != nil {
+		return session.reject("NetStream.Publish.Rejected", err)
+	}
+
+	if len(data) > 0 {
+		session.video.writeFrame(data, (msg.timestamp+uint32(frame.compositionTime))*90)
+	}
+
+	return nil
+}
+
+// Handles an audio message
+func (session *RTMPSession) handleAudio(msg *RTMPMessage) error {
+	if session.source == nil {
+		return nil // Not publishing
+	}
+
+	frame, err := parseRTMPAudioMessage(msg.payload)
+
+	if err != nil {
+		return session.reject("NetStream.Publish.Rejected", err)
+	}
+
+	if frame == nil {
+		return nil
+	}
+
+	if session.audio == nil && !session.ignored["audio"] {
+		session.audio, err = session.addTrack("audio", getRTMPOpusCodec())
+
+		if err == errRTMPLateTrack {
+			session.ignoreTrack("audio")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if session.audio == nil {
+		return nil // Ignored
+	}
+
+	if frame.sequenceHeader || len(frame.payload) == 0 {
+		return nil
+	}
+
+	session.audio.writeFrame(frame.payload, msg.timestamp*48)
+
+	return nil
+}
+
+// Creates a track and adds it to the source
+// Returns errRTMPLateTrack if the source is already ready without the track
+func (session *RTMPSession) addTrack(kind string, codec webrtc.RTPCodecCapability) (*RTMPTrack, error) {
+	source := session.source
+
+	source.statusMutex.Lock()
+	defer source.statusMutex.Unlock()
+
+	if source.closed {
+		return nil, errors.New("the source is closed")
+	}
+
+	if source.notifiedReady {
+		return nil, errRTMPLateTrack
+	}
+
+	var recorder *TrackRecorder
+
+	if source.record {
+		recorder = createTrackRecorder(&source.node.getConfig().Recording, source.sid, source.startTime, source.recordingId, webrtc.RTPCodecParameters{RTPCodecCapability: codec})
+	}
+
+	track, err := newRTMPTrack(kind, codec, source.sid, recorder)
+
+	if err != nil {
+		if recorder != nil {
+			recorder.close()
+		}
+		return nil, err
+	}
+
+	if kind == "video" {
+		source.localTrackVideo = track.track
+		source.gopCache = newGOPCache(&source.node.getConfig().GOPCache, track.track, codec)
+
+		if source.gopCache != nil {
+			track.writer = source.gopCache
+		}
+	} else {
+		source.localTrackAudio = track.track
+	}
+
+	// The track may not be announced in the metadata
+	if kind == "video" {
+		source.hasVideo = true
+	} else {
+		source.hasAudio = true
+	}
+
+	source.checkReady(false)
+
+	return track, nil
+}
+
+// Ignores a track received after the source is ready
+// The publishing continues with the other track
+func (session *RTMPSession) ignoreTrack(kind string) {
+	session.ignored[kind] = true
+	session.logger.Warning("The " + kind + " track was " + errRTMPLateTrack.Error() + ", it will be ignored. Send all the tracks within " + RTMP_TRACKS_WAIT_TIMEOUT.String() + ", or announce them in the metadata")
+}
+
+// Called when the time to wait for the tracks expires
+// The source becomes ready with the tracks received so far
+func (session *RTMPSession) onTracksWaitTimeout() {
+	source := session.source
+
+	source.statusMutex.Lock()
+	defer source.statusMutex.Unlock()
+
+	if source.notifiedReady || source.closed {
+		return
+	}
+
+	source.hasVideo = source.localTrackVideo != nil
+	source.hasAudio = source.localTrackAudio != nil
+
+	if !source.hasVideo && !source.hasAudio {
+		return // Nothing received yet, the first track makes the source ready
+	}
+
+	source.checkReady(false)
+}
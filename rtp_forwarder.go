@@ -0,0 +1,371 @@
+// RTP forwarder
+// Forwards the tracks of a stream as plain RTP to external UDP endpoints
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Payload type of the forwarded video packets
+const RTP_FORWARD_VIDEO_PAYLOAD_TYPE = 96
+
+// Payload type of the forwarded audio packets
+const RTP_FORWARD_AUDIO_PAYLOAD_TYPE = 111
+
+// RTPForwarder - Forwards the tracks of a stream to external UDP endpoints
+// It uses a sink to receive the tracks, so it works for local and relayed streams
+type RTPForwarder struct {
+	id   string           // Unique ID of the forwarder
+	sid  string           // Stream ID
+	node *WebRTC_CDN_Node // Reference to the node
+	sink *WRTC_Sink       // Sink receiving the tracks
+
+	host      string       // Destination IP address
+	videoPort int          // Destination port for the video (0 to not forward the video)
+	audioPort int          // Destination port for the audio (0 to not forward the audio)
+	videoConn *net.UDPConn // Socket to send the video packets
+	audioConn *net.UDPConn // Socket to send the audio packets
+	videoSSRC webrtc.SSRC  // SSRC of the forwarded video
+	audioSSRC webrtc.SSRC  // SSRC of the forwarded audio
+
+	mutex *sync.Mutex // Mutex to control access to the struct
+
+	receivers []*LocalTrackReceiver // Receivers of the current tracks
+
+	videoCodec *webrtc.RTPCodecCapability // Codec of the forwarded video (nil if not available)
+	audioCodec *webrtc.RTPCodecCapability // Codec of the forwarded audio (nil if not available)
+	version    int                        // Incremented when the tracks change, used for the SDP
+
+	readyChan chan struct{} // Closed when the tracks are available for the first time
+	ready     bool          // True if the ready channel was closed
+
+	closed bool // True if the forwarder was closed
+
+	startTime time.Time // Time the forwarder was created
+}
+
+// Registers a RTP forwarder, so it can be found later
+func (node *WebRTC_CDN_Node) addRTPForwarder(forwarder *RTPForwarder) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	node.rtpForwarders[forwarder.id] = forwarder
+}
+
+// Finds a RTP forwarder by its ID
+func (node *WebRTC_CDN_Node) getRTPForwarder(id string) *RTPForwarder {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	return node.rtpForwarders[id]
+}
+
+// Removes a RTP forwarder
+func (node *WebRTC_CDN_Node) removeRTPForwarder(id string) {
+	node.mutexHTTPResources.Lock()
+	defer node.mutexHTTPResources.Unlock()
+
+	delete(node.rtpForwarders, id)
+}
+
+// Creates a RTP forwarder
+// The host must be an IP address or a hostname resolving to one
+func newRTPForwarder(node *WebRTC_CDN_Node, sid string, host string, videoPort int, audioPort int, ip string) (*RTPForwarder, error) {
+	if videoPort == 0 && audioPort == 0 {
+		return nil, errors.New("at least one destination port must be provided")
+	}
+
+	if videoPort < 0 || videoPort > 65535 || audioPort < 0 || audioPort > 65535 {
+		return nil, errors.New("invalid destination port")
+	}
+
+	addr, err := net.ResolveIPAddr("ip", host)
+
+	if err != nil {
+		return nil, errors.New("invalid destination host: " + err.Error())
+	}
+
+	id, err := makeId(16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	forwarder := &RTPForwarder{
+		id:        id,
+		sid:       sid,
+		node:      node,
+		host:      addr.IP.String(),
+		videoPort: videoPort,
+		audioPort: audioPort,
+		videoSSRC: webrtc.SSRC(rand.Uint32()),
+		audioSSRC: webrtc.SSRC(rand.Uint32()),
+		mutex:     &sync.Mutex{},
+		receivers: make([]*LocalTrackReceiver, 0),
+		readyChan: make(chan struct{}),
+		startTime: time.Now(),
+	}
+
+	if videoPort != 0 {
+		forwarder.videoConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: addr.IP, Port: videoPort})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if audioPort != 0 {
+		forwarder.audioConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: addr.IP, Port: audioPort})
+
+		if err != nil {
+			forwarder.closeSockets()
+			return nil, err
+		}
+	}
+
+	forwarder.sink = &WRTC_Sink{
+		sinkId:     node.getSinkID(),
+		requestId:  id,
+		sid:        sid,
+		node:       node,
+		connection: nil,
+		forwarder:  forwarder,
+		ip:         ip,
+	}
+
+	forwarder.sink.init()
+
+	return forwarder, nil
+}
+
+// Registers the sink of the forwarder, to receive the tracks
+func (forwarder *RTPForwarder) start() {
+	forwarder.node.registerSink(forwarder.sink)
+}
+
+// Stops forwarding and releases the sockets
+func (forwarder *RTPForwarder) close() {
+	forwarder.mutex.Lock()
+
+	if forwarder.closed {
+		forwarder.mutex.Unlock()
+		return
+	}
+
+	forwarder.closed = true
+
+	forwarder.mutex.Unlock()
+
+	forwarder.sink.close()
+	forwarder.node.removeRTPForwarder(forwarder.id)
+
+	forwarder.closeSockets()
+}
+
+// Closes the UDP sockets
+func (forwarder *RTPForwarder) closeSockets() {
+	if forwarder.videoConn != nil {
+		forwarder.videoConn.Close()
+	}
+
+	if forwarder.audioConn != nil {
+		forwarder.audioConn.Close()
+	}
+}
+
+// Called when the tracks of the stream are available
+// Must be called with the sink status mutex locked
+func (forwarder *RTPForwarder) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP) {
+	forwarder.unbindTracks()
+
+	if forwarder.videoConn == nil {
+		localTrackVideo = nil
+	}
+
+	if forwarder.audioConn == nil {
+		localTrackAudio = nil
+	}
+
+	forwarder.mutex.Lock()
+
+	forwarder.videoCodec = nil
+	if localTrackVideo != nil {
+		codec := localTrackVideo.Codec()
+		forwarder.videoCodec = &codec
+	}
+
+	forwarder.audioCodec = nil
+	if localTrackAudio != nil {
+		codec := localTrackAudio.Codec()
+		forwarder.audioCodec = &codec
+	}
+
+	forwarder.version++
+
+	if !forwarder.ready && (forwarder.videoCodec != nil || forwarder.audioCodec != nil) {
+		forwarder.ready = true
+		close(forwarder.readyChan)
+	}
+
+	forwarder.mutex.Unlock()
+
+	// The track calls the receivers with its lock held,
+	// so binding must be done without the forwarder mutex
+
+	if localTrackVideo != nil {
+		forwarder.bindTrack(localTrackVideo, RTP_FORWARD_VIDEO_PAYLOAD_TYPE, forwarder.videoSSRC, forwarder.videoConn)
+	}
+
+	if localTrackAudio != nil {
+		forwarder.bindTrack(localTrackAudio, RTP_FORWARD_AUDIO_PAYLOAD_TYPE, forwarder.audioSSRC, forwarder.audioConn)
+	}
+}
+
+// Called when the tracks are no longer available
+// Must be called with the sink status mutex locked
+func (forwarder *RTPForwarder) onTracksClosed() {
+	forwarder.unbindTracks()
+
+	forwarder.mutex.Lock()
+	defer forwarder.mutex.Unlock()
+
+	forwarder.videoCodec = nil
+	forwarder.audioCodec = nil
+	forwarder.version++
+}
+
+// Sends the packets of a track to a socket
+// Must be called with the sink status mutex locked
+func (forwarder *RTPForwarder) bindTrack(track *webrtc.TrackLocalStaticRTP, payloadType webrtc.PayloadType, ssrc webrtc.SSRC, conn *net.UDPConn) {
+	receiver, err := newLocalTrackReceiver(track, payloadType, ssrc, func(header *rtp.Header, payload []byte) {
+		forwardRTPPacket(conn, header, payload)
+	})
+
+	if err != nil {
+		forwarder.sink.logger.Error(err)
+		return
+	}
+
+	if _, err := track.Bind(receiver); err != nil {
+		forwarder.sink.logger.Error(err)
+		return
+	}
+
+	forwarder.receivers = append(forwarder.receivers, receiver)
+}
+
+// Stops receiving the packets of the tracks
+// Must be called with the sink status mutex locked
+func (forwarder *RTPForwarder) unbindTracks() {
+	for _, receiver := range forwarder.receivers {
+		if err := receiver.track.Unbind(receiver); err != nil {
+			forwarder.sink.logger.Error(err)
+		}
+	}
+
+	forwarder.receivers = make([]*LocalTrackReceiver, 0)
+}
+
+// Sends a RTP packet to a socket
+// Header extensions are removed, since they are not negotiated
+func forwardRTPPacket(conn *net.UDPConn, header *rtp.Header, payload []byte) {
+	packet := rtp.Packet{
+		Header:  *header,
+		Payload: payload,
+	}
+
+	packet.Header.Extension = false
+	packet.Header.ExtensionProfile = 0
+	packet.Header.Extensions = nil
+
+	b, err := packet.Marshal()
+
+	if err != nil {
+		LogError(err)
+		return
+	}
+
+	// Errors are ignored, the receiver may not be listening yet
+	conn.Write(b)
+}
+
+// Waits for the tracks to be available
+// Returns false if the timeout is reached
+func (forwarder *RTPForwarder) waitReady(timeout time.Duration) bool {
+	select {
+	case <-forwarder.readyChan:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Generates the SDP file describing the forwarded tracks
+// Returns false if the tracks are not available
+func (forwarder *RTPForwarder) getSDP() (string, bool) {
+	forwarder.mutex.Lock()
+	defer forwarder.mutex.Unlock()
+
+	if forwarder.videoCodec == nil && forwarder.audioCodec == nil {
+		return "", false
+	}
+
+	addrType := "IP4"
+
+	if strings.Contains(forwarder.host, ":") {
+		addrType = "IP6"
+	}
+
+	sdp := &strings.Builder{}
+
+	sdp.WriteString("v=0\r\n")
+	fmt.Fprintf(sdp, "o=- 0 %d IN %s %s\r\n", forwarder.version, addrType, forwarder.host)
+	fmt.Fprintf(sdp, "s=%s\r\n", forwarder.sid)
+	fmt.Fprintf(sdp, "c=IN %s %s\r\n", addrType, forwarder.host)
+	sdp.WriteString("t=0 0\r\n")
+
+	if forwarder.videoCodec != nil {
+		writeSDPMediaSection(sdp, "video", forwarder.videoPort, RTP_FORWARD_VIDEO_PAYLOAD_TYPE, forwarder.videoCodec)
+	}
+
+	if forwarder.audioCodec != nil {
+		writeSDPMediaSection(sdp, "audio", forwarder.audioPort, RTP_FORWARD_AUDIO_PAYLOAD_TYPE, forwarder.audioCodec)
+	}
+
+	return sdp.String(), true
+}
+
+// Writes a media section of a SDP file
+func writeSDPMediaSection(sdp *strings.Builder, kind string, port int, payloadType webrtc.PayloadType, codec *webrtc.RTPCodecCapability) {
+	encodingName := codec.MimeType
+
+	if i := strings.Index(encodingName, "/"); i >= 0 {
+		encodingName = encodingName[i+1:]
+	}
+
+	rtpmap := encodingName + "/" + strconv.Itoa(int(codec.ClockRate))
+
+	if codec.Channels > 0 {
+		rtpmap += "/" + strconv.Itoa(int(codec.Channels))
+	}
+
+	fmt.Fprintf(sdp, "m=%s %d RTP/AVP %d\r\n", kind, port, payloadType)
+	fmt.Fprintf(sdp, "a=rtpmap:%d %s\r\n", payloadType, rtpmap)
+
+	if codec.SDPFmtpLine != "" {
+		fmt.Fprintf(sdp, "a=fmtp:%d %s\r\n", payloadType, codec.SDPFmtpLine)
+	}
+
+	sdp.WriteString("a=recvonly\r\n")
+}
@@ -0,0 +1,623 @@
+// Simulcast support
+// A simulcast source publishes several encodings (layers) of the same video,
+// identified by their RID. Each sink uses a layer switcher to choose the layer it receives.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Max time to wait for all the simulcast layers after the first one is received
+const SIMULCAST_LAYERS_WAIT_TIMEOUT = 3 * time.Second
+
+// Prefix for the IDs of the layer tracks sent between nodes
+const SIMULCAST_LAYER_TRACK_PREFIX = "video_"
+
+// Value of the layer preference for automatic selection
+const SIMULCAST_LAYER_AUTO = "AUTO"
+
+// Automatic layer selection parameters
+const SIMULCAST_AUTO_LOSS_DOWN = 0.1                 // Packet loss to switch to a lower layer
+const SIMULCAST_AUTO_LOSS_UP = 0.02                  // Max packet loss to consider switching to a higher layer
+const SIMULCAST_AUTO_DOWN_INTERVAL = 2 * time.Second // Min time between switches to lower layers
+const SIMULCAST_AUTO_UP_INTERVAL = 10 * time.Second  // Time with low packet loss to switch to a higher layer
+const SIMULCAST_BITRATE_WINDOW = 1 * time.Second     // Window to measure the bitrate of each layer
+const SIMULCAST_REMB_MARGIN = 1.2                    // Margin over the layer bitrate required by the receiver estimation
+
+// SimulcastTrack - Set of layers of a simulcast video track
+type SimulcastTrack struct {
+	mutex *sync.Mutex
+
+	layers    []*SimulcastLayer       // Layers, in order of arrival
+	switchers map[*LayerSwitcher]bool // Switchers receiving packets from the layers
+}
+
+// SimulcastLayer - Layer of a simulcast video track
+type SimulcastLayer struct {
+	rid string // Layer ID
+
+	simulcast *SimulcastTrack             // Set of layers
+	track     *webrtc.TrackLocalStaticRTP // Local track, used to send the layer to other nodes
+	codec     webrtc.RTPCodecCapability   // Codec of the layer
+
+	keyframeRequester *KeyframeRequester // Sends keyframe requests to the publisher of the layer
+
+	bitrate     float64   // Measured bitrate (bits per second)
+	windowBytes uint64    // Bytes received in the current window
+	windowStart time.Time // Start of the current window
+}
+
+// Creates a new simulcast track
+func newSimulcastTrack() *SimulcastTrack {
+	return &SimulcastTrack{
+		mutex:     &sync.Mutex{},
+		layers:    make([]*SimulcastLayer, 0),
+		switchers: make(map[*LayerSwitcher]bool),
+	}
+}
+
+// Adds a layer
+// The sendPLI function is called when a keyframe of the layer is needed
+func (simulcast *SimulcastTrack) addLayer(rid string, codec webrtc.RTPCodecCapability, sendPLI func()) (*SimulcastLayer, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, SIMULCAST_LAYER_TRACK_PREFIX+rid, "pion")
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &SimulcastLayer{
+		rid:               rid,
+		simulcast:         simulcast,
+		track:             track,
+		codec:             codec,
+		keyframeRequester: newKeyframeRequester(sendPLI),
+		windowStart:       time.Now(),
+	}
+
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	simulcast.layers = append(simulcast.layers, layer)
+
+	return layer, nil
+}
+
+// Finds a layer by its RID
+func (simulcast *SimulcastTrack) getLayer(rid string) *SimulcastLayer {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	for _, layer := range simulcast.layers {
+		if layer.rid == rid {
+			return layer
+		}
+	}
+
+	return nil
+}
+
+// Requests a keyframe for every layer
+func (simulcast *SimulcastTrack) requestKeyframes() {
+	simulcast.mutex.Lock()
+	layers := make([]*SimulcastLayer, len(simulcast.layers))
+	copy(layers, simulcast.layers)
+	simulcast.mutex.Unlock()
+
+	for _, layer := range layers {
+		layer.sendKeyframeRequest()
+	}
+}
+
+// Stops sending keyframe requests for the layers
+// Call when the publisher is closed
+func (simulcast *SimulcastTrack) close() {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	for _, layer := range simulcast.layers {
+		layer.keyframeRequester.close()
+	}
+}
+
+// Counts the layers
+func (simulcast *SimulcastTrack) countLayers() int {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	return len(simulcast.layers)
+}
+
+// Gets the list of layer IDs, in order of arrival
+func (simulcast *SimulcastTrack) getLayerIds() []string {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	rids := make([]string, 0, len(simulcast.layers))
+
+	for _, layer := range simulcast.layers {
+		rids = append(rids, layer.rid)
+	}
+
+	return rids
+}
+
+// Gets the layers, sorted from the highest quality to the lowest one
+// The quality is estimated from the measured bitrate
+func (simulcast *SimulcastTrack) getLayersByQuality() []*SimulcastLayer {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	layers := make([]*SimulcastLayer, len(simulcast.layers))
+	copy(layers, simulcast.layers)
+
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].bitrate > layers[j].bitrate
+	})
+
+	return layers
+}
+
+// Gets the layers to send to other node
+// If the list of requested layers is empty, all the layers are sent
+func (simulcast *SimulcastTrack) getLayersForSending(requested []string) []*SimulcastLayer {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	result := make([]*SimulcastLayer, 0, len(simulcast.layers))
+
+	for _, layer := range simulcast.layers {
+		if len(requested) == 0 || containsString(requested, layer.rid) {
+			result = append(result, layer)
+		}
+	}
+
+	if len(result) == 0 {
+		// None of the requested layers is available
+		result = append(result, simulcast.layers...)
+	}
+
+	return result
+}
+
+// Adds a switcher, so it receives the packets of the layers
+func (simulcast *SimulcastTrack) addSwitcher(switcher *LayerSwitcher) {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	simulcast.switchers[switcher] = true
+}
+
+// Removes a switcher
+func (simulcast *SimulcastTrack) removeSwitcher(switcher *LayerSwitcher) {
+	simulcast.mutex.Lock()
+	defer simulcast.mutex.Unlock()
+
+	delete(simulcast.switchers, switcher)
+}
+
+// Writes an RTP packet received for a layer
+// The packet is sent to the layer track and to the switchers
+func (layer *SimulcastLayer) Write(b []byte) (int, error) {
+	simulcast := layer.simulcast
+
+	simulcast.mutex.Lock()
+
+	// Measure bitrate
+	now := time.Now()
+	layer.windowBytes += uint64(len(b))
+	elapsed := now.Sub(layer.windowStart)
+	if elapsed >= SIMULCAST_BITRATE_WINDOW {
+		layer.bitrate = float64(layer.windowBytes*8) / elapsed.Seconds()
+		layer.windowBytes = 0
+		layer.windowStart = now
+	}
+
+	switchers := make([]*LayerSwitcher, 0, len(simulcast.switchers))
+	for switcher := range simulcast.switchers {
+		switchers = append(switchers, switcher)
+	}
+
+	simulcast.mutex.Unlock()
+
+	if len(switchers) > 0 {
+		packet := &rtp.Packet{}
+
+		if err := packet.Unmarshal(b); err == nil {
+			keyframe := isKeyframe(layer.codec.MimeType, packet.Payload)
+
+			for _, switcher := range switchers {
+				switcher.onPacket(layer, packet, keyframe)
+			}
+		}
+	}
+
+	return layer.track.Write(b)
+}
+
+// Gets the measured bitrate of the layer
+func (layer *SimulcastLayer) getBitrate() float64 {
+	layer.simulcast.mutex.Lock()
+	defer layer.simulcast.mutex.Unlock()
+
+	return layer.bitrate
+}
+
+// Requests a keyframe for the layer to the publisher
+// Requests are aggregated and rate limited
+func (layer *SimulcastLayer) sendKeyframeRequest() {
+	layer.keyframeRequester.request()
+}
+
+// LayerSwitcher - Sends one of the layers of a simulcast track
+// into a local track, switching layers on keyframes.
+// Sequence numbers and timestamps are rewritten, so the receiver sees a continuous stream.
+type LayerSwitcher struct {
+	simulcast *SimulcastTrack             // Set of layers
+	track     *webrtc.TrackLocalStaticRTP // Output track
+
+	mutex *sync.Mutex
+
+	auto    bool            // True for automatic selection
+	current *SimulcastLayer // Layer being sent
+	target  *SimulcastLayer // Layer to switch to, on the next keyframe
+
+	started        bool      // True after the first packet is sent
+	seqOffset      uint16    // Sequence number offset of the current layer
+	tsOffset       uint32    // Timestamp offset of the current layer
+	lastSeq        uint16    // Last sequence number sent
+	lastTimestamp  uint32    // Last timestamp sent
+	lastPacketTime time.Time // Time the last packet was sent
+
+	createdAt    time.Time // Time the switcher was created
+	lastSwitch   time.Time // Time of the last layer change
+	lowLossSince time.Time // Time since the packet loss is low (automatic selection)
+}
+
+// Creates a layer switcher for a simulcast track
+// The layer preference can be a layer ID or AUTO
+func newLayerSwitcher(simulcast *SimulcastTrack, preference string) (*LayerSwitcher, error) {
+	layers := simulcast.getLayersByQuality()
+
+	if len(layers) == 0 {
+		return nil, errors.New("the simulcast track has no layers")
+	}
+
+	track, err := webrtc.NewTrackLocalStaticRTP(layers[0].codec, "video", "pion")
+	if err != nil {
+		return nil, err
+	}
+
+	switcher := &LayerSwitcher{
+		simulcast: simulcast,
+		track:     track,
+		mutex:     &sync.Mutex{},
+		auto:      true,
+		createdAt: time.Now(),
+	}
+
+	switcher.setPreference(preference)
+
+	simulcast.addSwitcher(switcher)
+
+	return switcher, nil
+}
+
+// Sets the layer preference (layer ID or AUTO)
+// If the layer does not exist, the automatic selection is used
+func (switcher *LayerSwitcher) setPreference(preference string) {
+	var layer *SimulcastLayer
+
+	if preference != "" && !strings.EqualFold(preference, SIMULCAST_LAYER_AUTO) {
+		layer = switcher.simulcast.getLayer(preference)
+	}
+
+	switcher.mutex.Lock()
+
+	if layer == nil {
+		// Keep the current layer, adjusted from the feedback
+		// If there is no layer yet, it's selected when the bitrates are measured
+		switcher.auto = true
+		switcher.mutex.Unlock()
+		return
+	}
+
+	switcher.auto = false
+
+	switcher.mutex.Unlock()
+
+	switcher.switchTo(layer)
+}
+
+// Selects the initial layer for the automatic selection (the highest quality)
+// Waits for the bitrate of all the layers to be measured, to know their quality
+// Must be called with the switcher mutex locked
+func (switcher *LayerSwitcher) selectInitialLayer() {
+	layers := switcher.simulcast.getLayersByQuality()
+
+	if time.Since(switcher.createdAt) < 2*SIMULCAST_BITRATE_WINDOW {
+		for _, layer := range layers {
+			if layer.getBitrate() == 0 {
+				return // Not measured yet
+			}
+		}
+	}
+
+	switcher.target = layers[0]
+	switcher.lastSwitch = time.Now()
+
+	layers[0].sendKeyframeRequest()
+}
+
+// Switches to a layer
+// The switch happens on the next keyframe of the layer
+func (switcher *LayerSwitcher) switchTo(layer *SimulcastLayer) {
+	switcher.mutex.Lock()
+
+	if layer == switcher.current {
+		switcher.target = nil
+		switcher.mutex.Unlock()
+		return
+	}
+
+	if layer == switcher.target {
+		switcher.mutex.Unlock()
+		return
+	}
+
+	switcher.target = layer
+	switcher.lastSwitch = time.Now()
+
+	switcher.mutex.Unlock()
+
+	layer.sendKeyframeRequest()
+}
+
+// Called for each packet received for a layer
+func (switcher *LayerSwitcher) onPacket(layer *SimulcastLayer, packet *rtp.Packet, keyframe bool) {
+	switcher.mutex.Lock()
+	defer switcher.mutex.Unlock()
+
+	if switcher.current == nil && switcher.target == nil {
+		switcher.selectInitialLayer()
+	}
+
+	if layer == switcher.target && keyframe {
+		// Switch layers
+		switcher.current = layer
+		switcher.target = nil
+
+		if switcher.started {
+			// Continue after the last packet sent
+			elapsed := time.Since(switcher.lastPacketTime)
+			tsDelta := uint32(elapsed.Seconds() * float64(layer.codec.ClockRate))
+			if tsDelta == 0 {
+				tsDelta = 1
+			}
+
+			switcher.seqOffset = switcher.lastSeq + 1 - packet.SequenceNumber
+			switcher.tsOffset = switcher.lastTimestamp + tsDelta - packet.Timestamp
+		}
+	}
+
+	if layer != switcher.current {
+		return
+	}
+
+	header := packet.Header
+	header.SequenceNumber = packet.SequenceNumber + switcher.seqOffset
+	header.Timestamp = packet.Timestamp + switcher.tsOffset
+
+	if !switcher.started || isNewerSequenceNumber(header.SequenceNumber, switcher.lastSeq) {
+		switcher.lastSeq = header.SequenceNumber
+		switcher.lastTimestamp = header.Timestamp
+		switcher.lastPacketTime = time.Now()
+	}
+
+	switcher.started = true
+
+	err := switcher.track.WriteRTP(&rtp.Packet{Header: header, Payload: packet.Payload, PaddingSize: packet.PaddingSize})
+	if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		LogDebug("Could not write simulcast packet: " + err.Error())
+	}
+}
+
+// Called when a keyframe is requested by the receiver
+func (switcher *LayerSwitcher) onKeyframeRequest() {
+	switcher.mutex.Lock()
+
+	layer := switcher.target
+	if layer == nil {
+		layer = switcher.current
+	}
+
+	switcher.mutex.Unlock()
+
+	if layer != nil {
+		layer.sendKeyframeRequest()
+	}
+}
+
+// Called when the receiver reports the packet loss (0 to 1)
+// and optionally the estimated max bitrate (0 if unknown)
+// Adjusts the layer if the automatic selection is enabled
+func (switcher *LayerSwitcher) onReceiverFeedback(loss float64, estimatedBitrate float64) {
+	switcher.mutex.Lock()
+
+	if !switcher.auto || switcher.current == nil || switcher.target != nil {
+		switcher.mutex.Unlock()
+		return
+	}
+
+	current := switcher.current
+	now := time.Now()
+	sinceSwitch := now.Sub(switcher.lastSwitch)
+
+	if loss >= SIMULCAST_AUTO_LOSS_UP {
+		switcher.lowLossSince = time.Time{}
+	} else if switcher.lowLossSince.IsZero() {
+		switcher.lowLossSince = now
+	}
+
+	lowLossTime := time.Duration(0)
+	if !switcher.lowLossSince.IsZero() {
+		lowLossTime = now.Sub(switcher.lowLossSince)
+	}
+
+	switcher.mutex.Unlock()
+
+	layers := switcher.simulcast.getLayersByQuality()
+
+	currentIndex := -1
+	for i, layer := range layers {
+		if layer == current {
+			currentIndex = i
+			break
+		}
+	}
+
+	if currentIndex < 0 {
+		return
+	}
+
+	tooMuchForEstimation := estimatedBitrate > 0 && current.getBitrate() > estimatedBitrate
+
+	if (loss >= SIMULCAST_AUTO_LOSS_DOWN || tooMuchForEstimation) && sinceSwitch >= SIMULCAST_AUTO_DOWN_INTERVAL {
+		// Lower quality
+		if currentIndex+1 < len(layers) {
+			switcher.switchTo(layers[currentIndex+1])
+		}
+		return
+	}
+
+	if lowLossTime >= SIMULCAST_AUTO_UP_INTERVAL && sinceSwitch >= SIMULCAST_AUTO_UP_INTERVAL && currentIndex > 0 {
+		// Higher quality, if the estimation allows it
+		higher := layers[currentIndex-1]
+
+		if estimatedBitrate <= 0 || higher.getBitrate()*SIMULCAST_REMB_MARGIN <= estimatedBitrate {
+			switcher.switchTo(higher)
+		}
+	}
+}
+
+// Reads the RTCP feedback of the receiver
+// Keyframe requests and receiver reports are applied to the switcher
+func (switcher *LayerSwitcher) onRTCPPackets(packets []rtcp.Packet) {
+	var loss float64 = -1
+	var estimatedBitrate float64 = 0
+
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			switcher.onKeyframeRequest()
+		case *rtcp.ReceiverReport:
+			for _, report := range p.Reports {
+				l := float64(report.FractionLost) / 256
+				if l > loss {
+					loss = l
+				}
+			}
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			estimatedBitrate = float64(p.Bitrate)
+		}
+	}
+
+	if loss >= 0 || estimatedBitrate > 0 {
+		if loss < 0 {
+			loss = 0
+		}
+
+		switcher.onReceiverFeedback(loss, estimatedBitrate)
+	}
+}
+
+// Gets the layer being sent and the automatic selection status
+func (switcher *LayerSwitcher) getStatus() (layer string, auto bool) {
+	switcher.mutex.Lock()
+	defer switcher.mutex.Unlock()
+
+	if switcher.current != nil {
+		layer = switcher.current.rid
+	}
+
+	return layer, switcher.auto
+}
+
+// Stops the switcher
+func (switcher *LayerSwitcher) close() {
+	switcher.simulcast.removeSwitcher(switcher)
+}
+
+// Checks if a sequence number is newer than other, considering wrap-around
+func isNewerSequenceNumber(seq uint16, prev uint16) bool {
+	return seq != prev && seq-prev < 0x8000
+}
+
+// Checks if a list of strings contains a value
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parses a comma separated list of layer IDs
+func parseLayerList(list string) []string {
+	result := make([]string, 0)
+
+	for _, rid := range strings.Split(list, ",") {
+		rid = strings.TrimSpace(rid)
+
+		if rid != "" && !containsString(result, rid) {
+			result = append(result, rid)
+		}
+	}
+
+	return result
+}
+
+// Gets the simulcast layer IDs sent in the video section of an SDP
+// Returns an empty list if the SDP has no simulcast layers
+func getSDPSimulcastLayers(rawSDP string) []string {
+	parsed := sdp.SessionDescription{}
+
+	result := make([]string, 0)
+
+	if parsed.UnmarshalString(rawSDP) != nil {
+		return result
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+
+		for _, attr := range media.Attributes {
+			if attr.Key != "rid" {
+				continue
+			}
+
+			parts := strings.Fields(attr.Value)
+
+			if len(parts) >= 2 && parts[1] == "send" && !containsString(result, parts[0]) {
+				result = append(result, parts[0])
+			}
+		}
+
+		break // Only the first video section is used
+	}
+
+	return result
+}
@@ -0,0 +1,349 @@
+// Stream registry
+// Shared list of the streams being published in the cluster,
+// so the nodes can find a stream without broadcasting a RESOLVE message
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetime of the registry entries, refreshed by the node publishing the stream
+const STREAM_REGISTRY_DEFAULT_TTL_SECONDS = 30
+
+// StreamRegistryEntry - Location of a stream in the cluster
+type StreamRegistryEntry struct {
+	Node      string   `json:"node"`   // ID of the node publishing the stream
+	StartTime int64    `json:"start"`  // Unix timestamp (milliseconds) of the start of the publishing
+	Tracks    []string `json:"tracks"` // Kinds of the published tracks (video, audio)
+}
+
+// StreamRegistry - Storage of the stream locations
+// Entries expire if the node publishing the stream does not refresh them
+type StreamRegistry interface {
+	// Registers a stream published by the node, or refreshes the entry
+	Register(sid string, entry *StreamRegistryEntry) error
+
+	// Removes a stream, only if the entry was not replaced by other publisher
+	Unregister(sid string, entry *StreamRegistryEntry) error
+
+	// Finds the location of a stream
+	// Returns nil if the stream is not registered
+	Lookup(sid string) (*StreamRegistryEntry, error)
+
+	// Closes the registry
+	Close()
+}
+
+// Operation of the stream registry, run by the registry worker
+type streamRegistryOp struct {
+	sid        string
+	entry      *StreamRegistryEntry
+	logger     *Logger      // Logger for the errors
+	source     *WRTC_Source // Source of the entry, checked before refreshing it
+	unregister bool         // True to remove the entry, false to register it
+	refresh    bool         // Periodic refresh, skipped if the source is no longer published
+}
+
+// Queue of operations of the stream registry
+// Operations run one by one, in the same order they were added
+type streamRegistryQueue struct {
+	cond *sync.Cond
+
+	queue  []streamRegistryOp
+	closed bool
+
+	done chan struct{} // Closed when the worker stops
+}
+
+// Creates the queue of operations of the stream registry
+func newStreamRegistryQueue() *streamRegistryQueue {
+	return &streamRegistryQueue{
+		cond:   sync.NewCond(&sync.Mutex{}),
+		queue:  make([]streamRegistryOp, 0),
+		closed: false,
+		done:   make(chan struct{}),
+	}
+}
+
+// Adds an operation to the queue
+func (q *streamRegistryQueue) push(op streamRegistryOp) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.queue = append(q.queue, op)
+	q.cond.Signal()
+}
+
+// Waits for the next operation of the queue
+// Returns false if the queue is closed and there are no pending operations
+func (q *streamRegistryQueue) pop() (streamRegistryOp, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for len(q.queue) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if len(q.queue) == 0 {
+		return streamRegistryOp{}, false
+	}
+
+	op := q.queue[0]
+	q.queue = q.queue[1:]
+
+	return op, true
+}
+
+// Closes the queue
+// No more operations are accepted, but the pending ones still run
+func (q *streamRegistryQueue) close() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Creates the stream registry for the node, based on the configuration
+// Returns nil if the registry is not enabled
+func createStreamRegistry(config *Config) (StreamRegistry, error) {
+	if !config.Redis.StreamRegistry {
+		return nil, nil
+	}
+
+	if strings.ToUpper(config.MessageBus.Type) != "REDIS" {
+		return nil, errors.New("the stream registry requires the REDIS message bus")
+	}
+
+	return NewRedisStreamRegistry(&config.Redis), nil
+}
+
+// Gets the registry entry of a source
+func (source *WRTC_Source) getRegistryEntry() *StreamRegistryEntry {
+	tracks := make([]string, 0, 2)
+
+	if source.hasVideo {
+		tracks = append(tracks, "video")
+	}
+
+	if source.hasAudio {
+		tracks = append(tracks, "audio")
+	}
+
+	return &StreamRegistryEntry{
+		Node:      source.node.id,
+		StartTime: source.startTime.UnixMilli(),
+		Tracks:    tracks,
+	}
+}
+
+// Adds a source to the stream registry
+// The registry is updated in the background, so it can be called with the status mutex locked
+func (node *WebRTC_CDN_Node) registerStream(source *WRTC_Source) {
+	if node.registry == nil || node.isDraining() {
+		return
+	}
+
+	node.registryQueue.push(streamRegistryOp{
+		sid:    source.sid,
+		entry:  source.getRegistryEntry(),
+		logger: source.logger,
+		source: source,
+	})
+}
+
+// Removes a source from the stream registry
+// The registry is updated in the background, so it can be called with the status mutex locked
+// While draining, the streams are already removed
+func (node *WebRTC_CDN_Node) unregisterStream(source *WRTC_Source) {
+	if node.registry == nil || node.isDraining() {
+		return
+	}
+
+	node.registryQueue.push(streamRegistryOp{
+		sid:        source.sid,
+		entry:      source.getRegistryEntry(),
+		logger:     source.logger,
+		unregister: true,
+	})
+}
+
+// Runs the operations of the stream registry, one by one
+// A single worker keeps the order, so an entry is never registered again after being removed
+// Stops when the queue is closed and empty
+func (node *WebRTC_CDN_Node) runStreamRegistryWorker() {
+	if node.registry == nil {
+		return
+	}
+
+	defer close(node.registryQueue.done)
+
+	for {
+		op, ok := node.registryQueue.pop()
+
+		if !ok {
+			return // Closed
+		}
+
+		if op.unregister {
+			err := node.registry.Unregister(op.sid, op.entry)
+
+			if err != nil {
+				op.logger.Warning("Could not unregister the stream: " + err.Error())
+			}
+
+			continue
+		}
+
+		if node.isDraining() {
+			continue // The streams were removed when draining started
+		}
+
+		if op.refresh {
+			node.mutexStatus.Lock()
+			published := node.sources[op.sid] == op.source
+			node.mutexStatus.Unlock()
+
+			if !published {
+				continue
+			}
+		}
+
+		err := node.registry.Register(op.sid, op.entry)
+
+		if err != nil {
+			if op.refresh {
+				op.logger.Warning("Could not refresh the stream registry: " + err.Error())
+			} else {
+				op.logger.Warning("Could not register the stream: " + err.Error())
+			}
+		}
+	}
+}
+
+// Finds the node publishing a stream, in order to create a relay for the sinks
+// The registry is checked first. If the stream is not found, other nodes are asked with a RESOLVE message
+// Can be called with the status mutex locked
+func (node *WebRTC_CDN_Node) locateStream(sid string) {
+	if node.registry == nil {
+		node.sendResolveMessage(sid)
+		return
+	}
+
+	go func() {
+		entry, err := node.registry.Lookup(sid)
+
+		if err != nil {
+			metricStreamRegistryLookups.WithLabelValues("error").Inc()
+			LogWarning("Could not check the stream registry: " + err.Error())
+		} else if entry != nil && entry.Node != node.id {
+			metricStreamRegistryLookups.WithLabelValues("hit").Inc()
+			node.onStreamLocated(sid, entry)
+			return
+		} else {
+			metricStreamRegistryLookups.WithLabelValues("miss").Inc()
+		}
+
+		node.sendResolveMessage(sid)
+	}()
+}
+
+// Called when a stream is found in the registry
+// If there are sinks waiting for the stream, a relay is created
+// The relay keeps the entry, so it can be removed if the node does not have the stream
+func (node *WebRTC_CDN_Node) onStreamLocated(sid string, entry *StreamRegistryEntry) {
+	node.mutexStatus.Lock()
+	defer node.mutexStatus.Unlock()
+
+	if node.sources[sid] != nil || node.relays[sid] != nil {
+		return // Already available
+	}
+
+	if len(node.sinks[sid]) > 0 {
+		relay := node.createRelay(sid, entry.Node)
+		relay.registryEntry = entry
+	}
+}
+
+// Removes a stale registry entry, pointing to a node that does not have the stream
+// The entry is only removed if it was not replaced by other publisher
+// Can be called with the status mutex locked
+func (node *WebRTC_CDN_Node) removeStaleStream(sid string, entry *StreamRegistryEntry) {
+	if node.registry == nil {
+		return
+	}
+
+	node.registryQueue.push(streamRegistryOp{
+		sid:        sid,
+		entry:      entry,
+		logger:     getRootLogger().With("stream_id", sid),
+		unregister: true,
+	})
+}
+
+// Periodically refreshes the registry entries of the sources of the node
+// Stops when the node is draining
+func (node *WebRTC_CDN_Node) runStreamRegistryRefresh() {
+	if node.registry == nil {
+		return
+	}
+
+	period := time.Duration(node.getConfig().Redis.StreamRegistryTTLSeconds) * time.Second / 3
+
+	for {
+		time.Sleep(period)
+
+		if node.isDraining() {
+			return
+		}
+
+		node.mutexStatus.Lock()
+		sources := make([]*WRTC_Source, 0, len(node.sources))
+		for _, source := range node.sources {
+			sources = append(sources, source)
+		}
+		node.mutexStatus.Unlock()
+
+		for _, source := range sources {
+			node.registryQueue.push(streamRegistryOp{
+				sid:     source.sid,
+				entry:   source.getRegistryEntry(),
+				logger:  source.logger,
+				source:  source,
+				refresh: true,
+			})
+		}
+	}
+}
+
+// Removes all the sources of the node from the registry
+// Called when the node starts draining, since it stops announcing its streams
+// The operations are queued after the pending ones, so they run last
+func (node *WebRTC_CDN_Node) unregisterAllStreams() {
+	if node.registry == nil {
+		return
+	}
+
+	node.mutexStatus.Lock()
+	sources := make([]*WRTC_Source, 0, len(node.sources))
+	for _, source := range node.sources {
+		sources = append(sources, source)
+	}
+	node.mutexStatus.Unlock()
+
+	for _, source := range sources {
+		node.registryQueue.push(streamRegistryOp{
+			source:     source,
+			entry:      source.getRegistryEntry(),
+			unregister: true,
+		})
+	}
+}
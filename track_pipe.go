@@ -11,8 +11,16 @@ import (
 
 const TRACK_PIPE_BUFFER_LENGTH = 1400
 
-// Pipe a track to another track
-func pipeTrack(remoteTrack *webrtc.TrackRemote, localTrack *webrtc.TrackLocalStaticRTP) {
+// Pipe a track to another track (or a simulcast layer)
+// If a recorder is provided, the packets are also written into it
+func pipeTrack(remoteTrack *webrtc.TrackRemote, localTrack io.Writer, sid string, recorder *TrackRecorder) {
+	if recorder != nil {
+		defer recorder.close()
+	}
+
+	metrics := getTrackMetrics(remoteTrack.Kind().String(), sid)
+	defer metrics.release()
+
 	rtpBuf := make([]byte, TRACK_PIPE_BUFFER_LENGTH)
 	for {
 		i, _, readErr := remoteTrack.Read(rtpBuf)
@@ -20,6 +28,12 @@ func pipeTrack(remoteTrack *webrtc.TrackRemote, localTrack *webrtc.TrackLocalSta
 			return
 		}
 
+		metrics.onPacket(i)
+
+		if recorder != nil {
+			recorder.writePacket(rtpBuf[:i])
+		}
+
 		// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
 		if _, err := localTrack.Write(rtpBuf[:i]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
 			return
@@ -40,3 +54,18 @@ func readPacketsFromRTPSender(sender *webrtc.RTPSender) {
 		}
 	}
 }
+
+// Reads incoming RTCP packets, calling onKeyframeRequest
+// when they contain a keyframe request (PLI or FIR)
+func readKeyframeRequestsFromRTPSender(sender *webrtc.RTPSender, onKeyframeRequest func()) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		if hasKeyframeRequest(packets) {
+			onKeyframeRequest()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Local track receiver
+// Receives the packets of a local track without a peer connection
+
+package main
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// LocalTrackReceiver - Receives the packets of a local track
+// It's bound to the track like the senders of a peer connection
+type LocalTrackReceiver struct {
+	id          string
+	track       *webrtc.TrackLocalStaticRTP
+	payloadType webrtc.PayloadType
+	ssrc        webrtc.SSRC
+	onPacket    func(header *rtp.Header, payload []byte)
+}
+
+// Creates a receiver for a track
+// The packets are received with the given payload type and SSRC
+func newLocalTrackReceiver(track *webrtc.TrackLocalStaticRTP, payloadType webrtc.PayloadType, ssrc webrtc.SSRC, onPacket func(header *rtp.Header, payload []byte)) (*LocalTrackReceiver, error) {
+	id, err := makeId(8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalTrackReceiver{
+		id:          "local-" + id,
+		track:       track,
+		payloadType: payloadType,
+		ssrc:        ssrc,
+		onPacket:    onPacket,
+	}, nil
+}
+
+// CodecParameters returns the codec of the track
+func (receiver *LocalTrackReceiver) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: receiver.track.Codec(), PayloadType: receiver.payloadType}}
+}
+
+// HeaderExtensions returns no header extensions
+func (receiver *LocalTrackReceiver) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter {
+	return nil
+}
+
+// SSRC returns the SSRC of the packets
+func (receiver *LocalTrackReceiver) SSRC() webrtc.SSRC {
+	return receiver.ssrc
+}
+
+// SSRCRetransmission returns the SSRC for retransmissions (not used)
+func (receiver *LocalTrackReceiver) SSRCRetransmission() webrtc.SSRC {
+	return 0
+}
+
+// SSRCForwardErrorCorrection returns the SSRC for forward error correction (not used)
+func (receiver *LocalTrackReceiver) SSRCForwardErrorCorrection() webrtc.SSRC {
+	return 0
+}
+
+// WriteStream returns the receiver itself
+func (receiver *LocalTrackReceiver) WriteStream() webrtc.TrackLocalWriter {
+	return receiver
+}
+
+// ID returns the unique ID of the receiver
+func (receiver *LocalTrackReceiver) ID() string {
+	return receiver.id
+}
+
+// RTCPReader returns nil, since there is no RTCP
+func (receiver *LocalTrackReceiver) RTCPReader() interceptor.RTCPReader {
+	return nil
+}
+
+// WriteRTP receives a packet from the track
+func (receiver *LocalTrackReceiver) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	receiver.onPacket(header, payload)
+
+	return len(payload), nil
+}
+
+// Write receives a marshaled packet from the track
+func (receiver *LocalTrackReceiver) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+
+	return receiver.WriteRTP(&packet.Header, packet.Payload)
+}
@@ -0,0 +1,240 @@
+// Embedded TURN server
+// Optional TURN/STUN server, so there is no need for a separate one
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pion/turn/v5"
+	"github.com/pion/webrtc/v4"
+)
+
+// Default listening port of the embedded TURN server
+const EMBEDDED_TURN_DEFAULT_PORT = 3478
+
+// Default realm of the embedded TURN server
+const EMBEDDED_TURN_DEFAULT_REALM = "webrtc-cdn"
+
+// Default lifetime of the ephemeral credentials (1 day)
+const EMBEDDED_TURN_DEFAULT_CREDENTIALS_TTL_SECONDS = 86400
+
+// Default range of ports for the relayed connections
+const EMBEDDED_TURN_DEFAULT_RELAY_MIN_PORT = 49152
+const EMBEDDED_TURN_DEFAULT_RELAY_MAX_PORT = 65535
+
+// Registers the TURN server, so it can be closed
+// Returns false if the node is already shutting down
+func (node *WebRTC_CDN_Node) addTURNServer(server *turn.Server) bool {
+	node.mutexShutdown.Lock()
+	defer node.mutexShutdown.Unlock()
+
+	if node.draining {
+		return false
+	}
+
+	node.turnServer = server
+
+	return true
+}
+
+// Runs the embedded TURN server
+// It listens on the same port for UDP and TCP
+func (node *WebRTC_CDN_Node) runTURNServer(wg *sync.WaitGroup) {
+	defer func() {
+		wg.Done()
+	}()
+
+	config := &node.getConfig().EmbeddedTURN
+
+	if !config.Enabled {
+		return
+	}
+
+	bind_addr := node.getConfig().HTTP.BindAddress
+
+	if bind_addr == "" {
+		bind_addr = "0.0.0.0"
+	}
+
+	addr := net.JoinHostPort(bind_addr, strconv.Itoa(config.Port))
+
+	udpListener, err := net.ListenPacket("udp", addr)
+
+	if err != nil {
+		LogError(err)
+		return
+	}
+
+	tcpListener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		udpListener.Close()
+		LogError(err)
+		return
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       config.Realm,
+		AuthHandler: makeTURNAuthHandler(config),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: makeTURNRelayAddressGenerator(config, bind_addr),
+				PermissionHandler:     makeTURNPermissionHandler(config),
+			},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              tcpListener,
+				RelayAddressGenerator: makeTURNRelayAddressGenerator(config, bind_addr),
+				PermissionHandler:     makeTURNPermissionHandler(config),
+			},
+		},
+	})
+
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		LogError(err)
+		return
+	}
+
+	if !node.addTURNServer(server) {
+		server.Close()
+		return // Shutting down
+	}
+
+	getRootLogger().Info("Listening on "+addr, "service", "turn", "public_ip", config.publicAddr.String())
+}
+
+// Creates the generator of the relay addresses,
+// allocating the ports in the configured range
+func makeTURNRelayAddressGenerator(config *EmbeddedTURNConfig, bind_addr string) turn.RelayAddressGenerator {
+	return &turn.RelayAddressGeneratorPortRange{
+		RelayAddress: config.publicAddr,
+		Address:      bind_addr,
+		MinPort:      uint16(config.RelayMinPort),
+		MaxPort:      uint16(config.RelayMaxPort),
+	}
+}
+
+// Creates the permission handler
+// Relaying to loopback, private and link-local peers is denied, unless they are in the allowed ranges
+func makeTURNPermissionHandler(config *EmbeddedTURNConfig) turn.PermissionHandler {
+	return func(clientAddr net.Addr, peerIP net.IP) bool {
+		for _, ipRange := range config.allowedPeerRanges {
+			if ipRange.Contains(peerIP) {
+				return true
+			}
+		}
+
+		if peerIP.IsLoopback() || peerIP.IsPrivate() || peerIP.IsLinkLocalUnicast() || peerIP.IsUnspecified() || peerIP.IsMulticast() {
+			getRootLogger().Debug("Denied TURN permission to "+peerIP.String(), "service", "turn", "client", clientAddr.String())
+			return false
+		}
+
+		return true
+	}
+}
+
+// Creates the authentication handler
+// Users of the list are checked first, then the ephemeral credentials if the secret is set
+func makeTURNAuthHandler(config *EmbeddedTURNConfig) turn.AuthHandler {
+	var restAuthHandler turn.AuthHandler
+
+	if config.Secret != "" {
+		restAuthHandler = turn.LongTermTURNRESTAuthHandler(config.Secret, nil)
+	}
+
+	return func(ra *turn.RequestAttributes) (string, []byte, bool) {
+		if password, ok := config.credentials[ra.Username]; ok {
+			return ra.Username, turn.GenerateAuthKey(ra.Username, ra.Realm, password), true
+		}
+
+		if restAuthHandler != nil {
+			return restAuthHandler(ra)
+		}
+
+		return "", nil, false
+	}
+}
+
+// Gets the ICE servers to use the embedded TURN server
+// If the secret is set, ephemeral credentials are generated for the user
+func (config *EmbeddedTURNConfig) getICEServers(user string) []webrtc.ICEServer {
+	host := net.JoinHostPort(config.publicAddr.String(), strconv.Itoa(config.Port))
+
+	var username string
+	var password string
+
+	if config.Secret != "" {
+		u, p, err := generateTURNCredentials(config.Secret, user, config.CredentialsTTLSeconds)
+
+		if err != nil {
+			LogError(err)
+			return nil
+		}
+
+		username = u
+		password = p
+	} else {
+		username = config.defaultUser
+		password = config.credentials[username]
+	}
+
+	return []webrtc.ICEServer{
+		{
+			URLs: []string{"stun:" + host},
+		},
+		{
+			URLs:       []string{"turn:" + host + "?transport=udp", "turn:" + host + "?transport=tcp"},
+			Username:   username,
+			Credential: password,
+		},
+	}
+}
+
+// Detects the public IP of the node, if it was not configured
+// Called once at startup, since the network interfaces are listed
+func (config *EmbeddedTURNConfig) resolvePublicIP() error {
+	if !config.Enabled || config.publicAddr != nil {
+		return nil
+	}
+
+	config.publicAddr = detectPublicIP()
+
+	if config.publicAddr == nil {
+		return errors.New("embedded_turn.public_ip: the network interfaces have no public IPv4 address, it must be set")
+	}
+
+	return nil
+}
+
+// Detects the IP address to announce for the relayed connections
+// Returns the first global IPv4 address of the network interfaces,
+// skipping loopback, link-local and private addresses
+func detectPublicIP() net.IP {
+	addrs, err := net.InterfaceAddrs()
+
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+// WebRTC API
+// Shared by all the peer connections of the node
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// Size of the read buffer of the ICE TCP connections (in packets)
+const ICE_TCP_MUX_READ_BUFFER_SIZE = 8
+
+// Creates the WebRTC APIs, for the peer connections with the clients and between nodes
+// If the inter-node options are not enabled, the same API is used for both
+func createWebRTCAPIs(config *Config) (*webrtc.API, *webrtc.API, error) {
+	settingEngine, err := createSettingEngine(&config.ICE)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+
+	if !config.InterNode.Enabled {
+		return api, api, nil
+	}
+
+	interNodeSettingEngine := createInterNodeSettingEngine(settingEngine, &config.InterNode)
+
+	return api, webrtc.NewAPI(webrtc.WithSettingEngine(interNodeSettingEngine)), nil
+}
+
+// Creates the setting engine for the peer connections with the clients
+// If the mux ports are set, all the peer connections share them
+func createSettingEngine(config *ICEConfig) (webrtc.SettingEngine, error) {
+	settingEngine := webrtc.SettingEngine{}
+
+	// Candidates filters
+
+	filter := config.candidateFilter
+
+	if filter.hasInterfaceFilter() {
+		settingEngine.SetInterfaceFilter(filter.isInterfaceAllowed)
+	}
+
+	if filter.hasIPFilter() {
+		settingEngine.SetIPFilter(filter.isIPAllowed)
+	}
+
+	// NAT 1:1 IPs
+
+	if len(config.NAT1To1IPs) > 0 {
+		err := settingEngine.SetICEAddressRewriteRules(getNAT1To1RewriteRules(config)...)
+
+		if err != nil {
+			return settingEngine, err
+		}
+	}
+
+	// mDNS
+
+	switch strings.ToLower(config.MulticastDNSMode) {
+	case "disabled":
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	case "gather":
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryAndGather)
+	default:
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryOnly)
+	}
+
+	// Ports
+
+	if config.UDPPortMin != 0 && config.UDPPortMax != 0 {
+		err := settingEngine.SetEphemeralUDPPortRange(uint16(config.UDPPortMin), uint16(config.UDPPortMax))
+
+		if err != nil {
+			return settingEngine, err
+		}
+	}
+
+	if config.UDPMuxPort != 0 {
+		udpMuxOptions := make([]ice.UDPMuxFromPortOption, 0)
+
+		if filter.hasInterfaceFilter() {
+			udpMuxOptions = append(udpMuxOptions, ice.UDPMuxFromPortWithInterfaceFilter(filter.isInterfaceAllowed))
+		}
+
+		if filter.hasIPFilter() {
+			udpMuxOptions = append(udpMuxOptions, ice.UDPMuxFromPortWithIPFilter(filter.isIPAllowed))
+		}
+
+		udpMux, err := ice.NewMultiUDPMuxFromPort(config.UDPMuxPort, udpMuxOptions...)
+
+		if err != nil {
+			return settingEngine, err
+		}
+
+		settingEngine.SetICEUDPMux(udpMux)
+
+		getRootLogger().Info("Listening on :"+strconv.Itoa(config.UDPMuxPort), "service", "ice", "network", "udp")
+	}
+
+	if config.TCPMuxPort != 0 {
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: config.TCPMuxPort})
+
+		if err != nil {
+			return settingEngine, err
+		}
+
+		settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, ICE_TCP_MUX_READ_BUFFER_SIZE))
+
+		getRootLogger().Info("Listening on :"+strconv.Itoa(config.TCPMuxPort), "service", "ice", "network", "tcp")
+	}
+
+	return settingEngine, nil
+}
+
+// Creates the setting engine for the peer connections between nodes
+// It's a copy of the one for the clients (sharing the mux ports),
+// with the inter-node candidates filters and without the NAT 1:1 IPs
+// The filters are not applied to the UDP mux, so they cannot be set along with it (see validate)
+func createInterNodeSettingEngine(settingEngine webrtc.SettingEngine, config *InterNodeConfig) webrtc.SettingEngine {
+	filter := config.candidateFilter
+
+	if filter.hasInterfaceFilter() {
+		settingEngine.SetInterfaceFilter(filter.isInterfaceAllowed)
+	}
+
+	if filter.hasIPFilter() {
+		settingEngine.SetIPFilter(filter.isIPAllowed)
+	}
+
+	settingEngine.SetICEAddressRewriteRules() // Never fails when removing the rules
+
+	return settingEngine
+}
+
+// Gets the address rewrite rules for the NAT 1:1 IPs
+// IPs without a local address are mapped to all the local addresses of the same family
+func getNAT1To1RewriteRules(config *ICEConfig) []webrtc.ICEAddressRewriteRule {
+	candidateType := webrtc.ICECandidateTypeHost
+
+	if strings.ToLower(config.NAT1To1CandidateType) == "srflx" {
+		candidateType = webrtc.ICECandidateTypeSrflx
+	}
+
+	rules := make([]webrtc.ICEAddressRewriteRule, 0)
+	externalIPv4 := make([]string, 0)
+	externalIPv6 := make([]string, 0)
+
+	for _, mapping := range config.NAT1To1IPs {
+		externalIP, localIP, hasLocal := strings.Cut(mapping, "/")
+
+		if hasLocal {
+			rules = append(rules, webrtc.ICEAddressRewriteRule{
+				External:        []string{externalIP},
+				Local:           localIP,
+				AsCandidateType: candidateType,
+			})
+		} else if net.ParseIP(externalIP).To4() != nil {
+			externalIPv4 = append(externalIPv4, externalIP)
+		} else {
+			externalIPv6 = append(externalIPv6, externalIP)
+		}
+	}
+
+	// Limit the rules to the networks of the same family,
+	// so no candidates are generated for the other one
+
+	if len(externalIPv4) > 0 {
+		rules = append(rules, webrtc.ICEAddressRewriteRule{
+			External:        externalIPv4,
+			AsCandidateType: candidateType,
+			Networks:        []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeTCP4},
+		})
+	}
+
+	if len(externalIPv6) > 0 {
+		rules = append(rules, webrtc.ICEAddressRewriteRule{
+			External:        externalIPv6,
+			AsCandidateType: candidateType,
+			Networks:        []webrtc.NetworkType{webrtc.NetworkTypeUDP6, webrtc.NetworkTypeTCP6},
+		})
+	}
+
+	return rules
+}
@@ -3,38 +3,109 @@
 package main
 
 import (
-	"os"
+	"strings"
+	"time"
 
+	"github.com/pion/turn/v5"
 	"github.com/pion/webrtc/v4"
 )
 
-// This function loads WebRTC config from env variables
-func loadWebRTCConfig() webrtc.Configuration {
+// Default lifetime of the ephemeral TURN credentials (1 day)
+const TURN_DEFAULT_CREDENTIALS_TTL_SECONDS = 86400
+
+// User ID included in the ephemeral TURN credentials generated for the node peer connections
+const TURN_REST_NODE_USER = "webrtc-cdn"
+
+// This function loads the WebRTC config for the peer connections
+// If the embedded TURN server is enabled, it's included in the ICE servers
+func loadWebRTCConfig(config *Config) webrtc.Configuration {
+	return webrtc.Configuration{
+		ICEServers: loadICEServers(config, TURN_REST_NODE_USER, true),
+	}
+}
+
+// This function loads the WebRTC config for the peer connections between nodes
+// If the inter-node options are not enabled, it's the same config of the clients
+func loadInterNodeWebRTCConfig(config *Config) webrtc.Configuration {
+	if !config.InterNode.Enabled {
+		return loadWebRTCConfig(config)
+	}
+
 	peerConnectionConfig := webrtc.Configuration{
 		ICEServers: make([]webrtc.ICEServer, 0),
 	}
 
-	// STUN server
-	stunServer := os.Getenv("STUN_SERVER")
-	if stunServer != "" {
+	// STUN servers
+	if len(config.InterNode.STUNServers) > 0 {
 		peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, webrtc.ICEServer{
-			URLs: []string{stunServer},
-		})
-	} else {
-		peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, webrtc.ICEServer{
-			URLs: []string{"stun:stun.l.google.com:19302"},
+			URLs: config.InterNode.STUNServers,
 		})
 	}
 
-	// TURN server
-	turnServer := os.Getenv("TURN_SERVER")
-	if turnServer != "" {
+	// TURN servers
+	if len(config.InterNode.TURNServers) > 0 {
 		peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, webrtc.ICEServer{
-			URLs:       []string{turnServer},
-			Username:   os.Getenv("TURN_USERNAME"),
-			Credential: os.Getenv("TURN_PASSWORD"),
+			URLs:       config.InterNode.TURNServers,
+			Username:   config.InterNode.TURNUsername,
+			Credential: config.InterNode.TURNPassword,
 		})
 	}
 
+	// Candidate policy
+	if strings.ToLower(config.InterNode.CandidatePolicy) == "relay" {
+		peerConnectionConfig.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
 	return peerConnectionConfig
 }
+
+// Loads the list of ICE servers
+// If a TURN secret is set, ephemeral credentials are generated for the user
+// TURN servers with static credentials are only included if staticCredentials is true,
+// so they are not sent to the clients
+func loadICEServers(config *Config, user string, staticCredentials bool) []webrtc.ICEServer {
+	iceServers := make([]webrtc.ICEServer, 0)
+
+	// STUN servers
+	if len(config.WebRTC.STUNServers) > 0 {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs: config.WebRTC.STUNServers,
+		})
+	}
+
+	// TURN servers
+	if len(config.WebRTC.TURNServers) > 0 && (staticCredentials || config.WebRTC.TURNSecret != "") {
+		username := config.WebRTC.TURNUsername
+		password := config.WebRTC.TURNPassword
+
+		if config.WebRTC.TURNSecret != "" {
+			u, p, err := generateTURNCredentials(config.WebRTC.TURNSecret, user, config.WebRTC.TURNCredentialsTTLSeconds)
+
+			if err != nil {
+				LogError(err)
+			} else {
+				username = u
+				password = p
+			}
+		}
+
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       config.WebRTC.TURNServers,
+			Username:   username,
+			Credential: password,
+		})
+	}
+
+	// Embedded TURN server
+	if config.EmbeddedTURN.Enabled && (staticCredentials || config.EmbeddedTURN.Secret != "") {
+		iceServers = append(iceServers, config.EmbeddedTURN.getICEServers(user)...)
+	}
+
+	return iceServers
+}
+
+// Generates ephemeral TURN credentials (TURN REST API)
+// The username includes the expiration timestamp, and the password is a HMAC of the username
+func generateTURNCredentials(secret string, user string, ttlSeconds int) (string, string, error) {
+	return turn.GenerateLongTermTURNRESTCredentials(secret, user, time.Duration(ttlSeconds)*time.Second)
+}
@@ -4,11 +4,18 @@ package main
 
 import (
 	"encoding/json"
+	"io"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
+// Max time to wait for the tracks of the remote node
+// If the relay is not ready in time, it's closed and the stream is resolved again
+const RELAY_CONNECT_TIMEOUT = 15 * time.Second
+
 // WRTC_Relay - This data structure contains the status data
 // of an inter-node INPUT connection
 // Receives the tracks of a remote WRTC_Source
@@ -28,21 +35,38 @@ type WRTC_Relay struct {
 
 	localTrackVideo *webrtc.TrackLocalStaticRTP
 	localTrackAudio *webrtc.TrackLocalStaticRTP
+
+	keyframeRequester *KeyframeRequester // Sends keyframe requests to the remote node (nil for simulcast)
+	gopCache          *GOPCache          // Cache of the video track (nil if disabled or simulcast)
+
+	simulcast       *SimulcastTrack // Simulcast video layers (nil if the source is not simulcast)
+	simulcastLayers []string        // Layer IDs sent by the remote node
+	requestedLayers []string        // Layer IDs requested to the remote node (empty for all)
+
+	startTime    time.Time   // Time the relay was created
+	connectTimer *time.Timer // Fails the relay if it's not ready in time
+
+	registryEntry *StreamRegistryEntry // Registry entry the relay was created from (nil if found with RESOLVE)
+
+	logger *Logger // Logger including the relay fields
 }
 
 // Initialize
 func (relay *WRTC_Relay) init() {
 	relay.ready = false
 	relay.statusMutex = &sync.Mutex{}
+	relay.startTime = time.Now()
+	relay.logger = getRootLogger().With("stream_id", relay.sid, "remote_node", relay.remoteId)
 }
 
 // Called when an offer SDP message is received
-func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool) {
+func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool, layers []string) {
 	relay.statusMutex.Lock()
 	defer relay.statusMutex.Unlock()
 
 	relay.hasVideo = hasVideo
 	relay.hasAudio = hasAudio
+	relay.simulcastLayers = layers
 
 	// Clear old peer connection
 	if relay.peerConnection != nil {
@@ -52,12 +76,12 @@ func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool)
 		relay.peerConnection.Close()
 	}
 
-	peerConnectionConfig := loadWebRTCConfig() // Load WebRTC configuration
+	peerConnectionConfig := loadInterNodeWebRTCConfig(relay.node.getConfig()) // Load WebRTC configuration
 
 	// Create a new PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfig)
+	peerConnection, err := relay.node.nodeAPI.NewPeerConnection(peerConnectionConfig)
 	if err != nil {
-		LogError(err)
+		relay.logger.Error(err)
 		go relay.onClose()
 		return
 	}
@@ -68,19 +92,49 @@ func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool)
 		relay.statusMutex.Lock()
 		defer relay.statusMutex.Unlock()
 
-		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo && len(relay.simulcastLayers) > 0 {
+			// Simulcast layer, identified by the track ID
+			rid := strings.TrimPrefix(remoteTrack.ID(), SIMULCAST_LAYER_TRACK_PREFIX)
+
+			if relay.simulcast == nil {
+				relay.simulcast = newSimulcastTrack()
+			}
+
+			if relay.simulcast.getLayer(rid) != nil {
+				return
+			}
+
+			layer, err := relay.simulcast.addLayer(rid, remoteTrack.Codec().RTPCodecCapability, makePLISender(peerConnection, remoteTrack))
+			if err != nil {
+				relay.logger.Error(err)
+				return
+			}
+
+			if relay.localTrackVideo == nil {
+				relay.localTrackVideo = layer.track
+			}
+
+			go pipeTrack(remoteTrack, layer, relay.sid, nil)
+		} else if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
 			if relay.localTrackVideo != nil {
 				return
 			}
 
 			localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, "video", "pion")
 			if newTrackErr != nil {
-				LogError(newTrackErr)
+				relay.logger.Error(newTrackErr)
 			}
 
 			relay.localTrackVideo = localTrack
+			relay.keyframeRequester = newKeyframeRequester(makePLISender(peerConnection, remoteTrack))
+			relay.gopCache = newGOPCache(&relay.node.getConfig().GOPCache, localTrack, remoteTrack.Codec().RTPCodecCapability)
 
-			go pipeTrack(remoteTrack, localTrack)
+			var writer io.Writer = localTrack
+			if relay.gopCache != nil {
+				writer = relay.gopCache
+			}
+
+			go pipeTrack(remoteTrack, writer, relay.sid, nil)
 		} else if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
 			if relay.localTrackAudio != nil {
 				return
@@ -88,16 +142,20 @@ func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool)
 
 			localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, "audio", "pion")
 			if newTrackErr != nil {
-				LogError(newTrackErr)
+				relay.logger.Error(newTrackErr)
 			}
 
 			relay.localTrackAudio = localTrack
 
-			go pipeTrack(remoteTrack, localTrack)
+			go pipeTrack(remoteTrack, localTrack, relay.sid, nil)
 		} else {
 			return
 		}
 
+		if relay.simulcast != nil && relay.simulcast.countLayers() < len(relay.simulcastLayers) {
+			return // Waiting for more layers
+		}
+
 		if (!relay.hasAudio || relay.localTrackAudio != nil) && (!relay.hasVideo || relay.localTrackVideo != nil) {
 			// Received all the tracks, the relay is now ready
 			relay.node.onRelayReady(relay)
@@ -111,7 +169,7 @@ func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool)
 		if i != nil {
 			b, e := json.Marshal(i.ToJSON())
 			if e != nil {
-				LogError(e)
+				relay.logger.Error(e)
 			} else {
 				relay.sendICECandidate(string(b))
 			}
@@ -122,10 +180,10 @@ func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool)
 
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
-			LogDebug("Source relay Disconnected | RemoteNode: " + relay.remoteId + " | SreamID: " + relay.sid)
+			relay.logger.Debug("Relay disconnected")
 			relay.onClose()
 		} else if state == webrtc.PeerConnectionStateConnected {
-			LogDebug("Source relay Connected | RemoteNode: " + relay.remoteId + " | SreamID: " + relay.sid)
+			relay.logger.Debug("Relay connected")
 		}
 	})
 
@@ -133,26 +191,26 @@ func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool)
 	sd := webrtc.SessionDescription{}
 	err = json.Unmarshal([]byte(offerJSON), &sd)
 	if err != nil {
-		LogError(err)
+		relay.logger.Error(err)
 		return
 	}
 	err = relay.peerConnection.SetRemoteDescription(sd)
 	if err != nil {
-		LogError(err)
+		relay.logger.Error(err)
 		return
 	}
 
 	// Create SDP answer
 	answer, err := relay.peerConnection.CreateAnswer(nil)
 	if err != nil {
-		LogError(err)
+		relay.logger.Error(err)
 		return
 	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	err = relay.peerConnection.SetLocalDescription(answer)
 	if err != nil {
-		LogError(err)
+		relay.logger.Error(err)
 		return
 	}
 
@@ -160,7 +218,7 @@ func (relay *WRTC_Relay) onOffer(offerJSON string, hasVideo bool, hasAudio bool)
 	answerJSON, e := json.Marshal(answer)
 
 	if e != nil {
-		LogError(e)
+		relay.logger.Error(e)
 		return
 	}
 	relay.sendAnswer(string(answerJSON))
@@ -184,13 +242,54 @@ func (relay *WRTC_Relay) onICECandidate(candidateJSON string) {
 	err := json.Unmarshal([]byte(candidateJSON), &candidate)
 
 	if err != nil {
-		LogError(err)
+		relay.logger.Error(err)
 	}
 
 	err = relay.peerConnection.AddICECandidate(candidate)
 
 	if err != nil {
-		LogError(err)
+		relay.logger.Error(err)
+	}
+}
+
+// Requests a keyframe to the remote node, that forwards it to the publisher
+// rid is the simulcast layer ID. If empty, a keyframe is requested for every layer
+func (relay *WRTC_Relay) requestKeyframe(rid string) {
+	relay.statusMutex.Lock()
+
+	keyframeRequester := relay.keyframeRequester
+	simulcast := relay.simulcast
+
+	relay.statusMutex.Unlock()
+
+	if simulcast != nil {
+		if rid == "" {
+			simulcast.requestKeyframes()
+		} else if layer := simulcast.getLayer(rid); layer != nil {
+			layer.sendKeyframeRequest()
+		}
+	} else if keyframeRequester != nil {
+		keyframeRequester.request()
+	}
+}
+
+// Stops sending keyframe requests to the remote node
+// Must be called with the status mutex locked
+func (relay *WRTC_Relay) closeKeyframeRequesters() {
+	if relay.keyframeRequester != nil {
+		relay.keyframeRequester.close()
+	}
+
+	if relay.simulcast != nil {
+		relay.simulcast.close()
+	}
+}
+
+// Stops the connect timer
+// The timer is set when the relay is created, so it does not require the status mutex
+func (relay *WRTC_Relay) stopConnectTimer() {
+	if relay.connectTimer != nil {
+		relay.connectTimer.Stop()
 	}
 }
 
@@ -206,7 +305,7 @@ func (relay *WRTC_Relay) sendICECandidate(candidateJSON string) {
 	mp["sid"] = relay.sid
 	mp["data"] = candidateJSON
 
-	relay.node.sendRedisMessage(relay.remoteId, &mp)
+	relay.node.sendBusMessage(relay.remoteId, &mp)
 }
 
 // Send answer SDP message to the remote node
@@ -219,7 +318,7 @@ func (relay *WRTC_Relay) sendAnswer(answerJSON string) {
 	mp["sid"] = relay.sid
 	mp["data"] = answerJSON
 
-	relay.node.sendRedisMessage(relay.remoteId, &mp)
+	relay.node.sendBusMessage(relay.remoteId, &mp)
 }
 
 // Called if the peer connection is closed
@@ -236,6 +335,9 @@ func (relay *WRTC_Relay) onClose() {
 
 	relay.peerConnection = nil
 
+	relay.stopConnectTimer()
+	relay.closeKeyframeRequesters()
+
 	relay.node.onRelayClosed(relay)
 }
 
@@ -252,4 +354,7 @@ func (relay *WRTC_Relay) close() {
 	}
 
 	relay.peerConnection = nil
+
+	relay.stopConnectTimer()
+	relay.closeKeyframeRequesters()
 }
@@ -5,8 +5,8 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -23,7 +23,14 @@ type WRTC_Sink struct {
 	sid       string // Requested stream ID to pull
 
 	node       *WebRTC_CDN_Node    // Reference to the node
-	connection *Connection_Handler // Reference to the websocket connection
+	connection *Connection_Handler // Reference to the websocket connection (nil for WHEP, HLS and RTP sinks)
+
+	whep          bool          // True if the sink is a WHEP resource
+	whepReadyChan chan struct{} // Closed when the tracks are available for the WHEP sink
+	whepReady     bool          // True if the WHEP ready channel was closed
+
+	hls       *HLSPackager  // HLS packager receiving the tracks (nil if the sink is not HLS)
+	forwarder *RTPForwarder // RTP forwarder receiving the tracks (nil if the sink is not RTP)
 
 	closed bool // True when the sink is no longer active, prevent reconnection
 
@@ -36,20 +43,78 @@ type WRTC_Sink struct {
 
 	hasVideo        bool
 	localTrackVideo *webrtc.TrackLocalStaticRTP // Video track
+
+	simulcast     *SimulcastTrack // Simulcast video layers (nil if the stream is not simulcast)
+	layerSwitcher *LayerSwitcher  // Switcher to send the selected layer (simulcast only)
+	layer         string          // Layer preference (layer ID or AUTO)
+
+	gopSubscriber *GOPSubscriber // Receiver of the cached video track (nil if the track is not cached)
+
+	rtpSenderAudio *webrtc.RTPSender // Audio sender (WHEP only)
+	rtpSenderVideo *webrtc.RTPSender // Video sender (WHEP only)
+
+	ip        string    // IP address of the client
+	ipLimited bool      // If true, the WHEP resource counts for the IP limit
+	startTime time.Time // Time the sink was created
+
+	logger *Logger // Logger including the sink fields
 }
 
 // Initialize
 func (sink *WRTC_Sink) init() {
 	sink.statusMutex = &sync.Mutex{}
 	sink.closed = false
+	sink.startTime = time.Now()
+
+	if sink.whep {
+		sink.whepReadyChan = make(chan struct{})
+		sink.whepReady = false
+	}
+
+	if sink.connection != nil {
+		sink.logger = sink.connection.logger.With("protocol", "websocket")
+	} else if sink.hls != nil {
+		sink.logger = getRootLogger().With("protocol", "hls", "ip", sink.ip)
+	} else if sink.forwarder != nil {
+		sink.logger = getRootLogger().With("protocol", "rtp", "ip", sink.ip)
+	} else {
+		sink.logger = getRootLogger().With("protocol", "whep", "ip", sink.ip)
+	}
+
+	sink.logger = sink.logger.With("sink_id", sink.sinkId, "request_id", sink.requestId, "stream_id", sink.sid)
 }
 
 // Receive the tracks from local source or relay
-func (sink *WRTC_Sink) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP) {
+func (sink *WRTC_Sink) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP, simulcast *SimulcastTrack, gopCache *GOPCache) {
 	sink.statusMutex.Lock()
 	defer sink.statusMutex.Unlock()
 
+	// Stop sending the previous video
+	sink.releaseLayerSwitcher()
+	sink.releaseGOPSubscriber()
+
 	// Set video track
+	sink.simulcast = simulcast
+	if simulcast != nil && sink.hls == nil && sink.forwarder == nil {
+		// Each sink sends its own layer
+		switcher, err := newLayerSwitcher(simulcast, sink.layer)
+		if err != nil {
+			sink.logger.Error(err)
+			localTrackVideo = nil
+		} else {
+			sink.layerSwitcher = switcher
+			localTrackVideo = switcher.track
+		}
+	} else if gopCache != nil {
+		// Each sink sends its own track, starting with the cached packets
+		subscriber, err := gopCache.subscribe()
+		if err != nil {
+			sink.logger.Error(err)
+		} else {
+			sink.gopSubscriber = subscriber
+			localTrackVideo = subscriber.track
+		}
+	}
 	sink.localTrackVideo = localTrackVideo
 	sink.hasVideo = localTrackVideo != nil
 
@@ -57,6 +122,26 @@ func (sink *WRTC_Sink) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP
 	sink.localTrackAudio = localTrackAudio
 	sink.hasAudio = localTrackAudio != nil
 
+	if sink.whep {
+		// WHEP sinks cannot renegotiate, so they keep the connection
+		sink.onTracksReadyWHEP()
+		return
+	}
+
+	if sink.hls != nil {
+		// The packager receives the tracks directly
+		sink.hls.onTracksReady(sink.localTrackVideo, sink.localTrackAudio)
+		go sink.startVideo()
+		return
+	}
+
+	if sink.forwarder != nil {
+		// The forwarder receives the tracks directly
+		sink.forwarder.onTracksReady(sink.localTrackVideo, sink.localTrackAudio)
+		go sink.startVideo()
+		return
+	}
+
 	// If there is an existing connection, close it
 	if sink.peerConnection != nil {
 		sink.peerConnection.OnICECandidate(nil)
@@ -70,16 +155,43 @@ func (sink *WRTC_Sink) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP
 	go sink.runAfterTracksReady()
 }
 
-func (sink *WRTC_Sink) onTracksClosed(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP) {
+// Called when the tracks are no longer available
+func (sink *WRTC_Sink) onTracksClosed(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP, simulcast *SimulcastTrack, gopCache *GOPCache) {
 	sink.statusMutex.Lock()
 	defer sink.statusMutex.Unlock()
 
-	if sink.localTrackAudio == localTrackAudio && sink.localTrackVideo == localTrackVideo {
+	sameVideo := sink.localTrackVideo == localTrackVideo
+	if simulcast != nil || sink.simulcast != nil {
+		sameVideo = sink.simulcast == simulcast
+	} else if sink.gopSubscriber != nil {
+		sameVideo = sink.gopSubscriber.cache == gopCache
+	}
+
+	if sink.localTrackAudio == localTrackAudio && sameVideo {
+		sink.releaseLayerSwitcher()
+		sink.releaseGOPSubscriber()
+		sink.simulcast = nil
 		sink.localTrackAudio = nil
 		sink.localTrackVideo = nil
 		sink.hasAudio = false
 		sink.hasVideo = false
 
+		if sink.whep {
+			// Stop sending until new tracks are available
+			sink.replaceTracksWHEP()
+			return
+		}
+
+		if sink.hls != nil {
+			sink.hls.onTracksClosed()
+			return
+		}
+
+		if sink.forwarder != nil {
+			sink.forwarder.onTracksClosed()
+			return
+		}
+
 		if sink.peerConnection != nil {
 			sink.peerConnection.OnICECandidate(nil)
 			sink.peerConnection.OnConnectionStateChange(nil)
@@ -101,12 +213,12 @@ func (sink *WRTC_Sink) runAfterTracksReady() {
 		return // Nothing to do
 	}
 
-	peerConnectionConfig := loadWebRTCConfig() // Load config
+	peerConnectionConfig := loadWebRTCConfig(sink.node.getConfig()) // Load config
 
 	// Create a new PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfig)
+	peerConnection, err := sink.node.webrtcAPI.NewPeerConnection(peerConnectionConfig)
 	if err != nil {
-		LogError(err)
+		sink.logger.Error(err)
 		return
 	}
 
@@ -120,7 +232,7 @@ func (sink *WRTC_Sink) runAfterTracksReady() {
 		if i != nil {
 			b, e := json.Marshal(i.ToJSON())
 			if e != nil {
-				LogError(e)
+				sink.logger.Error(e)
 			} else {
 				sink.connection.sendICECandidate(sink.requestId, sink.sid, string(b))
 			}
@@ -132,10 +244,11 @@ func (sink *WRTC_Sink) runAfterTracksReady() {
 	// Connection status handler
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
-			sink.connection.logDebug("Sink Disconnected | sinkId: " + fmt.Sprint(sink.sinkId) + " | SreamID: " + sink.sid + " | RequestID: " + sink.requestId)
+			sink.logger.Debug("Sink disconnected")
 			sink.reconnect() // If the connection fails, retry it
 		} else if state == webrtc.PeerConnectionStateConnected {
-			sink.connection.logDebug("Sink Connected | sinkId: " + fmt.Sprint(sink.sinkId) + " | SreamID: " + sink.sid + " | RequestID: " + sink.requestId)
+			sink.logger.Debug("Sink connected")
+			sink.startVideo()
 		}
 	})
 
@@ -143,7 +256,7 @@ func (sink *WRTC_Sink) runAfterTracksReady() {
 	if sink.hasAudio {
 		audioSender, err := peerConnection.AddTrack(sink.localTrackAudio)
 		if err != nil {
-			LogError(err)
+			sink.logger.Error(err)
 			return
 		}
 
@@ -154,24 +267,24 @@ func (sink *WRTC_Sink) runAfterTracksReady() {
 	if sink.hasVideo {
 		videoSender, err := peerConnection.AddTrack(sink.localTrackVideo)
 		if err != nil {
-			LogError(err)
+			sink.logger.Error(err)
 			return
 		}
 
-		go readPacketsFromRTPSender(videoSender)
+		go sink.readVideoFeedback(videoSender)
 	}
 
 	// Generate offer
 	offer, err := peerConnection.CreateOffer(nil)
 	if err != nil {
-		LogError(err)
+		sink.logger.Error(err)
 		return
 	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	err = peerConnection.SetLocalDescription(offer)
 	if err != nil {
-		LogError(err)
+		sink.logger.Error(err)
 		return
 	}
 
@@ -180,7 +293,7 @@ func (sink *WRTC_Sink) runAfterTracksReady() {
 	offerJSON, e := json.Marshal(offer)
 
 	if e != nil {
-		LogError(e)
+		sink.logger.Error(e)
 		return
 	}
 
@@ -205,13 +318,13 @@ func (sink *WRTC_Sink) onICECandidate(candidateJSON string) {
 	err := json.Unmarshal([]byte(candidateJSON), &candidate)
 
 	if err != nil {
-		LogError(err)
+		sink.logger.Error(err)
 	}
 
 	err = sink.peerConnection.AddICECandidate(candidate)
 
 	if err != nil {
-		LogError(err)
+		sink.logger.Error(err)
 	}
 }
 
@@ -229,19 +342,26 @@ func (sink *WRTC_Sink) onAnswer(answerJSON string) {
 	err := json.Unmarshal([]byte(answerJSON), &sd)
 
 	if err != nil {
-		LogError(err)
+		sink.logger.Error(err)
 	}
 
 	// Set the remote SessionDescription
 	err = sink.peerConnection.SetRemoteDescription(sd)
 
 	if err != nil {
-		LogError(err)
+		sink.logger.Error(err)
 	}
 }
 
 // Reconnect if the peer connection is closed, but the sink is still active
 func (sink *WRTC_Sink) reconnect() {
+	if sink.whep {
+		// WHEP clients must request a new resource
+		sink.node.removeWHEPSink(sink.requestId)
+		sink.close()
+		return
+	}
+
 	sink.statusMutex.Lock()
 	defer sink.statusMutex.Unlock()
 
@@ -265,10 +385,131 @@ func (sink *WRTC_Sink) close() {
 		sink.peerConnection.Close()
 	}
 
+	if sink.hls != nil {
+		sink.hls.unbindTracks()
+	}
+
+	if sink.forwarder != nil {
+		sink.forwarder.unbindTracks()
+	}
+
+	sink.releaseLayerSwitcher()
+	sink.releaseGOPSubscriber()
+	sink.simulcast = nil
 	sink.peerConnection = nil
+	sink.rtpSenderAudio = nil
+	sink.rtpSenderVideo = nil
 	sink.hasAudio = false
 	sink.hasVideo = false
 	sink.localTrackAudio = nil
 	sink.localTrackVideo = nil
 	sink.node.removeSink(sink)
 }
+
+// Stops the layer switcher, if any
+// Must be called with the status mutex locked
+func (sink *WRTC_Sink) releaseLayerSwitcher() {
+	if sink.layerSwitcher != nil {
+		sink.layerSwitcher.close()
+	}
+
+	sink.layerSwitcher = nil
+}
+
+// Stops receiving the cached video track, if any
+// Must be called with the status mutex locked
+func (sink *WRTC_Sink) releaseGOPSubscriber() {
+	if sink.gopSubscriber != nil {
+		sink.gopSubscriber.close()
+	}
+
+	sink.gopSubscriber = nil
+}
+
+// Gets the layer switcher (nil if the stream is not simulcast)
+func (sink *WRTC_Sink) getLayerSwitcher() *LayerSwitcher {
+	sink.statusMutex.Lock()
+	defer sink.statusMutex.Unlock()
+
+	return sink.layerSwitcher
+}
+
+// Sets the layer preference (layer ID or AUTO)
+func (sink *WRTC_Sink) setLayer(layer string) {
+	sink.statusMutex.Lock()
+	defer sink.statusMutex.Unlock()
+
+	sink.layer = layer
+
+	if sink.layerSwitcher != nil {
+		sink.layerSwitcher.setPreference(layer)
+	}
+}
+
+// Reads the RTCP packets for the video track
+// The feedback is used by the layer switcher, for simulcast streams
+// Keyframe requests are forwarded to the publisher
+func (sink *WRTC_Sink) readVideoFeedback(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		switcher := sink.getLayerSwitcher()
+
+		if switcher != nil {
+			switcher.onRTCPPackets(packets)
+		} else if hasKeyframeRequest(packets) {
+			sink.node.requestKeyframe(sink.sid, "")
+		}
+	}
+}
+
+// Starts sending the video to a connected viewer
+// The cached packets are sent if available. If not, a keyframe is requested,
+// since the viewer needs one to start decoding.
+func (sink *WRTC_Sink) startVideo() {
+	sink.statusMutex.Lock()
+	subscriber := sink.gopSubscriber
+	sink.statusMutex.Unlock()
+
+	if subscriber != nil && subscriber.start() {
+		return
+	}
+
+	sink.requestKeyframe()
+}
+
+// Requests a keyframe of the video track received by the sink
+func (sink *WRTC_Sink) requestKeyframe() {
+	sink.statusMutex.Lock()
+	hasVideo := sink.hasVideo
+	switcher := sink.layerSwitcher
+	sink.statusMutex.Unlock()
+
+	if !hasVideo {
+		return
+	}
+
+	if switcher != nil {
+		switcher.onKeyframeRequest()
+	} else {
+		sink.node.requestKeyframe(sink.sid, "")
+	}
+}
+
+// Closes the sink and notifies the client
+func (sink *WRTC_Sink) kick() {
+	sink.close()
+
+	if sink.connection != nil {
+		sink.connection.sendSinkClose(sink.requestId, sink.sid)
+	} else if sink.hls != nil {
+		sink.hls.close()
+	} else if sink.forwarder != nil {
+		sink.forwarder.close()
+	} else {
+		sink.node.removeWHEPSink(sink.requestId)
+	}
+}
@@ -6,17 +6,13 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"io"
 	"sync"
 	"time"
 
-	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 )
 
-const rtcpPLIInterval = time.Second * 2
-
 // WRTC_Source -This data structure contains the status data
 // of a source connection (Client -> Node)
 // The source registers itself into the node, and the node pipes
@@ -26,9 +22,11 @@ type WRTC_Source struct {
 	sid       string // Stream ID being pushed
 
 	node       *WebRTC_CDN_Node    // Node reference
-	connection *Connection_Handler // Websocket connection reference
+	connection *Connection_Handler // Websocket connection reference (nil for WHIP and RTMP sources)
+	rtmp       *RTMPSession        // RTMP session (nil if the source is not RTMP)
 
-	ready bool // If true, tracks are available
+	ready         bool // If true, tracks are available
+	notifiedReady bool // If true, the node was notified the tracks are available
 
 	closed bool // If true, source is no longer active
 
@@ -40,8 +38,25 @@ type WRTC_Source struct {
 	localTrackAudio *webrtc.TrackLocalStaticRTP // Audio track
 
 	hasVideo        bool
-	localTrackVideo *webrtc.TrackLocalStaticRTP // Video track
+	localTrackVideo *webrtc.TrackLocalStaticRTP // Video track (first layer for simulcast sources)
+
+	keyframeRequester *KeyframeRequester // Sends keyframe requests to the publisher (nil for simulcast sources)
+	gopCache          *GOPCache          // Cache of the video track (nil if disabled or simulcast)
+
+	simulcast       *SimulcastTrack // Simulcast video layers (nil if the source is not simulcast)
+	simulcastLayers []string        // Layer IDs announced by the publisher
+	clientOffer     bool            // If true, the client sends the offer (required for simulcast)
 
+	exclusive bool // If true, other publishers of the stream are rejected
+	takeover  bool // If true, the source replaces any existing source of the stream
+
+	record      bool      // If true, the tracks are recorded
+	recordingId string    // Unique ID for the names of the recording files
+	ip          string    // IP address of the client
+	ipLimited   bool      // If true, the WHIP resource counts for the IP limit
+	startTime   time.Time // Time the source was created
+
+	logger *Logger // Logger including the source fields
 }
 
 // Initialize
@@ -49,20 +64,42 @@ func (source *WRTC_Source) init() {
 	source.closed = false
 	source.ready = false
 	source.statusMutex = &sync.Mutex{}
+	source.startTime = time.Now()
+
+	if source.record {
+		// Never fails (crypto/rand), and the recording files are created exclusively anyway
+		source.recordingId, _ = makeId(8)
+	}
+
+	if source.connection != nil {
+		source.logger = source.connection.logger.With("protocol", "websocket")
+	} else if source.rtmp != nil {
+		source.logger = source.rtmp.logger
+	} else {
+		source.logger = getRootLogger().With("protocol", "whip", "ip", source.ip)
+	}
+
+	source.logger = source.logger.With("request_id", source.requestId, "stream_id", source.sid)
 }
 
-// Creates the connection and generates the offer
-func (source *WRTC_Source) run() {
-	source.statusMutex.Lock()
-	defer source.statusMutex.Unlock()
+// Creates a recorder for a track, if recording is enabled
+func (source *WRTC_Source) createRecorder(remoteTrack *webrtc.TrackRemote) *TrackRecorder {
+	if !source.record {
+		return nil
+	}
 
-	peerConnectionConfig := loadWebRTCConfig() // Load config
+	return createTrackRecorder(&source.node.getConfig().Recording, source.sid, source.startTime, source.recordingId, remoteTrack.Codec())
+}
+
+// Creates the peer connection and sets up the event handlers
+// Must be called with the status mutex locked
+func (source *WRTC_Source) createPeerConnection() (*webrtc.PeerConnection, error) {
+	peerConnectionConfig := loadWebRTCConfig(source.node.getConfig()) // Load config
 
 	// Create a new PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfig)
+	peerConnection, err := source.node.webrtcAPI.NewPeerConnection(peerConnectionConfig)
 	if err != nil {
-		LogError(err)
-		return
+		return nil, err
 	}
 
 	source.peerConnection = peerConnection
@@ -72,7 +109,12 @@ func (source *WRTC_Source) run() {
 		source.statusMutex.Lock()
 		defer source.statusMutex.Unlock()
 
-		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo && remoteTrack.RID() != "" {
+			// Received simulcast layer
+			if !source.addSimulcastLayer(peerConnection, remoteTrack) {
+				return
+			}
+		} else if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
 			// Received video track
 			if source.localTrackVideo != nil {
 				return
@@ -80,26 +122,20 @@ func (source *WRTC_Source) run() {
 
 			localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, "video", "pion")
 			if newTrackErr != nil {
-				LogError(newTrackErr)
+				source.logger.Error(newTrackErr)
 				return
 			}
 
 			source.localTrackVideo = localTrack
+			source.keyframeRequester = newKeyframeRequester(makePLISender(peerConnection, remoteTrack))
+			source.gopCache = newGOPCache(&source.node.getConfig().GOPCache, localTrack, remoteTrack.Codec().RTPCodecCapability)
 
-			go pipeTrack(remoteTrack, localTrack)
-
-			// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-			// This can be less wasteful by processing incoming RTCP events, then we would emit a NACK/PLI when a viewer requests it
-			go func() {
-				ticker := time.NewTicker(rtcpPLIInterval)
-				for range ticker.C {
-					if rtcpSendErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpSendErr != nil {
-						if errors.Is(rtcpSendErr, io.ErrClosedPipe) {
-							return
-						}
-					}
-				}
-			}()
+			var writer io.Writer = localTrack
+			if source.gopCache != nil {
+				writer = source.gopCache
+			}
+
+			go pipeTrack(remoteTrack, writer, source.sid, source.createRecorder(remoteTrack))
 		} else if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
 			// Received audio track
 			if source.localTrackAudio != nil {
@@ -108,22 +144,18 @@ func (source *WRTC_Source) run() {
 
 			localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, "audio", "pion")
 			if newTrackErr != nil {
-				LogError(newTrackErr)
+				source.logger.Error(newTrackErr)
 				return
 			}
 
 			source.localTrackAudio = localTrack
 
-			go pipeTrack(remoteTrack, localTrack)
+			go pipeTrack(remoteTrack, localTrack, source.sid, source.createRecorder(remoteTrack))
 		} else {
 			return
 		}
 
-		if (!source.hasAudio || source.localTrackAudio != nil) && (!source.hasVideo || source.localTrackVideo != nil) {
-			// Received all the tracks
-			source.connection.logDebug("Source Ready | SreamID: " + source.sid + " | RequestID: " + source.requestId)
-			source.node.onSourceReady(source)
-		}
+		source.checkReady(false)
 	})
 
 	// ICE Candidate handler
@@ -131,10 +163,14 @@ func (source *WRTC_Source) run() {
 		source.statusMutex.Lock()
 		defer source.statusMutex.Unlock()
 
+		if source.connection == nil {
+			return // WHIP sources do not use trickle ICE
+		}
+
 		if i != nil {
 			b, e := json.Marshal(i.ToJSON())
 			if e != nil {
-				LogError(e)
+				source.logger.Error(e)
 			} else {
 				source.connection.sendICECandidate(source.requestId, source.sid, string(b))
 			}
@@ -146,19 +182,198 @@ func (source *WRTC_Source) run() {
 	// Connection status handler
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
-			source.connection.logDebug("Source Disconnected | SreamID: " + source.sid + " | RequestID: " + source.requestId)
+			source.logger.Debug("Source disconnected")
 			source.onClose() // Disconnected
 		} else if state == webrtc.PeerConnectionStateConnected {
-			source.connection.logDebug("Source Connected | SreamID: " + source.sid + " | RequestID: " + source.requestId)
+			source.logger.Debug("Source connected")
 		}
 	})
 
+	return peerConnection, nil
+}
+
+// Adds a simulcast layer from a remote track
+// Returns false if the layer was already added
+// Must be called with the status mutex locked
+func (source *WRTC_Source) addSimulcastLayer(peerConnection *webrtc.PeerConnection, remoteTrack *webrtc.TrackRemote) bool {
+	if source.simulcast == nil {
+		source.simulcast = newSimulcastTrack()
+	}
+
+	if source.simulcast.getLayer(remoteTrack.RID()) != nil {
+		return false
+	}
+
+	layer, err := source.simulcast.addLayer(remoteTrack.RID(), remoteTrack.Codec().RTPCodecCapability, makePLISender(peerConnection, remoteTrack))
+	if err != nil {
+		source.logger.Error(err)
+		return false
+	}
+
+	var recorder *TrackRecorder
+
+	recordedLayer := source.getRecordedLayer()
+
+	if remoteTrack.RID() == recordedLayer || (recordedLayer == "" && source.localTrackVideo == nil) {
+		recorder = source.createRecorder(remoteTrack)
+	}
+
+	if source.localTrackVideo == nil {
+		source.localTrackVideo = layer.track
+
+		if len(source.simulcastLayers) > 1 {
+			// Do not wait forever for layers the publisher may not send
+			time.AfterFunc(SIMULCAST_LAYERS_WAIT_TIMEOUT, func() {
+				source.statusMutex.Lock()
+				defer source.statusMutex.Unlock()
+
+				source.checkReady(true)
+			})
+		}
+	}
+
+	go pipeTrack(remoteTrack, layer, source.sid, recorder)
+
+	return true
+}
+
+// Gets the ID of the simulcast layer to record (only one layer is recorded)
+// It's the layer set in the configuration if the publisher announced it,
+// or the first layer announced by the publisher otherwise
+// Empty if the layers were not announced (the first received layer is recorded)
+func (source *WRTC_Source) getRecordedLayer() string {
+	if len(source.simulcastLayers) == 0 {
+		return ""
+	}
+
+	configured := source.node.getConfig().Recording.SimulcastLayer
+
+	for _, rid := range source.simulcastLayers {
+		if rid == configured {
+			return rid
+		}
+	}
+
+	return source.simulcastLayers[0]
+}
+
+// Checks if all the tracks were received, notifying the node if so
+// If force is true, the source is ready even if some simulcast layers are missing
+// Must be called with the status mutex locked
+func (source *WRTC_Source) checkReady(force bool) {
+	if source.notifiedReady || source.closed {
+		return
+	}
+
+	if source.hasAudio && source.localTrackAudio == nil {
+		return
+	}
+
+	if source.hasVideo {
+		if source.localTrackVideo == nil {
+			return
+		}
+
+		if !force && source.simulcast != nil && source.simulcast.countLayers() < len(source.simulcastLayers) {
+			return // Waiting for more layers
+		}
+	}
+
+	// Received all the tracks
+	source.notifiedReady = true
+	source.logger.Debug("Source ready")
+	source.node.onSourceReady(source)
+
+	if source.hasVideo {
+		fallbackInterval := time.Duration(source.node.getConfig().Keyframes.FallbackIntervalSeconds) * time.Second
+
+		if fallbackInterval > 0 {
+			go source.runKeyframeFallback(fallbackInterval)
+		}
+	}
+}
+
+// Requests a keyframe to the publisher
+// rid is the simulcast layer ID. If empty, a keyframe is requested for every layer
+func (source *WRTC_Source) requestKeyframe(rid string) {
+	source.statusMutex.Lock()
+
+	if source.closed {
+		source.statusMutex.Unlock()
+		return
+	}
+
+	keyframeRequester := source.keyframeRequester
+	simulcast := source.simulcast
+
+	source.statusMutex.Unlock()
+
+	if simulcast != nil {
+		if rid == "" {
+			simulcast.requestKeyframes()
+		} else if layer := simulcast.getLayer(rid); layer != nil {
+			layer.sendKeyframeRequest()
+		}
+	} else if keyframeRequester != nil {
+		keyframeRequester.request()
+	}
+}
+
+// Periodically requests keyframes while the stream is being consumed
+// Fallback for receivers that do not send keyframe requests
+func (source *WRTC_Source) runKeyframeFallback(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		source.statusMutex.Lock()
+		closed := source.closed
+		record := source.record
+		source.statusMutex.Unlock()
+
+		if closed {
+			return
+		}
+
+		if record || source.node.hasStreamConsumers(source.sid) {
+			source.requestKeyframe("")
+		}
+	}
+}
+
+// Stops sending keyframe requests to the publisher
+// Must be called with the status mutex locked
+func (source *WRTC_Source) closeKeyframeRequesters() {
+	if source.keyframeRequester != nil {
+		source.keyframeRequester.close()
+	}
+
+	if source.simulcast != nil {
+		source.simulcast.close()
+	}
+}
+
+// Creates the connection and generates the offer
+func (source *WRTC_Source) run() {
+	if source.clientOffer {
+		return // Waiting for the client offer
+	}
+
+	source.statusMutex.Lock()
+	defer source.statusMutex.Unlock()
+
+	peerConnection, err := source.createPeerConnection()
+	if err != nil {
+		source.logger.Error(err)
+		return
+	}
+
 	// Create transceivers
 
 	if source.hasVideo {
 		// Create transceiver to receive a VIDEO track
 		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
-			LogError(err)
+			source.logger.Error(err)
 			return
 		}
 	}
@@ -166,7 +381,7 @@ func (source *WRTC_Source) run() {
 	if source.hasAudio {
 		// Create transceiver to receive an AUDIO track
 		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
-			LogError(err)
+			source.logger.Error(err)
 			return
 		}
 	}
@@ -174,14 +389,14 @@ func (source *WRTC_Source) run() {
 	// Generate offer
 	offer, err := peerConnection.CreateOffer(nil)
 	if err != nil {
-		LogError(err)
+		source.logger.Error(err)
 		return
 	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	err = peerConnection.SetLocalDescription(offer)
 	if err != nil {
-		LogError(err)
+		source.logger.Error(err)
 		return
 	}
 
@@ -190,13 +405,117 @@ func (source *WRTC_Source) run() {
 	offerJSON, e := json.Marshal(offer)
 
 	if e != nil {
-		LogError(e)
+		source.logger.Error(e)
 		return
 	}
 
 	source.connection.sendOffer(source.requestId, source.sid, string(offerJSON))
 }
 
+// Creates the connection from an SDP offer sent by a WHIP client
+// Waits for the ICE gathering to complete and returns the SDP answer
+func (source *WRTC_Source) runWHIP(offerSDP string) (string, error) {
+	peerConnection, gatherComplete, err := source.startWHIP(offerSDP)
+	if err != nil {
+		return "", err
+	}
+
+	// WHIP clients expect all the candidates in the answer
+	// The status mutex must not be locked while waiting, since the ICE candidate handler uses it
+	<-gatherComplete
+
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// Creates the connection from an SDP offer sent by a WHIP client
+// Returns a channel that is closed when the ICE gathering is completed
+func (source *WRTC_Source) startWHIP(offerSDP string) (*webrtc.PeerConnection, <-chan struct{}, error) {
+	source.statusMutex.Lock()
+	defer source.statusMutex.Unlock()
+
+	answer, err := source.answerOffer(offerSDP)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(source.peerConnection)
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	err = source.peerConnection.SetLocalDescription(answer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return source.peerConnection, gatherComplete, nil
+}
+
+// Creates the connection from an SDP offer sent by the client
+// and generates the answer. The local description is not set.
+// Must be called with the status mutex locked
+func (source *WRTC_Source) answerOffer(offerSDP string) (webrtc.SessionDescription, error) {
+	peerConnection, err := source.createPeerConnection()
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	source.simulcastLayers = getSDPSimulcastLayers(offerSDP)
+
+	// Set the remote SessionDescription
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerSDP,
+	})
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	// Create SDP answer
+	return peerConnection.CreateAnswer(nil)
+}
+
+// OFFER message received from the client (client offer mode)
+func (source *WRTC_Source) onOffer(offerJSON string) {
+	source.statusMutex.Lock()
+	defer source.statusMutex.Unlock()
+
+	if !source.clientOffer || source.peerConnection != nil || source.closed {
+		return // Renegotiation is not supported
+	}
+
+	sd := webrtc.SessionDescription{}
+
+	err := json.Unmarshal([]byte(offerJSON), &sd)
+
+	if err != nil {
+		source.logger.Error(err)
+		return
+	}
+
+	answer, err := source.answerOffer(sd.SDP)
+	if err != nil {
+		source.logger.Error(err)
+		return
+	}
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	err = source.peerConnection.SetLocalDescription(answer)
+	if err != nil {
+		source.logger.Error(err)
+		return
+	}
+
+	// Send to the client
+
+	answerJSON, e := json.Marshal(answer)
+
+	if e != nil {
+		source.logger.Error(e)
+		return
+	}
+
+	source.connection.sendAnswer(source.requestId, source.sid, string(answerJSON))
+}
+
 // ICE Candidate message received from the client
 func (source *WRTC_Source) onICECandidate(candidateJSON string) {
 	source.statusMutex.Lock()
@@ -215,13 +534,13 @@ func (source *WRTC_Source) onICECandidate(candidateJSON string) {
 	err := json.Unmarshal([]byte(candidateJSON), &candidate)
 
 	if err != nil {
-		LogError(err)
+		source.logger.Error(err)
 	}
 
 	err = source.peerConnection.AddICECandidate(candidate)
 
 	if err != nil {
-		LogError(err)
+		source.logger.Error(err)
 	}
 }
 
@@ -239,14 +558,14 @@ func (source *WRTC_Source) onAnswer(answerJSON string) {
 	err := json.Unmarshal([]byte(answerJSON), &sd)
 
 	if err != nil {
-		LogError(err)
+		source.logger.Error(err)
 	}
 
 	// Set the remote SessionDescription
 	err = source.peerConnection.SetRemoteDescription(sd)
 
 	if err != nil {
-		LogError(err)
+		source.logger.Error(err)
 		return
 	}
 }
@@ -263,8 +582,10 @@ func (source *WRTC_Source) onClose() {
 	}
 	source.closed = true
 
+	source.closeKeyframeRequesters()
+
 	// Send close message to the connection
-	source.connection.sendSourceClose(source.requestId, source.sid)
+	source.notifyClose()
 
 	// Deregister source
 	source.node.onSourceClosed(source)
@@ -281,6 +602,8 @@ func (source *WRTC_Source) close(notifyConnection bool, deregister bool) {
 
 	source.closed = true
 
+	source.closeKeyframeRequesters()
+
 	if source.peerConnection != nil {
 		// Close the peer connection
 		source.peerConnection.OnConnectionStateChange(nil)
@@ -293,7 +616,7 @@ func (source *WRTC_Source) close(notifyConnection bool, deregister bool) {
 
 	// Send close message to the connection
 	if notifyConnection {
-		source.connection.sendSourceClose(source.requestId, source.sid)
+		source.notifyClose()
 	}
 
 	// Deregister source
@@ -301,3 +624,16 @@ func (source *WRTC_Source) close(notifyConnection bool, deregister bool) {
 		source.node.onSourceClosed(source)
 	}
 }
+
+// Notifies the client the source was closed
+// For WHIP sources, the resource is removed
+// For RTMP sources, the connection is closed
+func (source *WRTC_Source) notifyClose() {
+	if source.connection != nil {
+		source.connection.sendSourceClose(source.requestId, source.sid)
+	} else if source.rtmp != nil {
+		source.rtmp.close()
+	} else {
+		source.node.removeWHIPSource(source.requestId)
+	}
+}
@@ -5,7 +5,9 @@ package main
 
 import (
 	"encoding/json"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -30,20 +32,46 @@ type WRTC_Source_Sender struct {
 
 	hasVideo        bool
 	localTrackVideo *webrtc.TrackLocalStaticRTP // Video track
+
+	simulcast       *SimulcastTrack // Simulcast video layers (nil if the source is not simulcast)
+	requestedLayers []string        // Layers requested by the remote node (empty for all)
+	sentLayers      []string        // Layers being sent
+
+	gopSubscriber *GOPSubscriber // Receiver of the cached video track (nil if the track is not cached)
+
+	startTime time.Time // Time the sender was created
+
+	logger *Logger // Logger including the sender fields
 }
 
 // Initialize
 func (sender *WRTC_Source_Sender) init() {
 	sender.statusMutex = &sync.Mutex{}
 	sender.closed = false
+	sender.startTime = time.Now()
+	sender.logger = getRootLogger().With("stream_id", sender.sid, "remote_node", sender.remoteId)
 }
 
 // Receive the tracks from local source
-func (sender *WRTC_Source_Sender) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP) {
+func (sender *WRTC_Source_Sender) onTracksReady(localTrackVideo *webrtc.TrackLocalStaticRTP, localTrackAudio *webrtc.TrackLocalStaticRTP, simulcast *SimulcastTrack, gopCache *GOPCache) {
 	sender.statusMutex.Lock()
 	defer sender.statusMutex.Unlock()
 
 	// Set video track
+	sender.releaseGOPSubscriber()
+	sender.simulcast = simulcast
+
+	if simulcast == nil && gopCache != nil {
+		// The remote node receives its own track, starting with the cached packets
+		subscriber, err := gopCache.subscribe()
+		if err != nil {
+			sender.logger.Error(err)
+		} else {
+			sender.gopSubscriber = subscriber
+			localTrackVideo = subscriber.track
+		}
+	}
+
 	sender.localTrackVideo = localTrackVideo
 	sender.hasVideo = localTrackVideo != nil
 
@@ -73,12 +101,12 @@ func (sender *WRTC_Source_Sender) runAfterTracksReady() {
 		return // Nothing to do
 	}
 
-	peerConnectionConfig := loadWebRTCConfig() // Load config
+	peerConnectionConfig := loadInterNodeWebRTCConfig(sender.node.getConfig()) // Load config
 
 	// Create a new PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfig)
+	peerConnection, err := sender.node.nodeAPI.NewPeerConnection(peerConnectionConfig)
 	if err != nil {
-		LogError(err)
+		sender.logger.Error(err)
 		return
 	}
 
@@ -92,7 +120,7 @@ func (sender *WRTC_Source_Sender) runAfterTracksReady() {
 		if i != nil {
 			b, e := json.Marshal(i.ToJSON())
 			if e != nil {
-				LogError(e)
+				sender.logger.Error(e)
 			} else {
 				sender.sendICECandidate(string(b)) // Send candidate to the remote node
 			}
@@ -104,10 +132,11 @@ func (sender *WRTC_Source_Sender) runAfterTracksReady() {
 	// Connection status handler
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
-			LogDebug("Source Sender Disconnected | RemoteNode: " + sender.remoteId + " | SreamID: " + sender.sid)
+			sender.logger.Debug("Sender disconnected")
 			sender.onClose() // If the connection fails, close the sender
 		} else if state == webrtc.PeerConnectionStateConnected {
-			LogDebug("Source Sender Connected | RemoteNode: " + sender.remoteId + " | SreamID: " + sender.sid)
+			sender.logger.Debug("Sender connected")
+			sender.startVideo()
 		}
 	})
 
@@ -115,7 +144,7 @@ func (sender *WRTC_Source_Sender) runAfterTracksReady() {
 	if sender.hasAudio {
 		audioSender, err := peerConnection.AddTrack(sender.localTrackAudio)
 		if err != nil {
-			LogError(err)
+			sender.logger.Error(err)
 			return
 		}
 
@@ -123,27 +152,48 @@ func (sender *WRTC_Source_Sender) runAfterTracksReady() {
 	}
 
 	// Include the video track
-	if sender.hasVideo {
+	if sender.hasVideo && sender.simulcast != nil {
+		// Send a track for each requested layer
+		sender.sentLayers = make([]string, 0)
+
+		for _, layer := range sender.simulcast.getLayersForSending(sender.requestedLayers) {
+			videoSender, err := peerConnection.AddTrack(layer.track)
+			if err != nil {
+				sender.logger.Error(err)
+				return
+			}
+
+			sender.sentLayers = append(sender.sentLayers, layer.rid)
+
+			rid := layer.rid
+
+			go readKeyframeRequestsFromRTPSender(videoSender, func() {
+				sender.node.requestKeyframe(sender.sid, rid)
+			})
+		}
+	} else if sender.hasVideo {
 		videoSender, err := peerConnection.AddTrack(sender.localTrackVideo)
 		if err != nil {
-			LogError(err)
+			sender.logger.Error(err)
 			return
 		}
 
-		go readPacketsFromRTPSender(videoSender)
+		go readKeyframeRequestsFromRTPSender(videoSender, func() {
+			sender.node.requestKeyframe(sender.sid, "")
+		})
 	}
 
 	// Generate offer
 	offer, err := peerConnection.CreateOffer(nil)
 	if err != nil {
-		LogError(err)
+		sender.logger.Error(err)
 		return
 	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	err = peerConnection.SetLocalDescription(offer)
 	if err != nil {
-		LogError(err)
+		sender.logger.Error(err)
 		return
 	}
 
@@ -151,7 +201,7 @@ func (sender *WRTC_Source_Sender) runAfterTracksReady() {
 	offerJSON, e := json.Marshal(offer)
 
 	if e != nil {
-		LogError(e)
+		sender.logger.Error(e)
 		return
 	}
 
@@ -165,10 +215,59 @@ func (sender *WRTC_Source_Sender) onClose() {
 
 	sender.peerConnection = nil
 
+	sender.releaseGOPSubscriber()
+
 	// Remove the sender from the node
 	sender.node.onSenderClosed(sender)
 }
 
+// Starts sending the video to the connected remote node
+// The cached packets are sent if available. If not, a keyframe is requested,
+// since the remote node needs one to start forwarding the video.
+func (sender *WRTC_Source_Sender) startVideo() {
+	sender.statusMutex.Lock()
+	subscriber := sender.gopSubscriber
+	sender.statusMutex.Unlock()
+
+	if subscriber != nil && subscriber.start() {
+		return
+	}
+
+	sender.requestKeyframes()
+}
+
+// Stops receiving the cached video track, if any
+// Must be called with the status mutex locked
+func (sender *WRTC_Source_Sender) releaseGOPSubscriber() {
+	if sender.gopSubscriber != nil {
+		sender.gopSubscriber.close()
+	}
+
+	sender.gopSubscriber = nil
+}
+
+// Requests a keyframe of the video tracks sent to the remote node
+func (sender *WRTC_Source_Sender) requestKeyframes() {
+	sender.statusMutex.Lock()
+	hasVideo := sender.hasVideo
+	simulcast := sender.simulcast
+	sentLayers := sender.sentLayers
+	sender.statusMutex.Unlock()
+
+	if !hasVideo {
+		return
+	}
+
+	if simulcast == nil {
+		sender.node.requestKeyframe(sender.sid, "")
+		return
+	}
+
+	for _, rid := range sentLayers {
+		sender.node.requestKeyframe(sender.sid, rid)
+	}
+}
+
 // SEND
 
 // Send offer SDP message to the remote node
@@ -185,9 +284,12 @@ func (sender *WRTC_Source_Sender) sendOffer(offerJSON string) {
 	if sender.hasAudio {
 		mp["audio"] = "true"
 	}
+	if sender.simulcast != nil && len(sender.sentLayers) > 0 {
+		mp["layers"] = strings.Join(sender.sentLayers, ",")
+	}
 	mp["data"] = offerJSON
 
-	sender.node.sendRedisMessage(sender.remoteId, &mp)
+	sender.node.sendBusMessage(sender.remoteId, &mp)
 }
 
 // Send candidate message to the remote node
@@ -200,7 +302,7 @@ func (sender *WRTC_Source_Sender) sendICECandidate(candidate string) {
 	mp["sid"] = sender.sid
 	mp["data"] = candidate
 
-	sender.node.sendRedisMessage(sender.remoteId, &mp)
+	sender.node.sendBusMessage(sender.remoteId, &mp)
 }
 
 // RECEIVE
@@ -223,13 +325,13 @@ func (sender *WRTC_Source_Sender) onICECandidate(candidateJSON string) {
 	err := json.Unmarshal([]byte(candidateJSON), &candidate)
 
 	if err != nil {
-		LogError(err)
+		sender.logger.Error(err)
 	}
 
 	err = sender.peerConnection.AddICECandidate(candidate)
 
 	if err != nil {
-		LogError(err)
+		sender.logger.Error(err)
 	}
 }
 
@@ -247,14 +349,14 @@ func (sender *WRTC_Source_Sender) onAnswer(answerJSON string) {
 	err := json.Unmarshal([]byte(answerJSON), &sd)
 
 	if err != nil {
-		LogError(err)
+		sender.logger.Error(err)
 	}
 
 	// Set the remote SessionDescription
 	err = sender.peerConnection.SetRemoteDescription(sd)
 
 	if err != nil {
-		LogError(err)
+		sender.logger.Error(err)
 	}
 }
 
@@ -276,4 +378,6 @@ func (sender *WRTC_Source_Sender) close() {
 	sender.hasVideo = false
 	sender.localTrackAudio = nil
 	sender.localTrackVideo = nil
+	sender.simulcast = nil
+	sender.releaseGOPSubscriber()
 }